@@ -0,0 +1,249 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/semaphore"
+	"github.com/Comcast/webpa-common/xhttp"
+	"github.com/Comcast/webpa-common/xmetrics"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+)
+
+const (
+	DefaultAdmissionRetryAfter time.Duration = 10 * time.Second
+
+	// ConnectsPerSecondParameter is the AdmissionHandler form parameter which sets the connect budget
+	ConnectsPerSecondParameter = "connectsPerSecond"
+
+	// BurstParameter is the AdmissionHandler form parameter which sets the burst allowed by the connect budget
+	BurstParameter = "burst"
+)
+
+// the label values used with the AdmissionRejectedCounter metric
+const (
+	admissionRejectedRate = "rate"
+	admissionRejectedBusy = "busy"
+)
+
+var (
+	ErrorConnectRateExceeded = errors.New("Too many devices are connecting.  Retry later.")
+	ErrorTooManyUpgrades     = errors.New("Too many device connections are in progress.  Retry later.")
+)
+
+// AdmissionOptions configures the admission control applied to device connections
+type AdmissionOptions struct {
+	// ConnectsPerSecond is the global budget of device connections accepted per second.  If nonpositive,
+	// there is no connect budget.
+	ConnectsPerSecond float64
+
+	// Burst is the number of connections allowed in excess of ConnectsPerSecond over short periods.  If nonpositive,
+	// the ceiling of ConnectsPerSecond is used, with a minimum of 1.
+	Burst int
+
+	// MaxConcurrentUpgrades is the maximum number of device connections that may be in progress at once.
+	// If nonpositive, there is no limit.
+	MaxConcurrentUpgrades int
+
+	// RetryAfter is the minimum delay suggested to rejected devices with the Retry-After header.
+	// If nonpositive, DefaultAdmissionRetryAfter is used.
+	RetryAfter time.Duration
+
+	// RetryAfterJitter is the maximum random delay added to RetryAfter, so that rejected devices do not all
+	// return at the same moment.  If nonpositive, RetryAfter is used as the jitter.
+	RetryAfterJitter time.Duration
+}
+
+func (o *AdmissionOptions) retryAfter() time.Duration {
+	if o != nil && o.RetryAfter > 0 {
+		return o.RetryAfter
+	}
+
+	return DefaultAdmissionRetryAfter
+}
+
+func (o *AdmissionOptions) retryAfterJitter() time.Duration {
+	if o != nil && o.RetryAfterJitter > 0 {
+		return o.RetryAfterJitter
+	}
+
+	return o.retryAfter()
+}
+
+// Admission controls the rate at which devices are allowed to connect.  This protects a server from the thundering
+// herd of reconnecting devices that follows a restart or rehash.  Decorate produces an Alice-style constructor
+// which is placed in front of a ConnectHandler.
+//
+// The connect budget may be changed at runtime, either directly with SetBudget or over HTTP with an AdmissionHandler.
+type Admission struct {
+	now        func() time.Time
+	int63n     func(int64) int64
+	upgrades   semaphore.Interface
+	retryAfter time.Duration
+	jitter     time.Duration
+
+	admitted xmetrics.Incrementer
+	rejected metrics.Counter
+
+	lock   sync.RWMutex
+	rate   float64
+	burst  int
+	bucket *tokenBucket
+}
+
+// NewAdmission creates an Admission from a set of options
+func NewAdmission(o *AdmissionOptions, m Measures) *Admission {
+	a := &Admission{
+		now:        time.Now,
+		int63n:     rand.Int63n,
+		retryAfter: o.retryAfter(),
+		jitter:     o.retryAfterJitter(),
+		admitted:   m.Admitted,
+		rejected:   m.AdmissionRejected,
+	}
+
+	if o != nil {
+		if o.MaxConcurrentUpgrades > 0 {
+			a.upgrades = semaphore.New(o.MaxConcurrentUpgrades)
+		}
+
+		a.SetBudget(o.ConnectsPerSecond, o.Burst)
+	}
+
+	return a
+}
+
+// Budget returns the current connects-per-second budget and its burst.  A zero budget indicates that connections
+// are not rate limited.
+func (a *Admission) Budget() (float64, int) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.rate, a.burst
+}
+
+// SetBudget changes the connects-per-second budget.  A nonpositive or non-finite connectsPerSecond removes the budget
+// entirely.  A nonpositive burst is replaced with the ceiling of connectsPerSecond, with a minimum of 1.
+func (a *Admission) SetBudget(connectsPerSecond float64, burst int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !(connectsPerSecond > 0) || math.IsInf(connectsPerSecond, 1) {
+		a.rate, a.burst, a.bucket = 0, 0, nil
+		return
+	}
+
+	limit := RateLimit{Rate: connectsPerSecond, Burst: burst}
+	a.rate = connectsPerSecond
+	a.burst = int(limit.burst())
+	if a.bucket == nil {
+		a.bucket = newTokenBucket(&limit, a.now)
+	} else {
+		a.bucket.setLimit(a.rate, float64(a.burst))
+	}
+}
+
+func (a *Admission) allow() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.bucket == nil || a.bucket.allow()
+}
+
+// retryAfterSeconds computes a jittered Retry-After value, rounded up to whole seconds
+func (a *Admission) retryAfterSeconds() int64 {
+	delay := a.retryAfter + time.Duration(a.int63n(int64(a.jitter)+1))
+	return int64((delay + time.Second - 1) / time.Second)
+}
+
+func (a *Admission) reject(response http.ResponseWriter, request *http.Request, reason string, err error) {
+	a.rejected.With("reason", reason).Add(1.0)
+	retryAfter := a.retryAfterSeconds()
+
+	logging.GetLogger(request.Context()).Log(level.Key(), level.WarnValue(), logging.MessageKey(), "device connection rejected", "reason", reason, "retryAfter", retryAfter)
+	response.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	xhttp.WriteError(response, http.StatusServiceUnavailable, err)
+}
+
+// Decorate is an Alice-style constructor which applies this admission control to a handler, typically a ConnectHandler.
+// Rejected connections receive an http.StatusServiceUnavailable response with a jittered Retry-After header.
+func (a *Admission) Decorate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if a.upgrades != nil {
+			if !a.upgrades.TryAcquire() {
+				a.reject(response, request, admissionRejectedBusy, ErrorTooManyUpgrades)
+				return
+			}
+
+			defer a.upgrades.Release()
+		}
+
+		if !a.allow() {
+			a.reject(response, request, admissionRejectedRate, ErrorConnectRateExceeded)
+			return
+		}
+
+		a.admitted.Inc()
+		next.ServeHTTP(response, request)
+	})
+}
+
+// AdmissionHandler is an http.Handler which reports and changes the connect budget of an Admission.
+// A GET reports the current budget.  Any other method updates the budget from the ConnectsPerSecondParameter
+// and the optional BurstParameter form values, then reports the new budget.
+type AdmissionHandler struct {
+	Logger    log.Logger
+	Admission *Admission
+}
+
+func (ah *AdmissionHandler) logger() log.Logger {
+	if ah.Logger != nil {
+		return ah.Logger
+	}
+
+	return logging.DefaultLogger()
+}
+
+func (ah *AdmissionHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		if err := request.ParseForm(); err != nil {
+			ah.logger().Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "bad form request", logging.ErrorKey(), err)
+			xhttp.WriteError(response, http.StatusBadRequest, err)
+			return
+		}
+
+		v := request.FormValue(ConnectsPerSecondParameter)
+		if len(v) == 0 {
+			xhttp.WriteErrorf(response, http.StatusBadRequest, "missing %s parameter", ConnectsPerSecondParameter)
+			return
+		}
+
+		connectsPerSecond, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(connectsPerSecond) || math.IsInf(connectsPerSecond, 0) {
+			xhttp.WriteErrorf(response, http.StatusBadRequest, "the %s parameter must be a finite number", ConnectsPerSecondParameter)
+			return
+		}
+
+		var burst int
+		if v := request.FormValue(BurstParameter); len(v) > 0 {
+			if burst, err = strconv.Atoi(v); err != nil || burst < 0 {
+				xhttp.WriteErrorf(response, http.StatusBadRequest, "the %s parameter must be a nonnegative integer", BurstParameter)
+				return
+			}
+		}
+
+		ah.Admission.SetBudget(connectsPerSecond, burst)
+		ah.logger().Log(level.Key(), level.InfoValue(), logging.MessageKey(), "connect budget updated", "connectsPerSecond", connectsPerSecond, "burst", burst)
+	}
+
+	connectsPerSecond, burst := ah.Admission.Budget()
+	response.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(response, `{"%s": %g, "%s": %d}`, ConnectsPerSecondParameter, connectsPerSecond, BurstParameter, burst)
+}
@@ -0,0 +1,238 @@
+package device
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, o := range []*AdmissionOptions{nil, new(AdmissionOptions)} {
+		assert.Equal(DefaultAdmissionRetryAfter, o.retryAfter())
+		assert.Equal(DefaultAdmissionRetryAfter, o.retryAfterJitter())
+	}
+
+	o := AdmissionOptions{RetryAfter: 5 * time.Second}
+	assert.Equal(5*time.Second, o.retryAfter())
+	assert.Equal(5*time.Second, o.retryAfterJitter())
+
+	o.RetryAfterJitter = time.Minute
+	assert.Equal(time.Minute, o.retryAfterJitter())
+}
+
+func testAdmissionBudget(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		a      = NewAdmission(nil, NewMeasures(xmetricstest.NewProvider(nil, Metrics)))
+	)
+
+	rate, burst := a.Budget()
+	assert.Zero(rate)
+	assert.Zero(burst)
+	assert.True(a.allow())
+
+	a.SetBudget(2.5, 0)
+	rate, burst = a.Budget()
+	assert.Equal(2.5, rate)
+	assert.Equal(3, burst)
+
+	a.SetBudget(100.0, 250)
+	rate, burst = a.Budget()
+	assert.Equal(100.0, rate)
+	assert.Equal(250, burst)
+
+	a.SetBudget(-1.0, 10)
+	rate, burst = a.Budget()
+	assert.Zero(rate)
+	assert.Zero(burst)
+	assert.True(a.allow())
+
+	for _, invalid := range []float64{math.NaN(), math.Inf(1)} {
+		a.SetBudget(invalid, 10)
+		rate, burst = a.Budget()
+		assert.Zero(rate)
+		assert.Zero(burst)
+		assert.True(a.allow())
+	}
+}
+
+func testAdmissionRetryAfter(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		a      = NewAdmission(&AdmissionOptions{RetryAfter: 10 * time.Second, RetryAfterJitter: 5 * time.Second}, NewMeasures(xmetricstest.NewProvider(nil, Metrics)))
+	)
+
+	a.int63n = func(int64) int64 { return 0 }
+	assert.Equal(int64(10), a.retryAfterSeconds())
+
+	a.int63n = func(n int64) int64 { return n - 1 }
+	assert.Equal(int64(15), a.retryAfterSeconds())
+
+	a.int63n = func(int64) int64 { return int64(2500 * time.Millisecond) }
+	assert.Equal(int64(13), a.retryAfterSeconds())
+}
+
+func testAdmissionRate(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		p     = xmetricstest.NewProvider(nil, Metrics)
+		clock = &testClock{current: time.Now()}
+		a     = NewAdmission(&AdmissionOptions{RetryAfter: 30 * time.Second, RetryAfterJitter: 30 * time.Second}, NewMeasures(p))
+
+		handler = a.Decorate(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+			response.WriteHeader(http.StatusSwitchingProtocols)
+		}))
+
+		connect = func() *httptest.ResponseRecorder {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest("GET", "/connect", nil))
+			return response
+		}
+	)
+
+	a.now = clock.now
+	a.int63n = func(int64) int64 { return int64(7 * time.Second) }
+	a.SetBudget(1.0, 2)
+
+	assert.Equal(http.StatusSwitchingProtocols, connect().Code)
+	assert.Equal(http.StatusSwitchingProtocols, connect().Code)
+
+	rejected := connect()
+	require.Equal(http.StatusServiceUnavailable, rejected.Code)
+	assert.Equal("37", rejected.Header().Get("Retry-After"))
+	assert.Contains(rejected.Body.String(), ErrorConnectRateExceeded.Error())
+
+	clock.advance(time.Second)
+	assert.Equal(http.StatusSwitchingProtocols, connect().Code)
+
+	// raising the budget at runtime takes effect as tokens accumulate
+	a.SetBudget(100.0, 100)
+	clock.advance(time.Second)
+	for i := 0; i < 100; i++ {
+		assert.Equal(http.StatusSwitchingProtocols, connect().Code)
+	}
+
+	assert.Equal(http.StatusServiceUnavailable, connect().Code)
+
+	p.Assert(t, AdmittedCounter)(xmetricstest.Value(103.0))
+	p.Assert(t, AdmissionRejectedCounter, "reason", admissionRejectedRate)(xmetricstest.Value(2.0))
+}
+
+func testAdmissionBusy(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		p       = xmetricstest.NewProvider(nil, Metrics)
+		a       = NewAdmission(&AdmissionOptions{MaxConcurrentUpgrades: 1}, NewMeasures(p))
+		entered = make(chan struct{})
+		gate    = make(chan struct{})
+		done    = make(chan int)
+
+		handler = a.Decorate(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+			close(entered)
+			<-gate
+			response.WriteHeader(http.StatusSwitchingProtocols)
+		}))
+	)
+
+	go func() {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", "/connect", nil))
+		done <- response.Code
+	}()
+
+	<-entered
+
+	rejected := httptest.NewRecorder()
+	handler.ServeHTTP(rejected, httptest.NewRequest("GET", "/connect", nil))
+	assert.Equal(http.StatusServiceUnavailable, rejected.Code)
+	assert.NotEmpty(rejected.Header().Get("Retry-After"))
+	assert.Contains(rejected.Body.String(), ErrorTooManyUpgrades.Error())
+
+	close(gate)
+	assert.Equal(http.StatusSwitchingProtocols, <-done)
+
+	// once the first upgrade completes, another is allowed
+	handler = a.Decorate(http.HandlerFunc(func(response http.ResponseWriter, _ *http.Request) {
+		response.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+
+	admitted := httptest.NewRecorder()
+	handler.ServeHTTP(admitted, httptest.NewRequest("GET", "/connect", nil))
+	assert.Equal(http.StatusSwitchingProtocols, admitted.Code)
+
+	p.Assert(t, AdmittedCounter)(xmetricstest.Value(2.0))
+	p.Assert(t, AdmissionRejectedCounter, "reason", admissionRejectedBusy)(xmetricstest.Value(1.0))
+}
+
+func TestAdmission(t *testing.T) {
+	t.Run("Budget", testAdmissionBudget)
+	t.Run("RetryAfter", testAdmissionRetryAfter)
+	t.Run("Rate", testAdmissionRate)
+	t.Run("Busy", testAdmissionBusy)
+}
+
+func TestAdmissionHandler(t *testing.T) {
+	var (
+		a       = NewAdmission(&AdmissionOptions{ConnectsPerSecond: 50.0}, NewMeasures(xmetricstest.NewProvider(nil, Metrics)))
+		handler = &AdmissionHandler{Admission: a}
+	)
+
+	t.Run("Get", func(t *testing.T) {
+		assert := assert.New(t)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", "/admission", nil))
+
+		assert.Equal(http.StatusOK, response.Code)
+		assert.Equal("application/json", response.Header().Get("Content-Type"))
+		assert.JSONEq(`{"connectsPerSecond": 50, "burst": 50}`, response.Body.String())
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		assert := assert.New(t)
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest("PUT", "/admission", strings.NewReader("connectsPerSecond=12.5&burst=100"))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(response, request)
+
+		assert.Equal(http.StatusOK, response.Code)
+		assert.JSONEq(`{"connectsPerSecond": 12.5, "burst": 100}`, response.Body.String())
+
+		rate, burst := a.Budget()
+		assert.Equal(12.5, rate)
+		assert.Equal(100, burst)
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		assert := assert.New(t)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("POST", "/admission?connectsPerSecond=0", nil))
+
+		assert.Equal(http.StatusOK, response.Code)
+		assert.JSONEq(`{"connectsPerSecond": 0, "burst": 0}`, response.Body.String())
+	})
+
+	for _, query := range []string{"", "?connectsPerSecond=fast", "?connectsPerSecond=10&burst=lots", "?connectsPerSecond=NaN", "?connectsPerSecond=Inf", "?connectsPerSecond=-Inf", "?connectsPerSecond=10&burst=-1"} {
+		t.Run("BadRequest"+query, func(t *testing.T) {
+			assert := assert.New(t)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest("POST", "/admission"+query, nil))
+			assert.Equal(http.StatusBadRequest, response.Code)
+
+			rate, burst := a.Budget()
+			assert.Zero(rate)
+			assert.Zero(burst)
+		})
+	}
+}
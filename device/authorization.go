@@ -0,0 +1,142 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/go-kit/kit/metrics"
+)
+
+// WildcardPartnerID is the partner ID which, when held by a caller, overlaps with every device's partner IDs
+const WildcardPartnerID = "*"
+
+// the label values used with the AuthorizationRejectedCounter metric
+const (
+	authorizationNoCaller    = "no-caller"
+	authorizationTrust       = "trust"
+	authorizationDeviceTrust = "device-trust"
+	authorizationPartner     = "partner"
+)
+
+var ErrorUnauthorized = errors.New("The caller is not authorized to send messages to that device")
+
+// AuthorizationOptions configures the checks made before a request is routed to a connected device.  The caller's
+// handler.ContextValues, which secure/handler places in the request context, are compared with the attributes the
+// device presented when it connected.  Requests that fail any check are rejected with ErrorUnauthorized.  By default,
+// no checks are made.
+//
+// Requests held for devices that are not connected cannot be checked until the device connects, since the device's
+// attributes are unknown.  The caller is held along with each such request, and is checked before delivery.
+type AuthorizationOptions struct {
+	// PartnerOverlap requires the caller to share at least one partner ID with the device.  A caller holding
+	// WildcardPartnerID shares a partner with every device.
+	PartnerOverlap bool
+
+	// MinimumTrust is the lowest caller trust level allowed to message devices.  Trust levels are compared numerically,
+	// with unparseable levels treated as untrusted.  If nonpositive, this check is disabled.
+	MinimumTrust int
+
+	// DeviceTrust requires the caller's trust level to be at least the device's trust level
+	DeviceTrust bool
+
+	// ExemptSatClientIDs are the SAT client IDs of callers, such as internal services, which are exempt from all checks
+	ExemptSatClientIDs []string
+
+	// RequireCaller rejects requests with no handler.ContextValues.  By default, such requests, which did not pass through
+	// an authorizing HTTP handler, are allowed.
+	RequireCaller bool
+}
+
+func (o *AuthorizationOptions) enabled() bool {
+	return o != nil && (o.PartnerOverlap || o.MinimumTrust > 0 || o.DeviceTrust || o.RequireCaller)
+}
+
+// trustLevel parses a trust string, returning 0 if it is not a number
+func trustLevel(trust string) int {
+	level, err := strconv.Atoi(trust)
+	if err != nil {
+		return 0
+	}
+
+	return level
+}
+
+// partnersOverlap tests if a caller's partner IDs have any in common with a device's
+func partnersOverlap(caller, device []string) bool {
+	for _, c := range caller {
+		if c == WildcardPartnerID {
+			return true
+		}
+
+		for _, d := range device {
+			if c == d {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// authorizer enforces AuthorizationOptions
+type authorizer struct {
+	options  AuthorizationOptions
+	exempt   map[string]bool
+	rejected metrics.Counter
+}
+
+func newAuthorizer(o *AuthorizationOptions, m Measures) *authorizer {
+	if !o.enabled() {
+		return nil
+	}
+
+	a := &authorizer{
+		options:  *o,
+		exempt:   make(map[string]bool, len(o.ExemptSatClientIDs)),
+		rejected: m.AuthorizationRejected,
+	}
+
+	for _, id := range o.ExemptSatClientIDs {
+		a.exempt[id] = true
+	}
+
+	return a
+}
+
+func (a *authorizer) reject(reason string) error {
+	a.rejected.With("reason", reason).Add(1.0)
+	return ErrorUnauthorized
+}
+
+// authorize checks whether the caller in the given context may send messages to a device
+func (a *authorizer) authorize(ctx context.Context, d Interface) error {
+	caller, ok := handler.FromContext(ctx)
+	if !ok || caller == nil {
+		if a.options.RequireCaller {
+			return a.reject(authorizationNoCaller)
+		}
+
+		return nil
+	}
+
+	if a.exempt[caller.SatClientID] {
+		return nil
+	}
+
+	callerTrust := trustLevel(caller.Trust)
+	if a.options.MinimumTrust > 0 && callerTrust < a.options.MinimumTrust {
+		return a.reject(authorizationTrust)
+	}
+
+	if a.options.DeviceTrust && callerTrust < trustLevel(d.Trust()) {
+		return a.reject(authorizationDeviceTrust)
+	}
+
+	if a.options.PartnerOverlap && !partnersOverlap(caller.PartnerIDs, d.PartnerIDs()) {
+		return a.reject(authorizationPartner)
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package device
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizationOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	var nilOptions *AuthorizationOptions
+	assert.False(nilOptions.enabled())
+	assert.False((&AuthorizationOptions{}).enabled())
+	assert.False((&AuthorizationOptions{ExemptSatClientIDs: []string{"internal"}}).enabled())
+	assert.True((&AuthorizationOptions{PartnerOverlap: true}).enabled())
+	assert.True((&AuthorizationOptions{MinimumTrust: 1000}).enabled())
+	assert.True((&AuthorizationOptions{DeviceTrust: true}).enabled())
+	assert.True((&AuthorizationOptions{RequireCaller: true}).enabled())
+}
+
+func TestTrustLevel(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(1000, trustLevel("1000"))
+	assert.Equal(0, trustLevel("0"))
+	assert.Equal(0, trustLevel(""))
+	assert.Equal(0, trustLevel("trusted"))
+}
+
+func TestPartnersOverlap(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(partnersOverlap([]string{"comcast"}, []string{"cox", "comcast"}))
+	assert.True(partnersOverlap([]string{WildcardPartnerID}, nil))
+	assert.False(partnersOverlap([]string{"comcast"}, []string{"cox"}))
+	assert.False(partnersOverlap([]string{"comcast"}, nil))
+	assert.False(partnersOverlap(nil, []string{"comcast"}))
+}
+
+func testAuthorizerDisabled(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(newAuthorizer(nil, NewMeasures(xmetricstest.NewProvider(nil, Metrics))))
+	assert.Nil(newAuthorizer(&AuthorizationOptions{}, NewMeasures(xmetricstest.NewProvider(nil, Metrics))))
+}
+
+func testAuthorizerAuthorize(t *testing.T) {
+	testData := []struct {
+		description    string
+		options        AuthorizationOptions
+		caller         *handler.ContextValues
+		expectedReason string
+	}{
+		{
+			description: "NoCallerAllowed",
+			options:     AuthorizationOptions{PartnerOverlap: true},
+		},
+		{
+			description:    "NoCallerRejected",
+			options:        AuthorizationOptions{RequireCaller: true},
+			expectedReason: authorizationNoCaller,
+		},
+		{
+			description: "PartnerOverlap",
+			options:     AuthorizationOptions{PartnerOverlap: true},
+			caller:      &handler.ContextValues{PartnerIDs: []string{"other", "comcast"}},
+		},
+		{
+			description: "WildcardPartner",
+			options:     AuthorizationOptions{PartnerOverlap: true},
+			caller:      &handler.ContextValues{PartnerIDs: []string{WildcardPartnerID}},
+		},
+		{
+			description:    "NoPartnerOverlap",
+			options:        AuthorizationOptions{PartnerOverlap: true},
+			caller:         &handler.ContextValues{PartnerIDs: []string{"other"}},
+			expectedReason: authorizationPartner,
+		},
+		{
+			description: "MinimumTrust",
+			options:     AuthorizationOptions{MinimumTrust: 500},
+			caller:      &handler.ContextValues{Trust: "500"},
+		},
+		{
+			description:    "BelowMinimumTrust",
+			options:        AuthorizationOptions{MinimumTrust: 500},
+			caller:         &handler.ContextValues{Trust: "100"},
+			expectedReason: authorizationTrust,
+		},
+		{
+			description:    "UnparseableTrust",
+			options:        AuthorizationOptions{MinimumTrust: 500},
+			caller:         &handler.ContextValues{Trust: "high"},
+			expectedReason: authorizationTrust,
+		},
+		{
+			description: "DeviceTrust",
+			options:     AuthorizationOptions{DeviceTrust: true},
+			caller:      &handler.ContextValues{Trust: "1000"},
+		},
+		{
+			description:    "BelowDeviceTrust",
+			options:        AuthorizationOptions{DeviceTrust: true},
+			caller:         &handler.ContextValues{Trust: "999"},
+			expectedReason: authorizationDeviceTrust,
+		},
+		{
+			description: "ExemptSatClientID",
+			options:     AuthorizationOptions{PartnerOverlap: true, MinimumTrust: 2000, ExemptSatClientIDs: []string{"internal"}},
+			caller:      &handler.ContextValues{SatClientID: "internal"},
+		},
+		{
+			description:    "NotExemptSatClientID",
+			options:        AuthorizationOptions{PartnerOverlap: true, ExemptSatClientIDs: []string{"internal"}},
+			caller:         &handler.ContextValues{SatClientID: "external"},
+			expectedReason: authorizationPartner,
+		},
+	}
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			var (
+				assert  = assert.New(t)
+				require = require.New(t)
+				p       = xmetricstest.NewProvider(nil, Metrics)
+				a       = newAuthorizer(&record.options, NewMeasures(p))
+				d       = new(MockDevice)
+				ctx     = context.Background()
+			)
+
+			require.NotNil(a)
+			d.On("PartnerIDs").Return([]string{"comcast", "cox"}).Maybe()
+			d.On("Trust").Return("1000").Maybe()
+
+			if record.caller != nil {
+				ctx = handler.NewContextWithValue(ctx, record.caller)
+			}
+
+			err := a.authorize(ctx, d)
+			if len(record.expectedReason) > 0 {
+				assert.Equal(ErrorUnauthorized, err)
+				p.Assert(t, AuthorizationRejectedCounter, "reason", record.expectedReason)(xmetricstest.Value(1.0))
+			} else {
+				assert.NoError(err)
+			}
+
+			d.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	t.Run("Disabled", testAuthorizerDisabled)
+	t.Run("Authorize", testAuthorizerAuthorize)
+}
+
+func TestManagerAuthorization(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		p        = xmetricstest.NewProvider(nil, Metrics)
+		listener = newSessionTestListener()
+
+		options = &Options{
+			Logger:          logging.NewTestLogger(nil, t),
+			Authorization:   AuthorizationOptions{PartnerOverlap: true, ExemptSatClientIDs: []string{"internal"}},
+			Listeners:       []Listener{listener.OnDeviceEvent},
+			MetricsProvider: p,
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer func() {
+		connection.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	newRequest := func(caller *handler.ContextValues) *Request {
+		return (&Request{
+			Message: &wrp.SimpleEvent{Source: "test", Destination: string(testDeviceIDs[0])},
+			Format:  wrp.Msgpack,
+		}).WithContext(handler.NewContextWithValue(context.Background(), caller))
+	}
+
+	// the test device connects without partner IDs, so only exempt or wildcard callers may message it
+	_, err = manager.Route(newRequest(&handler.ContextValues{PartnerIDs: []string{"comcast"}}))
+	assert.Equal(ErrorUnauthorized, err)
+
+	_, err = manager.Route(newRequest(&handler.ContextValues{PartnerIDs: []string{WildcardPartnerID}}))
+	assert.NoError(err)
+	readTestMessage(require, connection)
+
+	_, err = manager.Route(newRequest(&handler.ContextValues{SatClientID: "internal"}))
+	assert.NoError(err)
+	readTestMessage(require, connection)
+
+	p.Assert(t, AuthorizationRejectedCounter, "reason", authorizationPartner)(xmetricstest.Value(1.0))
+}
@@ -1,5 +1,25 @@
 package device
 
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DuplicateCloseReason is the CloseReason text for a device disconnected because another connection with the same ID was made
+	DuplicateCloseReason = "duplicate"
+
+	// DeviceLimitReachedCloseReason is the CloseReason text for a device refused because the maximum number of devices are connected
+	DeviceLimitReachedCloseReason = "device-limit-reached"
+
+	// maxCloseText is the most text a close frame can hold, since control frames carry at most 125 bytes
+	// and the close code uses 2 of them
+	maxCloseText = 123
+)
+
 // CloseReason exposes metadata around why a particular device was closed
 type CloseReason struct {
 	// Err is the optional field that specifies the underlying error that occurred, such as
@@ -18,3 +38,102 @@ func (c CloseReason) String() string {
 
 	return errText + ":" + c.Text
 }
+
+// CloseCodes maps CloseReason text onto the websocket close codes sent to devices when they are disconnected.
+// A key ending in "*" matches any text with the preceding prefix, with the longest such prefix winning
+// when no key matches the text exactly.  The key "*" on its own therefore matches any text.
+type CloseCodes map[string]int
+
+// DefaultCloseCodes returns the close codes used when none are configured.  Each application reason gets
+// its own code in the private 4000-4999 range, and any other reason is sent as websocket.CloseGoingAway.
+//
+// The rehash, service discovery, drain and redirect entries correspond to the reasons used by the
+// rehasher and drain packages.
+func DefaultCloseCodes() CloseCodes {
+	return CloseCodes{
+		DuplicateCloseReason:          4000,
+		DeviceLimitReachedCloseReason: 4001,
+		RateLimitedCloseReason:        4002,
+		"rehash-other-instance":       4003,
+		"rehash-error":                4004,
+		"service-discovery-*":         4005,
+		"drained":                     4006,
+		"redirect:*":                  4007,
+		"*":                           websocket.CloseGoingAway,
+	}
+}
+
+// Code returns the close code for the given text.  If no key matches, websocket.CloseGoingAway is returned.
+func (cc CloseCodes) Code(text string) int {
+	if code, ok := cc[text]; ok {
+		return code
+	}
+
+	var (
+		code    = websocket.CloseGoingAway
+		longest = -1
+	)
+
+	for key, value := range cc {
+		if !strings.HasSuffix(key, "*") {
+			continue
+		}
+
+		prefix := key[:len(key)-1]
+		if len(prefix) > longest && strings.HasPrefix(text, prefix) {
+			code = value
+			longest = len(prefix)
+		}
+	}
+
+	return code
+}
+
+// FormatCloseMessage produces the payload of the close frame sent for the given reason.  Text that is
+// too long to fit in a control frame is truncated.
+func (cc CloseCodes) FormatCloseMessage(reason CloseReason) []byte {
+	text := reason.Text
+	if len(text) > maxCloseText {
+		text = text[:maxCloseText]
+		for len(text) > 0 && !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+
+	return websocket.FormatCloseMessage(cc.Code(reason.Text), text)
+}
+
+// merge returns a copy of these close codes with the given overrides applied
+func (cc CloseCodes) merge(overrides CloseCodes) CloseCodes {
+	merged := make(CloseCodes, len(cc)+len(overrides))
+	for key, value := range cc {
+		merged[key] = value
+	}
+
+	for key, value := range overrides {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// WriteClose sends a close frame describing why a device is being disconnected.  The write is bounded by the
+// given deadline, so that an unresponsive device cannot hold up its own disconnection.
+func WriteClose(w Writer, codes CloseCodes, reason CloseReason, deadline time.Time) error {
+	if err := w.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	return w.WriteMessage(websocket.CloseMessage, codes.FormatCloseMessage(reason))
+}
+
+// ParseCloseError extracts the close code and reason from an error returned by reading a device connection,
+// e.g. a connection obtained from a Dialer.  If the error is not the result of a close frame, this function
+// returns false.
+func ParseCloseError(err error) (int, CloseReason, bool) {
+	if closeError, ok := err.(*websocket.CloseError); ok {
+		return closeError.Code, CloseReason{Err: err, Text: closeError.Text}, true
+	}
+
+	return 0, CloseReason{}, false
+}
@@ -0,0 +1,193 @@
+package device
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseReasonString(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("*no error*:duplicate", CloseReason{Text: DuplicateCloseReason}.String())
+	assert.Equal("expected:readerror", CloseReason{Err: errors.New("expected"), Text: "readerror"}.String())
+}
+
+func TestCloseCodes(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		defaults = DefaultCloseCodes()
+	)
+
+	assert.Equal(4000, defaults.Code(DuplicateCloseReason))
+	assert.Equal(4001, defaults.Code(DeviceLimitReachedCloseReason))
+	assert.Equal(4002, defaults.Code(RateLimitedCloseReason))
+	assert.Equal(4005, defaults.Code("service-discovery-stopped"))
+	assert.Equal(4006, defaults.Code("drained"))
+	assert.Equal(4007, defaults.Code("redirect:http://instance.example.com:8080"))
+	assert.Equal(websocket.CloseGoingAway, defaults.Code("unknown"))
+	assert.Equal(websocket.CloseGoingAway, defaults.Code(""))
+
+	custom := CloseCodes{"*": websocket.CloseNormalClosure, "redirect:*": 4100, "redirect:east*": 4101}
+	assert.Equal(4100, custom.Code("redirect:west"))
+	assert.Equal(4101, custom.Code("redirect:east-1"))
+	assert.Equal(websocket.CloseNormalClosure, custom.Code(DuplicateCloseReason))
+
+	var empty CloseCodes
+	assert.Equal(websocket.CloseGoingAway, empty.Code(DuplicateCloseReason))
+
+	merged := defaults.merge(CloseCodes{DuplicateCloseReason: 4100})
+	assert.Equal(4100, merged.Code(DuplicateCloseReason))
+	assert.Equal(4000, defaults.Code(DuplicateCloseReason), "merging must not modify the original codes")
+}
+
+func TestCloseCodesFormatCloseMessage(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		codes  = DefaultCloseCodes()
+	)
+
+	assert.Equal(
+		websocket.FormatCloseMessage(4000, DuplicateCloseReason),
+		codes.FormatCloseMessage(CloseReason{Text: DuplicateCloseReason}),
+	)
+
+	// a multibyte character straddling the limit must not be split
+	long := "redirect:" + strings.Repeat("x", maxCloseText-10) + "éé"
+	message := codes.FormatCloseMessage(CloseReason{Text: long})
+	assert.True(len(message) <= 125)
+	assert.True(utf8.Valid(message[2:]))
+	assert.Equal(long[:maxCloseText-1], string(message[2:]))
+	assert.Equal(websocket.FormatCloseMessage(4007, long[:maxCloseText-1]), message)
+}
+
+func TestParseCloseError(t *testing.T) {
+	assert := assert.New(t)
+
+	code, reason, ok := ParseCloseError(&websocket.CloseError{Code: 4000, Text: DuplicateCloseReason})
+	assert.True(ok)
+	assert.Equal(4000, code)
+	assert.Equal(DuplicateCloseReason, reason.Text)
+	assert.Error(reason.Err)
+
+	code, reason, ok = ParseCloseError(errors.New("expected"))
+	assert.False(ok)
+	assert.Zero(code)
+	assert.Equal(CloseReason{}, reason)
+
+	_, _, ok = ParseCloseError(nil)
+	assert.False(ok)
+}
+
+// readCloseFrame reads from a dialed test device until the close frame sent by the manager arrives
+func readCloseFrame(require *require.Assertions, connection Connection) (int, CloseReason) {
+	require.NoError(connection.SetReadDeadline(time.Now().Add(10 * time.Second)))
+	for {
+		_, _, err := connection.ReadMessage()
+		if err != nil {
+			code, reason, ok := ParseCloseError(err)
+			require.True(ok, "expected a close frame, got %s", err)
+			return code, reason
+		}
+	}
+}
+
+func testManagerCloseFrameDuplicate(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		listener = newSessionTestListener()
+
+		_, server, connectURL = startWebsocketServer(&Options{
+			Listeners: []Listener{listener.OnDeviceEvent},
+		})
+	)
+
+	defer server.Close()
+
+	first, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer first.Close()
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	second, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer func() {
+		second.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	code, reason := readCloseFrame(require, first)
+	assert.Equal(4000, code)
+	assert.Equal(DuplicateCloseReason, reason.Text)
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+}
+
+func testManagerCloseFrameDisconnect(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		listener = newSessionTestListener()
+
+		manager, server, connectURL = startWebsocketServer(&Options{
+			CloseCodes: CloseCodes{"maintenance": 4500},
+			Listeners:  []Listener{listener.OnDeviceEvent},
+		})
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer connection.Close()
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	assert.True(manager.Disconnect(testDeviceIDs[0], CloseReason{Text: "maintenance"}))
+	code, reason := readCloseFrame(require, connection)
+	assert.Equal(4500, code)
+	assert.Equal("maintenance", reason.Text)
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+}
+
+func testManagerCloseFrameDeviceLimit(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		listener = newSessionTestListener()
+
+		_, server, connectURL = startWebsocketServer(&Options{
+			MaxDevices: 1,
+			Listeners:  []Listener{listener.OnDeviceEvent},
+		})
+	)
+
+	defer server.Close()
+
+	first, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer func() {
+		first.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	refused, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[1]), connectURL, nil)
+	require.NoError(err)
+	defer refused.Close()
+
+	code, reason := readCloseFrame(require, refused)
+	assert.Equal(4001, code)
+	assert.Equal(DeviceLimitReachedCloseReason, reason.Text)
+}
+
+func TestManagerCloseFrame(t *testing.T) {
+	t.Run("Duplicate", testManagerCloseFrameDuplicate)
+	t.Run("Disconnect", testManagerCloseFrameDisconnect)
+	t.Run("DeviceLimit", testManagerCloseFrameDeviceLimit)
+}
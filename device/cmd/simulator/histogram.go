@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFirstBucket is the upper bound of the smallest latency bucket
+	DefaultFirstBucket = time.Millisecond
+
+	// DefaultBucketCount is the number of latency buckets, each twice the size of the one before it
+	DefaultBucketCount = 16
+)
+
+// Histogram is a concurrency-safe latency histogram with exponentially sized buckets.  Observations
+// larger than the last bucket are counted in an overflow bucket.
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []time.Duration
+	counts []int
+	count  int
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewHistogram creates a Histogram whose first bucket holds observations up to first, with each of
+// the remaining buckets doubling in size.  Nonpositive arguments are replaced with defaults.
+func NewHistogram(first time.Duration, buckets int) *Histogram {
+	if first <= 0 {
+		first = DefaultFirstBucket
+	}
+
+	if buckets <= 0 {
+		buckets = DefaultBucketCount
+	}
+
+	h := &Histogram{
+		bounds: make([]time.Duration, buckets),
+		counts: make([]int, buckets+1),
+	}
+
+	for i := range h.bounds {
+		h.bounds[i] = first << uint(i)
+	}
+
+	return h
+}
+
+// Observe records a single latency
+func (h *Histogram) Observe(d time.Duration) {
+	bucket := len(h.bounds)
+	for i, bound := range h.bounds {
+		if d <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	h.lock.Lock()
+	h.counts[bucket]++
+	h.count++
+	h.sum += d
+	if h.count == 1 || d < h.min {
+		h.min = d
+	}
+
+	if d > h.max {
+		h.max = d
+	}
+
+	h.lock.Unlock()
+}
+
+// Count returns the number of observations recorded so far
+func (h *Histogram) Count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// Quantile returns an upper bound on the given quantile, which must be in the range (0, 1].  The returned
+// value is the upper bound of the bucket containing the quantile, or the maximum observation if that is smaller.
+// If nothing has been observed, this method returns zero.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.quantile(q)
+}
+
+func (h *Histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	var (
+		rank       = int(q*float64(h.count) + 0.5)
+		cumulative = 0
+	)
+
+	if rank < 1 {
+		rank = 1
+	}
+
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		if cumulative >= rank {
+			if bound > h.max {
+				return h.max
+			}
+
+			return bound
+		}
+	}
+
+	return h.max
+}
+
+// WriteTo writes a human-readable summary of this histogram, including the nonempty buckets
+func (h *Histogram) WriteTo(output io.Writer) (int64, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.count == 0 {
+		n, err := fmt.Fprintln(output, "  no observations")
+		return int64(n), err
+	}
+
+	var (
+		total int64
+		lines = []string{
+			fmt.Sprintf("  count=%d min=%s mean=%s max=%s", h.count, h.min, h.sum/time.Duration(h.count), h.max),
+			fmt.Sprintf("  p50=%s p90=%s p99=%s", h.quantile(0.5), h.quantile(0.9), h.quantile(0.99)),
+		}
+	)
+
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+
+		if i < len(h.bounds) {
+			lines = append(lines, fmt.Sprintf("  <= %-10s %d", h.bounds[i], c))
+		} else {
+			lines = append(lines, fmt.Sprintf("  >  %-10s %d", h.bounds[len(h.bounds)-1], c))
+		}
+	}
+
+	for _, line := range lines {
+		n, err := fmt.Fprintln(output, line)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
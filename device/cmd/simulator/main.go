@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+)
+
+func main() {
+	var (
+		c            Configuration
+		conveyJSON   string
+		payload      string
+		duration     time.Duration
+		compression  bool
+		loggingLevel string
+	)
+
+	flag.StringVar(&c.URL, "url", "", "the websocket URL devices connect to, e.g. ws://localhost:8080/api/v2/device (required)")
+	flag.IntVar(&c.Devices, "n", DefaultDevices, "the number of simulated devices")
+	flag.Uint64Var(&c.FirstMAC, "first-mac", 0, "the integer MAC address of the first simulated device")
+	flag.StringVar(&c.IDPattern, "id-pattern", "", "an fmt pattern taking the device number which overrides MAC device names, e.g. serial:sim-%06d")
+	flag.StringVar(&conveyJSON, "convey", "", "a JSON object sent by each device as convey data")
+	flag.Float64Var(&c.ConnectRate, "rate", 0, "devices per second that connect at startup, where 0 means all at once")
+	flag.DurationVar(&c.Latency, "latency", 0, "how long devices wait before responding to requests")
+	flag.DurationVar(&c.Jitter, "jitter", 0, "the maximum random time added to the response latency")
+	flag.StringVar(&payload, "payload", "{}", "the payload of device responses and events")
+	flag.StringVar(&c.ContentType, "content-type", DefaultContentType, "the content type of the payload")
+	flag.DurationVar(&c.EventInterval, "event-interval", 0, "how often each device sends an event, where 0 disables events")
+	flag.StringVar(&c.EventDestination, "event-destination", DefaultEventDestination, "the WRP destination of device events")
+	flag.DurationVar(&c.MinBackoff, "min-backoff", DefaultMinBackoff, "the initial wait before a device reconnects")
+	flag.DurationVar(&c.MaxBackoff, "max-backoff", DefaultMaxBackoff, "the maximum wait before a device reconnects")
+	flag.DurationVar(&duration, "duration", 0, "how long to run the simulation, where 0 means until interrupted")
+	flag.BoolVar(&compression, "compression", false, "offer permessage-deflate compression")
+	flag.StringVar(&loggingLevel, "log-level", "ERROR", "the logging level: ERROR, WARN, INFO, or DEBUG")
+	flag.Parse()
+
+	if len(conveyJSON) > 0 {
+		if err := json.Unmarshal([]byte(conveyJSON), &c.Convey); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid convey JSON: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	c.Payload = []byte(payload)
+	c.Dialer = device.NewDialer(device.DialerOptions{Compression: compression})
+
+	simulator, err := NewSimulator(
+		logging.New(&logging.Options{File: logging.StdoutFile, Level: loggingLevel}),
+		c,
+	)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid simulation: %s\n", err)
+		os.Exit(1)
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), duration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	simulator.Run(ctx).WriteTo(os.Stdout)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/websocket"
+
+	"github.com/Comcast/webpa-common/convey"
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+)
+
+const (
+	DefaultDevices          = 10
+	DefaultContentType      = "application/json"
+	DefaultEventDestination = "event:device-status/simulator"
+	DefaultMinBackoff       = time.Second
+	DefaultMaxBackoff       = time.Minute
+
+	// closeTimeout is how long a simulated device waits to send a close frame when the simulation ends
+	closeTimeout = time.Second
+)
+
+var (
+	ErrorNoURL      = errors.New("A websocket URL is required")
+	ErrorNoDevices  = errors.New("At least one simulated device is required")
+	ErrorBadBackoff = errors.New("The minimum backoff cannot exceed the maximum backoff")
+)
+
+// Configuration describes a simulation
+type Configuration struct {
+	// URL is the websocket URL simulated devices connect to
+	URL string
+
+	// Devices is the number of simulated devices
+	Devices int
+
+	// FirstMAC is the integer MAC address of the first simulated device.  Each subsequent device
+	// uses the next MAC address.  This field is ignored if IDPattern is set.
+	FirstMAC uint64
+
+	// IDPattern is an optional fmt pattern, taking a single integer, used to produce device names,
+	// e.g. "serial:sim-%06d".  Devices are numbered starting at zero.
+	IDPattern string
+
+	// Convey is the optional convey data sent by each simulated device
+	Convey convey.C
+
+	// ConnectRate is the number of devices per second that initially connect.  If nonpositive, all
+	// devices connect at once.
+	ConnectRate float64
+
+	// Latency is how long simulated devices wait before answering a request
+	Latency time.Duration
+
+	// Jitter is the maximum random amount of time added to Latency
+	Jitter time.Duration
+
+	// Payload is the payload of simulated device responses and events
+	Payload []byte
+
+	// ContentType is the content type of Payload.  If unset, DefaultContentType is used.
+	ContentType string
+
+	// EventInterval is how often each simulated device sends an event.  If nonpositive, no events are sent.
+	EventInterval time.Duration
+
+	// EventDestination is the WRP destination of simulated events.  If unset, DefaultEventDestination is used.
+	EventDestination string
+
+	// MinBackoff is the initial wait before a simulated device reconnects.  If nonpositive, DefaultMinBackoff is used.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the limit on the wait before a simulated device reconnects, which doubles after each
+	// failed attempt.  If nonpositive, DefaultMaxBackoff is used.
+	MaxBackoff time.Duration
+
+	// Dialer is the device Dialer used to connect simulated devices.  If unset, device.DefaultDialer() is used.
+	Dialer device.Dialer
+}
+
+// Statistics holds the results of a simulation
+type Statistics struct {
+	Connects      int64
+	ConnectErrors int64
+	Disconnects   int64
+	Requests      int64
+	Responses     int64
+	Events        int64
+	WriteErrors   int64
+
+	// ConnectLatency measures how long each successful dial took
+	ConnectLatency *Histogram
+
+	// ResponseLatency measures the time from receiving a request to writing its response
+	ResponseLatency *Histogram
+}
+
+// WriteTo writes a human-readable report of these statistics
+func (s *Statistics) WriteTo(output io.Writer) (int64, error) {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "connects=%d connectErrors=%d disconnects=%d\n",
+		atomic.LoadInt64(&s.Connects), atomic.LoadInt64(&s.ConnectErrors), atomic.LoadInt64(&s.Disconnects))
+	fmt.Fprintf(&buffer, "requests=%d responses=%d events=%d writeErrors=%d\n",
+		atomic.LoadInt64(&s.Requests), atomic.LoadInt64(&s.Responses), atomic.LoadInt64(&s.Events), atomic.LoadInt64(&s.WriteErrors))
+
+	fmt.Fprintln(&buffer, "connect latency:")
+	s.ConnectLatency.WriteTo(&buffer)
+	fmt.Fprintln(&buffer, "response latency:")
+	s.ResponseLatency.WriteTo(&buffer)
+
+	return buffer.WriteTo(output)
+}
+
+// Simulator runs a set of synthetic devices against a websocket endpoint
+type Simulator struct {
+	logger log.Logger
+	c      Configuration
+	header http.Header
+	stats  Statistics
+}
+
+// NewSimulator validates the given configuration, applying defaults, and produces a Simulator
+func NewSimulator(logger log.Logger, c Configuration) (*Simulator, error) {
+	if len(c.URL) == 0 {
+		return nil, ErrorNoURL
+	}
+
+	if c.Devices < 1 {
+		return nil, ErrorNoDevices
+	}
+
+	if len(c.ContentType) == 0 {
+		c.ContentType = DefaultContentType
+	}
+
+	if len(c.EventDestination) == 0 {
+		c.EventDestination = DefaultEventDestination
+	}
+
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DefaultMinBackoff
+	}
+
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if c.MinBackoff > c.MaxBackoff {
+		return nil, ErrorBadBackoff
+	}
+
+	if c.Dialer == nil {
+		c.Dialer = device.DefaultDialer()
+	}
+
+	if logger == nil {
+		logger = logging.DefaultLogger()
+	}
+
+	s := &Simulator{
+		logger: logger,
+		c:      c,
+		header: make(http.Header),
+		stats: Statistics{
+			ConnectLatency:  NewHistogram(0, 0),
+			ResponseLatency: NewHistogram(0, 0),
+		},
+	}
+
+	if len(c.Convey) > 0 {
+		var encoded bytes.Buffer
+		if err := convey.NewTranslator(nil).WriteTo(&encoded, c.Convey); err != nil {
+			return nil, err
+		}
+
+		s.header.Set(device.ConveyHeader, encoded.String())
+	}
+
+	return s, nil
+}
+
+// ID returns the device name of the i-th simulated device
+func (s *Simulator) ID(i int) device.ID {
+	if len(s.c.IDPattern) > 0 {
+		return device.ID(fmt.Sprintf(s.c.IDPattern, i))
+	}
+
+	return device.IntToMAC(s.c.FirstMAC + uint64(i))
+}
+
+// Statistics returns the statistics gathered by this simulator.  The returned instance is updated as
+// the simulation runs.
+func (s *Simulator) Statistics() *Statistics {
+	return &s.stats
+}
+
+// Run connects all the simulated devices, pacing connections by the configured rate, and keeps them
+// connected until the context is cancelled.  This method blocks until every simulated device has disconnected.
+func (s *Simulator) Run(ctx context.Context) *Statistics {
+	var (
+		wg   sync.WaitGroup
+		pace <-chan time.Time
+	)
+
+	if s.c.ConnectRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / s.c.ConnectRate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	s.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "simulation starting", "devices", s.c.Devices, "url", s.c.URL)
+
+Start:
+	for i := 0; i < s.c.Devices; i++ {
+		if pace != nil && i > 0 {
+			select {
+			case <-pace:
+			case <-ctx.Done():
+				break Start
+			}
+		}
+
+		wg.Add(1)
+		go s.simulate(ctx, &wg, s.ID(i))
+	}
+
+	wg.Wait()
+	s.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "simulation complete")
+	return &s.stats
+}
+
+// wait blocks for the given duration, returning false if the context was cancelled first
+func wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backoff returns a randomized wait based on the current backoff, along with the next backoff to use
+func (s *Simulator) backoff(current time.Duration) (time.Duration, time.Duration) {
+	next := current * 2
+	if next > s.c.MaxBackoff {
+		next = s.c.MaxBackoff
+	}
+
+	// full jitter in the upper half of the current backoff, so that reconnecting devices spread out
+	return current/2 + time.Duration(rand.Int63n(int64(current/2)+1)), next
+}
+
+// simulate runs a single simulated device, reconnecting with backoff, until the context is cancelled
+func (s *Simulator) simulate(ctx context.Context, wg *sync.WaitGroup, id device.ID) {
+	defer wg.Done()
+
+	var (
+		logger  = log.With(s.logger, "id", id)
+		current = s.c.MinBackoff
+		delay   time.Duration
+	)
+
+	for ctx.Err() == nil {
+		start := time.Now()
+		conn, _, err := s.c.Dialer.DialDevice(string(id), s.c.URL, s.header)
+		if err != nil {
+			atomic.AddInt64(&s.stats.ConnectErrors, 1)
+			delay, current = s.backoff(current)
+			logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to connect", "retryIn", delay, logging.ErrorKey(), err)
+			if !wait(ctx, delay) {
+				return
+			}
+
+			continue
+		}
+
+		s.stats.ConnectLatency.Observe(time.Since(start))
+		atomic.AddInt64(&s.stats.Connects, 1)
+		current = s.c.MinBackoff
+
+		err = s.session(ctx, logger, id, conn)
+		if ctx.Err() != nil {
+			return
+		}
+
+		atomic.AddInt64(&s.stats.Disconnects, 1)
+		delay, current = s.backoff(current)
+		if code, reason, ok := device.ParseCloseError(err); ok {
+			logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "disconnected", "retryIn", delay, "closeCode", code, "closeReason", reason.Text)
+		} else {
+			logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "disconnected", "retryIn", delay, logging.ErrorKey(), err)
+		}
+		if !wait(ctx, delay) {
+			return
+		}
+	}
+}
+
+// deviceConnection serializes writes to a simulated device's websocket
+type deviceConnection struct {
+	lock sync.Mutex
+	conn *websocket.Conn
+}
+
+func (dc *deviceConnection) write(message interface{}) error {
+	var data []byte
+	if err := wrp.NewEncoderBytes(&data, wrp.Msgpack).Encode(message); err != nil {
+		return err
+	}
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	return dc.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (dc *deviceConnection) close() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeTimeout),
+	)
+
+	dc.conn.Close()
+}
+
+// session handles a single connection of a simulated device, returning when that connection ends
+func (s *Simulator) session(ctx context.Context, logger log.Logger, id device.ID, conn *websocket.Conn) error {
+	var (
+		dc       = &deviceConnection{conn: conn}
+		done     = make(chan struct{})
+		inFlight sync.WaitGroup
+	)
+
+	defer func() {
+		close(done)
+		inFlight.Wait()
+	}()
+
+	inFlight.Add(1)
+	go func() {
+		defer inFlight.Done()
+		select {
+		case <-ctx.Done():
+			dc.close()
+		case <-done:
+			conn.Close()
+		}
+	}()
+
+	if s.c.EventInterval > 0 {
+		inFlight.Add(1)
+		go s.sendEvents(dc, &inFlight, done, id)
+	}
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		var request wrp.Message
+		if err := wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&request); err != nil {
+			logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "skipping malformed WRP message", logging.ErrorKey(), err)
+			continue
+		}
+
+		if request.Type != wrp.SimpleRequestResponseMessageType {
+			continue
+		}
+
+		atomic.AddInt64(&s.stats.Requests, 1)
+		inFlight.Add(1)
+		go s.respond(dc, &inFlight, done, time.Now(), &request)
+	}
+}
+
+// respond answers a request after the configured latency, unless the connection ends first
+func (s *Simulator) respond(dc *deviceConnection, inFlight *sync.WaitGroup, done <-chan struct{}, received time.Time, request *wrp.Message) {
+	defer inFlight.Done()
+
+	latency := s.c.Latency
+	if s.c.Jitter > 0 {
+		latency += time.Duration(rand.Int63n(int64(s.c.Jitter)))
+	}
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+	}
+
+	err := dc.write(&wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          request.Destination,
+		Destination:     request.Source,
+		TransactionUUID: request.TransactionUUID,
+		ContentType:     s.c.ContentType,
+		Payload:         s.c.Payload,
+	})
+
+	if err != nil {
+		atomic.AddInt64(&s.stats.WriteErrors, 1)
+		return
+	}
+
+	s.stats.ResponseLatency.Observe(time.Since(received))
+	atomic.AddInt64(&s.stats.Responses, 1)
+}
+
+// sendEvents emits periodic events until the connection ends
+func (s *Simulator) sendEvents(dc *deviceConnection, inFlight *sync.WaitGroup, done <-chan struct{}, id device.ID) {
+	defer inFlight.Done()
+
+	ticker := time.NewTicker(s.c.EventInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := dc.write(&wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      string(id),
+				Destination: s.c.EventDestination,
+				ContentType: s.c.ContentType,
+				Payload:     s.c.Payload,
+			})
+
+			if err != nil {
+				atomic.AddInt64(&s.stats.WriteErrors, 1)
+			} else {
+				atomic.AddInt64(&s.stats.Events, 1)
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Comcast/webpa-common/convey"
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+)
+
+func TestHistogram(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		h      = NewHistogram(time.Millisecond, 4)
+		output bytes.Buffer
+	)
+
+	assert.Zero(h.Count())
+	assert.Zero(h.Quantile(0.5))
+
+	h.WriteTo(&output)
+	assert.Contains(output.String(), "no observations")
+
+	for _, d := range []time.Duration{500 * time.Microsecond, time.Millisecond, 3 * time.Millisecond, 5 * time.Millisecond, time.Second} {
+		h.Observe(d)
+	}
+
+	assert.Equal(5, h.Count())
+	assert.Equal(time.Millisecond, h.Quantile(0.4))
+	assert.Equal(4*time.Millisecond, h.Quantile(0.6))
+	assert.Equal(8*time.Millisecond, h.Quantile(0.8))
+	assert.Equal(time.Second, h.Quantile(1.0))
+
+	output.Reset()
+	h.WriteTo(&output)
+	assert.Contains(output.String(), "count=5 min=500µs")
+	assert.Contains(output.String(), "max=1s")
+	assert.Contains(output.String(), ">  8ms")
+}
+
+func TestNewSimulator(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewSimulator(nil, Configuration{Devices: 1})
+	assert.Nil(s)
+	assert.Equal(ErrorNoURL, err)
+
+	s, err = NewSimulator(nil, Configuration{URL: "ws://localhost"})
+	assert.Nil(s)
+	assert.Equal(ErrorNoDevices, err)
+
+	s, err = NewSimulator(nil, Configuration{URL: "ws://localhost", Devices: 1, MinBackoff: time.Hour, MaxBackoff: time.Minute})
+	assert.Nil(s)
+	assert.Equal(ErrorBadBackoff, err)
+
+	s, err = NewSimulator(nil, Configuration{URL: "ws://localhost", Devices: 1, FirstMAC: 0xff})
+	if assert.NotNil(s) && assert.NoError(err) {
+		assert.Equal(device.ID("mac:0000000000ff"), s.ID(0))
+		assert.Equal(device.ID("mac:000000000100"), s.ID(1))
+		assert.Empty(s.header)
+	}
+
+	s, err = NewSimulator(nil, Configuration{URL: "ws://localhost", Devices: 1, IDPattern: "serial:sim-%03d", Convey: convey.C{"hw-model": "sim"}})
+	if assert.NotNil(s) && assert.NoError(err) {
+		assert.Equal(device.ID("serial:sim-007"), s.ID(7))
+		assert.NotEmpty(s.header.Get(device.ConveyHeader))
+	}
+}
+
+// startManager starts an in-process device.Manager, returning it along with the websocket URL devices connect to
+func startManager(t *testing.T, listeners ...device.Listener) (device.Manager, *httptest.Server, string) {
+	o := &device.Options{
+		Logger:    logging.NewTestLogger(nil, t),
+		Listeners: listeners,
+	}
+
+	var (
+		manager = device.NewManager(o)
+		server  = httptest.NewServer(
+			alice.New(device.UseID.FromHeader).Then(
+				&device.ConnectHandler{
+					Logger:    o.Logger,
+					Connector: manager,
+				},
+			),
+		)
+	)
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	u.Scheme = "ws"
+	return manager, server, u.String()
+}
+
+func awaitDevices(t *testing.T, manager device.Manager, expected int) bool {
+	timeout := time.After(5 * time.Second)
+	for manager.Len() != expected {
+		select {
+		case <-timeout:
+			return assert.Fail(t, "Simulated devices did not connect", "expected %d devices, found %d", expected, manager.Len())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	return true
+}
+
+func TestSimulator(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		events                      int32
+		manager, server, connectURL = startManager(t, func(e *device.Event) {
+			if e.Type == device.MessageReceived && e.Message.MessageType() == wrp.SimpleEventMessageType {
+				atomic.AddInt32(&events, 1)
+			}
+		})
+	)
+
+	defer server.Close()
+
+	simulator, err := NewSimulator(
+		logging.NewTestLogger(nil, t),
+		Configuration{
+			URL:           connectURL,
+			Devices:       5,
+			ConnectRate:   100,
+			Convey:        convey.C{"hw-model": "sim"},
+			Latency:       20 * time.Millisecond,
+			Payload:       []byte(`{"simulated": true}`),
+			EventInterval: 50 * time.Millisecond,
+			MinBackoff:    10 * time.Millisecond,
+			MaxBackoff:    50 * time.Millisecond,
+		},
+	)
+
+	require.NoError(err)
+	require.NotNil(simulator)
+
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		finished    = make(chan *Statistics, 1)
+	)
+
+	defer cancel()
+	go func() {
+		finished <- simulator.Run(ctx)
+	}()
+
+	require.True(awaitDevices(t, manager, 5))
+
+	d, ok := manager.Get(simulator.ID(2))
+	require.True(ok)
+	hwModel, _ := d.Convey().Get("hw-model")
+	assert.Equal("sim", hwModel)
+
+	requestContext, requestCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer requestCancel()
+
+	response, err := manager.Route(
+		(&device.Request{
+			Message: &wrp.SimpleRequestResponse{
+				Source:          "test",
+				Destination:     string(simulator.ID(2)),
+				TransactionUUID: "simulator-test",
+				Payload:         []byte("request"),
+			},
+			Format: wrp.Msgpack,
+		}).WithContext(requestContext),
+	)
+
+	require.NoError(err)
+	require.NotNil(response)
+	assert.Equal(`{"simulated": true}`, string(response.Message.Payload))
+	assert.Equal(string(simulator.ID(2)), response.Message.Source)
+	assert.Equal("test", response.Message.Destination)
+
+	// a disconnected device reconnects
+	assert.True(manager.Disconnect(simulator.ID(0), device.CloseReason{Text: "test"}))
+	timeout := time.After(5 * time.Second)
+	for atomic.LoadInt64(&simulator.Statistics().Connects) < 6 {
+		select {
+		case <-timeout:
+			assert.Fail("The simulated device did not reconnect")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	require.True(awaitDevices(t, manager, 5))
+
+	timeout = time.After(5 * time.Second)
+	for atomic.LoadInt32(&events) < 5 {
+		select {
+		case <-timeout:
+			assert.Fail("No simulated events were received")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+
+	var stats *Statistics
+	select {
+	case stats = <-finished:
+	case <-time.After(5 * time.Second):
+		assert.Fail("The simulation did not finish")
+		return
+	}
+
+	assert.Equal(int64(6), stats.Connects)
+	assert.Equal(int64(1), stats.Disconnects)
+	assert.Equal(int64(1), stats.Requests)
+	assert.Equal(int64(1), stats.Responses)
+	assert.True(stats.Events >= 5)
+	assert.Equal(6, stats.ConnectLatency.Count())
+	assert.True(stats.ResponseLatency.Quantile(1.0) >= 20*time.Millisecond)
+
+	var output bytes.Buffer
+	stats.WriteTo(&output)
+	assert.Contains(output.String(), "connects=6 connectErrors=0 disconnects=1")
+	assert.Contains(output.String(), "response latency:")
+
+	require.True(awaitDevices(t, manager, 0))
+}
@@ -0,0 +1,146 @@
+package device
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultCompressionLevel is the flate compression level used when none is configured.  It favors
+	// speed, since the server may be compressing frames for a very large number of devices.
+	DefaultCompressionLevel = 1
+
+	// MinCompressionLevel and MaxCompressionLevel bound the allowed compression levels.  See compress/flate.
+	MinCompressionLevel = -2
+	MaxCompressionLevel = 9
+
+	// permessageDeflate is the websocket extension token for RFC 7692 compression
+	permessageDeflate = "permessage-deflate"
+)
+
+var ErrorHijackNotSupported = errors.New("The HTTP response does not support hijacking")
+
+// CompressionOptions configures websocket permessage-deflate compression (RFC 7692).  Compression is only
+// used with devices that offer it during the websocket handshake.
+type CompressionOptions struct {
+	// Enabled indicates whether permessage-deflate is negotiated with devices that offer it
+	Enabled bool
+
+	// Level is the flate compression level for frames sent to devices.  If zero or outside the range
+	// MinCompressionLevel to MaxCompressionLevel, DefaultCompressionLevel is used.
+	Level int
+
+	// MinSize is the smallest frame, in bytes, that is compressed.  Smaller frames are sent uncompressed,
+	// as compressing them costs more than it saves.  If nonpositive, all frames are compressed.
+	MinSize int
+}
+
+func (o *CompressionOptions) enabled() bool {
+	return o != nil && o.Enabled
+}
+
+func (o *CompressionOptions) level() int {
+	if o != nil && o.Level != 0 && o.Level >= MinCompressionLevel && o.Level <= MaxCompressionLevel {
+		return o.Level
+	}
+
+	return DefaultCompressionLevel
+}
+
+func (o *CompressionOptions) minSize() int {
+	if o != nil && o.MinSize > 0 {
+		return o.MinSize
+	}
+
+	return 0
+}
+
+// offersPermessageDeflate tests if a set of handshake headers includes the permessage-deflate extension
+func offersPermessageDeflate(header http.Header) bool {
+	for _, value := range header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(value, ",") {
+			token := extension
+			if i := strings.IndexByte(extension, ';'); i >= 0 {
+				token = extension[:i]
+			}
+
+			if strings.EqualFold(strings.TrimSpace(token), permessageDeflate) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wireConn is a net.Conn which counts the bytes actually read from and written to the network
+type wireConn struct {
+	net.Conn
+	statistics Statistics
+}
+
+func (wc *wireConn) Read(p []byte) (int, error) {
+	n, err := wc.Conn.Read(p)
+	if n > 0 {
+		wc.statistics.AddWireBytesReceived(n)
+	}
+
+	return n, err
+}
+
+func (wc *wireConn) Write(p []byte) (int, error) {
+	n, err := wc.Conn.Write(p)
+	if n > 0 {
+		wc.statistics.AddWireBytesSent(n)
+	}
+
+	return n, err
+}
+
+// wireResponseWriter decorates an http.ResponseWriter so that the connection hijacked by a websocket
+// upgrade is a wireConn
+type wireResponseWriter struct {
+	http.ResponseWriter
+	statistics Statistics
+}
+
+func (wrw *wireResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := wrw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrorHijackNotSupported
+	}
+
+	c, brw, err := hijacker.Hijack()
+	if err != nil {
+		return c, brw, err
+	}
+
+	if brw.Reader.Buffered() > 0 {
+		// the upgrader rejects connections with data sent before the handshake completed,
+		// so there's no need to count anything
+		return c, brw, nil
+	}
+
+	wc := &wireConn{Conn: c, statistics: wrw.statistics}
+	return wc, bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc)), nil
+}
+
+// minSizeWriter disables compression for frames smaller than a minimum size
+type minSizeWriter struct {
+	*websocket.Conn
+	minSize int
+}
+
+func (msw *minSizeWriter) WriteMessage(messageType int, data []byte) error {
+	if len(data) < msw.minSize {
+		msw.Conn.EnableWriteCompression(false)
+		defer msw.Conn.EnableWriteCompression(true)
+	}
+
+	return msw.Conn.WriteMessage(messageType, data)
+}
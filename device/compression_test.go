@@ -0,0 +1,133 @@
+package device
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, o := range []*CompressionOptions{nil, new(CompressionOptions)} {
+		assert.False(o.enabled())
+		assert.Equal(DefaultCompressionLevel, o.level())
+		assert.Zero(o.minSize())
+	}
+
+	o := CompressionOptions{Enabled: true, Level: 9, MinSize: 512}
+	assert.True(o.enabled())
+	assert.Equal(9, o.level())
+	assert.Equal(512, o.minSize())
+
+	o.Level = -2
+	assert.Equal(-2, o.level())
+
+	o.Level = 10
+	assert.Equal(DefaultCompressionLevel, o.level())
+
+	o.Level = -3
+	assert.Equal(DefaultCompressionLevel, o.level())
+}
+
+func TestOffersPermessageDeflate(t *testing.T) {
+	testData := []struct {
+		header   http.Header
+		expected bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Sec-Websocket-Extensions": {"x-webkit-deflate-frame"}}, false},
+		{http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}}, true},
+		{http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; client_max_window_bits"}}, true},
+		{http.Header{"Sec-Websocket-Extensions": {"foo, Permessage-Deflate; server_no_context_takeover"}}, true},
+		{http.Header{"Sec-Websocket-Extensions": {"foo", "permessage-deflate"}}, true},
+	}
+
+	for _, record := range testData {
+		assert.Equal(t, record.expected, offersPermessageDeflate(record.header), "%v", record.header)
+	}
+}
+
+func testManagerCompression(t *testing.T, dialer Dialer, compression CompressionOptions, expectCompressed bool) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		listener = newSessionTestListener()
+		options  = &Options{
+			Logger:      logging.NewTestLogger(nil, t),
+			Compression: compression,
+			Listeners:   []Listener{listener.OnDeviceEvent},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+
+		payload = []byte(strings.Repeat("a highly compressible payload ", 512))
+	)
+
+	defer server.Close()
+
+	connection, response, err := dialer.DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	assert.Equal(expectCompressed, offersPermessageDeflate(response.Header))
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	d, ok := manager.Get(testDeviceIDs[0])
+	require.True(ok)
+	assert.Equal(expectCompressed, d.Statistics().Compressed())
+
+	// both a large frame and a frame under any minimum size are delivered intact
+	for _, expected := range [][]byte{payload, []byte("small")} {
+		_, err = manager.Route(&Request{
+			Message: &wrp.SimpleEvent{Source: "test", Destination: string(testDeviceIDs[0]), Payload: expected},
+			Format:  wrp.Msgpack,
+		})
+
+		require.NoError(err)
+		assert.Equal(expected, readTestMessage(require, connection).Payload)
+	}
+
+	require.NoError(connection.WriteMessage(
+		websocket.BinaryMessage,
+		wrp.MustEncode(&wrp.SimpleEvent{Source: string(testDeviceIDs[0]), Destination: "event:test", Payload: payload}, wrp.Msgpack),
+	))
+
+	require.NoError(connection.Close())
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+
+	statistics := d.Statistics()
+	assert.Equal(1, listener.count(MessageReceived))
+	assert.True(statistics.BytesSent() > len(payload))
+	assert.True(statistics.BytesReceived() > len(payload))
+	if expectCompressed {
+		assert.True(statistics.WireBytesSent() < statistics.BytesSent(), "%s", statistics)
+		assert.True(statistics.WireBytesReceived() < statistics.BytesReceived(), "%s", statistics)
+	} else {
+		assert.True(statistics.WireBytesSent() > statistics.BytesSent(), "%s", statistics)
+		assert.True(statistics.WireBytesReceived() > statistics.BytesReceived(), "%s", statistics)
+	}
+}
+
+func TestManagerCompression(t *testing.T) {
+	t.Run("Negotiated", func(t *testing.T) {
+		testManagerCompression(t, NewDialer(DialerOptions{Compression: true}), CompressionOptions{Enabled: true, MinSize: 64}, true)
+	})
+
+	t.Run("BestCompression", func(t *testing.T) {
+		testManagerCompression(t, NewDialer(DialerOptions{Compression: true, CompressionLevel: 9}), CompressionOptions{Enabled: true, Level: 9}, true)
+	})
+
+	t.Run("NotOffered", func(t *testing.T) {
+		testManagerCompression(t, DefaultDialer(), CompressionOptions{Enabled: true}, false)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		testManagerCompression(t, NewDialer(DialerOptions{Compression: true}), CompressionOptions{}, false)
+	})
+}
@@ -97,6 +97,18 @@ func SetPongHandler(r Reader, pongs xmetrics.Incrementer, deadline func() time.T
 	})
 }
 
+// statisticsIncrementer decorates an xmetrics.Incrementer so that each increment is also recorded
+// with a device's Statistics, e.g. to track ping latency
+type statisticsIncrementer struct {
+	xmetrics.Incrementer
+	record func()
+}
+
+func (si statisticsIncrementer) Inc() {
+	si.Incrementer.Inc()
+	si.record()
+}
+
 type instrumentedReader struct {
 	ReadCloser
 	statistics Statistics
@@ -2,7 +2,9 @@ package device
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync/atomic"
 	"time"
@@ -10,6 +12,8 @@ import (
 	"github.com/Comcast/webpa-common/convey"
 	"github.com/Comcast/webpa-common/convey/conveymetric"
 	"github.com/Comcast/webpa-common/secure"
+	"github.com/Comcast/webpa-common/xmetrics"
+	"github.com/go-kit/kit/metrics/discard"
 
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/go-kit/kit/log"
@@ -20,6 +24,16 @@ const (
 	stateClosed
 )
 
+// the states of a device's session with respect to this connection
+const (
+	sessionActive int32 = iota
+	sessionSuspended
+	sessionEnded
+)
+
+// errAttemptTimedOut is the internal error indicating that a single attempt of a retryable transaction timed out
+var errAttemptTimedOut = errors.New("The transaction attempt timed out")
+
 // envelope is a tuple of a device Request and a send-only channel for errors.
 // The write pump goroutine will use the complete channel to communicate the result
 // of the write operation.
@@ -115,11 +129,17 @@ type device struct {
 
 	statistics Statistics
 
-	state int32
+	state     int32
+	suspended int32
+
+	shutdown chan struct{}
+	messages chan *envelope
+	session  *session
+	limiter  *rateLimiter
 
-	shutdown     chan struct{}
-	messages     chan *envelope
-	transactions *Transactions
+	transactions       *TransactionOptions
+	transactionTimeout xmetrics.Incrementer
+	transactionRetry   xmetrics.Incrementer
 
 	c             convey.Interface
 	compliance    convey.Compliance
@@ -143,6 +163,10 @@ type deviceOptions struct {
 	QueueSize   int
 	ConnectedAt time.Time
 	Logger      log.Logger
+
+	Transactions       *TransactionOptions
+	TransactionTimeout xmetrics.Incrementer
+	TransactionRetry   xmetrics.Incrementer
 }
 
 // newDevice is an internal factory function for devices
@@ -163,24 +187,36 @@ func newDevice(o deviceOptions) *device {
 		o.Trust = secure.Untrusted
 	}
 
+	if o.TransactionTimeout == nil {
+		o.TransactionTimeout = xmetrics.NewIncrementer(discard.NewCounter())
+	}
+
+	if o.TransactionRetry == nil {
+		o.TransactionRetry = xmetrics.NewIncrementer(discard.NewCounter())
+	}
+
 	var partnerIDs []string
 	partnerIDs = append(partnerIDs, o.PartnerIDs...)
 
 	return &device{
-		id:           o.ID,
-		errorLog:     logging.Error(o.Logger, "id", o.ID),
-		infoLog:      logging.Info(o.Logger, "id", o.ID),
-		debugLog:     logging.Debug(o.Logger, "id", o.ID),
-		statistics:   NewStatistics(nil, o.ConnectedAt),
-		c:            o.C,
-		compliance:   o.Compliance,
-		state:        stateOpen,
-		shutdown:     make(chan struct{}),
-		messages:     make(chan *envelope, o.QueueSize),
-		transactions: NewTransactions(),
-		partnerIDs:   partnerIDs,
-		satClientID:  o.SatClientID,
-		trust:        o.Trust,
+		id:          o.ID,
+		errorLog:    logging.Error(o.Logger, "id", o.ID),
+		infoLog:     logging.Info(o.Logger, "id", o.ID),
+		debugLog:    logging.Debug(o.Logger, "id", o.ID),
+		statistics:  NewStatistics(nil, o.ConnectedAt),
+		c:           o.C,
+		compliance:  o.Compliance,
+		state:       stateOpen,
+		shutdown:    make(chan struct{}),
+		messages:    make(chan *envelope, o.QueueSize),
+		session:     newSession(o.Transactions),
+		partnerIDs:  partnerIDs,
+		satClientID: o.SatClientID,
+		trust:       o.Trust,
+
+		transactions:       o.Transactions,
+		transactionTimeout: o.TransactionTimeout,
+		transactionRetry:   o.TransactionRetry,
 	}
 }
 
@@ -204,19 +240,57 @@ func (d *device) MarshalJSON() ([]byte, error) {
 
 func (d *device) requestClose(reason CloseReason) error {
 	if atomic.CompareAndSwapInt32(&d.state, stateOpen, stateClosed) {
-		close(d.shutdown)
-		d.transactions.Close()
+		// stop the clock on this connection, so that its statistics are final regardless of when they are read
+		if s, ok := d.statistics.(*statistics); ok {
+			s.freeze()
+		}
 
 		if len(reason.Text) == 0 {
 			reason.Text = "unknown"
 		}
 
+		// the reason is stored before shutdown is signaled, so that the write pump can tell the device why it was closed
 		d.closeReason.Store(reason)
+		close(d.shutdown)
+
+		// a suspended device's session is held for a grace period, so that it can be resumed
+		if atomic.CompareAndSwapInt32(&d.suspended, sessionActive, sessionEnded) {
+			d.session.close()
+		}
 	}
 
 	return nil
 }
 
+// suspend marks this device's session as resumable, so that closing this device does not end its session.
+// This method returns false, and leaves the device unsuspended, if the session has already ended, e.g. because
+// this device was deliberately closed.
+func (d *device) suspend() bool {
+	if !atomic.CompareAndSwapInt32(&d.suspended, sessionActive, sessionSuspended) {
+		return false
+	}
+
+	// the session may have been ended by something other than this device, such as an expired predecessor
+	if d.session.closed() {
+		atomic.StoreInt32(&d.suspended, sessionEnded)
+		return false
+	}
+
+	return true
+}
+
+// isSuspended tests if this device's session was suspended when it disconnected.  This is true exactly when
+// suspendedSessions.suspend succeeded for this device.
+func (d *device) isSuspended() bool {
+	return atomic.LoadInt32(&d.suspended) == sessionSuspended
+}
+
+// adopt resumes the session of a previous, suspended device with the same ID.  This method must be
+// called before this device is registered or has any pumps running.
+func (d *device) adopt(previous *device) {
+	d.session = previous.session
+}
+
 func (d *device) ID() ID {
 	return d.id
 }
@@ -254,11 +328,12 @@ func (d *device) sendRequest(request *Request) error {
 	}
 
 	// once enqueued, wait until the context is cancelled
-	// or there's a result
+	// or there's a result.  the session is used rather than this device's shutdown
+	// channel, since a resumed session will deliver queued messages on a new connection.
 	select {
 	case <-done:
 		return request.Context().Err()
-	case <-d.shutdown:
+	case <-d.session.done:
 		return ErrorDeviceClosed
 	case err := <-complete:
 		return err
@@ -267,13 +342,16 @@ func (d *device) sendRequest(request *Request) error {
 
 // awaitResponse waits for the read pump to acquire a response that corresponds to the
 // request's transaction key.  The result channel will receive the response from the
-// read pump.
-func (d *device) awaitResponse(request *Request, result <-chan *Response) (*Response, error) {
+// read pump.  If the retry channel is not nil, errAttemptTimedOut is returned should that
+// channel fire before a response arrives.
+func (d *device) awaitResponse(request *Request, result <-chan *Response, retry <-chan time.Time) (*Response, error) {
 	select {
 	case <-request.Context().Done():
 		return nil, request.Context().Err()
-	case <-d.shutdown:
+	case <-d.session.done:
 		return nil, ErrorDeviceClosed
+	case <-retry:
+		return nil, errAttemptTimedOut
 	case response := <-result:
 		if response == nil {
 			return nil, ErrorTransactionCancelled
@@ -288,33 +366,69 @@ func (d *device) Send(request *Request) (*Response, error) {
 		return nil, ErrorDeviceClosed
 	}
 
-	var (
-		transactionKey, transactional = request.Transactional()
-		result                        <-chan *Response
-	)
-
-	if transactional {
-		var err error
-		if result, err = d.transactions.Register(transactionKey); err != nil {
-			// if a transaction key cannot be registered, we don't want to proceed.
-			// this indicates some larger problem, most often a duplicate transaction key.
-			return nil, err
-		}
+	switch d.limiter.checkOutbound(request.Context().Done()) {
+	case "":
+	case RateLimitDelay:
+		return nil, request.Context().Err()
+	case RateLimitDisconnect:
+		d.errorLog.Log(logging.MessageKey(), "outbound rate limit exceeded, disconnecting")
+		d.requestClose(CloseReason{Err: ErrorRateLimited, Text: RateLimitedCloseReason})
+		return nil, ErrorRateLimited
+	default:
+		return nil, ErrorRateLimited
+	}
 
-		// ensure that the transaction is cleared
-		defer d.transactions.Cancel(transactionKey)
+	transactionKey, transactional := request.Transactional()
+	if !transactional {
+		return nil, d.sendRequest(request)
 	}
 
-	if err := d.sendRequest(request); err != nil {
+	deadline, _ := request.Context().Deadline()
+	result, err := d.session.transactions.RegisterDeadline(transactionKey, deadline)
+	if err != nil {
+		// if a transaction key cannot be registered, we don't want to proceed.
+		// this indicates some larger problem, most often a duplicate transaction key.
 		return nil, err
 	}
 
-	if result == nil {
-		// if there is no pending transaction, we're done
-		return nil, nil
+	var response *Response
+
+	// ensure that the transaction is cleared, remembering it if it timed out so that a late response is recognized
+	defer func() {
+		if err == context.DeadlineExceeded {
+			d.transactionTimeout.Inc()
+			d.session.transactions.Timeout(transactionKey)
+		} else {
+			d.session.transactions.Cancel(transactionKey)
+		}
+	}()
+
+	retries := 0
+	if d.transactions.retryable(request.Message.MessageType()) {
+		retries = d.transactions.MaxRetries
 	}
 
-	return d.awaitResponse(request, result)
+	for attempt := 0; ; attempt++ {
+		if err = d.sendRequest(request); err != nil {
+			return nil, err
+		}
+
+		d.session.transactions.attempt(transactionKey)
+		if attempt >= retries {
+			response, err = d.awaitResponse(request, result, nil)
+			return response, err
+		}
+
+		timer := time.NewTimer(d.transactions.AttemptTimeout)
+		response, err = d.awaitResponse(request, result, timer.C)
+		timer.Stop()
+		if err != errAttemptTimedOut {
+			return response, err
+		}
+
+		d.debugLog.Log(logging.MessageKey(), "resending request", "transactionKey", transactionKey, "attempt", attempt+1)
+		d.transactionRetry.Inc()
+	}
 }
 
 func (d *device) Statistics() Statistics {
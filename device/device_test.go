@@ -76,10 +76,11 @@ func TestDevice(t *testing.T) {
 
 		assert.JSONEq(
 			fmt.Sprintf(
-				`{"id": "%s", "pending": 0, "statistics": {"duplications": 0, "bytesSent": 0, "messagesSent": 0, "bytesReceived": 0, "messagesReceived": 0, "connectedAt": "%s", "upTime": "%s"}}`,
+				`{"id": "%s", "pending": 0, "statistics": {"duplications": 0, "bytesSent": 0, "messagesSent": 0, "bytesReceived": 0, "messagesReceived": 0, "wireBytesSent": 0, "wireBytesReceived": 0, "compressed": false, "connectedAt": "%s", "upTime": "%s", "idleTime": "%s", "rates": {"bytesSent": 0, "messagesSent": 0, "bytesReceived": 0, "messagesReceived": 0}}}`,
 				record.expectedID,
 				expectedConnectedAt.UTC().Format(time.RFC3339Nano),
 				expectedUpTime,
+				expectedUpTime,
 			),
 			string(data),
 		)
@@ -19,8 +19,9 @@ var defaultWebsocketDialer websocketDialer = &websocket.Dialer{}
 
 // defaultDialer is the default device Dialer
 var defaultDialer Dialer = &dialer{
-	deviceHeader: DeviceNameHeader,
-	wd:           defaultWebsocketDialer,
+	deviceHeader:     DeviceNameHeader,
+	wd:               defaultWebsocketDialer,
+	compressionLevel: DefaultCompressionLevel,
 }
 
 // DefaultDialer returns a useful default device Dialer
@@ -28,6 +29,9 @@ func DefaultDialer() Dialer { return defaultDialer }
 
 // Dialer is a device-specific dialer for device websocket connections.  This interface has a similar
 // signature and usage pattern as gorilla's websocket.Dialer.
+//
+// When a Manager disconnects a device, it sends a close frame describing why.  ParseCloseError can be used
+// on the error returned by reading a dialed connection to obtain that close code and reason.
 type Dialer interface {
 	// DialDevice attempts to connect to the given device.  If supplied, the extra headers are passed
 	// along in the Dial call.  However, the extra http.Header object is not modified by this method.
@@ -42,13 +46,22 @@ type DialerOptions struct {
 
 	// WSDialer is the low-level websocket dialer to use.  If unset, an internal default gorilla dialer is used.
 	WSDialer websocketDialer
+
+	// Compression indicates whether the dialer offers permessage-deflate compression to the server.
+	// This option is ignored if WSDialer is set, in which case that dialer's own configuration applies.
+	Compression bool
+
+	// CompressionLevel is the flate compression level used for frames sent by dialed connections when
+	// compression is negotiated.  If zero or out of range, DefaultCompressionLevel is used.
+	CompressionLevel int
 }
 
 // NewDialer produces a device dialer using the supplied set of options
 func NewDialer(o DialerOptions) Dialer {
 	d := &dialer{
-		deviceHeader: o.DeviceHeader,
-		wd:           o.WSDialer,
+		deviceHeader:     o.DeviceHeader,
+		wd:               o.WSDialer,
+		compressionLevel: (&CompressionOptions{Level: o.CompressionLevel}).level(),
 	}
 
 	if len(d.deviceHeader) == 0 {
@@ -56,7 +69,11 @@ func NewDialer(o DialerOptions) Dialer {
 	}
 
 	if d.wd == nil {
-		d.wd = defaultWebsocketDialer
+		if o.Compression {
+			d.wd = &websocket.Dialer{EnableCompression: true}
+		} else {
+			d.wd = defaultWebsocketDialer
+		}
 	}
 
 	return d
@@ -64,8 +81,9 @@ func NewDialer(o DialerOptions) Dialer {
 
 // dialer is the internal device Dialer implementation
 type dialer struct {
-	deviceHeader string
-	wd           websocketDialer
+	deviceHeader     string
+	wd               websocketDialer
+	compressionLevel int
 }
 
 func (d *dialer) DialDevice(deviceName, url string, extra http.Header) (*websocket.Conn, *http.Response, error) {
@@ -77,7 +95,13 @@ func (d *dialer) DialDevice(deviceName, url string, extra http.Header) (*websock
 	}
 
 	requestHeader.Set(d.deviceHeader, deviceName)
-	return d.wd.Dial(url, requestHeader)
+	c, response, err := d.wd.Dial(url, requestHeader)
+	if err == nil && response != nil && offersPermessageDeflate(response.Header) {
+		// this is a noop unless compression was actually negotiated
+		err = c.SetCompressionLevel(d.compressionLevel)
+	}
+
+	return c, response, err
 }
 
 // MustDialDevice panics if the dial operation fails.  Mostly useful for test code.
@@ -2,12 +2,33 @@ package drain
 
 import "net/http"
 
-// Cancel is an HTTP handler that allows cancellation of drain jobs
+// JobIDParameter is the optional Cancel form parameter which identifies a scheduled or running job to cancel
+const JobIDParameter = "id"
+
+// Cancel is an HTTP handler that allows cancellation of drain jobs.  If a Scheduler is set and the request
+// has a JobIDParameter, that scheduled or running job is cancelled and a 204 is returned.  Otherwise, the running
+// drain job is cancelled and this handler waits for it to exit.
 type Cancel struct {
-	Drainer Interface
+	Drainer   Interface
+	Scheduler Scheduler
 }
 
 func (c *Cancel) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if id := request.FormValue(JobIDParameter); len(id) > 0 {
+		if c.Scheduler == nil {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := c.Scheduler.Cancel(id); err != nil {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	done, err := c.Drainer.Cancel()
 	if err != nil {
 		response.WriteHeader(http.StatusConflict)
@@ -15,7 +15,7 @@ func testCancelNotActive(t *testing.T) {
 		assert = assert.New(t)
 
 		d      = new(mockDrainer)
-		cancel = Cancel{d}
+		cancel = Cancel{Drainer: d}
 
 		response = httptest.NewRecorder()
 		request  = httptest.NewRequest("GET", "/", nil)
@@ -33,7 +33,7 @@ func testCancelSuccess(t *testing.T) {
 		assert = assert.New(t)
 
 		d          = new(mockDrainer)
-		cancel     = Cancel{d}
+		cancel     = Cancel{Drainer: d}
 		done       = make(chan struct{})
 		cancelWait = make(chan time.Time)
 		serveHTTP  = make(chan struct{})
@@ -68,7 +68,7 @@ func testCancelTimeout(t *testing.T) {
 		assert = assert.New(t)
 
 		d          = new(mockDrainer)
-		cancel     = Cancel{d}
+		cancel     = Cancel{Drainer: d}
 		done       = make(chan struct{})
 		cancelWait = make(chan time.Time)
 		serveHTTP  = make(chan struct{})
@@ -99,8 +99,54 @@ func testCancelTimeout(t *testing.T) {
 	d.AssertExpectations(t)
 }
 
+func testCancelJob(t *testing.T) {
+	testData := []struct {
+		err          error
+		expectedCode int
+	}{
+		{nil, http.StatusNoContent},
+		{ErrJobNotFound, http.StatusNotFound},
+	}
+
+	for _, record := range testData {
+		var (
+			assert = assert.New(t)
+
+			d        = new(mockDrainer)
+			s        = new(mockScheduler)
+			cancel   = Cancel{Drainer: d, Scheduler: s}
+			response = httptest.NewRecorder()
+			request  = httptest.NewRequest("DELETE", "/?id=12", nil)
+		)
+
+		s.On("Cancel", "12").Return(record.err).Once()
+		cancel.ServeHTTP(response, request)
+		assert.Equal(record.expectedCode, response.Code)
+
+		d.AssertExpectations(t)
+		s.AssertExpectations(t)
+	}
+}
+
+func testCancelJobNoScheduler(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		d        = new(mockDrainer)
+		cancel   = Cancel{Drainer: d}
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("DELETE", "/?id=12", nil)
+	)
+
+	cancel.ServeHTTP(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	d.AssertExpectations(t)
+}
+
 func TestCancel(t *testing.T) {
 	t.Run("NotActive", testCancelNotActive)
 	t.Run("Success", testCancelSuccess)
 	t.Run("Timeout", testCancelTimeout)
+	t.Run("Job", testCancelJob)
+	t.Run("JobNoScheduler", testCancelJobNoScheduler)
 }
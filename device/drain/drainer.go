@@ -1,7 +1,11 @@
 package drain
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,12 +16,17 @@ import (
 
 	"github.com/Comcast/webpa-common/device"
 	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/service"
+	"github.com/Comcast/webpa-common/wrp"
 	"github.com/Comcast/webpa-common/xmetrics"
 )
 
 var (
 	ErrActive    error = errors.New("A drain operation is already running")
 	ErrNotActive error = errors.New("No drain operation is running")
+
+	ErrInvalidOrder         error = errors.New("Invalid drain order")
+	ErrRedirectNotSupported error = errors.New("No service accessor is configured for redirecting devices")
 )
 
 const (
@@ -29,6 +38,26 @@ const (
 
 	Drained = "drained"
 
+	// RedirectCloseReasonPrefix is prepended to the instance a redirected device was told to reconnect to
+	// in order to form that device's close reason
+	RedirectCloseReasonPrefix = "redirect:"
+
+	// RedirectEventSource is the WRP source of the redirect hint sent to devices prior to disconnection, used when
+	// no source is configured with WithRedirectSource and the host name cannot be determined
+	RedirectEventSource = "dns:localhost"
+
+	// RedirectHintTimeout is the time allowed for sending a redirect hint to a single device
+	RedirectHintTimeout time.Duration = 5 * time.Second
+
+	// RedirectEventSuffix is appended to a device's ID to form the WRP destination of a redirect hint
+	RedirectEventSuffix = "/redirect"
+
+	// OrderOldest drains the devices with the longest lived connections first
+	OrderOldest = "oldest"
+
+	// OrderNewest drains the most recently connected devices first
+	OrderNewest = "newest"
+
 	// disconnectBatchSize is the arbitrary size of batches used when no rate is associated with the drain,
 	// i.e. disconnect as fast as possible
 	disconnectBatchSize int = 1000
@@ -77,6 +106,35 @@ func WithManager(m device.Manager) Option {
 	}
 }
 
+// WithRedirector configures the service.Accessor used to hint drained devices as to which instance they
+// should reconnect to.  Jobs with Redirect set are rejected unless an accessor is configured.
+func WithRedirector(a service.Accessor) Option {
+	return func(dr *drainer) {
+		dr.redirector = a
+	}
+}
+
+// WithRedirectSource configures the WRP source of the redirect hints sent to devices.  This should be a locator
+// identifying this server, such as dns:talaria-1.example.com.  By default, the host name is used.
+func WithRedirectSource(source string) Option {
+	return func(dr *drainer) {
+		if len(source) > 0 {
+			dr.redirectSource = source
+		} else {
+			dr.redirectSource = defaultRedirectSource()
+		}
+	}
+}
+
+// defaultRedirectSource produces the dns locator for this host
+func defaultRedirectSource() string {
+	if hostname, err := os.Hostname(); err == nil && len(hostname) > 0 {
+		return wrp.SchemeDNS + ":" + hostname
+	}
+
+	return RedirectEventSource
+}
+
 func WithStateGauge(s xmetrics.Setter) Option {
 	return func(dr *drainer) {
 		if s != nil {
@@ -115,6 +173,19 @@ type Job struct {
 	// Tick is the time unit for the Rate field.  If Rate is set but this field is not set,
 	// a tick of 1 second is used as the default.
 	Tick time.Duration `json:"tick,omitempty" schema:"tick"`
+
+	// Query is an optional device.Query expression which restricts the drain to matching devices.
+	// When set, Count and Percent are relative to the number of matching devices at the time the job starts.
+	Query string `json:"query,omitempty" schema:"query"`
+
+	// Order is the optional order in which devices are drained, either OrderOldest or OrderNewest.  When set,
+	// the matching devices are snapshotted and sorted by connection time when the job starts.  If unset,
+	// devices are drained in whatever order the registry visits them.
+	Order string `json:"order,omitempty" schema:"order"`
+
+	// Redirect indicates whether each device is sent a WRP hint naming the instance it should reconnect to
+	// prior to being disconnected.  The instance is also conveyed in the device's close reason.
+	Redirect bool `json:"redirect,omitempty" schema:"redirect"`
 }
 
 // ToMap returns a map representation of this Job appropriate for marshaling to formats like JSON.
@@ -136,9 +207,61 @@ func (j Job) ToMap() map[string]interface{} {
 		m["tick"] = j.Tick.String()
 	}
 
+	if len(j.Query) > 0 {
+		m["query"] = j.Query
+	}
+
+	if len(j.Order) > 0 {
+		m["order"] = j.Order
+	}
+
+	if j.Redirect {
+		m["redirect"] = true
+	}
+
 	return m
 }
 
+// less returns the device comparison function for this job's Order, or nil if this job is unordered
+func (j Job) less() (func(device.Interface, device.Interface) bool, error) {
+	switch j.Order {
+	case "":
+		return nil, nil
+
+	case OrderOldest:
+		return func(l, r device.Interface) bool {
+			return l.Statistics().ConnectedAt().Before(r.Statistics().ConnectedAt())
+		}, nil
+
+	case OrderNewest:
+		return func(l, r device.Interface) bool {
+			return l.Statistics().ConnectedAt().After(r.Statistics().ConnectedAt())
+		}, nil
+
+	default:
+		return nil, ErrInvalidOrder
+	}
+}
+
+// parse validates the parts of this job which do not depend on any drainer, returning the parsed Query
+// and the device comparison function for the Order
+func (j Job) parse() (*device.Query, func(device.Interface, device.Interface) bool, error) {
+	var q *device.Query
+	if len(j.Query) > 0 {
+		var err error
+		if q, err = device.ParseQuery(j.Query); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	less, err := j.less()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return q, less, nil
+}
+
 // normalize applies some basic logic to interpret defaults and set values appropriately for a given device count
 func (j *Job) normalize(deviceCount int) {
 	if j.Percent > 0 {
@@ -185,9 +308,10 @@ func defaultNewTicker(d time.Duration) (<-chan time.Time, func()) {
 // New constructs a drainer using the supplied options
 func New(options ...Option) Interface {
 	dr := &drainer{
-		logger:    logging.DefaultLogger(),
-		now:       time.Now,
-		newTicker: defaultNewTicker,
+		logger:         logging.DefaultLogger(),
+		redirectSource: defaultRedirectSource(),
+		now:            time.Now,
+		newTicker:      defaultNewTicker,
 		m: metrics{
 			state:   discard.NewGauge(),
 			counter: discard.NewCounter(),
@@ -221,6 +345,8 @@ type jobContext struct {
 	logger    log.Logger
 	t         *tracker
 	j         Job
+	q         *device.Query
+	ordered   *orderedDevices
 	batchSize int
 	ticker    <-chan time.Time
 	stop      func()
@@ -228,14 +354,40 @@ type jobContext struct {
 	done      chan struct{}
 }
 
+// orderedDevices is a sorted snapshot of the devices an ordered job drains.  Only the job's goroutine
+// touches an instance, so no locking is necessary.
+type orderedDevices struct {
+	devices []device.Interface
+	next    int
+}
+
+// visit supplies each remaining device to the given function, in order, until that function returns false.
+// The device for which the function returned false is visited again on the next call.
+func (od *orderedDevices) visit(f func(device.Interface) bool) {
+	for od.next < len(od.devices) {
+		if !f(od.devices[od.next]) {
+			return
+		}
+
+		od.next++
+	}
+}
+
+// redirectHint is the JSON payload of the WRP message sent to redirected devices
+type redirectHint struct {
+	Instance string `json:"instance"`
+}
+
 // drainer is the internal implementation of Interface
 type drainer struct {
-	logger    log.Logger
-	connector device.Connector
-	registry  device.Registry
-	now       func() time.Time
-	newTicker func(time.Duration) (<-chan time.Time, func())
-	m         metrics
+	logger         log.Logger
+	connector      device.Connector
+	registry       device.Registry
+	redirector     service.Accessor
+	redirectSource string
+	now            func() time.Time
+	newTicker      func(time.Duration) (<-chan time.Time, func())
+	m              metrics
 
 	controlLock sync.RWMutex
 	active      uint32
@@ -246,13 +398,25 @@ type drainer struct {
 // nextBatch grabs a batch of devices, bounded by the size of the supplied batch channel, and attempts
 // to disconnect each of them.  This method is sensitive to the jc.cancel channel.  If cancelled, or if
 // no more devices are available, this method returns false.
-func (dr *drainer) nextBatch(jc jobContext, batch chan device.ID) (more bool, visited int) {
+func (dr *drainer) nextBatch(jc jobContext, batch chan device.Interface) (more bool, visited int) {
 	jc.logger.Log(level.Key(), level.DebugValue(), logging.MessageKey(), "nextBatch starting")
 
+	visit := dr.registry.VisitAll
+	if jc.ordered != nil {
+		visit = func(f func(device.Interface) bool) int {
+			jc.ordered.visit(f)
+			return 0
+		}
+	}
+
 	more = true
-	dr.registry.VisitAll(func(d device.Interface) bool {
+	visit(func(d device.Interface) bool {
+		if jc.q != nil && !jc.q.Matches(d) {
+			return true
+		}
+
 		select {
-		case batch <- d.ID():
+		case batch <- d:
 			return true
 		case <-jc.cancel:
 			jc.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "job cancelled")
@@ -273,8 +437,8 @@ func (dr *drainer) nextBatch(jc jobContext, batch chan device.ID) (more bool, vi
 		drained := 0
 		for finished := false; more && !finished; {
 			select {
-			case id := <-batch:
-				if dr.connector.Disconnect(id, device.CloseReason{Text: Drained}) {
+			case d := <-batch:
+				if dr.connector.Disconnect(d.ID(), dr.closeReason(jc, d)) {
 					drained++
 				}
 			case <-jc.cancel:
@@ -298,6 +462,43 @@ func (dr *drainer) nextBatch(jc jobContext, batch chan device.ID) (more bool, vi
 	return
 }
 
+// closeReason produces the reason for disconnecting the given device.  For redirecting jobs, this method
+// also sends the device a hint naming the instance it should reconnect to.  Failing to send a hint does
+// not prevent the device from being drained.
+func (dr *drainer) closeReason(jc jobContext, d device.Interface) device.CloseReason {
+	if !jc.j.Redirect {
+		return device.CloseReason{Text: Drained}
+	}
+
+	instance, err := dr.redirector.Get(d.ID().Bytes())
+	if err != nil {
+		jc.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to determine redirect instance", "device", d.ID(), logging.ErrorKey(), err)
+		return device.CloseReason{Text: Drained}
+	}
+
+	// a device that isn't reading must not stall the drain
+	ctx, cancel := context.WithTimeout(context.Background(), RedirectHintTimeout)
+	defer cancel()
+
+	payload, _ := json.Marshal(redirectHint{Instance: instance})
+	_, err = d.Send((&device.Request{
+		Message: &wrp.Message{
+			Type:        wrp.SimpleEventMessageType,
+			Source:      dr.redirectSource,
+			Destination: string(d.ID()) + RedirectEventSuffix,
+			ContentType: "application/json",
+			Payload:     payload,
+		},
+		Format: wrp.Msgpack,
+	}).WithContext(ctx))
+
+	if err != nil {
+		jc.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to send redirect hint", "device", d.ID(), logging.ErrorKey(), err)
+	}
+
+	return device.CloseReason{Text: RedirectCloseReasonPrefix + instance}
+}
+
 func (dr *drainer) jobFinished(jc jobContext) {
 	if jc.stop != nil {
 		jc.stop()
@@ -329,12 +530,12 @@ func (dr *drainer) drain(jc jobContext) {
 		remaining = jc.j.Count
 		visited   = 0
 		more      = true
-		batch     = make(chan device.ID, jc.j.Rate)
+		batch     = make(chan device.Interface, jc.j.Rate)
 	)
 
 	for more && remaining > 0 {
 		if remaining < jc.j.Rate {
-			batch = make(chan device.ID, remaining)
+			batch = make(chan device.Interface, remaining)
 		}
 
 		select {
@@ -357,12 +558,12 @@ func (dr *drainer) disconnect(jc jobContext) {
 		remaining = jc.j.Count
 		visited   = 0
 		more      = true
-		batch     = make(chan device.ID, jc.batchSize)
+		batch     = make(chan device.Interface, jc.batchSize)
 	)
 
 	for more && remaining > 0 {
 		if remaining < jc.batchSize {
-			batch = make(chan device.ID, remaining)
+			batch = make(chan device.Interface, remaining)
 		}
 
 		more, visited = dr.nextBatch(jc, batch)
@@ -370,8 +571,70 @@ func (dr *drainer) disconnect(jc jobContext) {
 	}
 }
 
+// deviceCount returns the number of devices that a job with the given query would drain
+func (dr *drainer) deviceCount(q *device.Query) int {
+	if q == nil {
+		return dr.registry.Len()
+	}
+
+	count := 0
+	dr.registry.VisitAll(func(d device.Interface) bool {
+		if q.Matches(d) {
+			count++
+		}
+
+		return true
+	})
+
+	return count
+}
+
+// snapshot captures the devices matching the given query, sorted by the given comparison
+func (dr *drainer) snapshot(q *device.Query, less func(device.Interface, device.Interface) bool) *orderedDevices {
+	od := new(orderedDevices)
+	dr.registry.VisitAll(func(d device.Interface) bool {
+		if q == nil || q.Matches(d) {
+			od.devices = append(od.devices, d)
+		}
+
+		return true
+	})
+
+	sort.SliceStable(od.devices, func(i, j int) bool {
+		return less(od.devices[i], od.devices[j])
+	})
+
+	return od
+}
+
+// prepare checks everything about a job which would prevent this drainer from starting it, other than
+// another drain being active.  The job's parsed Query and device comparison function are returned.
+func (dr *drainer) prepare(j Job) (*device.Query, func(device.Interface, device.Interface) bool, error) {
+	q, less, err := j.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if j.Redirect && dr.redirector == nil {
+		return nil, nil, ErrRedirectNotSupported
+	}
+
+	return q, less, nil
+}
+
 func (dr *drainer) Start(j Job) (<-chan struct{}, Job, error) {
-	j.normalize(dr.registry.Len())
+	q, less, err := dr.prepare(j)
+	if err != nil {
+		return nil, Job{}, err
+	}
+
+	var ordered *orderedDevices
+	if less != nil {
+		ordered = dr.snapshot(q, less)
+		j.normalize(len(ordered.devices))
+	} else {
+		j.normalize(dr.deviceCount(q))
+	}
 
 	defer dr.controlLock.Unlock()
 	dr.controlLock.Lock()
@@ -388,9 +651,11 @@ func (dr *drainer) Start(j Job) (<-chan struct{}, Job, error) {
 			started: dr.now().UTC(),
 			counter: dr.m.counter,
 		},
-		j:      j,
-		cancel: make(chan struct{}),
-		done:   make(chan struct{}),
+		j:       j,
+		q:       q,
+		ordered: ordered,
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 
 	if jc.j.Rate > 0 {
@@ -430,6 +695,7 @@ func (dr *drainer) Cancel() (<-chan struct{}, error) {
 
 	dr.m.state.Set(MetricNotDraining)
 	jc := dr.current.Load().(jobContext)
+	jc.t.cancel()
 	close(jc.cancel)
 	return jc.done, nil
 }
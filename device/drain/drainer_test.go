@@ -1,14 +1,19 @@
 package drain
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/Comcast/webpa-common/device"
 	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/service"
+	"github.com/Comcast/webpa-common/wrp"
 	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,8 +45,56 @@ func testJobNormalize(t *testing.T) {
 	}
 }
 
+func testJobToMap(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(
+		map[string]interface{}{"count": 0},
+		Job{}.ToMap(),
+	)
+
+	assert.Equal(
+		map[string]interface{}{"count": 10, "rate": 2, "tick": "1m0s", "order": OrderNewest, "redirect": true},
+		Job{Count: 10, Rate: 2, Tick: time.Minute, Order: OrderNewest, Redirect: true}.ToMap(),
+	)
+}
+
+func testJobLess(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		now   = time.Now()
+		older = new(device.MockDevice)
+		newer = new(device.MockDevice)
+	)
+
+	older.On("Statistics").Return(device.NewStatistics(nil, now.Add(-time.Hour)))
+	newer.On("Statistics").Return(device.NewStatistics(nil, now))
+
+	less, err := Job{}.less()
+	assert.Nil(less)
+	assert.NoError(err)
+
+	less, err = Job{Order: OrderOldest}.less()
+	require.NoError(err)
+	assert.True(less(older, newer))
+	assert.False(less(newer, older))
+
+	less, err = Job{Order: OrderNewest}.less()
+	require.NoError(err)
+	assert.True(less(newer, older))
+	assert.False(less(older, newer))
+
+	less, err = Job{Order: "sideways"}.less()
+	assert.Nil(less)
+	assert.Equal(ErrInvalidOrder, err)
+}
+
 func TestJob(t *testing.T) {
 	t.Run("Normalize", testJobNormalize)
+	t.Run("ToMap", testJobToMap)
+	t.Run("Less", testJobLess)
 }
 
 func testWithLoggerDefault(t *testing.T) {
@@ -332,6 +385,7 @@ func testDrainerDrainAll(t *testing.T, deviceCount int) {
 	assert.Equal(expectedStarted.UTC(), progress.Started)
 	require.NotNil(progress.Finished)
 	assert.Equal(expectedFinished.UTC(), *progress.Finished)
+	assert.False(progress.Cancelled)
 
 	assert.Empty(manager.devices)
 	assert.True(stopCalled)
@@ -466,6 +520,9 @@ func testDrainerVisitCancel(t *testing.T) {
 
 	provider.Assert(t, "state")(xmetricstest.Value(MetricNotDraining))
 	provider.Assert(t, "counter")(xmetricstest.Value(0.0))
+
+	_, _, progress := d.Status()
+	assert.True(progress.Cancelled)
 }
 
 func testDrainerDisconnectCancel(t *testing.T) {
@@ -582,6 +639,245 @@ func testDrainerDrainCancel(t *testing.T) {
 	assert.True(stopCalled)
 }
 
+func testDrainerQuery(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		provider = xmetricstest.NewProvider(nil)
+		logger   = logging.NewTestLogger(nil, t)
+
+		manager = generateManager(assert, 100)
+
+		d = New(
+			WithLogger(logger),
+			WithRegistry(manager),
+			WithConnector(manager),
+			WithDrainCounter(provider.NewCounter("counter")),
+		)
+	)
+
+	require.NotNil(d)
+	close(manager.pauseDisconnect)
+	close(manager.pauseVisit)
+
+	done, job, err := d.Start(Job{Query: "id ="})
+	assert.Nil(done)
+	assert.Error(err)
+	assert.Equal(Job{}, job)
+
+	active, _, _ := d.Status()
+	assert.False(active)
+
+	query := `id = mac:000000000001 or id = mac:000000000002 or id = mac:000000000003`
+	done, job, err = d.Start(Job{Percent: 70, Query: query})
+	require.NoError(err)
+	require.NotNil(done)
+	assert.Equal(Job{Count: 2, Percent: 70, Query: query}, job)
+	assert.Equal(
+		map[string]interface{}{"count": 2, "percent": 70, "query": query},
+		job.ToMap(),
+	)
+
+	select {
+	case <-done:
+		// passed
+	case <-time.After(5 * time.Second):
+		assert.Fail("Query drain failed to complete")
+		return
+	}
+
+	provider.Assert(t, "counter")(xmetricstest.Value(2.0))
+
+	_, _, progress := d.Status()
+	assert.Equal(2, progress.Visited)
+	assert.Equal(2, progress.Drained)
+	assert.Len(manager.devices, 98)
+
+	remaining := 0
+	for _, id := range []device.ID{"mac:000000000001", "mac:000000000002", "mac:000000000003"} {
+		if _, ok := manager.devices[id]; ok {
+			remaining++
+		}
+	}
+
+	assert.Equal(1, remaining)
+}
+
+// setConnectedAt gives each device in the manager a connection time, with higher MACs connecting later
+func setConnectedAt(manager *stubManager, start time.Time) {
+	for id, d := range manager.devices {
+		mac, _ := strconv.ParseUint(string(id[len("mac:"):]), 16, 64)
+		d.(*device.MockDevice).On("Statistics").Return(device.NewStatistics(nil, start.Add(time.Duration(mac)*time.Minute)))
+	}
+}
+
+func testDrainerOrder(t *testing.T, order string, expected []device.ID) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		provider = xmetricstest.NewProvider(nil)
+		logger   = logging.NewTestLogger(nil, t)
+
+		manager = generateManager(assert, 50)
+
+		d = New(
+			WithLogger(logger),
+			WithRegistry(manager),
+			WithConnector(manager),
+			WithDrainCounter(provider.NewCounter("counter")),
+		)
+	)
+
+	require.NotNil(d)
+	setConnectedAt(manager, time.Now().Add(-24*time.Hour))
+	close(manager.pauseDisconnect)
+	close(manager.pauseVisit)
+
+	done, job, err := d.Start(Job{Count: len(expected), Rate: 2, Order: order})
+	require.NoError(err)
+	require.NotNil(done)
+	assert.Equal(Job{Count: len(expected), Rate: 2, Tick: time.Second, Order: order}, job)
+
+	select {
+	case <-done:
+		// passed
+	case <-time.After(10 * time.Second):
+		assert.Fail("Ordered drain failed to complete")
+		return
+	}
+
+	provider.Assert(t, "counter")(xmetricstest.Value(float64(len(expected))))
+	assert.Len(manager.devices, 50-len(expected))
+	for _, id := range expected {
+		assert.Equal(device.CloseReason{Text: Drained}, manager.reasons[id], "device %s was not drained", id)
+	}
+}
+
+func testDrainerInvalidOrder(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		manager = generateManager(assert, 10)
+		d       = New(WithRegistry(manager), WithConnector(manager))
+	)
+
+	done, job, err := d.Start(Job{Order: "sideways"})
+	assert.Nil(done)
+	assert.Equal(Job{}, job)
+	assert.Equal(ErrInvalidOrder, err)
+}
+
+func testDrainerRedirect(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		logger  = logging.NewTestLogger(nil, t)
+
+		sendError  = errors.New("expected")
+		manager    = generateManager(assert, 5)
+		redirector = service.AccessorFunc(func(key []byte) (string, error) {
+			if string(key) == "mac:000000000004" {
+				return "", errors.New("expected")
+			}
+
+			return "http://" + string(key[len(key)-1]) + ".xfinity.net", nil
+		})
+
+		d = New(
+			WithLogger(logger),
+			WithRegistry(manager),
+			WithConnector(manager),
+			WithRedirector(redirector),
+			WithRedirectSource("dns:talaria.xfinity.net"),
+		)
+	)
+
+	require.NotNil(d)
+	close(manager.pauseDisconnect)
+	close(manager.pauseVisit)
+
+	mocks := make(map[device.ID]*device.MockDevice, len(manager.devices))
+	for id, md := range manager.devices {
+		mocks[id] = md.(*device.MockDevice)
+		var (
+			id       = id
+			instance = "http://" + string(id[len(id)-1]) + ".xfinity.net"
+			result   error
+		)
+
+		if id == "mac:000000000003" {
+			// failing to send the hint does not prevent the device from being redirected
+			result = sendError
+		}
+
+		if id != "mac:000000000004" {
+			md.(*device.MockDevice).On("Send", mock.MatchedBy(func(r *device.Request) bool {
+				m, ok := r.Message.(*wrp.Message)
+				_, hasDeadline := r.Context().Deadline()
+				return ok && hasDeadline &&
+					m.Type == wrp.SimpleEventMessageType &&
+					m.Source == "dns:talaria.xfinity.net" &&
+					m.Destination == string(id)+RedirectEventSuffix &&
+					string(m.Payload) == `{"instance":"`+instance+`"}`
+			})).Return(nil, result).Once()
+		}
+	}
+
+	done, job, err := d.Start(Job{Redirect: true})
+	require.NoError(err)
+	require.NotNil(done)
+	assert.Equal(Job{Count: 5, Redirect: true}, job)
+
+	select {
+	case <-done:
+		// passed
+	case <-time.After(5 * time.Second):
+		assert.Fail("Redirect drain failed to complete")
+		return
+	}
+
+	assert.Empty(manager.devices)
+	assert.Equal(device.CloseReason{Text: RedirectCloseReasonPrefix + "http://0.xfinity.net"}, manager.reasons["mac:000000000000"])
+	assert.Equal(device.CloseReason{Text: RedirectCloseReasonPrefix + "http://3.xfinity.net"}, manager.reasons["mac:000000000003"])
+	assert.Equal(device.CloseReason{Text: Drained}, manager.reasons["mac:000000000004"])
+
+	for id, md := range mocks {
+		if id == "mac:000000000004" {
+			md.AssertNotCalled(t, "Send", mock.Anything)
+		} else {
+			md.AssertNumberOfCalls(t, "Send", 1)
+		}
+	}
+}
+
+func testDrainerRedirectNotSupported(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		manager = generateManager(assert, 10)
+		d       = New(WithRegistry(manager), WithConnector(manager))
+	)
+
+	done, job, err := d.Start(Job{Redirect: true})
+	assert.Nil(done)
+	assert.Equal(Job{}, job)
+	assert.Equal(ErrRedirectNotSupported, err)
+}
+
+func TestRedirectSource(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		manager = generateManager(assert, 0)
+	)
+
+	for _, source := range []string{RedirectEventSource, defaultRedirectSource(), New(WithManager(manager)).(*drainer).redirectSource} {
+		l, err := wrp.ParseLocator(source)
+		require.NoError(err)
+		assert.Equal(wrp.SchemeDNS, l.Scheme)
+	}
+
+	assert.Equal(defaultRedirectSource(), New(WithManager(manager), WithRedirectSource("")).(*drainer).redirectSource)
+}
+
 func TestDrainer(t *testing.T) {
 	deviceCounts := []int{0, 1, 2, disconnectBatchSize - 1, disconnectBatchSize, disconnectBatchSize + 1, 1709}
 
@@ -604,4 +900,20 @@ func TestDrainer(t *testing.T) {
 	t.Run("VisitCancel", testDrainerVisitCancel)
 	t.Run("DisconnectCancel", testDrainerDisconnectCancel)
 	t.Run("DrainCancel", testDrainerDrainCancel)
+	t.Run("Query", testDrainerQuery)
+
+	t.Run("Order", func(t *testing.T) {
+		t.Run("Oldest", func(t *testing.T) {
+			testDrainerOrder(t, OrderOldest, []device.ID{"mac:000000000000", "mac:000000000001", "mac:000000000002", "mac:000000000003", "mac:000000000004"})
+		})
+
+		t.Run("Newest", func(t *testing.T) {
+			testDrainerOrder(t, OrderNewest, []device.ID{"mac:000000000031", "mac:000000000030", "mac:00000000002f"})
+		})
+
+		t.Run("Invalid", testDrainerInvalidOrder)
+	})
+
+	t.Run("Redirect", testDrainerRedirect)
+	t.Run("RedirectNotSupported", testDrainerRedirectNotSupported)
 }
@@ -0,0 +1,117 @@
+package drain
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JobStore is the persistence strategy for a Scheduler's drain jobs.  The entire set of jobs, including
+// history, is saved each time any job changes.  The set of jobs is expected to be small.
+//
+// Implementations must be safe for concurrent use.
+type JobStore interface {
+	// Load returns all the jobs previously saved.  A store that has never been saved returns no records and no error.
+	Load() ([]Record, error)
+
+	// Save replaces the stored jobs with the given records
+	Save([]Record) error
+}
+
+// memoryJobStore is a JobStore that holds records in process memory
+type memoryJobStore struct {
+	lock    sync.Mutex
+	records []Record
+}
+
+// NewMemoryJobStore creates a JobStore which holds jobs in memory.  Jobs held by the returned store
+// do not survive a process restart.
+func NewMemoryJobStore() JobStore {
+	return new(memoryJobStore)
+}
+
+func (s *memoryJobStore) Load() ([]Record, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	return append([]Record(nil), s.records...), nil
+}
+
+func (s *memoryJobStore) Save(records []Record) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	s.records = append([]Record(nil), records...)
+	return nil
+}
+
+// fileJobStore is a JobStore that holds records as a JSON array in a single file
+type fileJobStore struct {
+	lock sync.Mutex
+	path string
+}
+
+// NewFileJobStore creates a JobStore which holds jobs in the given file.  The file is replaced
+// atomically on each save, so a crash never leaves a partially written file behind.  Jobs held
+// by the returned store survive a process restart.
+func NewFileJobStore(path string) JobStore {
+	return &fileJobStore{
+		path: path,
+	}
+}
+
+func (s *fileJobStore) Load() ([]Record, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (s *fileJobStore) Save(records []Record) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	directory := filepath.Dir(s.path)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(directory, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
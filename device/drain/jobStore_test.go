@@ -0,0 +1,75 @@
+package drain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testJobStore(t *testing.T, js JobStore) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		started  = time.Unix(1550000000, 0).UTC()
+		finished = started.Add(time.Hour)
+		records  = []Record{
+			{
+				ID:       "1",
+				Job:      Job{Count: 100, Rate: 10, Tick: time.Minute},
+				State:    JobComplete,
+				Progress: Progress{Visited: 100, Drained: 98, Started: started, Finished: &finished},
+				Created:  started,
+			},
+			{
+				ID:      "2",
+				Job:     Job{Percent: 50, Query: "id ^= mac:"},
+				Window:  Window{NotBefore: finished, NotAfter: finished.Add(time.Hour)},
+				State:   JobScheduled,
+				Created: started,
+			},
+		}
+	)
+
+	loaded, err := js.Load()
+	assert.Empty(loaded)
+	assert.NoError(err)
+
+	require.NoError(js.Save(records))
+	loaded, err = js.Load()
+	require.NoError(err)
+	assert.Equal(records, loaded)
+
+	require.NoError(js.Save(records[1:]))
+	loaded, err = js.Load()
+	require.NoError(err)
+	assert.Equal(records[1:], loaded)
+}
+
+func TestMemoryJobStore(t *testing.T) {
+	testJobStore(t, NewMemoryJobStore())
+}
+
+func TestFileJobStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	t.Run("Store", func(t *testing.T) {
+		testJobStore(t, NewFileJobStore(filepath.Join(directory, "jobs", "drain.json")))
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		path := filepath.Join(directory, "corrupt.json")
+		require.NoError(t, ioutil.WriteFile(path, []byte("this is not json"), 0644))
+
+		loaded, err := NewFileJobStore(path).Load()
+		assert.Empty(t, loaded)
+		assert.Error(t, err)
+	})
+}
@@ -28,10 +28,36 @@ func (m *mockDrainer) Cancel() (<-chan struct{}, error) {
 	return arguments.Get(0).(<-chan struct{}), arguments.Error(1)
 }
 
+type mockScheduler struct {
+	mock.Mock
+}
+
+func (m *mockScheduler) Schedule(j Job, w Window) (Record, error) {
+	arguments := m.Called(j, w)
+	return arguments.Get(0).(Record), arguments.Error(1)
+}
+
+func (m *mockScheduler) Cancel(id string) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *mockScheduler) Jobs() []Record {
+	return m.Called().Get(0).([]Record)
+}
+
+func (m *mockScheduler) History() []Record {
+	return m.Called().Get(0).([]Record)
+}
+
+func (m *mockScheduler) Stop() {
+	m.Called()
+}
+
 type stubManager struct {
 	lock    sync.RWMutex
 	assert  *assert.Assertions
 	devices map[device.ID]device.Interface
+	reasons map[device.ID]device.CloseReason
 
 	disconnect      chan struct{}
 	pauseDisconnect chan struct{}
@@ -60,6 +86,7 @@ func (sm *stubManager) Disconnect(id device.ID, reason device.CloseReason) bool
 
 	if _, exists := sm.devices[id]; exists {
 		delete(sm.devices, id)
+		sm.reasons[id] = reason
 		return true
 	}
 
@@ -71,6 +98,11 @@ func (sm *stubManager) DisconnectIf(func(device.ID) (device.CloseReason, bool))
 	return -1
 }
 
+func (sm *stubManager) DisconnectDeviceIf(func(device.Interface) (device.CloseReason, bool)) int {
+	sm.assert.Fail("DisconnectDeviceIf is not supported")
+	return -1
+}
+
 func (sm *stubManager) DisconnectAll(device.CloseReason) int {
 	sm.assert.Fail("DisconnectAll is not supported")
 	return -1
@@ -114,6 +146,7 @@ func generateManager(assert *assert.Assertions, count uint64) *stubManager {
 	sm := &stubManager{
 		assert:          assert,
 		devices:         make(map[device.ID]device.Interface, count),
+		reasons:         make(map[device.ID]device.CloseReason, count),
 		disconnect:      make(chan struct{}, 10),
 		pauseDisconnect: make(chan struct{}),
 		visit:           make(chan struct{}, 10),
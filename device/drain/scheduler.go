@@ -0,0 +1,672 @@
+package drain
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/Comcast/webpa-common/logging"
+)
+
+var (
+	ErrJobNotFound   error = errors.New("No such scheduled or running drain job")
+	ErrInvalidWindow error = errors.New("The drain window has already ended or ends before it begins")
+)
+
+// JobState describes where a scheduled drain job is in its lifecycle
+type JobState string
+
+const (
+	// JobScheduled indicates a job waiting for its window to open or for earlier jobs to finish
+	JobScheduled JobState = "scheduled"
+
+	// JobRunning indicates a job that is currently draining devices
+	JobRunning JobState = "running"
+
+	// JobComplete indicates a job that drained all the devices it was asked to, or ran out of devices
+	JobComplete JobState = "complete"
+
+	// JobCancelled indicates a job that was cancelled, either before or while it ran
+	JobCancelled JobState = "cancelled"
+
+	// JobExpired indicates a job whose window closed before it could start or finish
+	JobExpired JobState = "expired"
+
+	// JobFailed indicates a job that could not be started
+	JobFailed JobState = "failed"
+)
+
+const (
+	// DefaultMaxHistory is the default number of finished jobs retained by a Scheduler
+	DefaultMaxHistory = 100
+
+	// DefaultProgressInterval is the default interval at which a Scheduler saves the progress of a running job
+	DefaultProgressInterval time.Duration = 10 * time.Second
+
+	// startRetryInterval is how long a Scheduler waits before retrying a job that could not start
+	// because a drain was started outside the Scheduler
+	startRetryInterval time.Duration = 5 * time.Second
+)
+
+// Window restricts when a scheduled job may run.  A zero NotBefore means the job may run as soon as earlier jobs
+// finish, while a zero NotAfter means there is no deadline.
+type Window struct {
+	// NotBefore is the earliest time at which the job may start
+	NotBefore time.Time `json:"notBefore"`
+
+	// NotAfter is the time at which the window closes.  A job that has not started by this time expires
+	// without running, and a job that is still running is cancelled.
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// ToMap returns a map representation of this Window appropriate for marshaling, omitting unset times
+func (w Window) ToMap() map[string]interface{} {
+	m := make(map[string]interface{}, 2)
+	if !w.NotBefore.IsZero() {
+		m["notBefore"] = w.NotBefore.Format(time.RFC3339)
+	}
+
+	if !w.NotAfter.IsZero() {
+		m["notAfter"] = w.NotAfter.Format(time.RFC3339)
+	}
+
+	return m
+}
+
+// Record describes a drain job known to a Scheduler, whether scheduled, running, or finished
+type Record struct {
+	// ID is the unique identifier assigned to the job by the Scheduler
+	ID string `json:"id"`
+
+	// Job describes the drain.  Once the job starts, this is the normalized Job with its computed Count.
+	Job Job `json:"job"`
+
+	// Window is the time window in which the job may run
+	Window Window `json:"window"`
+
+	// State is the current state of the job
+	State JobState `json:"state"`
+
+	// Progress is the cumulative progress of the job, across any restarts of the process
+	Progress Progress `json:"progress"`
+
+	// Created is the UTC time at which the job was scheduled
+	Created time.Time `json:"created"`
+
+	// Resumed is the number of times the job was resumed after a process restart
+	Resumed int `json:"resumed,omitempty"`
+
+	// Error is the reason a JobFailed job could not start
+	Error string `json:"error,omitempty"`
+}
+
+// ToMap returns a map representation of this Record appropriate for marshaling to formats like JSON
+func (r Record) ToMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"id":      r.ID,
+		"job":     r.Job.ToMap(),
+		"window":  r.Window.ToMap(),
+		"state":   r.State,
+		"created": r.Created.Format(time.RFC3339Nano),
+	}
+
+	if !r.Progress.Started.IsZero() {
+		m["progress"] = r.Progress
+	}
+
+	if r.Resumed > 0 {
+		m["resumed"] = r.Resumed
+	}
+
+	if len(r.Error) > 0 {
+		m["error"] = r.Error
+	}
+
+	return m
+}
+
+// Scheduler queues drain jobs, runs them one at a time with a drain Interface, and persists them to a JobStore.
+// A Scheduler created over a store that holds the jobs of a previous process resumes any job that was running and
+// reports the history of finished jobs.
+type Scheduler interface {
+	// Schedule adds a job to the queue.  Jobs run in order of their window's NotBefore time, then in the order
+	// they were scheduled.  The returned Record includes the ID assigned to the job.
+	Schedule(Job, Window) (Record, error)
+
+	// Cancel cancels a scheduled or running job.  If no such job exists or it has already finished, ErrJobNotFound is returned.
+	Cancel(id string) error
+
+	// Jobs returns the running job, if any, followed by the scheduled jobs in the order they will run
+	Jobs() []Record
+
+	// History returns the finished jobs, most recently finished first
+	History() []Record
+
+	// Stop halts this Scheduler, cancelling any running drain.  A running job is left in the JobRunning
+	// state in the JobStore, so that a Scheduler in a subsequent process resumes it.
+	Stop()
+}
+
+// SchedulerOption is a configuration option for a Scheduler
+type SchedulerOption func(*scheduler)
+
+// WithSchedulerLogger configures a Scheduler with a logger, using the default logger if l is nil
+func WithSchedulerLogger(l log.Logger) SchedulerOption {
+	return func(s *scheduler) {
+		if l != nil {
+			s.logger = l
+		} else {
+			s.logger = logging.DefaultLogger()
+		}
+	}
+}
+
+// WithJobStore configures the persistence strategy for a Scheduler.  If js is nil, jobs are held in memory.
+func WithJobStore(js JobStore) SchedulerOption {
+	return func(s *scheduler) {
+		if js != nil {
+			s.store = js
+		} else {
+			s.store = NewMemoryJobStore()
+		}
+	}
+}
+
+// WithMaxHistory configures the number of finished jobs a Scheduler retains.  If nonpositive, DefaultMaxHistory is used.
+func WithMaxHistory(n int) SchedulerOption {
+	return func(s *scheduler) {
+		if n > 0 {
+			s.maxHistory = n
+		} else {
+			s.maxHistory = DefaultMaxHistory
+		}
+	}
+}
+
+// WithProgressInterval configures how often a Scheduler saves the progress of a running job.  If nonpositive,
+// DefaultProgressInterval is used.
+func WithProgressInterval(d time.Duration) SchedulerOption {
+	return func(s *scheduler) {
+		if d > 0 {
+			s.progressInterval = d
+		} else {
+			s.progressInterval = DefaultProgressInterval
+		}
+	}
+}
+
+func defaultNewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// NewScheduler constructs a Scheduler which runs jobs with the given drainer.  Any jobs in the configured JobStore
+// are loaded: scheduled jobs are queued, running jobs are queued to resume with the devices they had yet to visit,
+// and finished jobs become history.  An error is returned if the store cannot be loaded.
+func NewScheduler(d Interface, options ...SchedulerOption) (Scheduler, error) {
+	if d == nil {
+		panic("A drain Interface is required")
+	}
+
+	s := &scheduler{
+		logger:           logging.DefaultLogger(),
+		drainer:          d,
+		store:            NewMemoryJobStore(),
+		maxHistory:       DefaultMaxHistory,
+		progressInterval: DefaultProgressInterval,
+		retryInterval:    startRetryInterval,
+		now:              time.Now,
+		newTimer:         defaultNewTimer,
+		newTicker:        defaultNewTicker,
+		wake:             make(chan struct{}, 1),
+		shutdown:         make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+
+	for _, f := range options {
+		f(s)
+	}
+
+	records, err := s.store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range records {
+		if id, err := strconv.ParseUint(r.ID, 10, 64); err == nil && id > s.lastID {
+			s.lastID = id
+		}
+
+		switch r.State {
+		case JobScheduled:
+			s.enqueue(r)
+
+		case JobRunning:
+			s.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "resuming drain job", "id", r.ID, "visited", r.Progress.Visited)
+			r.State = JobScheduled
+			r.Resumed++
+			s.enqueue(r)
+
+		default:
+			s.history = append(s.history, r)
+		}
+	}
+
+	// history is kept oldest first internally
+	sort.SliceStable(s.history, func(i, j int) bool {
+		return finishedAt(s.history[i]).Before(finishedAt(s.history[j]))
+	})
+
+	s.trimHistory()
+	s.save()
+	go s.run()
+	return s, nil
+}
+
+func finishedAt(r Record) time.Time {
+	if r.Progress.Finished != nil {
+		return *r.Progress.Finished
+	}
+
+	return r.Created
+}
+
+// runningJob is the runtime state of the job currently being executed by the drainer
+type runningJob struct {
+	record    *Record
+	base      Progress
+	cancelled bool
+}
+
+// scheduler is the internal implementation of Scheduler
+type scheduler struct {
+	logger           log.Logger
+	drainer          Interface
+	store            JobStore
+	maxHistory       int
+	progressInterval time.Duration
+	retryInterval    time.Duration
+	now              func() time.Time
+	newTimer         func(time.Duration) (<-chan time.Time, func() bool)
+	newTicker        func(time.Duration) (<-chan time.Time, func())
+
+	lock    sync.Mutex
+	lastID  uint64
+	queue   []*Record
+	running *runningJob
+	history []Record
+
+	wake     chan struct{}
+	stopOnce sync.Once
+	shutdown chan struct{}
+	stopped  chan struct{}
+}
+
+// enqueue inserts a record into the queue, preserving order.  This method must be invoked under the lock.
+func (s *scheduler) enqueue(r Record) {
+	s.queue = append(s.queue, &r)
+	sort.SliceStable(s.queue, func(i, j int) bool {
+		return s.queue[i].Window.NotBefore.Before(s.queue[j].Window.NotBefore)
+	})
+}
+
+// dequeue removes a record from the queue.  This method must be invoked under the lock.
+func (s *scheduler) dequeue(r *Record) {
+	for i, candidate := range s.queue {
+		if candidate == r {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// trimHistory discards the oldest finished jobs beyond the maximum.  This method must be invoked under the lock.
+func (s *scheduler) trimHistory() {
+	if excess := len(s.history) - s.maxHistory; excess > 0 {
+		s.history = append([]Record(nil), s.history[excess:]...)
+	}
+}
+
+// save persists all jobs.  Errors are logged, as the in-memory state remains authoritative.
+// This method must be invoked under the lock.
+func (s *scheduler) save() {
+	records := make([]Record, 0, len(s.history)+len(s.queue)+1)
+	records = append(records, s.history...)
+	if s.running != nil {
+		records = append(records, *s.running.record)
+	}
+
+	for _, r := range s.queue {
+		records = append(records, *r)
+	}
+
+	if err := s.store.Save(records); err != nil {
+		s.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to save drain jobs", logging.ErrorKey(), err)
+	}
+}
+
+// finish moves a record into history.  This method must be invoked under the lock.
+func (s *scheduler) finish(r *Record, state JobState) {
+	r.State = state
+	if r.Progress.Finished == nil {
+		finished := s.now().UTC()
+		r.Progress.Finished = &finished
+	}
+
+	s.history = append(s.history, *r)
+	s.trimHistory()
+	s.save()
+	s.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "drain job finished", "id", r.ID, "state", r.State, "visited", r.Progress.Visited, "drained", r.Progress.Drained)
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// validate checks everything that would cause the drainer to reject a job, so that callers learn of
+// problems when scheduling rather than from a failed job in the history.  Drainers other than the one
+// created by New are assumed to support every job whose Query and Order are valid.
+func (s *scheduler) validate(j Job) error {
+	if dr, ok := s.drainer.(*drainer); ok {
+		_, _, err := dr.prepare(j)
+		return err
+	}
+
+	_, _, err := j.parse()
+	return err
+}
+
+func (s *scheduler) Schedule(j Job, w Window) (Record, error) {
+	if err := s.validate(j); err != nil {
+		return Record{}, err
+	}
+
+	now := s.now()
+	if !w.NotAfter.IsZero() && (!w.NotAfter.After(now) || !w.NotAfter.After(w.NotBefore)) {
+		return Record{}, ErrInvalidWindow
+	}
+
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	s.lastID++
+	r := Record{
+		ID:      strconv.FormatUint(s.lastID, 10),
+		Job:     j,
+		Window:  w,
+		State:   JobScheduled,
+		Created: now.UTC(),
+	}
+
+	s.enqueue(r)
+	s.save()
+	s.signal()
+	s.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "drain job scheduled", "id", r.ID, "notBefore", w.NotBefore, "notAfter", w.NotAfter)
+	return r, nil
+}
+
+func (s *scheduler) Cancel(id string) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	if s.running != nil && s.running.record.ID == id {
+		s.running.cancelled = true
+		s.drainer.Cancel()
+		return nil
+	}
+
+	for _, r := range s.queue {
+		if r.ID == id {
+			s.dequeue(r)
+			s.finish(r, JobCancelled)
+			s.signal()
+			return nil
+		}
+	}
+
+	return ErrJobNotFound
+}
+
+func (s *scheduler) Jobs() []Record {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	jobs := make([]Record, 0, len(s.queue)+1)
+	if s.running != nil {
+		jobs = append(jobs, *s.running.record)
+	}
+
+	for _, r := range s.queue {
+		jobs = append(jobs, *r)
+	}
+
+	return jobs
+}
+
+func (s *scheduler) History() []Record {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	history := make([]Record, len(s.history))
+	for i, r := range s.history {
+		history[len(history)-1-i] = r
+	}
+
+	return history
+}
+
+func (s *scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.shutdown)
+	})
+
+	<-s.stopped
+}
+
+// wait blocks until the given duration elapses, the scheduler is signalled, or the scheduler is stopped.
+// This method returns false if the scheduler was stopped.
+func (s *scheduler) wait(d time.Duration) bool {
+	timer, stop := s.newTimer(d)
+	defer stop()
+
+	select {
+	case <-timer:
+		return true
+	case <-s.wake:
+		return true
+	case <-s.shutdown:
+		return false
+	}
+}
+
+// run is the scheduler's goroutine, which executes jobs from the queue as their windows open
+func (s *scheduler) run() {
+	defer close(s.stopped)
+
+	for {
+		s.lock.Lock()
+		var next *Record
+		if len(s.queue) > 0 {
+			next = s.queue[0]
+		}
+
+		s.lock.Unlock()
+
+		if next == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.shutdown:
+				return
+			}
+		}
+
+		if delay := next.Window.NotBefore.Sub(s.now()); delay > 0 {
+			if !s.wait(delay) {
+				return
+			}
+
+			continue
+		}
+
+		if !s.execute(next) {
+			return
+		}
+	}
+}
+
+// execute runs a single job to completion.  This method returns false if the scheduler was stopped.
+func (s *scheduler) execute(r *Record) bool {
+	s.lock.Lock()
+	if r.State != JobScheduled {
+		// cancelled while the run loop was deciding what to do
+		s.lock.Unlock()
+		return true
+	}
+
+	if !r.Window.NotAfter.IsZero() && !s.now().Before(r.Window.NotAfter) {
+		s.dequeue(r)
+		s.finish(r, JobExpired)
+		s.lock.Unlock()
+		return true
+	}
+
+	// a job resumed after a restart drains only the devices it had yet to visit
+	j := r.Job
+	if r.Progress.Visited > 0 {
+		j.Count -= r.Progress.Visited
+		j.Percent = 0
+		if j.Count <= 0 {
+			s.dequeue(r)
+			s.finish(r, JobComplete)
+			s.lock.Unlock()
+			return true
+		}
+	}
+
+	// starting an ordered or filtered job walks the whole registry, so the lock is not held while doing so
+	s.lock.Unlock()
+	done, actual, err := s.drainer.Start(j)
+	s.lock.Lock()
+
+	if r.State != JobScheduled {
+		// cancelled while starting, in which case Cancel has already moved the job into history
+		s.lock.Unlock()
+		if err == nil {
+			s.drainer.Cancel()
+			<-done
+		}
+
+		return true
+	}
+
+	switch {
+	case err == ErrActive:
+		s.lock.Unlock()
+		s.logger.Log(level.Key(), level.WarnValue(), logging.MessageKey(), "another drain is active: delaying drain job", "id", r.ID)
+		return s.wait(s.retryInterval)
+
+	case err != nil:
+		s.dequeue(r)
+		r.Error = err.Error()
+		s.finish(r, JobFailed)
+		s.lock.Unlock()
+		return true
+	}
+
+	if r.Progress.Visited == 0 {
+		r.Job = actual
+	}
+
+	s.dequeue(r)
+	r.State = JobRunning
+	rj := &runningJob{record: r, base: r.Progress}
+	s.running = rj
+	s.save()
+	s.lock.Unlock()
+
+	s.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "drain job started", "id", r.ID, "count", actual.Count, "resumed", r.Resumed)
+
+	ticker, stopTicker := s.newTicker(s.progressInterval)
+	defer stopTicker()
+
+	var (
+		deadline <-chan time.Time
+		outcome  = JobComplete
+	)
+
+	if !r.Window.NotAfter.IsZero() {
+		timer, stopTimer := s.newTimer(r.Window.NotAfter.Sub(s.now()))
+		defer stopTimer()
+		deadline = timer
+	}
+
+	for {
+		select {
+		case <-done:
+			s.lock.Lock()
+			s.updateProgress(rj)
+
+			// the drainer may also have been cancelled directly, rather than through this scheduler
+			if rj.cancelled || (outcome == JobComplete && r.Progress.Cancelled) {
+				outcome = JobCancelled
+			}
+
+			s.running = nil
+			s.finish(r, outcome)
+			s.lock.Unlock()
+			return true
+
+		case <-ticker:
+			s.lock.Lock()
+			s.updateProgress(rj)
+			s.save()
+			s.lock.Unlock()
+
+		case <-deadline:
+			s.logger.Log(level.Key(), level.WarnValue(), logging.MessageKey(), "drain window closed: cancelling drain job", "id", r.ID)
+			outcome = JobExpired
+			deadline = nil
+			s.drainer.Cancel()
+
+		case <-s.shutdown:
+			// leave the job in the running state, so that it is resumed by the next process
+			if stopped, err := s.drainer.Cancel(); err == nil {
+				<-stopped
+			}
+
+			s.lock.Lock()
+			s.updateProgress(rj)
+			r.Progress.Finished = nil
+			s.save()
+			s.running = nil
+			s.lock.Unlock()
+			return false
+		}
+	}
+}
+
+// updateProgress merges the drainer's progress into the running job's cumulative progress.
+// This method must be invoked under the lock.
+func (s *scheduler) updateProgress(rj *runningJob) {
+	_, _, p := s.drainer.Status()
+	rj.record.Progress = Progress{
+		Visited:   rj.base.Visited + p.Visited,
+		Drained:   rj.base.Drained + p.Drained,
+		Started:   rj.base.Started,
+		Finished:  p.Finished,
+		Cancelled: p.Cancelled,
+	}
+
+	if rj.record.Progress.Started.IsZero() {
+		rj.record.Progress.Started = p.Started
+	}
+}
@@ -0,0 +1,534 @@
+package drain
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDrainer is an Interface whose jobs run until the test finishes them
+type fakeDrainer struct {
+	lock     sync.Mutex
+	active   bool
+	job      Job
+	progress Progress
+	done     chan struct{}
+	startErr error
+	started  chan Job
+
+	// starting, if set, receives a value each time Start is entered, and Start then blocks until gate is closed
+	starting chan struct{}
+	gate     chan struct{}
+}
+
+func newFakeDrainer() *fakeDrainer {
+	return &fakeDrainer{
+		started: make(chan Job, 10),
+	}
+}
+
+func (fd *fakeDrainer) Start(j Job) (<-chan struct{}, Job, error) {
+	if fd.starting != nil {
+		fd.starting <- struct{}{}
+		<-fd.gate
+	}
+
+	defer fd.lock.Unlock()
+	fd.lock.Lock()
+
+	if fd.startErr != nil {
+		return nil, Job{}, fd.startErr
+	} else if fd.active {
+		return nil, Job{}, ErrActive
+	}
+
+	j.normalize(100)
+	fd.active = true
+	fd.job = j
+	fd.progress = Progress{Started: time.Now().UTC()}
+	fd.done = make(chan struct{})
+	fd.started <- j
+	return fd.done, j, nil
+}
+
+func (fd *fakeDrainer) Status() (bool, Job, Progress) {
+	defer fd.lock.Unlock()
+	fd.lock.Lock()
+	return fd.active, fd.job, fd.progress
+}
+
+// advance updates the progress of the running job
+func (fd *fakeDrainer) advance(visited, drained int) {
+	defer fd.lock.Unlock()
+	fd.lock.Lock()
+	fd.progress.Visited = visited
+	fd.progress.Drained = drained
+}
+
+func (fd *fakeDrainer) stop() <-chan struct{} {
+	finished := time.Now().UTC()
+	fd.progress.Finished = &finished
+	fd.active = false
+	close(fd.done)
+	return fd.done
+}
+
+// finish completes the running job with the given progress
+func (fd *fakeDrainer) finish(visited, drained int) {
+	defer fd.lock.Unlock()
+	fd.lock.Lock()
+	fd.progress.Visited = visited
+	fd.progress.Drained = drained
+	fd.stop()
+}
+
+func (fd *fakeDrainer) Cancel() (<-chan struct{}, error) {
+	defer fd.lock.Unlock()
+	fd.lock.Lock()
+
+	if !fd.active {
+		return nil, ErrNotActive
+	}
+
+	fd.progress.Cancelled = true
+	return fd.stop(), nil
+}
+
+func awaitStart(t *testing.T, fd *fakeDrainer) Job {
+	select {
+	case j := <-fd.started:
+		return j
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "No drain job was started")
+		return Job{}
+	}
+}
+
+// awaitHistory waits for a scheduler's history to reach a certain length
+func awaitHistory(t *testing.T, s Scheduler, length int) []Record {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if history := s.History(); len(history) >= length {
+			return history
+		}
+	}
+
+	assert.Fail(t, "The scheduler's history did not grow", "expected length: %d", length)
+	return s.History()
+}
+
+// awaitNoJobs waits for a scheduler to have no scheduled or running jobs
+func awaitNoJobs(t *testing.T, s Scheduler) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(s.Jobs()) == 0 {
+			return
+		}
+	}
+
+	assert.Fail(t, "The scheduler still has jobs")
+}
+
+func newTestScheduler(t *testing.T, fd *fakeDrainer, options ...SchedulerOption) Scheduler {
+	s, err := NewScheduler(fd, append([]SchedulerOption{WithSchedulerLogger(logging.NewTestLogger(nil, t))}, options...)...)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	return s
+}
+
+func testSchedulerImmediate(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		fd = newFakeDrainer()
+		s  = newTestScheduler(t, fd)
+	)
+
+	defer s.Stop()
+	record, err := s.Schedule(Job{Percent: 10, Rate: 5}, Window{})
+	require.NoError(err)
+	assert.Equal("1", record.ID)
+	assert.Equal(JobScheduled, record.State)
+
+	assert.Equal(Job{Count: 10, Percent: 10, Rate: 5, Tick: time.Second}, awaitStart(t, fd))
+	fd.advance(5, 5)
+	jobs := s.Jobs()
+	require.Len(jobs, 1)
+	assert.Equal(JobRunning, jobs[0].State)
+	assert.Equal(10, jobs[0].Job.Count)
+
+	fd.finish(10, 9)
+	history := awaitHistory(t, s, 1)
+	require.Len(history, 1)
+	assert.Equal("1", history[0].ID)
+	assert.Equal(JobComplete, history[0].State)
+	assert.Equal(10, history[0].Progress.Visited)
+	assert.Equal(9, history[0].Progress.Drained)
+	assert.NotNil(history[0].Progress.Finished)
+	assert.Empty(s.Jobs())
+}
+
+func testSchedulerQueue(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		fd  = newFakeDrainer()
+		s   = newTestScheduler(t, fd)
+		now = time.Now()
+	)
+
+	defer s.Stop()
+	_, err := s.Schedule(Job{Count: 1}, Window{})
+	require.NoError(err)
+	awaitStart(t, fd)
+
+	// the later window runs after the earlier one, regardless of the order scheduled
+	_, err = s.Schedule(Job{Count: 3}, Window{NotBefore: now.Add(200 * time.Millisecond)})
+	require.NoError(err)
+	_, err = s.Schedule(Job{Count: 2}, Window{NotBefore: now.Add(100 * time.Millisecond)})
+	require.NoError(err)
+
+	jobs := s.Jobs()
+	require.Len(jobs, 3)
+	assert.Equal([]string{"1", "3", "2"}, []string{jobs[0].ID, jobs[1].ID, jobs[2].ID})
+	assert.Equal([]JobState{JobRunning, JobScheduled, JobScheduled}, []JobState{jobs[0].State, jobs[1].State, jobs[2].State})
+
+	fd.finish(1, 1)
+	assert.Equal(2, awaitStart(t, fd).Count)
+	assert.False(time.Now().Before(now.Add(100 * time.Millisecond)))
+
+	fd.finish(2, 2)
+	assert.Equal(3, awaitStart(t, fd).Count)
+	assert.False(time.Now().Before(now.Add(200 * time.Millisecond)))
+
+	fd.finish(3, 3)
+	history := awaitHistory(t, s, 3)
+	require.Len(history, 3)
+	assert.Equal([]string{"2", "3", "1"}, []string{history[0].ID, history[1].ID, history[2].ID})
+}
+
+func testSchedulerInvalidWindow(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		fd  = newFakeDrainer()
+		s   = newTestScheduler(t, fd)
+		now = time.Now()
+	)
+
+	defer s.Stop()
+	_, err := s.Schedule(Job{}, Window{NotAfter: now.Add(-time.Minute)})
+	assert.Equal(ErrInvalidWindow, err)
+
+	_, err = s.Schedule(Job{}, Window{NotBefore: now.Add(time.Hour), NotAfter: now.Add(time.Minute)})
+	assert.Equal(ErrInvalidWindow, err)
+
+	_, err = s.Schedule(Job{Query: "this is not a query"}, Window{})
+	assert.Error(err)
+
+	_, err = s.Schedule(Job{Order: "nosuch"}, Window{})
+	assert.Equal(ErrInvalidOrder, err)
+
+	assert.Empty(s.Jobs())
+}
+
+func testSchedulerValidation(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		manager = generateManager(assert, 0)
+	)
+
+	s, err := NewScheduler(New(WithRegistry(manager), WithConnector(manager)), WithSchedulerLogger(logging.NewTestLogger(nil, t)))
+	require.NoError(err)
+	defer s.Stop()
+
+	// everything the drainer would reject is rejected at schedule time, rather than failing later
+	_, err = s.Schedule(Job{Redirect: true}, Window{})
+	assert.Equal(ErrRedirectNotSupported, err)
+
+	_, err = s.Schedule(Job{Order: "nosuch"}, Window{})
+	assert.Equal(ErrInvalidOrder, err)
+
+	_, err = s.Schedule(Job{Query: "this is not a query"}, Window{})
+	assert.Error(err)
+
+	assert.Empty(s.Jobs())
+	assert.Empty(s.History())
+}
+
+func testSchedulerCancelWhileStarting(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		fd = newFakeDrainer()
+	)
+
+	fd.starting = make(chan struct{}, 1)
+	fd.gate = make(chan struct{})
+
+	s := newTestScheduler(t, fd)
+	defer s.Stop()
+
+	record, err := s.Schedule(Job{Order: OrderOldest}, Window{})
+	require.NoError(err)
+
+	select {
+	case <-fd.starting:
+	case <-time.After(5 * time.Second):
+		require.Fail("The drainer was not started")
+	}
+
+	// the scheduler remains responsive while the drainer starts
+	jobs := s.Jobs()
+	require.Len(jobs, 1)
+	assert.Equal(JobScheduled, jobs[0].State)
+	assert.NoError(s.Cancel(record.ID))
+
+	close(fd.gate)
+	awaitStart(t, fd)
+	history := awaitHistory(t, s, 1)
+	require.Len(history, 1)
+	assert.Equal(JobCancelled, history[0].State)
+	awaitNoJobs(t, s)
+
+	// the drain started on behalf of the cancelled job is cancelled as well
+	active, _, progress := fd.Status()
+	assert.False(active)
+	assert.True(progress.Cancelled)
+}
+
+func testSchedulerExpired(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		fd  = newFakeDrainer()
+		s   = newTestScheduler(t, fd)
+		now = time.Now()
+	)
+
+	defer s.Stop()
+
+	// a running job is cancelled when its window closes
+	_, err := s.Schedule(Job{}, Window{NotAfter: now.Add(200 * time.Millisecond)})
+	require.NoError(err)
+	awaitStart(t, fd)
+
+	// a job still waiting when its window closes never runs
+	_, err = s.Schedule(Job{}, Window{NotAfter: now.Add(100 * time.Millisecond)})
+	require.NoError(err)
+
+	history := awaitHistory(t, s, 2)
+	require.Len(history, 2)
+	for _, record := range history {
+		assert.Equal(JobExpired, record.State)
+	}
+
+	assert.Equal("2", history[0].ID)
+	assert.Equal("1", history[1].ID)
+}
+
+func testSchedulerCancel(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		fd = newFakeDrainer()
+		s  = newTestScheduler(t, fd, WithMaxHistory(2))
+	)
+
+	defer s.Stop()
+	running, err := s.Schedule(Job{}, Window{})
+	require.NoError(err)
+	awaitStart(t, fd)
+
+	for i := 0; i < 2; i++ {
+		scheduled, err := s.Schedule(Job{}, Window{NotBefore: time.Now().Add(time.Hour)})
+		require.NoError(err)
+		assert.NoError(s.Cancel(scheduled.ID))
+	}
+
+	assert.NoError(s.Cancel(running.ID))
+	awaitNoJobs(t, s)
+	history := s.History()
+
+	// only the most recent history is retained
+	require.Len(history, 2)
+	assert.Equal(running.ID, history[0].ID)
+	assert.Equal(JobCancelled, history[0].State)
+	assert.Equal("3", history[1].ID)
+	assert.Equal(JobCancelled, history[1].State)
+
+	assert.Equal(ErrJobNotFound, s.Cancel(running.ID))
+	assert.Equal(ErrJobNotFound, s.Cancel("nosuchjob"))
+}
+
+func testSchedulerCancelDrainer(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		fd = newFakeDrainer()
+		s  = newTestScheduler(t, fd)
+	)
+
+	defer s.Stop()
+	running, err := s.Schedule(Job{Count: 10}, Window{})
+	require.NoError(err)
+	awaitStart(t, fd)
+
+	// cancelling the drainer directly, as the Cancel handler does without a job id, still cancels the job
+	fd.advance(4, 4)
+	_, err = fd.Cancel()
+	require.NoError(err)
+
+	history := awaitHistory(t, s, 1)
+	require.Len(history, 1)
+	assert.Equal(running.ID, history[0].ID)
+	assert.Equal(JobCancelled, history[0].State)
+	assert.Equal(4, history[0].Progress.Visited)
+	assert.True(history[0].Progress.Cancelled)
+}
+
+func testSchedulerStartErrors(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		fd          = newFakeDrainer()
+		expectedErr = errors.New("expected")
+	)
+
+	// a drain started outside the scheduler delays scheduled jobs
+	_, _, err := fd.Start(Job{})
+	require.NoError(err)
+	awaitStart(t, fd)
+
+	s := newTestScheduler(t, fd)
+	defer s.Stop()
+	s.(*scheduler).retryInterval = 50 * time.Millisecond
+
+	_, err = s.Schedule(Job{Count: 5}, Window{})
+	require.NoError(err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(JobScheduled, s.Jobs()[0].State)
+
+	fd.finish(100, 100)
+	assert.Equal(5, awaitStart(t, fd).Count)
+	fd.finish(5, 5)
+	awaitHistory(t, s, 1)
+
+	fd.lock.Lock()
+	fd.startErr = expectedErr
+	fd.lock.Unlock()
+
+	_, err = s.Schedule(Job{}, Window{})
+	require.NoError(err)
+	history := awaitHistory(t, s, 2)
+	assert.Equal(JobFailed, history[0].State)
+	assert.Equal(expectedErr.Error(), history[0].Error)
+}
+
+func testSchedulerResume(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		store = NewMemoryJobStore()
+		first = newFakeDrainer()
+		s     = newTestScheduler(t, first, WithJobStore(store), WithProgressInterval(10*time.Millisecond))
+	)
+
+	_, err := s.Schedule(Job{Percent: 50}, Window{})
+	require.NoError(err)
+	awaitStart(t, first)
+	first.advance(20, 18)
+
+	// progress is saved periodically while the job runs
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if records, _ := store.Load(); len(records) == 1 && records[0].Progress.Visited == 20 {
+			break
+		}
+	}
+
+	s.Stop()
+	records, err := store.Load()
+	require.NoError(err)
+	require.Len(records, 1)
+	assert.Equal(JobRunning, records[0].State)
+	assert.Equal(20, records[0].Progress.Visited)
+	assert.Nil(records[0].Progress.Finished)
+
+	// a new process resumes the job with the devices it had yet to visit
+	var (
+		second = newFakeDrainer()
+		s2     = newTestScheduler(t, second, WithJobStore(store))
+	)
+
+	defer s2.Stop()
+	assert.Equal(Job{Count: 30}, awaitStart(t, second))
+
+	jobs := s2.Jobs()
+	require.Len(jobs, 1)
+	assert.Equal(1, jobs[0].Resumed)
+	assert.Equal(50, jobs[0].Job.Count)
+
+	second.finish(30, 29)
+	history := awaitHistory(t, s2, 1)
+	require.Len(history, 1)
+	assert.Equal(JobComplete, history[0].State)
+	assert.Equal(50, history[0].Progress.Visited)
+	assert.Equal(47, history[0].Progress.Drained)
+	assert.Equal(records[0].Progress.Started, history[0].Progress.Started)
+
+	// identifiers continue where the previous process left off
+	next, err := s2.Schedule(Job{}, Window{NotBefore: time.Now().Add(time.Hour)})
+	require.NoError(err)
+	assert.Equal("2", next.ID)
+
+	// history is also reported after a restart
+	s2.Stop()
+	s3 := newTestScheduler(t, newFakeDrainer(), WithJobStore(store))
+	defer s3.Stop()
+	assert.Len(s3.History(), 1)
+	assert.Len(s3.Jobs(), 1)
+}
+
+func TestScheduler(t *testing.T) {
+	t.Run("Immediate", testSchedulerImmediate)
+	t.Run("Queue", testSchedulerQueue)
+	t.Run("InvalidWindow", testSchedulerInvalidWindow)
+	t.Run("Validation", testSchedulerValidation)
+	t.Run("Expired", testSchedulerExpired)
+	t.Run("Cancel", testSchedulerCancel)
+	t.Run("CancelDrainer", testSchedulerCancelDrainer)
+	t.Run("CancelWhileStarting", testSchedulerCancelWhileStarting)
+	t.Run("StartErrors", testSchedulerStartErrors)
+	t.Run("Resume", testSchedulerResume)
+}
+
+func TestNewSchedulerStoreError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Panics(func() {
+		NewScheduler(nil)
+	})
+
+	// a directory cannot be loaded as a file
+	s, err := NewScheduler(newFakeDrainer(), WithJobStore(NewFileJobStore("/")))
+	assert.Nil(s)
+	assert.Error(err)
+
+	s, err = NewScheduler(newFakeDrainer(), WithJobStore(nil), WithSchedulerLogger(nil), WithMaxHistory(0), WithProgressInterval(0))
+	assert.NotNil(s)
+	assert.NoError(err)
+	s.Stop()
+}
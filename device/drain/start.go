@@ -2,18 +2,54 @@ package drain
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/Comcast/webpa-common/device"
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/Comcast/webpa-common/xhttp"
 	"github.com/Comcast/webpa-common/xhttp/converter"
+	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/gorilla/schema"
 )
 
+const (
+	// NotBeforeParameter is the optional Start form parameter, in RFC3339 format, which schedules a job for a future time
+	NotBeforeParameter = "notBefore"
+
+	// NotAfterParameter is the optional Start form parameter, in RFC3339 format, which closes a scheduled job's window
+	NotAfterParameter = "notAfter"
+)
+
+var ErrSchedulingNotSupported = errors.New("Scheduled drain jobs are not supported")
+
+// parseWindow removes the scheduling window parameters from a form and parses them
+func parseWindow(form url.Values) (w Window, err error) {
+	if v := form.Get(NotBeforeParameter); len(v) > 0 {
+		if w.NotBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+
+	if v := form.Get(NotAfterParameter); len(v) > 0 {
+		if w.NotAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+
+	form.Del(NotBeforeParameter)
+	form.Del(NotAfterParameter)
+	return
+}
+
+// Start is an HTTP handler which starts drain jobs.  If a Scheduler is set, jobs are scheduled instead, optionally
+// within a window given by the NotBeforeParameter and NotAfterParameter, and the response describes the scheduled job.
 type Start struct {
-	Drainer Interface
+	Drainer   Interface
+	Scheduler Scheduler
 }
 
 func (s *Start) ServeHTTP(response http.ResponseWriter, request *http.Request) {
@@ -24,6 +60,13 @@ func (s *Start) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	window, err := parseWindow(request.Form)
+	if err != nil {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "invalid drain window", logging.ErrorKey(), err)
+		xhttp.WriteError(response, http.StatusBadRequest, err)
+		return
+	}
+
 	var (
 		decoder = schema.NewDecoder()
 		input   Job
@@ -36,6 +79,37 @@ func (s *Start) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if len(input.Query) > 0 {
+		if _, err := device.ParseQuery(input.Query); err != nil {
+			logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "invalid device query", logging.ErrorKey(), err)
+			xhttp.WriteError(response, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if _, err := input.less(); err != nil {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "invalid drain order", logging.ErrorKey(), err)
+		xhttp.WriteError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	if s.Scheduler != nil {
+		record, err := s.Scheduler.Schedule(input, window)
+		if err != nil {
+			logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to schedule drain job", logging.ErrorKey(), err)
+			xhttp.WriteError(response, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(logger, response, record.ToMap())
+		return
+	}
+
+	if !window.NotBefore.IsZero() || !window.NotAfter.IsZero() {
+		xhttp.WriteError(response, http.StatusBadRequest, ErrSchedulingNotSupported)
+		return
+	}
+
 	_, output, err := s.Drainer.Start(input)
 	if err != nil {
 		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to start drain job", logging.ErrorKey(), err)
@@ -43,7 +117,11 @@ func (s *Start) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if message, err := json.Marshal(output.ToMap()); err != nil {
+	writeJSON(logger, response, output.ToMap())
+}
+
+func writeJSON(logger log.Logger, response http.ResponseWriter, v interface{}) {
+	if message, err := json.Marshal(v); err != nil {
 		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to marshal response", logging.ErrorKey(), err)
 	} else {
 		response.Header().Set("Content-Type", "application/json")
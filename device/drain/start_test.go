@@ -18,7 +18,7 @@ func testStartServeHTTPDefaultLogger(t *testing.T) {
 
 		d                     = new(mockDrainer)
 		done  <-chan struct{} = make(chan struct{})
-		start                 = Start{d}
+		start                 = Start{Drainer: d}
 
 		response = httptest.NewRecorder()
 		request  = httptest.NewRequest("POST", "/", nil)
@@ -61,6 +61,14 @@ func testStartServeHTTPValid(t *testing.T) {
 			"/foo?count=22&rate=10&tick=20s",
 			Job{Count: 22, Rate: 10, Tick: 20 * time.Second},
 		},
+		{
+			"/foo?percent=50&query=id+%5E%3D+mac%3A",
+			Job{Percent: 50, Query: "id ^= mac:"},
+		},
+		{
+			"/foo?count=10&order=oldest&redirect=true",
+			Job{Count: 10, Order: OrderOldest, Redirect: true},
+		},
 	}
 
 	for _, record := range testData {
@@ -70,7 +78,7 @@ func testStartServeHTTPValid(t *testing.T) {
 
 				d                     = new(mockDrainer)
 				done  <-chan struct{} = make(chan struct{})
-				start                 = Start{d}
+				start                 = Start{Drainer: d}
 
 				ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
 				response = httptest.NewRecorder()
@@ -96,7 +104,7 @@ func testStartServeHTTPParseFormError(t *testing.T) {
 		assert = assert.New(t)
 
 		d     = new(mockDrainer)
-		start = Start{d}
+		start = Start{Drainer: d}
 
 		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
 		response = httptest.NewRecorder()
@@ -113,7 +121,7 @@ func testStartServeHTTPInvalidQuery(t *testing.T) {
 		assert = assert.New(t)
 
 		d     = new(mockDrainer)
-		start = Start{d}
+		start = Start{Drainer: d}
 
 		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
 		response = httptest.NewRecorder()
@@ -125,13 +133,47 @@ func testStartServeHTTPInvalidQuery(t *testing.T) {
 	d.AssertExpectations(t)
 }
 
+func testStartServeHTTPInvalidDeviceQuery(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		d     = new(mockDrainer)
+		start = Start{Drainer: d}
+
+		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("POST", "/foo?query=nosuch+%3D+foo", nil).WithContext(ctx)
+	)
+
+	start.ServeHTTP(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	d.AssertExpectations(t)
+}
+
+func testStartServeHTTPInvalidOrder(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		d     = new(mockDrainer)
+		start = Start{Drainer: d}
+
+		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("POST", "/foo?order=sideways", nil).WithContext(ctx)
+	)
+
+	start.ServeHTTP(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	d.AssertExpectations(t)
+}
+
 func testStartServeHTTPStartError(t *testing.T) {
 	var (
 		assert = assert.New(t)
 
 		d             = new(mockDrainer)
 		done          <-chan struct{}
-		start         = Start{d}
+		start         = Start{Drainer: d}
 		expectedError = errors.New("expected")
 
 		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
@@ -145,12 +187,114 @@ func testStartServeHTTPStartError(t *testing.T) {
 	d.AssertExpectations(t)
 }
 
+func testStartServeHTTPSchedule(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		d       = new(mockDrainer)
+		s       = new(mockScheduler)
+		start   = Start{Drainer: d, Scheduler: s}
+		created = time.Date(2019, 2, 12, 0, 0, 0, 0, time.UTC)
+		window  = Window{
+			NotBefore: time.Date(2019, 2, 13, 2, 0, 0, 0, time.UTC),
+			NotAfter:  time.Date(2019, 2, 13, 4, 0, 0, 0, time.UTC),
+		}
+
+		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("POST", "/foo?percent=20&rate=10&notBefore=2019-02-13T02:00:00Z&notAfter=2019-02-13T04:00:00Z", nil).WithContext(ctx)
+	)
+
+	s.On("Schedule", Job{Percent: 20, Rate: 10}, window).
+		Return(Record{ID: "12", Job: Job{Percent: 20, Rate: 10}, Window: window, State: JobScheduled, Created: created}, error(nil)).
+		Once()
+
+	start.ServeHTTP(response, request)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal("application/json", response.HeaderMap.Get("Content-Type"))
+	assert.JSONEq(
+		`{"id": "12", "job": {"count": 0, "percent": 20, "rate": 10}, "window": {"notBefore": "2019-02-13T02:00:00Z", "notAfter": "2019-02-13T04:00:00Z"}, "state": "scheduled", "created": "2019-02-12T00:00:00Z"}`,
+		response.Body.String(),
+	)
+
+	d.AssertExpectations(t)
+	s.AssertExpectations(t)
+}
+
+func testStartServeHTTPScheduleError(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		d     = new(mockDrainer)
+		s     = new(mockScheduler)
+		start = Start{Drainer: d, Scheduler: s}
+
+		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("POST", "/foo?notAfter=2019-02-13T04:00:00Z", nil).WithContext(ctx)
+	)
+
+	s.On("Schedule", Job{}, Window{NotAfter: time.Date(2019, 2, 13, 4, 0, 0, 0, time.UTC)}).Return(Record{}, ErrInvalidWindow).Once()
+	start.ServeHTTP(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+
+	d.AssertExpectations(t)
+	s.AssertExpectations(t)
+}
+
+func testStartServeHTTPInvalidWindow(t *testing.T) {
+	for _, uri := range []string{"/foo?notBefore=tomorrow", "/foo?notAfter=2019-02-13"} {
+		t.Run(uri, func(t *testing.T) {
+			var (
+				assert = assert.New(t)
+
+				d     = new(mockDrainer)
+				s     = new(mockScheduler)
+				start = Start{Drainer: d, Scheduler: s}
+
+				ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
+				response = httptest.NewRecorder()
+				request  = httptest.NewRequest("POST", uri, nil).WithContext(ctx)
+			)
+
+			start.ServeHTTP(response, request)
+			assert.Equal(http.StatusBadRequest, response.Code)
+			d.AssertExpectations(t)
+			s.AssertExpectations(t)
+		})
+	}
+}
+
+func testStartServeHTTPSchedulingNotSupported(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		d     = new(mockDrainer)
+		start = Start{Drainer: d}
+
+		ctx      = logging.WithLogger(context.Background(), logging.NewTestLogger(nil, t))
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("POST", "/foo?notBefore=2019-02-13T02:00:00Z", nil).WithContext(ctx)
+	)
+
+	start.ServeHTTP(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Contains(response.Body.String(), ErrSchedulingNotSupported.Error())
+	d.AssertExpectations(t)
+}
+
 func TestStart(t *testing.T) {
 	t.Run("ServeHTTP", func(t *testing.T) {
 		t.Run("DefaultLogger", testStartServeHTTPDefaultLogger)
 		t.Run("Valid", testStartServeHTTPValid)
 		t.Run("ParseFormError", testStartServeHTTPParseFormError)
 		t.Run("InvalidQuery", testStartServeHTTPInvalidQuery)
+		t.Run("InvalidDeviceQuery", testStartServeHTTPInvalidDeviceQuery)
+		t.Run("InvalidOrder", testStartServeHTTPInvalidOrder)
 		t.Run("StartError", testStartServeHTTPStartError)
+		t.Run("Schedule", testStartServeHTTPSchedule)
+		t.Run("ScheduleError", testStartServeHTTPScheduleError)
+		t.Run("InvalidWindow", testStartServeHTTPInvalidWindow)
+		t.Run("SchedulingNotSupported", testStartServeHTTPSchedulingNotSupported)
 	})
 }
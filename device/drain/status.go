@@ -7,23 +7,39 @@ import (
 	"github.com/Comcast/webpa-common/xhttp"
 )
 
-// Status returns a JSON message describing the status of the drain job
+// Status returns a JSON message describing the status of the drain job.  If a Scheduler is set, the message
+// also describes the scheduled jobs and the history of finished jobs.
 type Status struct {
-	Drainer Interface
+	Drainer   Interface
+	Scheduler Scheduler
+}
+
+func recordsToMaps(records []Record) []map[string]interface{} {
+	maps := make([]map[string]interface{}, len(records))
+	for i, r := range records {
+		maps[i] = r.ToMap()
+	}
+
+	return maps
 }
 
 func (s *Status) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	var (
 		active, job, progress = s.Drainer.Status()
-		message, err          = json.Marshal(
-			map[string]interface{}{
-				"active":   active,
-				"job":      job.ToMap(),
-				"progress": progress,
-			},
-		)
+		status                = map[string]interface{}{
+			"active":   active,
+			"job":      job.ToMap(),
+			"progress": progress,
+		}
 	)
 
+	if s.Scheduler != nil {
+		status["scheduled"] = recordsToMaps(s.Scheduler.Jobs())
+		status["history"] = recordsToMaps(s.Scheduler.History())
+	}
+
+	message, err := json.Marshal(status)
+
 	if err != nil {
 		xhttp.WriteError(response, http.StatusInternalServerError, err)
 		return
@@ -16,7 +16,7 @@ func testStatus(t *testing.T, active bool, j Job, p Progress, expectedJSON strin
 		assert = assert.New(t)
 
 		d      = new(mockDrainer)
-		status = Status{d}
+		status = Status{Drainer: d}
 
 		response = httptest.NewRecorder()
 		request  = httptest.NewRequest("GET", "/", nil)
@@ -63,3 +63,39 @@ func TestStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestStatusScheduler(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		d       = new(mockDrainer)
+		s       = new(mockScheduler)
+		status  = Status{Drainer: d, Scheduler: s}
+		created = time.Date(2019, 2, 12, 0, 0, 0, 0, time.UTC)
+		started = created.Add(time.Hour)
+
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("GET", "/", nil)
+	)
+
+	d.On("Status").Return(false, Job{}, Progress{}).Once()
+	s.On("Jobs").Return([]Record{{ID: "2", Job: Job{Count: 10}, State: JobScheduled, Created: created}}).Once()
+	s.On("History").Return([]Record{{ID: "1", Job: Job{Count: 5}, State: JobComplete, Created: created, Progress: Progress{Visited: 5, Drained: 5, Started: started}}}).Once()
+
+	status.ServeHTTP(response, request)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.JSONEq(
+		fmt.Sprintf(
+			`{
+				"active": false, "job": {"count": 0}, "progress": {"visited": 0, "drained": 0, "started": "%s"},
+				"scheduled": [{"id": "2", "job": {"count": 10}, "window": {}, "state": "scheduled", "created": "2019-02-12T00:00:00Z"}],
+				"history": [{"id": "1", "job": {"count": 5}, "window": {}, "state": "complete", "created": "2019-02-12T00:00:00Z", "progress": {"visited": 5, "drained": 5, "started": "2019-02-12T01:00:00Z"}}]
+			}`,
+			time.Time{}.Format(time.RFC3339Nano),
+		),
+		response.Body.String(),
+	)
+
+	d.AssertExpectations(t)
+	s.AssertExpectations(t)
+}
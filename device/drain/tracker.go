@@ -24,21 +24,26 @@ type Progress struct {
 	// Finished is the UTC system time at which the drain job finished or was canceled.
 	// If the job is running, this field will be nil.
 	Finished *time.Time `json:"finished,omitempty"`
+
+	// Cancelled indicates that the drain job was cancelled while it was running
+	Cancelled bool `json:"cancelled,omitempty"`
 }
 
 type tracker struct {
-	visited  int32
-	drained  int32
-	started  time.Time
-	finished atomic.Value
-	counter  xmetrics.Adder
+	visited   int32
+	drained   int32
+	cancelled uint32
+	started   time.Time
+	finished  atomic.Value
+	counter   xmetrics.Adder
 }
 
 func (t *tracker) Progress() Progress {
 	p := Progress{
-		Visited: int(atomic.LoadInt32(&t.visited)),
-		Drained: int(atomic.LoadInt32(&t.drained)),
-		Started: t.started,
+		Visited:   int(atomic.LoadInt32(&t.visited)),
+		Drained:   int(atomic.LoadInt32(&t.drained)),
+		Started:   t.started,
+		Cancelled: atomic.LoadUint32(&t.cancelled) != 0,
 	}
 
 	if finished, ok := t.finished.Load().(time.Time); ok && !finished.IsZero() {
@@ -57,6 +62,10 @@ func (t *tracker) addDrained(delta int) {
 	t.counter.Add(float64(delta))
 }
 
+func (t *tracker) cancel() {
+	atomic.StoreUint32(&t.cancelled, 1)
+}
+
 func (t *tracker) done(timestamp time.Time) {
 	t.finished.Store(timestamp)
 }
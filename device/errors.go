@@ -19,6 +19,7 @@ var (
 	ErrorNoSuchTransactionKey         = errors.New("That transaction key is not registered")
 	ErrorTransactionAlreadyRegistered = errors.New("That transaction is already registered")
 	ErrorTransactionCancelled         = errors.New("The transaction has been cancelled")
+	ErrorDuplicateTransactionResponse = errors.New("That transaction has already been completed")
 	ErrorResponseNoContents           = errors.New("The response has no contents")
 	ErrorDeviceBusy                   = errors.New("That device is busy")
 	ErrorDeviceClosed                 = errors.New("That device has been closed")
@@ -0,0 +1,314 @@
+package device
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/go-kit/kit/metrics"
+)
+
+// OverflowPolicy determines what an EventBus does with an event when a listener's queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits for room in the listener's queue.  This is the default policy, and it means that
+	// a slow listener still applies backpressure, but only once its queue has filled.
+	OverflowBlock OverflowPolicy = "block"
+
+	// OverflowDropOldest discards the oldest queued event to make room for the new one
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+
+	// OverflowDropNewest discards the new event, leaving the queue as it is
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+
+	// DefaultEventBusWorkers is the number of goroutines that deliver events to each listener
+	DefaultEventBusWorkers = 1
+)
+
+// EventBusOptions configures asynchronous delivery of device events to listeners
+type EventBusOptions struct {
+	// QueueSize is the capacity of each listener's queue.  If nonpositive, no event bus is used and listeners
+	// are invoked synchronously from each device's pumps.
+	QueueSize int
+
+	// Workers is the number of goroutines delivering events to each listener.  If nonpositive,
+	// DefaultEventBusWorkers is used.  With more than one worker, a listener may observe events out of order.
+	Workers int
+
+	// Overflow is the policy applied when a listener's queue is full.  If unset or unrecognized,
+	// OverflowBlock is used.
+	Overflow OverflowPolicy
+}
+
+func (o *EventBusOptions) enabled() bool {
+	return o != nil && o.QueueSize > 0
+}
+
+func (o *EventBusOptions) workers() int {
+	if o != nil && o.Workers > 0 {
+		return o.Workers
+	}
+
+	return DefaultEventBusWorkers
+}
+
+func (o *EventBusOptions) overflow() OverflowPolicy {
+	if o != nil {
+		switch o.Overflow {
+		case OverflowDropOldest, OverflowDropNewest:
+			return o.Overflow
+		}
+	}
+
+	return OverflowBlock
+}
+
+// listenerQueue is the bounded queue of events waiting for a single listener
+type listenerQueue struct {
+	listener Listener
+	events   chan *Event
+	depth    metrics.Gauge
+	dropped  metrics.Counter
+}
+
+func (lq *listenerQueue) updateDepth() {
+	lq.depth.Set(float64(len(lq.events)))
+}
+
+func (lq *listenerQueue) work(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for e := range lq.events {
+		lq.updateDepth()
+		lq.listener(e)
+	}
+}
+
+// EventBus delivers events to listeners asynchronously, so that slow listeners do not stall device I/O.
+// Each listener has its own bounded queue and worker goroutines.  Dispatch is itself a Listener, which
+// allows an EventBus to be used anywhere a Listener is expected.
+//
+// Each dispatched event is deep copied, so listeners may safely retain an event and its Message and Contents.
+// Listeners must still never modify events, since a single copy is shared by all listeners.
+type EventBus struct {
+	lock     sync.RWMutex
+	closed   bool
+	overflow OverflowPolicy
+	queues   []*listenerQueue
+	wg       sync.WaitGroup
+}
+
+// NewEventBus starts an EventBus which delivers events to the given listeners.  If the options
+// do not specify a queue size, each queue holds a single event.
+func NewEventBus(o *EventBusOptions, m Measures, listeners ...Listener) *EventBus {
+	var (
+		queueSize = 1
+		workers   = o.workers()
+		eb        = &EventBus{
+			overflow: o.overflow(),
+			queues:   make([]*listenerQueue, len(listeners)),
+		}
+	)
+
+	if o.enabled() {
+		queueSize = o.QueueSize
+	}
+
+	for i, l := range listeners {
+		label := strconv.Itoa(i)
+		lq := &listenerQueue{
+			listener: l,
+			events:   make(chan *Event, queueSize),
+			depth:    m.EventQueueDepth.With("listener", label),
+			dropped:  m.EventDropped.With("listener", label),
+		}
+
+		eb.queues[i] = lq
+		eb.wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go lq.work(&eb.wg)
+		}
+	}
+
+	return eb
+}
+
+// Dispatch queues a copy of the given event for each listener.  Events dispatched after Close are
+// counted as dropped.
+func (eb *EventBus) Dispatch(e *Event) {
+	eb.lock.RLock()
+	defer eb.lock.RUnlock()
+
+	if eb.closed {
+		for _, lq := range eb.queues {
+			lq.dropped.Add(1.0)
+		}
+
+		return
+	}
+
+	if len(eb.queues) == 0 {
+		return
+	}
+
+	e = copyEvent(e)
+	for _, lq := range eb.queues {
+		switch eb.overflow {
+		case OverflowDropNewest:
+			select {
+			case lq.events <- e:
+			default:
+				lq.dropped.Add(1.0)
+			}
+
+		case OverflowDropOldest:
+			for enqueued := false; !enqueued; {
+				select {
+				case lq.events <- e:
+					enqueued = true
+				default:
+					select {
+					case <-lq.events:
+						lq.dropped.Add(1.0)
+					default:
+					}
+				}
+			}
+
+		default:
+			lq.events <- e
+		}
+
+		lq.updateDepth()
+	}
+}
+
+// Close stops accepting events and waits for the events already queued to be delivered.
+// This method is idempotent.
+func (eb *EventBus) Close() {
+	eb.lock.Lock()
+	if eb.closed {
+		eb.lock.Unlock()
+		return
+	}
+
+	eb.closed = true
+	for _, lq := range eb.queues {
+		close(lq.events)
+	}
+
+	eb.lock.Unlock()
+	eb.wg.Wait()
+}
+
+// copyEvent produces a deep copy of an event's message and contents.  The Device is shared.
+func copyEvent(e *Event) *Event {
+	clone := *e
+	clone.Message = copyMessage(e.Message)
+	clone.Contents = copyBytes(e.Contents)
+	return &clone
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+
+	return append([]string{}, s...)
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	clone := make(map[string]string, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+
+	return clone
+}
+
+func copySpans(s [][]string) [][]string {
+	if s == nil {
+		return nil
+	}
+
+	clone := make([][]string, len(s))
+	for i, span := range s {
+		clone[i] = copyStrings(span)
+	}
+
+	return clone
+}
+
+func copyInt64(v *int64) *int64 {
+	if v == nil {
+		return nil
+	}
+
+	clone := *v
+	return &clone
+}
+
+func copyBool(v *bool) *bool {
+	if v == nil {
+		return nil
+	}
+
+	clone := *v
+	return &clone
+}
+
+// copyMessage deep copies the WRP message types defined in the wrp package.  Any other
+// implementation of wrp.Typed is returned as is.
+func copyMessage(m wrp.Typed) wrp.Typed {
+	switch v := m.(type) {
+	case *wrp.Message:
+		return v.Clone()
+
+	case *wrp.SimpleRequestResponse:
+		clone := *v
+		clone.Status = copyInt64(v.Status)
+		clone.RequestDeliveryResponse = copyInt64(v.RequestDeliveryResponse)
+		clone.Headers = copyStrings(v.Headers)
+		clone.Metadata = copyMetadata(v.Metadata)
+		clone.Spans = copySpans(v.Spans)
+		clone.IncludeSpans = copyBool(v.IncludeSpans)
+		clone.Payload = copyBytes(v.Payload)
+		clone.PartnerIDs = copyStrings(v.PartnerIDs)
+		return &clone
+
+	case *wrp.SimpleEvent:
+		clone := *v
+		clone.Headers = copyStrings(v.Headers)
+		clone.Metadata = copyMetadata(v.Metadata)
+		clone.Payload = copyBytes(v.Payload)
+		clone.PartnerIDs = copyStrings(v.PartnerIDs)
+		return &clone
+
+	case *wrp.CRUD:
+		clone := *v
+		clone.Headers = copyStrings(v.Headers)
+		clone.Metadata = copyMetadata(v.Metadata)
+		clone.Spans = copySpans(v.Spans)
+		clone.IncludeSpans = copyBool(v.IncludeSpans)
+		clone.Status = copyInt64(v.Status)
+		clone.RequestDeliveryResponse = copyInt64(v.RequestDeliveryResponse)
+		clone.Payload = copyBytes(v.Payload)
+		clone.PartnerIDs = copyStrings(v.PartnerIDs)
+		return &clone
+
+	default:
+		return m
+	}
+}
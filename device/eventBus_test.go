@@ -0,0 +1,304 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBusOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, o := range []*EventBusOptions{nil, new(EventBusOptions)} {
+		assert.False(o.enabled())
+		assert.Equal(DefaultEventBusWorkers, o.workers())
+		assert.Equal(OverflowBlock, o.overflow())
+	}
+
+	o := EventBusOptions{QueueSize: 10, Workers: 3, Overflow: OverflowDropOldest}
+	assert.True(o.enabled())
+	assert.Equal(3, o.workers())
+	assert.Equal(OverflowDropOldest, o.overflow())
+
+	o.Overflow = "nosuch"
+	assert.Equal(OverflowBlock, o.overflow())
+}
+
+func testCopyMessage(t *testing.T, original wrp.Typed, mutate func()) {
+	assert := assert.New(t)
+
+	clone := copyMessage(original)
+	assert.Equal(original, clone)
+	assert.False(original == clone)
+
+	mutate()
+	assert.NotEqual(original, clone)
+}
+
+func TestCopyMessage(t *testing.T) {
+	var (
+		status       int64 = 200
+		includeSpans       = true
+	)
+
+	t.Run("Nil", func(t *testing.T) {
+		assert.Nil(t, copyMessage(nil))
+	})
+
+	t.Run("Message", func(t *testing.T) {
+		m := &wrp.Message{
+			Type:         wrp.SimpleRequestResponseMessageType,
+			Source:       "test",
+			Status:       &status,
+			Headers:      []string{"X-Header"},
+			Metadata:     map[string]string{"key": "value"},
+			Spans:        [][]string{{"span", "1", "2"}},
+			IncludeSpans: &includeSpans,
+			Payload:      []byte("payload"),
+			PartnerIDs:   []string{"comcast"},
+		}
+
+		testCopyMessage(t, m, func() { m.Payload[0] = 'P' })
+		testCopyMessage(t, m, func() { m.Metadata["key"] = "changed" })
+		testCopyMessage(t, m, func() { m.Spans[0][0] = "changed" })
+		testCopyMessage(t, m, func() { *m.Status = 500 })
+	})
+
+	t.Run("SimpleRequestResponse", func(t *testing.T) {
+		m := &wrp.SimpleRequestResponse{Source: "test", Payload: []byte("payload"), PartnerIDs: []string{"comcast"}}
+		testCopyMessage(t, m, func() { m.PartnerIDs[0] = "sky" })
+	})
+
+	t.Run("SimpleEvent", func(t *testing.T) {
+		m := &wrp.SimpleEvent{Source: "test", Headers: []string{"X-Header"}, Payload: []byte("payload")}
+		testCopyMessage(t, m, func() { m.Headers[0] = "X-Changed" })
+	})
+
+	t.Run("CRUD", func(t *testing.T) {
+		m := &wrp.CRUD{Source: "test", Path: "/foo", Payload: []byte("payload")}
+		testCopyMessage(t, m, func() { m.Payload[0] = 'P' })
+	})
+}
+
+func testEventBusDispatch(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		first    = make(chan *Event, 1)
+		second   = make(chan *Event, 1)
+		bus      = NewEventBus(&EventBusOptions{QueueSize: 10}, NewMeasures(xmetricstest.NewProvider(nil, Metrics)), func(e *Event) { first <- e }, func(e *Event) { second <- e })
+		message  = &wrp.Message{Type: wrp.SimpleEventMessageType, Payload: []byte("payload")}
+		contents = wrp.MustEncode(message, wrp.Msgpack)
+		original = &Event{Type: MessageReceived, Message: message, Format: wrp.Msgpack, Contents: contents}
+	)
+
+	defer bus.Close()
+	bus.Dispatch(original)
+
+	// the dispatched event is a copy, so the caller is free to reuse its message and contents
+	message.Payload[0] = 'P'
+	contents[0] = 0
+
+	for _, events := range []chan *Event{first, second} {
+		select {
+		case e := <-events:
+			require.NotNil(e)
+			assert.False(e == original)
+			assert.Equal(MessageReceived, e.Type)
+			assert.Equal("payload", string(e.Message.(*wrp.Message).Payload))
+			assert.Equal(wrp.MustEncode(&wrp.Message{Type: wrp.SimpleEventMessageType, Payload: []byte("payload")}, wrp.Msgpack), e.Contents)
+		case <-time.After(5 * time.Second):
+			assert.Fail("The event was not delivered")
+		}
+	}
+}
+
+func testEventBusOverflow(t *testing.T, policy OverflowPolicy, expected []EventType) {
+	var (
+		assert = assert.New(t)
+
+		p         = xmetricstest.NewProvider(nil, Metrics)
+		started   = make(chan struct{}, 1)
+		gate      = make(chan struct{})
+		delivered []EventType
+
+		bus = NewEventBus(
+			&EventBusOptions{QueueSize: 1, Overflow: policy},
+			NewMeasures(p),
+			func(e *Event) {
+				delivered = append(delivered, e.Type)
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+
+				<-gate
+			},
+		)
+	)
+
+	bus.Dispatch(&Event{Type: Connect})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		assert.Fail("The listener was not invoked")
+	}
+
+	// the listener is now blocked with an empty queue
+	bus.Dispatch(&Event{Type: MessageSent})
+	bus.Dispatch(&Event{Type: MessageReceived})
+	bus.Dispatch(&Event{Type: Disconnect})
+	p.Assert(t, EventDroppedCounter, "listener", "0")(xmetricstest.Value(2.0))
+	p.Assert(t, EventQueueDepthGauge, "listener", "0")(xmetricstest.Value(1.0))
+
+	close(gate)
+	bus.Close()
+	assert.Equal(expected, delivered)
+}
+
+func testEventBusClose(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		p      = xmetricstest.NewProvider(nil, Metrics)
+
+		delivered []EventType
+		bus       = NewEventBus(&EventBusOptions{QueueSize: 10}, NewMeasures(p), func(e *Event) { delivered = append(delivered, e.Type) })
+	)
+
+	bus.Dispatch(&Event{Type: Connect})
+	bus.Dispatch(&Event{Type: MessageSent})
+
+	// close waits for queued events to be delivered
+	bus.Close()
+	assert.Equal([]EventType{Connect, MessageSent}, delivered)
+
+	bus.Dispatch(&Event{Type: Disconnect})
+	bus.Close()
+	assert.Equal([]EventType{Connect, MessageSent}, delivered)
+	p.Assert(t, EventDroppedCounter, "listener", "0")(xmetricstest.Value(1.0))
+}
+
+func TestEventBus(t *testing.T) {
+	t.Run("Dispatch", testEventBusDispatch)
+	t.Run("DropNewest", func(t *testing.T) {
+		testEventBusOverflow(t, OverflowDropNewest, []EventType{Connect, MessageSent})
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		testEventBusOverflow(t, OverflowDropOldest, []EventType{Connect, Disconnect})
+	})
+
+	t.Run("Close", testEventBusClose)
+}
+
+func TestManagerEventBus(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		gate     = make(chan struct{})
+		listener = newSessionTestListener()
+		options  = &Options{
+			Logger:   logging.NewTestLogger(nil, t),
+			EventBus: EventBusOptions{QueueSize: 100},
+			Listeners: []Listener{
+				func(*Event) { <-gate },
+				listener.OnDeviceEvent,
+			},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	// with synchronous dispatch, the blocked listener would stall the connection itself
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	_, err = manager.Route(&Request{
+		Message: &wrp.SimpleEvent{Source: "test", Destination: string(testDeviceIDs[0])},
+		Format:  wrp.Msgpack,
+	})
+
+	assert.NoError(err)
+	readTestMessage(require, connection)
+
+	require.NoError(connection.WriteMessage(
+		websocket.BinaryMessage,
+		wrp.MustEncode(&wrp.SimpleEvent{Source: string(testDeviceIDs[0]), Destination: "event:test"}, wrp.Msgpack),
+	))
+
+	require.NoError(connection.Close())
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	close(gate)
+
+	assert.Equal(1, listener.count(MessageSent))
+	assert.Equal(1, listener.count(MessageReceived))
+}
+
+func TestManagerClose(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		p      = xmetricstest.NewProvider(nil, Metrics)
+
+		gate      = make(chan struct{})
+		delivered = make(chan EventType, 10)
+
+		m = NewManager(&Options{
+			EventBus:        EventBusOptions{QueueSize: 10},
+			MetricsProvider: p,
+			Listeners: []Listener{
+				func(e *Event) {
+					<-gate
+					delivered <- e.Type
+				},
+			},
+		}).(*manager)
+	)
+
+	m.dispatch(&Event{Type: Connect})
+	m.dispatch(&Event{Type: Disconnect})
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		m.Close()
+	}()
+
+	// close must wait on the events already queued
+	select {
+	case <-closed:
+		assert.Fail("Close returned before queued events were delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gate)
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		assert.Fail("Close did not return")
+	}
+
+	assert.Equal(Connect, <-delivered)
+	assert.Equal(Disconnect, <-delivered)
+
+	m.dispatch(&Event{Type: Connect})
+	m.Close()
+	assert.Empty(delivered)
+	p.Assert(t, EventDroppedCounter, "listener", "0")(xmetricstest.Value(1.0))
+
+	// without an event bus, there is nothing to shut down
+	closer, ok := NewManager(nil).(Closer)
+	if assert.True(ok) {
+		closer.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package eventrouter
+
+import (
+	"github.com/Comcast/webpa-common/xmetrics"
+)
+
+const (
+	EventRouterMatchedCounter   = "event_router_matched_count"
+	EventRouterDeliveredCounter = "event_router_delivered_count"
+	EventRouterFailedCounter    = "event_router_failed_count"
+	EventRouterDroppedCounter   = "event_router_dropped_count"
+	EventRouterRetryCounter     = "event_router_retry_count"
+
+	// RuleLabel is the label identifying the Rule for each event router metric
+	RuleLabel = "rule"
+)
+
+// Metrics is the event router module function that adds default event router metrics
+func Metrics() []xmetrics.Metric {
+	return []xmetrics.Metric{
+		{
+			Name:       EventRouterMatchedCounter,
+			Type:       "counter",
+			LabelNames: []string{RuleLabel},
+		},
+		{
+			Name:       EventRouterDeliveredCounter,
+			Type:       "counter",
+			LabelNames: []string{RuleLabel},
+		},
+		{
+			Name:       EventRouterFailedCounter,
+			Type:       "counter",
+			LabelNames: []string{RuleLabel},
+		},
+		{
+			Name:       EventRouterDroppedCounter,
+			Type:       "counter",
+			LabelNames: []string{RuleLabel},
+		},
+		{
+			Name:       EventRouterRetryCounter,
+			Type:       "counter",
+			LabelNames: []string{RuleLabel},
+		},
+	}
+}
@@ -0,0 +1,330 @@
+package eventrouter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics/provider"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/httppool"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/wrp/wrpmeta"
+)
+
+const (
+	DefaultWorkers       = 2
+	DefaultQueueSize     = 1000
+	DefaultRetryInterval = time.Second
+)
+
+// HTTPClient is the behavior required to deliver messages upstream.  *http.Client implements this interface.
+type HTTPClient interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Option is a configuration option for a Router
+type Option func(*Router)
+
+// WithLogger configures a Router with a logger, using the default logger if l is nil.
+func WithLogger(l log.Logger) Option {
+	return func(r *Router) {
+		if l == nil {
+			r.logger = logging.DefaultLogger()
+		} else {
+			r.logger = l
+		}
+	}
+}
+
+// WithRules appends routing rules.  Each message is delivered once for every rule it matches.
+func WithRules(rules ...Rule) Option {
+	return func(r *Router) {
+		r.rules = append(r.rules, rules...)
+	}
+}
+
+// WithHTTPClient configures the client used to deliver messages.  If c is nil, http.DefaultClient is used.
+func WithHTTPClient(c HTTPClient) Option {
+	return func(r *Router) {
+		if c == nil {
+			r.client = http.DefaultClient
+		} else {
+			r.client = c
+		}
+	}
+}
+
+// WithQueue configures the queue each destination URL gets.  Nonpositive values are replaced with
+// DefaultWorkers and DefaultQueueSize.  Messages are dropped when a destination's queue is full.
+func WithQueue(workers, queueSize int) Option {
+	return func(r *Router) {
+		if workers > 0 {
+			r.workers = workers
+		} else {
+			r.workers = DefaultWorkers
+		}
+
+		if queueSize > 0 {
+			r.queueSize = queueSize
+		} else {
+			r.queueSize = DefaultQueueSize
+		}
+	}
+}
+
+// WithRetries configures how many times a failed delivery is retried, and how long to wait between attempts.
+// A delivery fails if the request cannot be sent, or if the response has a 5xx or 429 status.  By default,
+// deliveries are not retried.
+func WithRetries(retries int, interval time.Duration) Option {
+	return func(r *Router) {
+		r.retries = retries
+		if interval > 0 {
+			r.retryInterval = interval
+		} else {
+			r.retryInterval = DefaultRetryInterval
+		}
+	}
+}
+
+// WithConveyMetadata configures the convey fields copied into the metadata of each routed message
+func WithConveyMetadata(fields ...wrpmeta.Field) Option {
+	return func(r *Router) {
+		r.conveyFields = append(r.conveyFields, fields...)
+	}
+}
+
+// WithFormat configures the format in which messages are delivered.  The default is wrp.Msgpack.
+func WithFormat(f wrp.Format) Option {
+	return func(r *Router) {
+		r.format = f
+	}
+}
+
+// WithMetricsProvider configures the metrics subsystem for per-rule metrics.
+// A nil provider passed to this option means to discard all metrics.
+func WithMetricsProvider(p provider.Provider) Option {
+	return func(r *Router) {
+		if p == nil {
+			r.provider = provider.NewDiscardProvider()
+		} else {
+			r.provider = p
+		}
+	}
+}
+
+// Router routes device-originated events to upstream HTTP endpoints.  Its OnDeviceEvent method is a device.Listener.
+//
+// Each received message is matched against the Router's rules.  A matching message is enriched with the device's
+// partner IDs and any configured convey metadata, then POSTed to each of the rule's URLs.  Every URL has its own
+// httppool queue, so that a slow endpoint cannot hold up delivery to any other.
+type Router struct {
+	logger        log.Logger
+	rules         []Rule
+	client        HTTPClient
+	workers       int
+	queueSize     int
+	retries       int
+	retryInterval time.Duration
+	conveyFields  []wrpmeta.Field
+	format        wrp.Format
+	provider      provider.Provider
+
+	compiled    []*rule
+	dispatchers map[string]httppool.DispatchCloser
+	shutdown    chan struct{}
+	closeOnce   sync.Once
+}
+
+// New creates and starts a Router.  An error is returned if any rule is invalid.
+func New(options ...Option) (*Router, error) {
+	r := &Router{
+		logger:        logging.DefaultLogger(),
+		client:        http.DefaultClient,
+		workers:       DefaultWorkers,
+		queueSize:     DefaultQueueSize,
+		retryInterval: DefaultRetryInterval,
+		format:        wrp.Msgpack,
+		provider:      provider.NewDiscardProvider(),
+		dispatchers:   make(map[string]httppool.DispatchCloser),
+		shutdown:      make(chan struct{}),
+	}
+
+	for _, o := range options {
+		o(r)
+	}
+
+	for _, rr := range r.rules {
+		compiled, err := newRule(rr, r.provider)
+		if err != nil {
+			return nil, err
+		}
+
+		r.compiled = append(r.compiled, compiled)
+	}
+
+	for _, compiled := range r.compiled {
+		for _, url := range compiled.URLs {
+			if _, ok := r.dispatchers[url]; ok {
+				continue
+			}
+
+			r.dispatchers[url] = (&httppool.Client{
+				Name:      url,
+				Handler:   &deliveryHandler{router: r},
+				Logger:    r.logger,
+				QueueSize: r.queueSize,
+				Workers:   r.workers,
+			}).Start()
+		}
+	}
+
+	return r, nil
+}
+
+// Close stops delivering messages.  Queued messages are abandoned, and any retries are cancelled.
+// This method is idempotent.
+func (r *Router) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.shutdown)
+		for _, d := range r.dispatchers {
+			d.Close()
+		}
+	})
+
+	return nil
+}
+
+// OnDeviceEvent is a device.Listener that routes the events received from devices
+func (r *Router) OnDeviceEvent(e *device.Event) {
+	if e.Type != device.MessageReceived {
+		return
+	}
+
+	message, ok := e.Message.(*wrp.Message)
+	if !ok || message.Type != wrp.SimpleEventMessageType {
+		return
+	}
+
+	var contents []byte
+	for _, compiled := range r.compiled {
+		if !compiled.matches(message) {
+			continue
+		}
+
+		compiled.matched.Add(1.0)
+		if contents == nil {
+			var err error
+			if contents, err = r.encode(e.Device, message); err != nil {
+				r.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to encode routed message", "id", e.Device.ID(), logging.ErrorKey(), err)
+				return
+			}
+		}
+
+		for _, url := range compiled.URLs {
+			taken, err := r.dispatchers[url].Offer(r.newTask(compiled, url, e.Device.ID(), contents))
+			if !taken {
+				compiled.dropped.Add(1.0)
+				r.logger.Log(level.Key(), level.WarnValue(), logging.MessageKey(), "dropped routed message", "rule", compiled.Name, "url", url, logging.ErrorKey(), err)
+			}
+		}
+	}
+}
+
+// encode produces the enriched, encoded form of a device's message.  Since the event's message cannot be
+// modified or retained, enrichment is done on a copy.
+func (r *Router) encode(d device.Interface, message *wrp.Message) ([]byte, error) {
+	enriched := *message
+	if len(enriched.Source) == 0 {
+		enriched.Source = string(d.ID())
+	}
+
+	if len(enriched.PartnerIDs) == 0 {
+		enriched.PartnerIDs = d.PartnerIDs()
+	}
+
+	if len(r.conveyFields) > 0 {
+		enriched.Metadata, _ = wrpmeta.NewBuilder().
+			Add(message.Metadata, true).
+			Apply(d.Convey(), r.conveyFields...).
+			Build()
+	}
+
+	var contents []byte
+	err := wrp.NewEncoderBytes(&contents, r.format).Encode(&enriched)
+	return contents, err
+}
+
+// ruleContextKey is the request context key for the rule a delivery is made on behalf of
+type ruleContextKey struct{}
+
+func (r *Router) newTask(compiled *rule, url string, id device.ID, contents []byte) httppool.Task {
+	return func() (*http.Request, httppool.Consumer, error) {
+		request, err := http.NewRequest("POST", url, bytes.NewReader(contents))
+		if err != nil {
+			compiled.failed.Add(1.0)
+			return nil, nil, err
+		}
+
+		request.Header.Set("Content-Type", r.format.ContentType())
+		request.Header.Set(device.DeviceNameHeader, string(id))
+		return request.WithContext(context.WithValue(request.Context(), ruleContextKey{}, compiled)), nil, nil
+	}
+}
+
+// deliveryHandler is the httppool handler for a Router's deliveries.  It retries failed deliveries
+// and records the outcome of each against the rule it was made for.
+type deliveryHandler struct {
+	router *Router
+}
+
+func retryable(response *http.Response, err error) bool {
+	return err != nil || response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+}
+
+func (dh *deliveryHandler) Do(request *http.Request) (*http.Response, error) {
+	compiled := request.Context().Value(ruleContextKey{}).(*rule)
+	for attempt := 0; ; attempt++ {
+		response, err := dh.router.client.Do(request)
+		if !retryable(response, err) {
+			if response.StatusCode < 300 {
+				compiled.delivered.Add(1.0)
+			} else {
+				compiled.failed.Add(1.0)
+			}
+
+			return response, nil
+		}
+
+		if attempt >= dh.router.retries {
+			compiled.failed.Add(1.0)
+			return response, err
+		}
+
+		if response != nil {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		select {
+		case <-dh.router.shutdown:
+			compiled.failed.Add(1.0)
+			return nil, httppool.ErrorClosed
+		case <-time.After(dh.router.retryInterval):
+		}
+
+		compiled.retried.Add(1.0)
+		if request.Body, err = request.GetBody(); err != nil {
+			compiled.failed.Add(1.0)
+			return nil, err
+		}
+	}
+}
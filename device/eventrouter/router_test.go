@@ -0,0 +1,287 @@
+package eventrouter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Comcast/webpa-common/convey"
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/wrp/wrpmeta"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+)
+
+// delivery is a message received by a test endpoint
+type delivery struct {
+	header  http.Header
+	message wrp.Message
+}
+
+// startEndpoint starts a test endpoint which decodes each routed message.  The status function
+// returns the response code for each request, numbered from zero.
+func startEndpoint(t *testing.T, status func(int) int) (*httptest.Server, <-chan delivery) {
+	var (
+		deliveries = make(chan delivery, 10)
+		requests   int32
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		var d delivery
+		d.header = request.Header
+		body, err := ioutil.ReadAll(request.Body)
+		if assert.NoError(t, err) && assert.NoError(t, wrp.NewDecoderBytes(body, wrp.Msgpack).Decode(&d.message)) {
+			deliveries <- d
+		}
+
+		response.WriteHeader(status(int(atomic.AddInt32(&requests, 1) - 1)))
+	}))
+
+	return server, deliveries
+}
+
+func awaitDelivery(t *testing.T, deliveries <-chan delivery) (delivery, bool) {
+	select {
+	case d := <-deliveries:
+		return d, true
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "No message was delivered")
+		return delivery{}, false
+	}
+}
+
+type silentT struct{}
+
+func (silentT) Errorf(string, ...interface{}) {}
+
+// awaitCounter waits for an asynchronously updated rule counter to reach the expected value
+func awaitCounter(t *testing.T, p xmetricstest.Provider, name, rule string, expected float64) bool {
+	timeout := time.After(5 * time.Second)
+	for !p.Assert(silentT{}, name, RuleLabel, rule)(xmetricstest.Value(expected)) {
+		select {
+		case <-timeout:
+			return p.Assert(t, name, RuleLabel, rule)(xmetricstest.Value(expected))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	return true
+}
+
+func newTestDevice() *device.MockDevice {
+	d := new(device.MockDevice)
+	d.On("ID").Return(device.ID("mac:112233445566"))
+	d.On("PartnerIDs").Return([]string{"comcast"})
+	d.On("Convey").Return(convey.C{"hw-model": "XB3", "fw-name": "firmware"})
+	return d
+}
+
+func TestNewInvalidRule(t *testing.T) {
+	assert := assert.New(t)
+	r, err := New(WithRules(Rule{Name: "invalid"}))
+	assert.Nil(r)
+	assert.Equal(ErrorRuleNoURLs, err)
+}
+
+func testRouterRouting(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		p       = xmetricstest.NewProvider(nil, Metrics)
+
+		statusServer, statusDeliveries = startEndpoint(t, func(int) int { return http.StatusOK })
+		allServer, allDeliveries       = startEndpoint(t, func(int) int { return http.StatusAccepted })
+
+		d = newTestDevice()
+	)
+
+	defer statusServer.Close()
+	defer allServer.Close()
+
+	router, err := New(
+		WithLogger(logging.NewTestLogger(nil, t)),
+		WithMetricsProvider(p),
+		WithConveyMetadata(wrpmeta.Field{From: "hw-model", To: "/hw-model"}, wrpmeta.Field{From: "nosuch"}),
+		WithRules(
+			Rule{Name: "status", Events: []string{"device-status"}, URLs: []string{statusServer.URL}},
+			Rule{Name: "all", URLs: []string{allServer.URL}},
+		),
+	)
+
+	require.NoError(err)
+	require.NotNil(router)
+	defer router.Close()
+
+	// none of these are routed
+	router.OnDeviceEvent(&device.Event{Type: device.Connect, Device: d})
+	router.OnDeviceEvent(&device.Event{
+		Type:    device.MessageReceived,
+		Device:  d,
+		Message: &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, Destination: "event:device-status"},
+	})
+
+	router.OnDeviceEvent(&device.Event{
+		Type:   device.MessageReceived,
+		Device: d,
+		Message: &wrp.Message{
+			Type:        wrp.SimpleEventMessageType,
+			Destination: "event:device-status/mac:112233445566/online",
+			Metadata:    map[string]string{"existing": "value"},
+			Payload:     []byte("online"),
+		},
+	})
+
+	router.OnDeviceEvent(&device.Event{
+		Type:   device.MessageReceived,
+		Device: d,
+		Message: &wrp.Message{
+			Type:        wrp.SimpleEventMessageType,
+			Source:      "mac:112233445566/iot",
+			Destination: "event:iot",
+			PartnerIDs:  []string{"partner"},
+		},
+	})
+
+	if routed, ok := awaitDelivery(t, statusDeliveries); ok {
+		assert.Equal(wrp.Msgpack.ContentType(), routed.header.Get("Content-Type"))
+		assert.Equal("mac:112233445566", routed.header.Get(device.DeviceNameHeader))
+		assert.Equal("mac:112233445566", routed.message.Source)
+		assert.Equal("event:device-status/mac:112233445566/online", routed.message.Destination)
+		assert.Equal([]string{"comcast"}, routed.message.PartnerIDs)
+		assert.Equal(map[string]string{"existing": "value", "/hw-model": "XB3"}, routed.message.Metadata)
+		assert.Equal([]byte("online"), routed.message.Payload)
+	}
+
+	destinations := make(map[string]wrp.Message)
+	for i := 0; i < 2; i++ {
+		if routed, ok := awaitDelivery(t, allDeliveries); ok {
+			destinations[routed.message.Destination] = routed.message
+		}
+	}
+
+	require.Contains(destinations, "event:iot")
+	assert.Equal("mac:112233445566/iot", destinations["event:iot"].Source)
+	assert.Equal([]string{"partner"}, destinations["event:iot"].PartnerIDs)
+	assert.Equal(map[string]string{"/hw-model": "XB3"}, destinations["event:iot"].Metadata)
+	assert.Contains(destinations, "event:device-status/mac:112233445566/online")
+
+	assert.True(awaitCounter(t, p, EventRouterDeliveredCounter, "status", 1.0))
+	assert.True(awaitCounter(t, p, EventRouterDeliveredCounter, "all", 2.0))
+	p.Assert(t, EventRouterMatchedCounter, RuleLabel, "status")(xmetricstest.Value(1.0))
+	p.Assert(t, EventRouterMatchedCounter, RuleLabel, "all")(xmetricstest.Value(2.0))
+	p.Assert(t, EventRouterFailedCounter, RuleLabel, "all")(xmetricstest.Value(0.0))
+	p.Assert(t, EventRouterDroppedCounter, RuleLabel, "all")(xmetricstest.Value(0.0))
+
+	select {
+	case unexpected := <-statusDeliveries:
+		assert.Fail("Unexpected delivery", "%v", unexpected.message)
+	default:
+	}
+}
+
+func testRouterRetries(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		p       = xmetricstest.NewProvider(nil, Metrics)
+
+		flakyServer, flakyDeliveries = startEndpoint(t, func(i int) int {
+			if i < 2 {
+				return http.StatusServiceUnavailable
+			}
+
+			return http.StatusOK
+		})
+
+		brokenServer, brokenDeliveries = startEndpoint(t, func(int) int { return http.StatusInternalServerError })
+		rejectServer, rejectDeliveries = startEndpoint(t, func(int) int { return http.StatusBadRequest })
+
+		d = newTestDevice()
+	)
+
+	defer flakyServer.Close()
+	defer brokenServer.Close()
+	defer rejectServer.Close()
+
+	router, err := New(
+		WithLogger(logging.NewTestLogger(nil, t)),
+		WithMetricsProvider(p),
+		WithRetries(2, time.Millisecond),
+		WithRules(
+			Rule{Name: "flaky", URLs: []string{flakyServer.URL}},
+			Rule{Name: "broken", URLs: []string{brokenServer.URL}},
+			Rule{Name: "reject", URLs: []string{rejectServer.URL}},
+		),
+	)
+
+	require.NoError(err)
+	require.NotNil(router)
+	defer router.Close()
+
+	router.OnDeviceEvent(&device.Event{
+		Type:    device.MessageReceived,
+		Device:  d,
+		Message: &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:iot", Payload: []byte("retried")},
+	})
+
+	for i := 0; i < 3; i++ {
+		if routed, ok := awaitDelivery(t, flakyDeliveries); ok {
+			assert.Equal([]byte("retried"), routed.message.Payload, "every attempt must send the complete message")
+		}
+
+		awaitDelivery(t, brokenDeliveries)
+	}
+
+	awaitDelivery(t, rejectDeliveries)
+
+	assert.True(awaitCounter(t, p, EventRouterDeliveredCounter, "flaky", 1.0))
+	assert.True(awaitCounter(t, p, EventRouterFailedCounter, "broken", 1.0))
+	assert.True(awaitCounter(t, p, EventRouterFailedCounter, "reject", 1.0))
+	p.Assert(t, EventRouterRetryCounter, RuleLabel, "flaky")(xmetricstest.Value(2.0))
+	p.Assert(t, EventRouterFailedCounter, RuleLabel, "flaky")(xmetricstest.Value(0.0))
+	p.Assert(t, EventRouterRetryCounter, RuleLabel, "broken")(xmetricstest.Value(2.0))
+	p.Assert(t, EventRouterDeliveredCounter, RuleLabel, "broken")(xmetricstest.Value(0.0))
+	p.Assert(t, EventRouterRetryCounter, RuleLabel, "reject")(xmetricstest.Value(0.0))
+}
+
+func testRouterClosed(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		p       = xmetricstest.NewProvider(nil, Metrics)
+		d       = newTestDevice()
+	)
+
+	router, err := New(
+		WithLogger(logging.NewTestLogger(nil, t)),
+		WithMetricsProvider(p),
+		WithRules(Rule{Name: "closed", URLs: []string{"http://localhost:1"}}),
+	)
+
+	require.NoError(err)
+	require.NotNil(router)
+	assert.NoError(router.Close())
+	assert.NoError(router.Close())
+
+	router.OnDeviceEvent(&device.Event{
+		Type:    device.MessageReceived,
+		Device:  d,
+		Message: &wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:iot"},
+	})
+
+	p.Assert(t, EventRouterMatchedCounter, RuleLabel, "closed")(xmetricstest.Value(1.0))
+	p.Assert(t, EventRouterDroppedCounter, RuleLabel, "closed")(xmetricstest.Value(1.0))
+}
+
+func TestRouter(t *testing.T) {
+	t.Run("Routing", testRouterRouting)
+	t.Run("Retries", testRouterRetries)
+	t.Run("Closed", testRouterClosed)
+}
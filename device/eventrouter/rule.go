@@ -0,0 +1,125 @@
+package eventrouter
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+
+	"github.com/Comcast/webpa-common/event"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/provider"
+)
+
+// EventPrefix is the scheme of WRP destinations that name events, e.g. event:device-status/mac:112233445566/online
+const EventPrefix = "event:"
+
+var (
+	ErrorRuleNoName = errors.New("A rule must have a name")
+	ErrorRuleNoURLs = errors.New("A rule must have at least one URL")
+)
+
+// EventName extracts the event name from a WRP destination.  For example, the event name of
+// event:device-status/mac:112233445566/online is device-status.  If the destination is not
+// an event locator, this function returns false.
+func EventName(destination string) (string, bool) {
+	l, err := wrp.ParseLocator(destination)
+	if err != nil || l.Scheme != wrp.SchemeEvent {
+		return "", false
+	}
+
+	return l.Authority, true
+}
+
+// Rule describes which device-originated messages are routed to which upstream HTTP endpoints
+type Rule struct {
+	// Name identifies this rule in logs and metrics.  This field is required.
+	Name string
+
+	// Destination is an optional regular expression which a message's WRP destination must match
+	Destination string
+
+	// Events is the optional set of event names, as returned by EventName, which a message must have
+	Events []string
+
+	// URLs are the endpoints which receive each matching message.  At least one URL is required.
+	URLs []string
+}
+
+// RulesFromMultiMap creates one Rule for each event type in an event.MultiMap, which routes that event
+// to the URLs it is mapped to.  The returned rules are named for their events, and are in event order.
+func RulesFromMultiMap(m event.MultiMap) []Rule {
+	rules := make([]Rule, 0, len(m))
+	for eventType, urls := range m {
+		rules = append(rules, Rule{
+			Name:   eventType,
+			Events: []string{eventType},
+			URLs:   urls,
+		})
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// rule is the compiled, instrumented form of a Rule
+type rule struct {
+	Rule
+	destination *regexp.Regexp
+	events      map[string]bool
+
+	matched   metrics.Counter
+	delivered metrics.Counter
+	failed    metrics.Counter
+	dropped   metrics.Counter
+	retried   metrics.Counter
+}
+
+func newRule(r Rule, p provider.Provider) (*rule, error) {
+	if len(r.Name) == 0 {
+		return nil, ErrorRuleNoName
+	}
+
+	if len(r.URLs) == 0 {
+		return nil, ErrorRuleNoURLs
+	}
+
+	compiled := &rule{
+		Rule:      r,
+		matched:   p.NewCounter(EventRouterMatchedCounter).With(RuleLabel, r.Name),
+		delivered: p.NewCounter(EventRouterDeliveredCounter).With(RuleLabel, r.Name),
+		failed:    p.NewCounter(EventRouterFailedCounter).With(RuleLabel, r.Name),
+		dropped:   p.NewCounter(EventRouterDroppedCounter).With(RuleLabel, r.Name),
+		retried:   p.NewCounter(EventRouterRetryCounter).With(RuleLabel, r.Name),
+	}
+
+	if len(r.Destination) > 0 {
+		var err error
+		if compiled.destination, err = regexp.Compile(r.Destination); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.Events) > 0 {
+		compiled.events = make(map[string]bool, len(r.Events))
+		for _, e := range r.Events {
+			compiled.events[e] = true
+		}
+	}
+
+	return compiled, nil
+}
+
+// matches tests if the given message should be routed by this rule
+func (r *rule) matches(m *wrp.Message) bool {
+	if r.destination != nil && !r.destination.MatchString(m.Destination) {
+		return false
+	}
+
+	if r.events != nil {
+		name, ok := EventName(m.Destination)
+		return ok && r.events[name]
+	}
+
+	return true
+}
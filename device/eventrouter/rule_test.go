@@ -0,0 +1,111 @@
+package eventrouter
+
+import (
+	"testing"
+
+	"github.com/Comcast/webpa-common/event"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/go-kit/kit/metrics/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventName(t *testing.T) {
+	testData := []struct {
+		destination  string
+		expectedName string
+		expectedOK   bool
+	}{
+		{"event:device-status/mac:112233445566/online", "device-status", true},
+		{"event:iot", "iot", true},
+		{"event:", "", false},
+		{"event:/foo", "", false},
+		{"mac:112233445566/config", "", false},
+		{"", "", false},
+	}
+
+	for _, record := range testData {
+		t.Run(record.destination, func(t *testing.T) {
+			name, ok := EventName(record.destination)
+			assert.Equal(t, record.expectedName, name)
+			assert.Equal(t, record.expectedOK, ok)
+		})
+	}
+}
+
+func TestRulesFromMultiMap(t *testing.T) {
+	assert := assert.New(t)
+	assert.Empty(RulesFromMultiMap(event.MultiMap{}))
+	assert.Equal(
+		[]Rule{
+			{Name: "device-status", Events: []string{"device-status"}, URLs: []string{"http://a", "http://b"}},
+			{Name: "iot", Events: []string{"iot"}, URLs: []string{"http://c"}},
+		},
+		RulesFromMultiMap(event.MultiMap{
+			"iot":           []string{"http://c"},
+			"device-status": []string{"http://a", "http://b"},
+		}),
+	)
+}
+
+func testNewRuleInvalid(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		p      = provider.NewDiscardProvider()
+	)
+
+	r, err := newRule(Rule{URLs: []string{"http://a"}}, p)
+	assert.Nil(r)
+	assert.Equal(ErrorRuleNoName, err)
+
+	r, err = newRule(Rule{Name: "test"}, p)
+	assert.Nil(r)
+	assert.Equal(ErrorRuleNoURLs, err)
+
+	r, err = newRule(Rule{Name: "test", Destination: "(", URLs: []string{"http://a"}}, p)
+	assert.Nil(r)
+	assert.Error(err)
+}
+
+func testNewRuleMatches(t *testing.T) {
+	testData := []struct {
+		rule        Rule
+		destination string
+		expected    bool
+	}{
+		{Rule{}, "event:iot", true},
+		{Rule{}, "mac:112233445566/config", true},
+		{Rule{Events: []string{"iot", "device-status"}}, "event:iot", true},
+		{Rule{Events: []string{"iot", "device-status"}}, "event:device-status/mac:112233445566/online", true},
+		{Rule{Events: []string{"iot", "device-status"}}, "event:other", false},
+		{Rule{Events: []string{"iot"}}, "iot", false},
+		{Rule{Destination: "/online$"}, "event:device-status/mac:112233445566/online", true},
+		{Rule{Destination: "/online$"}, "event:device-status/mac:112233445566/offline", false},
+		{Rule{Destination: "^event:.*/mac:", Events: []string{"device-status"}}, "event:device-status/mac:112233445566/online", true},
+		{Rule{Destination: "^event:.*/mac:", Events: []string{"device-status"}}, "event:device-status/uuid:1234/online", false},
+	}
+
+	for i, record := range testData {
+		var (
+			assert  = assert.New(t)
+			require = require.New(t)
+		)
+
+		record.rule.Name = "test"
+		record.rule.URLs = []string{"http://a"}
+		r, err := newRule(record.rule, provider.NewDiscardProvider())
+		require.NoError(err)
+		require.NotNil(r)
+
+		assert.Equal(
+			record.expected,
+			r.matches(&wrp.Message{Type: wrp.SimpleEventMessageType, Destination: record.destination}),
+			"test %d: %s", i, record.destination,
+		)
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	t.Run("Invalid", testNewRuleInvalid)
+	t.Run("Matches", testNewRuleMatches)
+}
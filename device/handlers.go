@@ -2,10 +2,15 @@ package device
 
 import (
 	"bytes"
+	"container/heap"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Comcast/webpa-common/logging"
@@ -18,7 +23,49 @@ import (
 
 const (
 	DefaultMessageTimeout time.Duration = 2 * time.Minute
-	DefaultListRefresh    time.Duration = 10 * time.Second
+
+	// DefaultListRefresh was the default cache interval of a ListHandler.
+	//
+	// Deprecated: device lists are no longer cached.
+	DefaultListRefresh time.Duration = 10 * time.Second
+
+	// ListQueryParameter is the ListHandler request parameter containing an optional device Query
+	ListQueryParameter = "query"
+
+	// ListPrefixParameter is the ListHandler request parameter restricting the list to device IDs with a given prefix
+	ListPrefixParameter = "prefix"
+
+	// ListPartnerParameter is the ListHandler request parameter restricting the list to devices with a given partner ID
+	ListPartnerParameter = "partner"
+
+	// ListTrustParameter is the ListHandler request parameter restricting the list to devices with a given trust level
+	ListTrustParameter = "trust"
+
+	// ListFieldsParameter is the ListHandler request parameter containing a comma-separated list of the device
+	// fields to write.  Device IDs are always written.  If not supplied, the complete device JSON is written.
+	ListFieldsParameter = "fields"
+
+	// ListLimitParameter is the ListHandler request parameter containing the maximum number of devices to list
+	ListLimitParameter = "limit"
+
+	// ListCursorParameter is the ListHandler request parameter containing the cursor returned with the previous page
+	ListCursorParameter = "cursor"
+
+	// ListFormatParameter is the ListHandler request parameter selecting the output format
+	ListFormatParameter = "format"
+
+	// ListNextCursorHeader is the ListHandler response header containing the cursor for the next page of devices
+	ListNextCursorHeader = "X-Webpa-Device-List-Next"
+
+	ListFieldID         = "id"
+	ListFieldStatistics = "stats"
+	ListFieldConvey     = "convey"
+
+	ListFormatJSON   = "json"
+	ListFormatNDJSON = "ndjson"
+
+	// NDJSONContentType is the content type of newline-delimited JSON device lists
+	NDJSONContentType = "application/x-ndjson"
 )
 
 // Timeout returns an Alice-style constructor which enforces a timeout for all device request contexts.
@@ -114,6 +161,10 @@ type MessageHandler struct {
 
 	// Router is the device message Router to use.  This field is required.
 	Router Router
+
+	// Validator checks each decoded message before it is routed.  Invalid messages are rejected with
+	// a 400 response describing the problems.  If not set, messages are not validated.
+	Validator wrp.Validator
 }
 
 func (mh *MessageHandler) logger() log.Logger {
@@ -132,16 +183,28 @@ func (mh *MessageHandler) decodeRequest(httpRequest *http.Request) (deviceReques
 	}
 
 	deviceRequest, err = DecodeRequest(httpRequest.Body, format)
-	if err == nil {
-		deviceRequest = deviceRequest.WithContext(httpRequest.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	if mh.Validator != nil {
+		if err := mh.Validator.Validate(deviceRequest.Message.(*wrp.Message)); err != nil {
+			return nil, err
+		}
 	}
 
-	return
+	return deviceRequest.WithContext(httpRequest.Context()), nil
 }
 
 func (mh *MessageHandler) ServeHTTP(httpResponse http.ResponseWriter, httpRequest *http.Request) {
 	deviceRequest, err := mh.decodeRequest(httpRequest)
-	if err != nil {
+	if invalid, ok := err.(*wrp.ValidationError); ok {
+		mh.logger().Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "Invalid request message", logging.ErrorKey(), err)
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(httpResponse).Encode(invalid)
+		return
+	} else if err != nil {
 		mh.logger().Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "Unable to decode request", logging.ErrorKey(), err)
 		xhttp.WriteErrorf(
 			httpResponse,
@@ -180,6 +243,14 @@ func (mh *MessageHandler) ServeHTTP(httpResponse http.ResponseWriter, httpReques
 			code = http.StatusBadRequest
 		case ErrorTransactionAlreadyRegistered:
 			code = http.StatusBadRequest
+		case ErrorOfflineQueueFull:
+			code = http.StatusServiceUnavailable
+		case ErrorOfflineMessageTooLarge:
+			code = http.StatusRequestEntityTooLarge
+		case ErrorRateLimited:
+			code = http.StatusTooManyRequests
+		case ErrorUnauthorized:
+			code = http.StatusForbidden
 		}
 
 		mh.logger().Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "Could not process device request", logging.ErrorKey(), err, "code", code)
@@ -223,87 +294,324 @@ func (ch *ConnectHandler) ServeHTTP(response http.ResponseWriter, request *http.
 	}
 }
 
-// ListHandler is an HTTP handler which can take updated JSON device lists.
+// ListHandler is an HTTP handler which streams the list of connected devices.  Devices are snapshotted from the
+// Registry and then written one at a time, so that the complete list is never held in memory.
+//
+// The list may be filtered with ListQueryParameter, ListPrefixParameter, ListPartnerParameter, and ListTrustParameter,
+// and projected with ListFieldsParameter.  If ListLimitParameter is set, devices are listed in ID order one page at a time.
+// When more devices remain, the ListNextCursorHeader is set to the value of ListCursorParameter for the next page.
+// Output is a JSON document by default, or newline-delimited JSON if ListFormatParameter is ListFormatNDJSON.
 type ListHandler struct {
 	Logger   log.Logger
 	Registry Registry
-	Refresh  time.Duration
 
-	lock        sync.RWMutex
-	cacheExpiry time.Time
-	cache       bytes.Buffer
-	cacheBytes  []byte
+	// Refresh is no longer used, as device lists are streamed rather than cached.
+	//
+	// Deprecated: this field is ignored.
+	Refresh time.Duration
+}
 
-	now func() time.Time
+// listFields is a projection of the device fields written by a ListHandler
+type listFields struct {
+	statistics bool
+	convey     bool
 }
 
-func (lh *ListHandler) refresh() time.Duration {
-	if lh.Refresh < 1 {
-		return DefaultListRefresh
+func parseListFields(v string) (*listFields, error) {
+	f := new(listFields)
+	for _, field := range strings.Split(v, ",") {
+		switch strings.TrimSpace(field) {
+		case ListFieldID:
+		case ListFieldStatistics:
+			f.statistics = true
+		case ListFieldConvey:
+			f.convey = true
+		default:
+			return nil, fmt.Errorf("Invalid device list field: %s", field)
+		}
 	}
 
-	return lh.Refresh
+	return f, nil
 }
 
-func (lh *ListHandler) _now() time.Time {
-	if lh.now != nil {
-		return lh.now()
+// listRequest holds the parsed parameters of a device list request
+type listRequest struct {
+	query   *Query
+	prefix  string
+	partner string
+	trust   string
+	fields  *listFields
+	limit   int
+	cursor  ID
+	ndjson  bool
+}
+
+func parseListRequest(request *http.Request) (*listRequest, error) {
+	var (
+		values = request.URL.Query()
+		lr     = &listRequest{
+			prefix:  values.Get(ListPrefixParameter),
+			partner: values.Get(ListPartnerParameter),
+			trust:   values.Get(ListTrustParameter),
+			cursor:  ID(values.Get(ListCursorParameter)),
+		}
+
+		err error
+	)
+
+	if v := values.Get(ListQueryParameter); len(v) > 0 {
+		if lr.query, err = ParseQuery(v); err != nil {
+			return nil, err
+		}
 	}
 
-	return time.Now()
-}
+	if v := values.Get(ListFieldsParameter); len(v) > 0 {
+		if lr.fields, err = parseListFields(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := values.Get(ListLimitParameter); len(v) > 0 {
+		if lr.limit, err = strconv.Atoi(v); err != nil || lr.limit < 1 {
+			return nil, fmt.Errorf("Invalid device list limit: %s", v)
+		}
+	}
 
-// tryCache returns the currently cache JSON bytes along with a flag indicating expiry.
-// This method returns true if the cached JSON bytes have expired, false otherwise.
-func (lh *ListHandler) tryCache() ([]byte, bool) {
-	defer lh.lock.RUnlock()
-	lh.lock.RLock()
+	switch values.Get(ListFormatParameter) {
+	case "", ListFormatJSON:
+	case ListFormatNDJSON:
+		lr.ndjson = true
+	default:
+		return nil, fmt.Errorf("Invalid device list format: %s", values.Get(ListFormatParameter))
+	}
 
-	return lh.cacheBytes, lh.cacheExpiry.Before(lh._now())
+	return lr, nil
 }
 
-func (lh *ListHandler) updateCache() []byte {
-	defer lh.lock.Unlock()
-	lh.lock.Lock()
+// matches tests if a device passes all of this request's filters
+func (lr *listRequest) matches(d Interface) bool {
+	if len(lr.cursor) > 0 && d.ID() <= lr.cursor {
+		return false
+	}
 
-	if lh.cacheExpiry.Before(lh._now()) {
-		lh.cache.Reset()
-		lh.cache.WriteString(`{"devices":[`)
+	if len(lr.prefix) > 0 && !strings.HasPrefix(string(d.ID()), lr.prefix) {
+		return false
+	}
 
-		needsSeparator := false
-		lh.Registry.VisitAll(func(d Interface) bool {
-			if needsSeparator {
-				lh.cache.WriteString(`,`)
+	if len(lr.trust) > 0 && d.Trust() != lr.trust {
+		return false
+	}
+
+	if len(lr.partner) > 0 {
+		found := false
+		for _, partnerID := range d.PartnerIDs() {
+			if partnerID == lr.partner {
+				found = true
+				break
 			}
+		}
 
-			if data, err := d.MarshalJSON(); err != nil {
-				lh.cache.WriteString(
-					fmt.Sprintf(`{"id": "%s", "error": "%s"}`, d.ID(), err),
-				)
-			} else {
-				lh.cache.Write(data)
+		if !found {
+			return false
+		}
+	}
+
+	return lr.query == nil || lr.query.Matches(d)
+}
+
+// marshal produces the JSON for a single device, honoring this request's field projection
+func (lr *listRequest) marshal(d Interface) ([]byte, error) {
+	if lr.fields == nil {
+		return d.MarshalJSON()
+	}
+
+	id, err := json.Marshal(string(d.ID()))
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	fmt.Fprintf(&output, `{"id": %s`, id)
+	if lr.fields.statistics {
+		data, err := d.Statistics().MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&output, `, "pending": %d, "statistics": %s`, d.Pending(), data)
+	}
+
+	if lr.fields.convey {
+		data, err := json.Marshal(d.Convey())
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&output, `, "convey": %s`, data)
+	}
+
+	output.WriteString(`}`)
+	return output.Bytes(), nil
+}
+
+// listPage is a max-heap of devices by ID, used to retain the first page of devices in ID order
+type listPage []Interface
+
+func (lp listPage) Len() int {
+	return len(lp)
+}
+
+func (lp listPage) Less(i, j int) bool {
+	return lp[i].ID() > lp[j].ID()
+}
+
+func (lp listPage) Swap(i, j int) {
+	lp[i], lp[j] = lp[j], lp[i]
+}
+
+func (lp *listPage) Push(v interface{}) {
+	*lp = append(*lp, v.(Interface))
+}
+
+func (lp *listPage) Pop() interface{} {
+	last := len(*lp) - 1
+	v := (*lp)[last]
+	*lp = (*lp)[:last]
+	return v
+}
+
+// selectDevices snapshots the devices matching a list request.  Only references to the devices are retained.  If the
+// request has a limit, at most that many devices are returned in ID order, along with a flag indicating whether more remain.
+func (lh *ListHandler) selectDevices(lr *listRequest) ([]Interface, bool) {
+	if lr.limit < 1 {
+		var devices []Interface
+		lh.Registry.VisitAll(func(d Interface) bool {
+			if lr.matches(d) {
+				devices = append(devices, d)
 			}
 
-			needsSeparator = true
 			return true
 		})
 
-		lh.cache.WriteString(`]}`)
-		lh.cacheBytes = lh.cache.Bytes()
-		lh.cacheExpiry = lh._now().Add(lh.refresh())
+		return devices, false
 	}
 
-	return lh.cacheBytes
+	var (
+		page = make(listPage, 0, lr.limit)
+		more = false
+	)
+
+	lh.Registry.VisitAll(func(d Interface) bool {
+		if !lr.matches(d) {
+			return true
+		}
+
+		if len(page) < lr.limit {
+			heap.Push(&page, d)
+		} else {
+			more = true
+			if d.ID() < page[0].ID() {
+				page[0] = d
+				heap.Fix(&page, 0)
+			}
+		}
+
+		return true
+	})
+
+	sort.Slice(page, func(i, j int) bool { return page[i].ID() < page[j].ID() })
+	return page, more
 }
 
+// writeDevices streams the given devices as either a JSON document or newline-delimited JSON.  Writing
+// stops at the first error, which usually means the client has gone away.
+func (lh *ListHandler) writeDevices(output io.Writer, lr *listRequest, devices []Interface, next ID) error {
+	var (
+		buffer    bytes.Buffer
+		separator = ","
+	)
+
+	if lr.ndjson {
+		separator = "\n"
+	} else {
+		buffer.WriteString(`{"devices":[`)
+	}
+
+	for i, d := range devices {
+		if i > 0 {
+			buffer.WriteString(separator)
+		}
+
+		if data, err := lr.marshal(d); err != nil {
+			data, _ = json.Marshal(struct {
+				ID    string `json:"id"`
+				Error string `json:"error"`
+			}{string(d.ID()), err.Error()})
+
+			buffer.Write(data)
+		} else {
+			buffer.Write(data)
+		}
+
+		if _, err := buffer.WriteTo(output); err != nil {
+			return err
+		}
+	}
+
+	if lr.ndjson {
+		if len(devices) > 0 {
+			buffer.WriteString("\n")
+		}
+	} else if len(next) > 0 {
+		data, err := json.Marshal(string(next))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&buffer, `],"next":%s}`, data)
+	} else {
+		buffer.WriteString(`]}`)
+	}
+
+	_, err := buffer.WriteTo(output)
+	return err
+}
+
+// ServeHTTP streams the list of devices matching the request's parameters.
 func (lh *ListHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	lh.Logger.Log(level.Key(), level.DebugValue(), "handler", "ListHandler", logging.MessageKey(), "ServeHTTP")
-	response.Header().Set("Content-Type", "application/json")
 
-	if cacheBytes, expired := lh.tryCache(); expired {
-		response.Write(lh.updateCache())
+	lr, err := parseListRequest(request)
+	if err != nil {
+		lh.Logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "invalid device list request", "query", request.URL.RawQuery, logging.ErrorKey(), err)
+		xhttp.WriteErrorf(
+			response,
+			http.StatusBadRequest,
+			"Invalid device list request: %s",
+			err,
+		)
+
+		return
+	}
+
+	var (
+		devices, more = lh.selectDevices(lr)
+		next          ID
+	)
+
+	if more {
+		next = devices[len(devices)-1].ID()
+		response.Header().Set(ListNextCursorHeader, string(next))
+	}
+
+	if lr.ndjson {
+		response.Header().Set("Content-Type", NDJSONContentType)
 	} else {
-		response.Write(cacheBytes)
+		response.Header().Set("Content-Type", "application/json")
+	}
+
+	if err := lh.writeDevices(response, lr, devices, next); err != nil {
+		lh.Logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to write device list", logging.ErrorKey(), err)
 	}
 }
 
@@ -8,9 +8,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Comcast/webpa-common/convey"
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/Comcast/webpa-common/wrp"
 	"github.com/gorilla/mux"
@@ -258,6 +261,35 @@ func testMessageHandlerServeHTTPDecodeError(t *testing.T) {
 	router.AssertExpectations(t)
 }
 
+func testMessageHandlerServeHTTPInvalidMessage(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		contents = wrp.MustEncode(&wrp.SimpleRequestResponse{Source: "dns:example.com", Destination: "mac:112233445566"}, wrp.Msgpack)
+		response = httptest.NewRecorder()
+		request  = httptest.NewRequest("POST", "/foo", bytes.NewReader(contents))
+
+		router  = new(mockRouter)
+		handler = MessageHandler{
+			Router:    router,
+			Validator: wrp.DefaultValidator(),
+		}
+
+		actualResponseBody struct {
+			Errors []wrp.FieldError `json:"errors"`
+		}
+	)
+
+	handler.ServeHTTP(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Equal("application/json", response.HeaderMap.Get("Content-Type"))
+	require.NoError(json.Unmarshal(response.Body.Bytes(), &actualResponseBody))
+	assert.Equal([]wrp.FieldError{{Field: "transaction_uuid", Reason: "is required"}}, actualResponseBody.Errors)
+
+	router.AssertExpectations(t)
+}
+
 func testMessageHandlerServeHTTPRouteError(t *testing.T, routeError error, expectedCode int) {
 	var (
 		assert  = assert.New(t)
@@ -504,6 +536,7 @@ func TestMessageHandler(t *testing.T) {
 
 	t.Run("ServeHTTP", func(t *testing.T) {
 		t.Run("DecodeError", testMessageHandlerServeHTTPDecodeError)
+		t.Run("InvalidMessage", testMessageHandlerServeHTTPInvalidMessage)
 		t.Run("EncodeError", testMessageHandlerServeHTTPEncodeError)
 
 		t.Run("RouteError", func(t *testing.T) {
@@ -512,6 +545,8 @@ func TestMessageHandler(t *testing.T) {
 			testMessageHandlerServeHTTPRouteError(t, ErrorNonUniqueID, http.StatusBadRequest)
 			testMessageHandlerServeHTTPRouteError(t, ErrorInvalidTransactionKey, http.StatusBadRequest)
 			testMessageHandlerServeHTTPRouteError(t, ErrorTransactionAlreadyRegistered, http.StatusBadRequest)
+			testMessageHandlerServeHTTPRouteError(t, ErrorRateLimited, http.StatusTooManyRequests)
+			testMessageHandlerServeHTTPRouteError(t, ErrorUnauthorized, http.StatusForbidden)
 			testMessageHandlerServeHTTPRouteError(t, errors.New("random error"), http.StatusGatewayTimeout)
 		})
 
@@ -587,20 +622,6 @@ func TestConnectHandler(t *testing.T) {
 	})
 }
 
-func testListHandlerRefresh(t *testing.T) {
-	var (
-		assert  = assert.New(t)
-		handler = ListHandler{
-			Logger: logging.NewTestLogger(nil, t),
-		}
-	)
-
-	assert.Equal(DefaultListRefresh, handler.refresh())
-
-	handler.Refresh = 67 * time.Minute
-	assert.Equal(67*time.Minute, handler.refresh())
-}
-
 func testListHandlerServeHTTP(t *testing.T) {
 	var (
 		assert              = assert.New(t)
@@ -635,8 +656,6 @@ func testListHandlerServeHTTP(t *testing.T) {
 		}).
 		Return(0).Once()
 
-	assert.True(handler.cacheExpiry.IsZero())
-
 	{
 		var (
 			request  = httptest.NewRequest("GET", "/", nil)
@@ -645,15 +664,12 @@ func testListHandlerServeHTTP(t *testing.T) {
 
 		handler.ServeHTTP(response, request)
 		assert.Equal(http.StatusOK, response.Code)
+		assert.Equal("application/json", response.HeaderMap.Get("Content-Type"))
+		assert.Empty(response.HeaderMap.Get(ListNextCursorHeader))
 
 		data, err := ioutil.ReadAll(response.Body)
 		require.NoError(err)
 		assert.JSONEq(`{"devices":[]}`, string(data))
-
-		assert.False(handler.cacheExpiry.IsZero())
-		cacheDuration := handler.cacheExpiry.Sub(time.Now())
-		assert.True(cacheDuration > 0)
-		assert.True(cacheDuration <= handler.refresh(), "The cache duration %s should be less than the refresh interval %s", cacheDuration, handler.refresh())
 	}
 
 	expectedJSON := bytes.NewBufferString(`{"devices":[`)
@@ -675,44 +691,368 @@ func testListHandlerServeHTTP(t *testing.T) {
 			response = httptest.NewRecorder()
 		)
 
-		handler.cacheExpiry = time.Time{}
+		// device lists are never cached, so this reflects the current devices
 		handler.ServeHTTP(response, request)
 		assert.Equal(http.StatusOK, response.Code)
 
 		data, err = ioutil.ReadAll(response.Body)
 		require.NoError(err)
 		assert.JSONEq(expectedJSON.String(), string(data))
+	}
+
+	registry.AssertExpectations(t)
+}
 
-		assert.False(handler.cacheExpiry.IsZero())
-		cacheDuration := handler.cacheExpiry.Sub(time.Now())
-		assert.True(cacheDuration > 0)
-		assert.True(cacheDuration <= handler.refresh(), "The cache duration %s should be less than the refresh interval %s", cacheDuration, handler.refresh())
+// listTestRegistry returns a MockRegistry which visits the given devices any number of times
+func listTestRegistry(devices ...Interface) *MockRegistry {
+	registry := new(MockRegistry)
+	registry.On("VisitAll", mock.MatchedBy(func(func(Interface) bool) bool { return true })).
+		Run(func(arguments mock.Arguments) {
+			visitor := arguments.Get(0).(func(Interface) bool)
+			for _, d := range devices {
+				if !visitor(d) {
+					break
+				}
+			}
+		}).
+		Return(len(devices))
+
+	return registry
+}
+
+// listTestDevices creates devices with fixed statistics for ListHandler tests
+func listTestDevices(t *testing.T, options ...deviceOptions) []Interface {
+	var (
+		logger  = logging.NewTestLogger(nil, t)
+		devices = make([]Interface, 0, len(options))
+	)
+
+	for _, o := range options {
+		o.QueueSize = 1
+		o.Logger = logger
+		d := newDevice(o)
+		d.statistics = NewStatistics(func() time.Time { return time.Unix(1000, 0) }, time.Unix(0, 0))
+		devices = append(devices, d)
+	}
+
+	return devices
+}
+
+// listTestIDs extracts the device IDs from a JSON device list
+func listTestIDs(t *testing.T, body []byte) (ids []string, next string) {
+	var output struct {
+		Devices []struct {
+			ID string `json:"id"`
+		} `json:"devices"`
+		Next string `json:"next"`
+	}
+
+	require.NoError(t, json.Unmarshal(body, &output))
+	for _, d := range output.Devices {
+		ids = append(ids, d.ID)
+	}
+
+	return ids, output.Next
+}
+
+func testListHandlerFilters(t *testing.T) {
+	var (
+		devices = listTestDevices(
+			t,
+			deviceOptions{ID: ID("mac:112233445566"), PartnerIDs: []string{"comcast"}, Trust: "1000"},
+			deviceOptions{ID: ID("mac:665544332211"), PartnerIDs: []string{"cox", "comcast"}},
+			deviceOptions{ID: ID("uuid:1234"), PartnerIDs: []string{"cox"}, Trust: "1000"},
+		)
+
+		handler = ListHandler{
+			Logger:   logging.NewTestLogger(nil, t),
+			Registry: listTestRegistry(devices...),
+		}
+	)
+
+	testData := []struct {
+		target      string
+		expectedIDs []string
+	}{
+		{"/?prefix=mac%3A", []string{"mac:112233445566", "mac:665544332211"}},
+		{"/?partner=cox", []string{"mac:665544332211", "uuid:1234"}},
+		{"/?trust=1000", []string{"mac:112233445566", "uuid:1234"}},
+		{"/?prefix=mac%3A&partner=cox", []string{"mac:665544332211"}},
+		{"/?partner=cox&query=id+%5E%3D+uuid%3A", []string{"uuid:1234"}},
+		{"/?partner=nosuch", nil},
+	}
+
+	for _, record := range testData {
+		t.Run(record.target, func(t *testing.T) {
+			var (
+				assert   = assert.New(t)
+				request  = httptest.NewRequest("GET", record.target, nil)
+				response = httptest.NewRecorder()
+			)
+
+			handler.ServeHTTP(response, request)
+			assert.Equal(http.StatusOK, response.Code)
+
+			ids, next := listTestIDs(t, response.Body.Bytes())
+			sort.Strings(ids)
+			assert.Equal(record.expectedIDs, ids)
+			assert.Empty(next)
+		})
+	}
+}
+
+func testListHandlerFields(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		devices = listTestDevices(
+			t,
+			deviceOptions{ID: ID("mac:112233445566"), C: convey.C{"hw-model": "XB3"}},
+		)
+
+		handler = ListHandler{
+			Logger:   logging.NewTestLogger(nil, t),
+			Registry: listTestRegistry(devices...),
+		}
+	)
+
+	{
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", "/?fields=id", nil))
+		assert.Equal(http.StatusOK, response.Code)
+		assert.JSONEq(`{"devices":[{"id": "mac:112233445566"}]}`, response.Body.String())
 	}
 
-	lastCacheExpiry := handler.cacheExpiry
+	{
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", "/?fields=convey", nil))
+		assert.Equal(http.StatusOK, response.Code)
+		assert.JSONEq(`{"devices":[{"id": "mac:112233445566", "convey": {"hw-model": "XB3"}}]}`, response.Body.String())
+	}
+
+	{
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", "/?fields=stats,convey", nil))
+		assert.Equal(http.StatusOK, response.Code)
+
+		statistics, err := devices[0].Statistics().MarshalJSON()
+		require.NoError(err)
+		assert.JSONEq(
+			`{"devices":[{"id": "mac:112233445566", "pending": 0, "statistics": `+string(statistics)+`, "convey": {"hw-model": "XB3"}}]}`,
+			response.Body.String(),
+		)
+	}
+}
+
+func testListHandlerPagination(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		devices = listTestDevices(
+			t,
+			deviceOptions{ID: ID("mac:000000000004")},
+			deviceOptions{ID: ID("mac:000000000001")},
+			deviceOptions{ID: ID("mac:000000000005")},
+			deviceOptions{ID: ID("mac:000000000003")},
+			deviceOptions{ID: ID("mac:000000000002")},
+		)
+
+		handler = ListHandler{
+			Logger:   logging.NewTestLogger(nil, t),
+			Registry: listTestRegistry(devices...),
+		}
+
+		pages  [][]string
+		cursor string
+	)
+
+	for {
+		target := "/?limit=2"
+		if len(cursor) > 0 {
+			target += "&cursor=" + cursor
+		}
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", target, nil))
+		require.Equal(http.StatusOK, response.Code)
+
+		ids, next := listTestIDs(t, response.Body.Bytes())
+		assert.Equal(next, response.HeaderMap.Get(ListNextCursorHeader))
+		pages = append(pages, ids)
+		if len(next) == 0 {
+			break
+		}
+
+		require.True(len(pages) < 5, "pagination did not terminate")
+		cursor = next
+	}
+
+	assert.Equal(
+		[][]string{
+			{"mac:000000000001", "mac:000000000002"},
+			{"mac:000000000003", "mac:000000000004"},
+			{"mac:000000000005"},
+		},
+		pages,
+	)
+}
+
+func testListHandlerNDJSON(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		devices = listTestDevices(
+			t,
+			deviceOptions{ID: ID("mac:000000000002")},
+			deviceOptions{ID: ID("mac:000000000001")},
+			deviceOptions{ID: ID("mac:000000000003")},
+		)
+
+		handler = ListHandler{
+			Logger:   logging.NewTestLogger(nil, t),
+			Registry: listTestRegistry(devices...),
+		}
+	)
+
+	{
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", "/?format=ndjson&fields=id&limit=2", nil))
+		assert.Equal(http.StatusOK, response.Code)
+		assert.Equal(NDJSONContentType, response.HeaderMap.Get("Content-Type"))
+		assert.Equal("mac:000000000002", response.HeaderMap.Get(ListNextCursorHeader))
+
+		lines := strings.Split(response.Body.String(), "\n")
+		require.Len(lines, 3)
+		assert.JSONEq(`{"id": "mac:000000000001"}`, lines[0])
+		assert.JSONEq(`{"id": "mac:000000000002"}`, lines[1])
+		assert.Empty(lines[2])
+	}
+
+	{
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest("GET", "/?format=ndjson&prefix=nosuch", nil))
+		assert.Equal(http.StatusOK, response.Code)
+		assert.Empty(response.Body.String())
+	}
+}
+
+// listTestMarshalError is a convey value whose JSON cannot be produced
+type listTestMarshalError struct{}
+
+func (listTestMarshalError) MarshalJSON() ([]byte, error) {
+	return nil, errors.New(`unable to marshal "value"`)
+}
+
+func testListHandlerEscaping(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		devices = listTestDevices(
+			t,
+			deviceOptions{ID: ID(`dns:"quoted"\name`), C: convey.C{"hw-model": "XB3"}},
+			deviceOptions{ID: ID(`dns:"broken"`), C: convey.C{"bad": listTestMarshalError{}}},
+		)
+
+		handler = ListHandler{Logger: logging.NewTestLogger(nil, t)}
+		lr      = &listRequest{fields: &listFields{convey: true}}
+		output  bytes.Buffer
+	)
+
+	require.NoError(handler.writeDevices(&output, lr, devices, ID(`dns:"next"`)))
+
+	var actual struct {
+		Devices []map[string]interface{} `json:"devices"`
+		Next    string                   `json:"next"`
+	}
+
+	require.NoError(json.Unmarshal(output.Bytes(), &actual), output.String())
+	require.Len(actual.Devices, 2)
+	assert.Equal(`dns:"quoted"\name`, actual.Devices[0]["id"])
+	assert.Equal(map[string]interface{}{"hw-model": "XB3"}, actual.Devices[0]["convey"])
+	assert.Equal(`dns:"broken"`, actual.Devices[1]["id"])
+	assert.Contains(actual.Devices[1]["error"], `unable to marshal "value"`)
+	assert.Equal(`dns:"next"`, actual.Next)
+}
+
+func testListHandlerBadRequest(t *testing.T) {
+	handler := ListHandler{
+		Logger:   logging.NewTestLogger(nil, t),
+		Registry: new(MockRegistry),
+	}
+
+	for _, target := range []string{"/?query=nosuch+%3D+foo", "/?fields=nosuch", "/?limit=0", "/?limit=abc", "/?format=xml"} {
+		t.Run(target, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest("GET", target, nil))
+			assert.Equal(t, http.StatusBadRequest, response.Code)
+		})
+	}
+}
+
+func testListHandlerQuery(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		registry = new(MockRegistry)
+		logger   = logging.NewTestLogger(nil, t)
+
+		firstDevice  = newDevice(deviceOptions{ID: ID("mac:112233445566"), QueueSize: 1, Logger: logger})
+		secondDevice = newDevice(deviceOptions{ID: ID("uuid:1234"), QueueSize: 1, Logger: logger})
+
+		handler = ListHandler{
+			Logger:   logger,
+			Registry: registry,
+		}
+	)
+
+	firstDevice.statistics = NewStatistics(func() time.Time { return time.Unix(1000, 0) }, time.Unix(0, 0))
+	secondDevice.statistics = NewStatistics(func() time.Time { return time.Unix(1000, 0) }, time.Unix(0, 0))
+
+	registry.On("VisitAll", mock.MatchedBy(func(func(Interface) bool) bool { return true })).
+		Run(func(arguments mock.Arguments) {
+			visitor := arguments.Get(0).(func(Interface) bool)
+			visitor(firstDevice)
+			visitor(secondDevice)
+		}).
+		Return(2).Once()
 
 	{
 		var (
-			request  = httptest.NewRequest("GET", "/", nil)
+			request  = httptest.NewRequest("GET", "/?query=id+%5E%3D+uuid%3A", nil)
 			response = httptest.NewRecorder()
 		)
 
-		// this should yield the cached bytes
 		handler.ServeHTTP(response, request)
 		assert.Equal(http.StatusOK, response.Code)
+		assert.Equal("application/json", response.HeaderMap.Get("Content-Type"))
 
-		data, err := ioutil.ReadAll(response.Body)
+		expected, err := secondDevice.MarshalJSON()
 		require.NoError(err)
-		assert.JSONEq(expectedJSON.String(), string(data))
-		assert.Equal(lastCacheExpiry, handler.cacheExpiry)
+		assert.JSONEq(`{"devices":[`+string(expected)+`]}`, response.Body.String())
+	}
+
+	{
+		var (
+			request  = httptest.NewRequest("GET", "/?query=nosuch+%3D+foo", nil)
+			response = httptest.NewRecorder()
+		)
+
+		handler.ServeHTTP(response, request)
+		assert.Equal(http.StatusBadRequest, response.Code)
 	}
 
 	registry.AssertExpectations(t)
 }
 
 func TestListHandler(t *testing.T) {
-	t.Run("Refresh", testListHandlerRefresh)
 	t.Run("ServeHTTP", testListHandlerServeHTTP)
+	t.Run("Query", testListHandlerQuery)
+	t.Run("Filters", testListHandlerFilters)
+	t.Run("Fields", testListHandlerFields)
+	t.Run("Pagination", testListHandlerPagination)
+	t.Run("NDJSON", testListHandlerNDJSON)
+	t.Run("Escaping", testListHandlerEscaping)
+	t.Run("BadRequest", testListHandlerBadRequest)
 }
 
 func testStatHandlerNoPathVariables(t *testing.T) {
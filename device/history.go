@@ -0,0 +1,401 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/convey"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// DefaultHistoryMaxRecords is the default capacity of a memory HistoryStore
+	DefaultHistoryMaxRecords = 10000
+
+	// DefaultHistoryMaxFileSize is the default size, in bytes, at which a file HistoryStore rotates its file
+	DefaultHistoryMaxFileSize int64 = 64 * 1024 * 1024
+
+	// HistoryLimitParameter is the optional HistoryHandler query parameter which limits the number of records returned
+	HistoryLimitParameter = "limit"
+)
+
+// HistoryRecord describes one completed connection of a device, from connect to disconnect
+type HistoryRecord struct {
+	ID               ID            `json:"id"`
+	ConnectedAt      time.Time     `json:"connectedAt"`
+	Duration         time.Duration `json:"duration"`
+	BytesSent        int           `json:"bytesSent"`
+	BytesReceived    int           `json:"bytesReceived"`
+	MessagesSent     int           `json:"messagesSent"`
+	MessagesReceived int           `json:"messagesReceived"`
+	Duplications     int           `json:"duplications"`
+	CloseReason      string        `json:"closeReason,omitempty"`
+	CloseError       string        `json:"closeError,omitempty"`
+	Convey           convey.C      `json:"convey,omitempty"`
+}
+
+// NewHistoryRecord captures the history of a device's connection.  This function is normally
+// invoked once the device has disconnected, so that its statistics and close reason are final.
+func NewHistoryRecord(d Interface) HistoryRecord {
+	var (
+		statistics  = d.Statistics()
+		closeReason = d.CloseReason()
+
+		record = HistoryRecord{
+			ID:               d.ID(),
+			ConnectedAt:      statistics.ConnectedAt(),
+			Duration:         statistics.UpTime(),
+			BytesSent:        statistics.BytesSent(),
+			BytesReceived:    statistics.BytesReceived(),
+			MessagesSent:     statistics.MessagesSent(),
+			MessagesReceived: statistics.MessagesReceived(),
+			Duplications:     statistics.Duplications(),
+			CloseReason:      closeReason.Text,
+		}
+	)
+
+	if closeReason.Err != nil {
+		record.CloseError = closeReason.Err.Error()
+	}
+
+	if c, ok := d.Convey().(convey.C); ok && len(c) > 0 {
+		record.Convey = make(convey.C, len(c))
+		for k, v := range c {
+			record.Convey[k] = v
+		}
+	}
+
+	return record
+}
+
+// HistoryStore is the storage strategy for device connection history.  Stores are bounded: once full,
+// the oldest records are discarded.
+//
+// Implementations must be safe for concurrent use.
+type HistoryStore interface {
+	// Append records a completed connection
+	Append(HistoryRecord) error
+
+	// Query returns the records held for a device, newest first.  If limit is positive, no more
+	// than limit records are returned.
+	Query(id ID, limit int) ([]HistoryRecord, error)
+}
+
+// historyMemoryStore is a HistoryStore that holds records in a fixed-size ring
+type historyMemoryStore struct {
+	lock    sync.RWMutex
+	records []HistoryRecord
+	next    int
+	full    bool
+}
+
+// NewHistoryMemoryStore creates a HistoryStore which holds the most recent maxRecords records, across all
+// devices, in memory.  If maxRecords is nonpositive, DefaultHistoryMaxRecords is used.
+func NewHistoryMemoryStore(maxRecords int) HistoryStore {
+	if maxRecords < 1 {
+		maxRecords = DefaultHistoryMaxRecords
+	}
+
+	return &historyMemoryStore{
+		records: make([]HistoryRecord, maxRecords),
+	}
+}
+
+func (s *historyMemoryStore) Append(r HistoryRecord) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	s.records[s.next] = r
+	s.next++
+	if s.next == len(s.records) {
+		s.next = 0
+		s.full = true
+	}
+
+	return nil
+}
+
+func (s *historyMemoryStore) Query(id ID, limit int) ([]HistoryRecord, error) {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	count := s.next
+	if s.full {
+		count = len(s.records)
+	}
+
+	var result []HistoryRecord
+	for i := 0; i < count && (limit < 1 || len(result) < limit); i++ {
+		// walk backwards from the most recently appended record
+		position := (s.next - 1 - i + len(s.records)) % len(s.records)
+		if s.records[position].ID == id {
+			result = append(result, s.records[position])
+		}
+	}
+
+	return result, nil
+}
+
+// historyFileStore is a HistoryStore that appends records, one JSON object per line, to a file.
+// When the file reaches its maximum size, it is rotated so that at most two files exist.
+type historyFileStore struct {
+	lock    sync.Mutex
+	logger  log.Logger
+	path    string
+	maxSize int64
+}
+
+// NewHistoryFileStore creates a HistoryStore which appends records to the given file.  When the file
+// grows beyond maxSize bytes, it is renamed with a ".1" suffix, replacing any previous rotated file, and a new file
+// is started.  If maxSize is nonpositive, DefaultHistoryMaxFileSize is used.  Records held by the returned
+// store survive a process restart.
+//
+// Lines which cannot be parsed, such as the remains of an interrupted write, are skipped and logged to the
+// given logger so that one damaged record does not hide the rest of a device's history.
+func NewHistoryFileStore(logger log.Logger, path string, maxSize int64) HistoryStore {
+	if logger == nil {
+		logger = logging.DefaultLogger()
+	}
+
+	if maxSize < 1 {
+		maxSize = DefaultHistoryMaxFileSize
+	}
+
+	return &historyFileStore{
+		logger:  logger,
+		path:    path,
+		maxSize: maxSize,
+	}
+}
+
+func (s *historyFileStore) rotatedPath() string {
+	return s.path + ".1"
+}
+
+func (s *historyFileStore) Append(r HistoryRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	if info, err := os.Stat(s.path); err == nil && info.Size()+int64(len(line)) > s.maxSize {
+		if err := os.Rename(s.path, s.rotatedPath()); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// open opens the rotated file and the current file, oldest first, skipping any that do not exist.  The files are
+// opened together under the lock, so that a concurrent rotation cannot cause records to be missed or read twice.
+// Once open, the files can be read without the lock, which leaves Append unblocked.
+func (s *historyFileStore) open() ([]*os.File, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	var files []*os.File
+	for _, path := range []string{s.rotatedPath(), s.path} {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// readFile visits the records for a device in a single file, oldest first.  Malformed lines are skipped.
+func (s *historyFileStore) readFile(file *os.File, id ID, f func(HistoryRecord)) error {
+	// records are written with encoding/json, which escapes more than strconv.Quote does
+	quoted, err := json.Marshal(string(id))
+	if err != nil {
+		return err
+	}
+
+	var (
+		reader = bufio.NewReader(file)
+		number = 0
+	)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial trailing line is the remains of a failed write, or a write in progress
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		number++
+
+		// avoid unmarshaling records which cannot possibly be for this device
+		if !bytes.Contains(line, quoted) {
+			continue
+		}
+
+		var record HistoryRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			s.logger.Log(level.Key(), level.WarnValue(), logging.MessageKey(), "skipping malformed device history record", "path", file.Name(), "line", number, logging.ErrorKey(), err)
+			continue
+		}
+
+		if record.ID == id {
+			f(record)
+		}
+	}
+}
+
+func (s *historyFileStore) Query(id ID, limit int) ([]HistoryRecord, error) {
+	files, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var records []HistoryRecord
+	for _, file := range files {
+		if err := s.readFile(file, id, func(r HistoryRecord) { records = append(records, r) }); err != nil {
+			return nil, err
+		}
+	}
+
+	// reverse, so that the newest records are first
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+
+	return records, nil
+}
+
+// NewHistoryListener produces a Listener which appends a HistoryRecord to the given store each time
+// a device disconnects.  Since a file store does I/O, it is best to register the returned listener
+// with an EventBus so that device goroutines are not blocked.  Errors from the store are logged.
+func NewHistoryListener(logger log.Logger, store HistoryStore) Listener {
+	if logger == nil {
+		logger = logging.DefaultLogger()
+	}
+
+	return func(e *Event) {
+		if e.Type != Disconnect || e.Device == nil {
+			return
+		}
+
+		record := NewHistoryRecord(e.Device)
+		if err := store.Append(record); err != nil {
+			logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to record device history", "id", record.ID, logging.ErrorKey(), err)
+		}
+	}
+}
+
+// HistoryHandler is an http.Handler that returns the connection history of a device as a JSON array, newest first.
+// The device name is specified as a gorilla path variable.  The optional HistoryLimitParameter query parameter
+// limits the number of records returned.
+type HistoryHandler struct {
+	Logger   log.Logger
+	Store    HistoryStore
+	Variable string
+}
+
+func (hh *HistoryHandler) logger() log.Logger {
+	if hh.Logger != nil {
+		return hh.Logger
+	}
+
+	return logging.DefaultLogger()
+}
+
+func (hh *HistoryHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	logger := hh.logger()
+	name, ok := mux.Vars(request)[hh.Variable]
+	if !ok {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "missing path variable", "variable", hh.Variable)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id, err := ParseID(name)
+	if err != nil {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to parse identifier", "deviceName", name, logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var limit int
+	if v := request.URL.Query().Get(HistoryLimitParameter); len(v) > 0 {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := hh.Store.Query(id, limit)
+	if err != nil {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to query device history", "deviceName", name, logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if records == nil {
+		records = []HistoryRecord{}
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to marshal device history as JSON", "deviceName", name, logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(data)
+}
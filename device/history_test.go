@@ -0,0 +1,341 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/convey"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHistoryRecord(id ID, connectedAt time.Time) HistoryRecord {
+	return HistoryRecord{
+		ID:               id,
+		ConnectedAt:      connectedAt,
+		Duration:         time.Hour,
+		BytesSent:        100,
+		BytesReceived:    200,
+		MessagesSent:     1,
+		MessagesReceived: 2,
+		CloseReason:      "read-error",
+		CloseError:       "connection reset",
+	}
+}
+
+func testHistoryStore(t *testing.T, s HistoryStore) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		id    = ID("mac:112233445566")
+		other = ID("mac:ffffffffffff")
+		start = time.Unix(1550000000, 0).UTC()
+	)
+
+	records, err := s.Query(id, 0)
+	assert.Empty(records)
+	assert.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(s.Append(newTestHistoryRecord(id, start.Add(time.Duration(i)*time.Minute))))
+		require.NoError(s.Append(newTestHistoryRecord(other, start)))
+	}
+
+	records, err = s.Query(id, 0)
+	require.NoError(err)
+	require.Len(records, 3)
+	for i, record := range records {
+		assert.Equal(newTestHistoryRecord(id, start.Add(time.Duration(2-i)*time.Minute)), record)
+	}
+
+	records, err = s.Query(id, 2)
+	require.NoError(err)
+	require.Len(records, 2)
+	assert.True(start.Add(2 * time.Minute).Equal(records[0].ConnectedAt))
+
+	records, err = s.Query(other, 0)
+	assert.Len(records, 3)
+	assert.NoError(err)
+}
+
+func TestHistoryMemoryStore(t *testing.T) {
+	t.Run("Store", func(t *testing.T) {
+		testHistoryStore(t, NewHistoryMemoryStore(0))
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		var (
+			assert = assert.New(t)
+			id     = ID("mac:112233445566")
+			start  = time.Unix(1550000000, 0).UTC()
+			s      = NewHistoryMemoryStore(3)
+		)
+
+		for i := 0; i < 5; i++ {
+			assert.NoError(s.Append(newTestHistoryRecord(id, start.Add(time.Duration(i)*time.Minute))))
+		}
+
+		records, err := s.Query(id, 0)
+		assert.NoError(err)
+		if assert.Len(records, 3) {
+			assert.Equal(start.Add(4*time.Minute), records[0].ConnectedAt)
+			assert.Equal(start.Add(2*time.Minute), records[2].ConnectedAt)
+		}
+	})
+}
+
+func TestHistoryFileStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "history")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	t.Run("Store", func(t *testing.T) {
+		testHistoryStore(t, NewHistoryFileStore(logging.NewTestLogger(nil, t), filepath.Join(directory, "store", "history.json"), 0))
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		var (
+			assert  = assert.New(t)
+			require = require.New(t)
+
+			id    = ID("mac:112233445566")
+			start = time.Unix(1550000000, 0).UTC()
+			path  = filepath.Join(directory, "rotate.json")
+
+			// room for roughly two records per file
+			s = NewHistoryFileStore(logging.NewTestLogger(nil, t), path, 500)
+		)
+
+		for i := 0; i < 6; i++ {
+			require.NoError(s.Append(newTestHistoryRecord(id, start.Add(time.Duration(i)*time.Minute))))
+		}
+
+		_, err := os.Stat(path + ".1")
+		assert.NoError(err)
+
+		// the oldest records were discarded along with the first rotated file
+		records, err := s.Query(id, 0)
+		require.NoError(err)
+		require.True(len(records) > 0 && len(records) < 6)
+		assert.Equal(start.Add(5*time.Minute), records[0].ConnectedAt)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		var (
+			assert  = assert.New(t)
+			require = require.New(t)
+
+			id    = ID("mac:112233445566")
+			start = time.Unix(1550000000, 0).UTC()
+			path  = filepath.Join(directory, "malformed.json")
+			s     = NewHistoryFileStore(logging.NewTestLogger(nil, t), path, 0)
+		)
+
+		first, err := json.Marshal(newTestHistoryRecord(id, start))
+		require.NoError(err)
+		second, err := json.Marshal(newTestHistoryRecord(id, start.Add(time.Minute)))
+		require.NoError(err)
+
+		// an interrupted write leaves a partial record in the middle of the file
+		var contents []byte
+		contents = append(contents, first...)
+		contents = append(contents, '\n')
+		contents = append(contents, `{"id":"mac:112233445566","connectedAt":`...)
+		contents = append(contents, '\n')
+		contents = append(contents, second...)
+		contents = append(contents, '\n')
+		require.NoError(ioutil.WriteFile(path, contents, 0644))
+		require.NoError(s.Append(newTestHistoryRecord(id, start.Add(2*time.Minute))))
+
+		records, err := s.Query(id, 0)
+		require.NoError(err)
+		require.Len(records, 3)
+		assert.Equal(start.Add(2*time.Minute), records[0].ConnectedAt)
+		assert.Equal(start.Add(time.Minute), records[1].ConnectedAt)
+		assert.Equal(start, records[2].ConnectedAt)
+	})
+
+	t.Run("EscapedID", func(t *testing.T) {
+		var (
+			assert  = assert.New(t)
+			require = require.New(t)
+
+			// encoding/json escapes these characters, e.g. < as \u003c
+			id    = ID("dns:<a>&b")
+			start = time.Unix(1550000000, 0).UTC()
+			s     = NewHistoryFileStore(logging.NewTestLogger(nil, t), filepath.Join(directory, "escaped.json"), 0)
+		)
+
+		require.NoError(s.Append(newTestHistoryRecord(id, start)))
+		require.NoError(s.Append(newTestHistoryRecord(ID("dns:other"), start)))
+
+		records, err := s.Query(id, 0)
+		require.NoError(err)
+		require.Len(records, 1)
+		assert.Equal(id, records[0].ID)
+	})
+}
+
+func TestNewHistoryRecord(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		connectedAt = time.Unix(1550000000, 0).UTC()
+		statistics  = NewStatistics(func() time.Time { return connectedAt.Add(time.Minute) }, connectedAt)
+		c           = convey.C{"fw-name": "test"}
+		d           = new(MockDevice)
+	)
+
+	statistics.AddBytesSent(10)
+	statistics.AddBytesReceived(20)
+	statistics.AddMessagesSent(1)
+	statistics.AddMessagesReceived(2)
+	statistics.AddDuplications(3)
+
+	d.On("ID").Return(ID("mac:112233445566"))
+	d.On("Statistics").Return(statistics)
+	d.On("CloseReason").Return(CloseReason{Err: errors.New("expected"), Text: "read-error"})
+	d.On("Convey").Return(c)
+
+	record := NewHistoryRecord(d)
+	assert.Equal(
+		HistoryRecord{
+			ID:               ID("mac:112233445566"),
+			ConnectedAt:      connectedAt,
+			Duration:         time.Minute,
+			BytesSent:        10,
+			BytesReceived:    20,
+			MessagesSent:     1,
+			MessagesReceived: 2,
+			Duplications:     3,
+			CloseReason:      "read-error",
+			CloseError:       "expected",
+			Convey:           convey.C{"fw-name": "test"},
+		},
+		record,
+	)
+
+	// the record does not share the device's convey map
+	c["fw-name"] = "changed"
+	assert.Equal("test", record.Convey["fw-name"])
+	d.AssertExpectations(t)
+}
+
+func TestNewHistoryListener(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		listener = newSessionTestListener()
+		store    = NewHistoryMemoryStore(10)
+		options  = &Options{
+			Logger:    logging.NewTestLogger(nil, t),
+			Listeners: []Listener{NewHistoryListener(logging.NewTestLogger(nil, t), store), listener.OnDeviceEvent},
+		}
+
+		_, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+		require.NoError(err)
+		awaitSessionEvent(assert, listener.connected, "connect")
+
+		require.NoError(connection.Close())
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}
+
+	records, err := store.Query(testDeviceIDs[0], 0)
+	require.NoError(err)
+	require.Len(records, 2)
+	for _, record := range records {
+		assert.Equal(testDeviceIDs[0], record.ID)
+		assert.NotEmpty(record.CloseReason)
+		assert.False(record.ConnectedAt.IsZero())
+	}
+
+	assert.False(records[0].ConnectedAt.Before(records[1].ConnectedAt))
+}
+
+type mockHistoryStore struct {
+	mock.Mock
+}
+
+func (m *mockHistoryStore) Append(r HistoryRecord) error {
+	return m.Called(r).Error(0)
+}
+
+func (m *mockHistoryStore) Query(id ID, limit int) ([]HistoryRecord, error) {
+	arguments := m.Called(id, limit)
+	first, _ := arguments.Get(0).([]HistoryRecord)
+	return first, arguments.Error(1)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	var (
+		id     = ID("mac:112233445566")
+		record = newTestHistoryRecord(id, time.Unix(1550000000, 0).UTC())
+	)
+
+	testData := []struct {
+		url          string
+		limit        int
+		records      []HistoryRecord
+		err          error
+		expectedCode int
+		expectedBody string
+	}{
+		{"/device/mac:112233445566/history", 0, []HistoryRecord{record}, nil, http.StatusOK, `[{"id": "mac:112233445566", "connectedAt": "2019-02-12T19:33:20Z", "duration": 3600000000000, "bytesSent": 100, "bytesReceived": 200, "messagesSent": 1, "messagesReceived": 2, "duplications": 0, "closeReason": "read-error", "closeError": "connection reset"}]`},
+		{"/device/mac:112233445566/history?limit=5", 5, nil, nil, http.StatusOK, `[]`},
+		{"/device/mac:112233445566/history?limit=-1", 0, nil, nil, http.StatusBadRequest, ""},
+		{"/device/mac:112233445566/history?limit=all", 0, nil, nil, http.StatusBadRequest, ""},
+		{"/device/notavaliddeviceid/history", 0, nil, nil, http.StatusBadRequest, ""},
+		{"/device/mac:112233445566/history", 0, nil, errors.New("expected"), http.StatusInternalServerError, ""},
+	}
+
+	for i, record := range testData {
+		t.Logf("%d: %s", i, record.url)
+
+		var (
+			assert  = assert.New(t)
+			store   = new(mockHistoryStore)
+			handler = &HistoryHandler{Logger: logging.NewTestLogger(nil, t), Store: store, Variable: "deviceID"}
+			router  = mux.NewRouter()
+
+			response = httptest.NewRecorder()
+		)
+
+		if record.expectedCode != http.StatusBadRequest {
+			store.On("Query", id, record.limit).Return(record.records, record.err).Once()
+		}
+
+		router.Handle("/device/{deviceID}/history", handler)
+		router.ServeHTTP(response, httptest.NewRequest("GET", record.url, nil))
+		assert.Equal(record.expectedCode, response.Code)
+		if len(record.expectedBody) > 0 {
+			assert.Equal("application/json", response.Header().Get("Content-Type"))
+			assert.JSONEq(record.expectedBody, response.Body.String())
+		}
+
+		store.AssertExpectations(t)
+	}
+
+	t.Run("NoPathVariable", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		(&HistoryHandler{Store: new(mockHistoryStore), Variable: "deviceID"}).ServeHTTP(response, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusInternalServerError, response.Code)
+	})
+}
@@ -3,9 +3,8 @@ package device
 import (
 	"fmt"
 	"net/http"
-	"regexp"
-	"strings"
-	"unicode"
+
+	"github.com/Comcast/webpa-common/wrp"
 )
 
 // ID represents a normalized identifer for a device.
@@ -16,22 +15,7 @@ func (id ID) Bytes() []byte {
 	return []byte(id)
 }
 
-const (
-	hexDigits     = "0123456789abcdefABCDEF"
-	macDelimiters = ":-.,"
-	macPrefix     = "mac"
-	macLength     = 12
-)
-
-var (
-	invalidID = ID("")
-
-	// idPattern is the precompiled regular expression that all device identifiers must match.
-	// Matching is partial, as everything after the service is ignored.
-	idPattern = regexp.MustCompile(
-		`^(?P<prefix>(?i)mac|uuid|dns|serial):(?P<id>[^/]+)(?P<service>/[^/]+)?`,
-	)
-)
+var invalidID = ID("")
 
 // IntToMAC accepts a 64-bit integer and formats that as a device MAC address identifier
 // The returned ID will be of the form mac:XXXXXXXXXXXX, where X is a hexadecimal digit using
@@ -40,41 +24,15 @@ func IntToMAC(value uint64) ID {
 	return ID(fmt.Sprintf("mac:%012x", value&0x0000FFFFFFFFFFFF))
 }
 
-// ParseID parses a raw device name into a canonicalized identifier.
+// ParseID parses a raw device name into a canonicalized identifier.  The device name may be any WRP locator
+// that identifies a device, so everything after the authority is ignored.  Event locators are not device names.
 func ParseID(deviceName string) (ID, error) {
-	match := idPattern.FindStringSubmatch(deviceName)
-	if match == nil {
+	l, err := wrp.ParseLocator(deviceName)
+	if err != nil || l.Scheme == wrp.SchemeEvent {
 		return invalidID, ErrorInvalidDeviceName
 	}
 
-	var (
-		prefix = strings.ToLower(match[1])
-		idPart = match[2]
-	)
-
-	if prefix == macPrefix {
-		var invalidCharacter rune = -1
-		idPart = strings.Map(
-			func(r rune) rune {
-				switch {
-				case strings.ContainsRune(hexDigits, r):
-					return unicode.ToLower(r)
-				case strings.ContainsRune(macDelimiters, r):
-					return -1
-				default:
-					invalidCharacter = r
-					return -1
-				}
-			},
-			idPart,
-		)
-
-		if invalidCharacter != -1 || len(idPart) != macLength {
-			return invalidID, ErrorInvalidDeviceName
-		}
-	}
-
-	return ID(fmt.Sprintf("%s:%s", prefix, idPart)), nil
+	return ID(l.ID()), nil
 }
 
 // IDHashParser is a parsing function that examines an HTTP request to produce
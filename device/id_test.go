@@ -47,6 +47,8 @@ func TestParseID(t *testing.T) {
 		{"invalid:a-BB-44-55", "", true},
 		{"mac:11-aa-BB-44-55", "", true},
 		{"MAC:invalid45566", "", true},
+		{"event:device-status/mac:112233445566/online", "", true},
+		{"mac:/service", "", true},
 		{"mac:481d70187fef", "mac:481d70187fef", false},
 		{"mac:481d70187fef/parodus/tag/test0", "mac:481d70187fef", false},
 	}
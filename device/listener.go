@@ -21,6 +21,8 @@ const (
 
 	// MessageReceived indicates that a message has been successfully received and
 	// dispatched to any goroutine waiting on it, as would be the case for a response.
+	// A further response to a resent transaction which has already completed is also a MessageReceived,
+	// with the Error field set to ErrorDuplicateTransactionResponse.
 	MessageReceived
 
 	// MessageFailed indicates that a message could not be sent to a device, either because
@@ -36,6 +38,31 @@ const (
 	// was no waiting transaction
 	TransactionBroken
 
+	// OfflineMessageQueued indicates that a message routed to a device that is not connected has been
+	// held for later delivery.  The Device field is nil for this event, as there is no connected device.
+	OfflineMessageQueued
+
+	// OfflineMessageExpired indicates that a message held for a device was discarded because its TTL
+	// elapsed before the device connected.  The Device field is set only if the expiration was noticed
+	// when the device connected.
+	OfflineMessageExpired
+
+	// OfflineMessageFlushed indicates that a held message was delivered to a device after it connected.
+	OfflineMessageFlushed
+
+	// SessionResumed indicates that a device connected within the grace period of its previous connection's
+	// suspended session, and has adopted that session's pending transactions and any held messages.
+	SessionResumed
+
+	// SessionExpired indicates that the grace period of a suspended session elapsed without the device
+	// reconnecting.  Pending transactions and held messages for that session have failed.  The Device
+	// field is the device whose connection was lost.
+	SessionExpired
+
+	// TransactionLate indicates receipt of a response to a transaction that had already timed out.  The
+	// Error field is a *LateResponseError describing the transaction and the latency of the response.
+	TransactionLate
+
 	InvalidEventString string = "!!INVALID DEVICE EVENT TYPE!!"
 )
 
@@ -60,6 +87,18 @@ func (et EventType) String() string {
 		return "TransactionComplete"
 	case TransactionBroken:
 		return "TransactionBroken"
+	case OfflineMessageQueued:
+		return "OfflineMessageQueued"
+	case OfflineMessageExpired:
+		return "OfflineMessageExpired"
+	case OfflineMessageFlushed:
+		return "OfflineMessageFlushed"
+	case SessionResumed:
+		return "SessionResumed"
+	case SessionExpired:
+		return "SessionExpired"
+	case TransactionLate:
+		return "TransactionLate"
 	default:
 		return InvalidEventString
 	}
@@ -68,7 +107,8 @@ func (et EventType) String() string {
 // Event represents a single occurrence of interest for device-related applications.
 // Instances of Event should be considered immutable by application code.  Also, Event
 // instances should not be stored across calls to a listener, as the infrastructure is
-// free to reuse Event instances.
+// free to reuse Event instances.  The exception is an Event delivered by an EventBus, which
+// is a deep copy that listeners may retain.
 type Event struct {
 	// Type describes the kind of this event.  This field is always set.
 	Type EventType
@@ -81,7 +121,8 @@ type Event struct {
 	//
 	// Never assume that it is safe to use this Message outside the listener invocation.  Make
 	// a copy if this Message is needed by other goroutines or if it needs to be part of a long-lived
-	// data structure.
+	// data structure.  When Options.PooledMessages is set, a received *wrp.Message is reused for
+	// subsequent messages as soon as the listeners return, so wrp.Message.Clone must be used to retain it.
 	Message wrp.Typed
 
 	// Format is the encoding format of the Contents field
@@ -97,7 +138,8 @@ type Event struct {
 
 	// Error is the error which occurred during an attempt to send a message.  This field is only populated
 	// for MessageFailed events when there was an actual error.  For MessageFailed events that indicate a
-	// device was disconnected with enqueued messages, this field will be nil.
+	// device was disconnected with enqueued messages, this field will be nil.  Certain received messages
+	// also carry an error, as described by each EventType.
 	Error error
 }
 
@@ -18,6 +18,12 @@ func testEventString(t *testing.T) {
 			MessageFailed,
 			TransactionComplete,
 			TransactionBroken,
+			OfflineMessageQueued,
+			OfflineMessageExpired,
+			OfflineMessageFlushed,
+			SessionResumed,
+			SessionExpired,
+			TransactionLate,
 		}
 	)
 
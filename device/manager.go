@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -46,6 +47,14 @@ type Connector interface {
 	// a deadlock will likely occur.
 	DisconnectIf(func(ID) (CloseReason, bool)) int
 
+	// DisconnectDeviceIf is like DisconnectIf, except that the predicate is passed each device
+	// rather than just its ID.  This allows devices to be selected by any of their metadata, e.g. with a Query.
+	// As with DisconnectIf, the devices are removed by ID, so any duplicates under a matching ID are removed as well.
+	//
+	// No methods on this Manager should be called from within the predicate function, or
+	// a deadlock will likely occur.
+	DisconnectDeviceIf(func(Interface) (CloseReason, bool)) int
+
 	// DisconnectAll disconnects all devices from this instance, and returns the count of
 	// devices disconnected.
 	DisconnectAll(CloseReason) int
@@ -83,15 +92,36 @@ type Manager interface {
 	Registry
 }
 
+// Closer is implemented by the Manager returned from NewManager, and releases the resources it holds
+// beyond its devices.  Obtain it with a type assertion:
+//
+//	if closer, ok := manager.(device.Closer); ok {
+//	    closer.Close()
+//	}
+type Closer interface {
+	// Close stops the EventBus, if one was configured, waiting for the events it has already queued to be
+	// delivered.  Events dispatched afterward are counted as dropped.  Devices are not disconnected, so
+	// DisconnectAll should be called first if listeners must observe the Disconnect events.  Listeners invoked
+	// synchronously are unaffected.  This method is idempotent.
+	Close()
+}
+
 // NewManager constructs a Manager from a set of options.  A ConnectionFactory will be
 // created from the options if one is not supplied.
 func NewManager(o *Options) Manager {
 	var (
-		logger   = o.logger()
-		measures = NewMeasures(o.metricsProvider())
+		logger    = o.logger()
+		measures  = NewMeasures(o.metricsProvider())
+		listeners = o.listeners()
+		bus       *EventBus
 	)
 
-	return &manager{
+	if o.eventBus().enabled() && len(listeners) > 0 {
+		bus = NewEventBus(o.eventBus(), measures, listeners...)
+		listeners = []Listener{bus.Dispatch}
+	}
+
+	m := &manager{
 		logger:   logger,
 		errorLog: logging.Error(logger),
 		debugLog: logging.Debug(logger),
@@ -100,19 +130,35 @@ func NewManager(o *Options) Manager {
 		writeDeadline:    NewDeadline(o.writeTimeout(), o.now()),
 		upgrader:         o.upgrader(),
 		conveyTranslator: conveyhttp.NewHeaderTranslator("", nil),
-		devices: newRegistry(registryOptions{
+		devices: newDeviceRegistry(registryOptions{
 			Logger:   logger,
 			Limit:    o.maxDevices(),
+			Shards:   o.registryShards(),
 			Measures: measures,
 		}),
 		conveyHWMetric: conveymetric.NewConveyMetric(measures.Models, "hw-model", "model"),
 
 		deviceMessageQueueSize: o.deviceMessageQueueSize(),
 		pingPeriod:             o.pingPeriod(),
+		compressionLevel:       o.compression().level(),
+		compressionMinSize:     o.compression().minSize(),
+		closeCodes:             o.closeCodes(),
+
+		offline:      newOfflineQueue(o.offlineQueue(), o.now(), measures),
+		rateLimits:   newRateLimits(o.rateLimits(), o.now(), measures),
+		authorizer:   newAuthorizer(o.authorization(), measures),
+		validator:    o.validator(),
+		transactions: o.transactions(),
+
+		pooledMessages: o.pooledMessages(),
 
-		listeners: o.listeners(),
+		bus:       bus,
+		listeners: listeners,
 		measures:  measures,
 	}
+
+	m.sessions = newSuspendedSessions(o.sessions(), m.expireSession)
+	return m
 }
 
 // manager is the internal Manager implementation.
@@ -126,12 +172,25 @@ type manager struct {
 	upgrader         *websocket.Upgrader
 	conveyTranslator conveyhttp.HeaderTranslator
 
-	devices        *registry
+	devices        deviceRegistry
 	conveyHWMetric conveymetric.Interface
 
 	deviceMessageQueueSize int
 	pingPeriod             time.Duration
+	compressionLevel       int
+	compressionMinSize     int
+	closeCodes             CloseCodes
+
+	offline      *offlineQueue
+	sessions     *suspendedSessions
+	rateLimits   *rateLimits
+	authorizer   *authorizer
+	validator    wrp.Validator
+	transactions *TransactionOptions
+
+	pooledMessages bool
 
+	bus       *EventBus
 	listeners []Listener
 	measures  Measures
 }
@@ -172,6 +231,10 @@ func (m *manager) Connect(response http.ResponseWriter, request *http.Request, r
 		SatClientID: satClientID,
 		Trust:       trust,
 		Logger:      m.logger,
+
+		Transactions:       m.transactions,
+		TransactionTimeout: m.measures.TransactionTimeout,
+		TransactionRetry:   m.measures.TransactionRetry,
 	})
 
 	if cvyErr == nil {
@@ -184,7 +247,7 @@ func (m *manager) Connect(response http.ResponseWriter, request *http.Request, r
 		d.errorLog.Log(logging.MessageKey(), "missing security information")
 	}
 
-	c, err := m.upgrader.Upgrade(response, request, responseHeader)
+	c, err := m.upgrader.Upgrade(&wireResponseWriter{response, d.statistics}, request, responseHeader)
 	if err != nil {
 		d.errorLog.Log(logging.MessageKey(), "failed websocket upgrade", logging.ErrorKey(), err)
 		return nil, err
@@ -192,15 +255,55 @@ func (m *manager) Connect(response http.ResponseWriter, request *http.Request, r
 
 	d.debugLog.Log(logging.MessageKey(), "websocket upgrade complete", "localAddress", c.LocalAddr().String())
 
-	pinger, err := NewPinger(c, m.measures.Ping, []byte(d.ID()), m.writeDeadline)
+	var writer WriteCloser = c
+	if m.upgrader.EnableCompression && offersPermessageDeflate(request.Header) {
+		d.statistics.SetCompressed(true)
+		if err := c.SetCompressionLevel(m.compressionLevel); err != nil {
+			d.errorLog.Log(logging.MessageKey(), "unable to set compression level", logging.ErrorKey(), err)
+		}
+
+		if m.compressionMinSize > 0 {
+			writer = &minSizeWriter{Conn: c, minSize: m.compressionMinSize}
+		}
+	}
+
+	pinger, err := NewPinger(c, statisticsIncrementer{m.measures.Ping, d.statistics.RecordPing}, []byte(d.ID()), m.writeDeadline)
 	if err != nil {
 		d.errorLog.Log(logging.MessageKey(), "unable to create pinger", logging.ErrorKey(), err)
 		c.Close()
 		return nil, err
 	}
 
+	// the limiter references shared partner buckets, so it is created only once the device is either added
+	// or released below
+	if m.rateLimits != nil {
+		d.limiter = m.rateLimits.forDevice(d)
+	}
+
+	var previous *device
+	if m.sessions != nil {
+		var resumed bool
+		if previous, resumed = m.sessions.resume(id); resumed {
+			d.adopt(previous)
+		}
+	}
+
 	if err := m.devices.add(d); err != nil {
 		d.errorLog.Log(logging.MessageKey(), "unable to register device", logging.ErrorKey(), err)
+
+		// the resumed session is no longer suspended, so it must be ended here or its held messages
+		// and pending transactions would never fail
+		if previous != nil {
+			m.expireSession(previous)
+		}
+
+		if m.rateLimits != nil {
+			m.rateLimits.release(d.limiter)
+		}
+		if reason := d.CloseReason(); len(reason.Text) > 0 {
+			WriteClose(c, m.closeCodes, reason, m.writeDeadline())
+		}
+
 		c.Close()
 		return nil, err
 	}
@@ -228,14 +331,91 @@ func (m *manager) Connect(response http.ResponseWriter, request *http.Request, r
 	d.conveyClosure = metricClosure
 	m.dispatch(event)
 
-	SetPongHandler(c, m.measures.Pong, m.readDeadline)
+	SetPongHandler(c, statisticsIncrementer{m.measures.Pong, d.statistics.RecordPong}, m.readDeadline)
 	closeOnce := new(sync.Once)
 	go m.readPump(d, InstrumentReader(c, d.statistics), closeOnce)
-	go m.writePump(d, InstrumentWriter(c, d.statistics), pinger, closeOnce)
+	closer := func(reason CloseReason) error {
+		return WriteClose(c, m.closeCodes, reason, m.writeDeadline())
+	}
+
+	go m.writePump(d, InstrumentWriter(writer, d.statistics), pinger, closer, closeOnce)
+
+	if previous != nil {
+		m.resumeSession(d, previous)
+	}
+
+	if m.offline != nil {
+		go m.flushOffline(d)
+	}
 
 	return d, nil
 }
 
+// resumeSession moves any messages held with a suspended session to the device that resumed it
+func (m *manager) resumeSession(d *device, previous *device) {
+	moved := 0
+	for {
+		select {
+		case e := <-previous.messages:
+			select {
+			case d.messages <- e:
+				moved++
+			default:
+				d.errorLog.Log(logging.MessageKey(), "no room to resume message", "deviceMessage", e)
+				m.failEnvelope(d, e, ErrorDeviceClosed)
+			}
+
+		default:
+			d.infoLog.Log(logging.MessageKey(), "session resumed", "messages", moved, "transactions", d.session.transactions.Len())
+			m.dispatch(&Event{
+				Type:   SessionResumed,
+				Device: d,
+			})
+
+			return
+		}
+	}
+}
+
+// expireSession ends the session of a suspended device whose grace period has elapsed, failing
+// any messages held with that session
+func (m *manager) expireSession(d *device) {
+	d.session.close()
+	for {
+		select {
+		case e := <-d.messages:
+			m.failEnvelope(d, e, ErrorDeviceClosed)
+		default:
+			d.infoLog.Log(logging.MessageKey(), "session expired")
+			m.dispatch(&Event{
+				Type:   SessionExpired,
+				Device: d,
+			})
+
+			return
+		}
+	}
+}
+
+// failEnvelope notifies both the sender and any listeners that a message could not be delivered
+func (m *manager) failEnvelope(d *device, e *envelope, err error) {
+	e.complete <- err
+	m.dispatch(&Event{
+		Type:     MessageFailed,
+		Device:   d,
+		Message:  e.request.Message,
+		Format:   e.request.Format,
+		Contents: e.request.Contents,
+		Error:    err,
+	})
+}
+
+func (m *manager) Close() {
+	if m.bus != nil {
+		m.bus.Close()
+	}
+}
+
 func (m *manager) dispatch(e *Event) {
 	for _, listener := range m.listeners {
 		listener(e)
@@ -250,8 +430,16 @@ func (m *manager) dispatch(e *Event) {
 // dispatches message failed events for any messages that were waiting to be delivered
 // at the time of pump closure.
 func (m *manager) pumpClose(d *device, c io.Closer, reason CloseReason) {
+	// the session must be suspended before the device is closed, so that its transactions are kept
+	if m.sessions != nil && m.sessions.suspend(d) {
+		d.infoLog.Log(logging.MessageKey(), "session suspended", "transactions", d.session.transactions.Len())
+	}
+
 	// remove will invoke requestClose()
 	m.devices.remove(d.id, reason)
+	if m.rateLimits != nil {
+		m.rateLimits.release(d.limiter)
+	}
 
 	closeError := c.Close()
 
@@ -297,9 +485,40 @@ func (m *manager) readPump(d *device, r ReadCloser, closeOnce *sync.Once) {
 			continue
 		}
 
+		switch d.limiter.checkInbound(d.shutdown) {
+		case "":
+		case RateLimitDelay:
+			// the device was closed while the message was delayed
+			return
+		case RateLimitDisconnect:
+			d.errorLog.Log(logging.MessageKey(), "inbound rate limit exceeded, disconnecting")
+			d.requestClose(CloseReason{Err: ErrorRateLimited, Text: RateLimitedCloseReason})
+			return
+		default:
+			d.debugLog.Log(logging.MessageKey(), "inbound rate limit exceeded, dropping message")
+			continue
+		}
+
+		message, err := m.decodeMessage(decoder, data)
+		if err != nil {
+			d.errorLog.Log(logging.MessageKey(), "skipping malformed WRP message", logging.ErrorKey(), err)
+			continue
+		}
+
+		if m.validator != nil {
+			if err := m.validator.Validate(message); err != nil {
+				d.errorLog.Log(logging.MessageKey(), "skipping invalid WRP message", logging.ErrorKey(), err)
+				m.measures.InvalidMessage.Inc()
+				m.releaseMessage(message)
+				continue
+			}
+		}
+
 		var (
-			message = new(wrp.Message)
-			event   = Event{
+			// a response delivered to a transaction is retained by whoever is waiting on that transaction
+			retained bool
+
+			event = Event{
 				Type:     MessageReceived,
 				Device:   d,
 				Message:  message,
@@ -308,21 +527,13 @@ func (m *manager) readPump(d *device, r ReadCloser, closeOnce *sync.Once) {
 			}
 		)
 
-		decoder.ResetBytes(data)
-		err := decoder.Decode(message)
-		decoder.ResetBytes(nil)
-		if err != nil {
-			d.errorLog.Log(logging.MessageKey(), "skipping malformed WRP message", logging.ErrorKey(), err)
-			continue
-		}
-
 		if message.Type == wrp.SimpleRequestResponseMessageType {
 			m.measures.RequestResponse.Add(1.0)
 		}
 
 		// update any waiting transaction
 		if message.IsTransactionPart() {
-			err := d.transactions.Complete(
+			transaction, err := d.session.transactions.complete(
 				message.TransactionKey(),
 				&Response{
 					Device:   d,
@@ -332,23 +543,67 @@ func (m *manager) readPump(d *device, r ReadCloser, closeOnce *sync.Once) {
 				},
 			)
 
-			if err != nil {
+			if late, ok := err.(*LateResponseError); ok {
+				d.infoLog.Log(logging.MessageKey(), "late transaction response", "transactionKey", message.TransactionKey(), "latency", late.Latency)
+				m.measures.TransactionLate.Inc()
+				m.measures.TransactionLatency.With(TransactionOutcomeLabel, TransactionOutcomeLate).Observe(late.Latency.Seconds())
+				event.Type = TransactionLate
+				event.Error = err
+			} else if err == ErrorDuplicateTransactionResponse {
+				// the device responded to more than one attempt of a resent request
+				d.debugLog.Log(logging.MessageKey(), "duplicate transaction response", "transactionKey", message.TransactionKey(), "attempts", transaction.Attempts)
+				m.measures.TransactionDuplicate.Inc()
+				event.Error = err
+			} else if err != nil {
 				d.errorLog.Log(logging.MessageKey(), "Error while completing transaction", "transactionKey", message.TransactionKey(), logging.ErrorKey(), err)
 				event.Type = TransactionBroken
 				event.Error = err
 			} else {
+				latency := time.Since(transaction.Created)
+				m.measures.TransactionLatency.With(TransactionOutcomeLabel, TransactionOutcomeComplete).Observe(latency.Seconds())
+				d.statistics.AddTransactionLatency(latency)
 				event.Type = TransactionComplete
+				retained = true
 			}
 		}
 
 		m.dispatch(&event)
+		if !retained {
+			m.releaseMessage(message)
+		}
+	}
+}
+
+// decodeMessage decodes a frame received from a device.  If pooled messages are enabled, the returned message
+// must be passed to releaseMessage once it is no longer needed.
+func (m *manager) decodeMessage(decoder wrp.Decoder, data []byte) (*wrp.Message, error) {
+	if m.pooledMessages {
+		return wrp.DecodePooled(decoder, data)
+	}
+
+	message := new(wrp.Message)
+	decoder.ResetBytes(data)
+	err := decoder.Decode(message)
+	decoder.ResetBytes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// releaseMessage returns a message produced by decodeMessage to the pool, if pooled messages are enabled.
+// Otherwise, the message is left for the garbage collector, since listeners may have retained it.
+func (m *manager) releaseMessage(message *wrp.Message) {
+	if m.pooledMessages {
+		message.Release()
 	}
 }
 
 // writePump is the goroutine which services messages addressed to the device.
 // this goroutine exits when either an explicit shutdown is requested or any
 // error occurs on the connection.
-func (m *manager) writePump(d *device, w WriteCloser, pinger func() error, closeOnce *sync.Once) {
+func (m *manager) writePump(d *device, w WriteCloser, pinger func() error, closer func(CloseReason) error, closeOnce *sync.Once) {
 	defer d.debugLog.Log(logging.MessageKey(), "writePump exiting")
 	d.debugLog.Log(logging.MessageKey(), "writePump starting")
 
@@ -380,6 +635,12 @@ func (m *manager) writePump(d *device, w WriteCloser, pinger func() error, close
 			})
 		}
 
+		// a suspended session holds onto its queued messages, if so configured.  isSuspended records whether
+		// pumpClose actually suspended the session, which it never does for a deliberately closed device.
+		if m.sessions != nil && m.sessions.keepMessages && d.isSuspended() {
+			return
+		}
+
 		// drain the messages, dispatching them as message failed events.  we never close
 		// the message channel, so just drain until a receive would block.
 		//
@@ -389,6 +650,7 @@ func (m *manager) writePump(d *device, w WriteCloser, pinger func() error, close
 			select {
 			case undeliverable := <-d.messages:
 				d.errorLog.Log(logging.MessageKey(), "undeliverable message", "deviceMessage", undeliverable)
+				undeliverable.complete <- ErrorDeviceClosed
 				m.dispatch(&Event{
 					Type:     MessageFailed,
 					Device:   d,
@@ -409,6 +671,12 @@ func (m *manager) writePump(d *device, w WriteCloser, pinger func() error, close
 		select {
 		case <-d.shutdown:
 			d.debugLog.Log(logging.MessageKey(), "explicit shutdown")
+
+			// tell the device why it is being disconnected.  this is best effort, as the connection is closed regardless.
+			if err := closer(d.CloseReason()); err != nil {
+				d.debugLog.Log(logging.MessageKey(), "unable to send close frame", logging.ErrorKey(), err)
+			}
+
 			writeError = w.Close()
 			return
 
@@ -463,6 +731,12 @@ func (m *manager) DisconnectIf(filter func(ID) (CloseReason, bool)) int {
 	})
 }
 
+func (m *manager) DisconnectDeviceIf(filter func(Interface) (CloseReason, bool)) int {
+	return m.devices.removeIf(func(d *device) (CloseReason, bool) {
+		return filter(d)
+	})
+}
+
 func (m *manager) DisconnectAll(reason CloseReason) int {
 	return m.devices.removeAll(reason)
 }
@@ -485,8 +759,138 @@ func (m *manager) Route(request *Request) (*Response, error) {
 	if destination, err := request.ID(); err != nil {
 		return nil, err
 	} else if d, ok := m.devices.get(destination); ok {
+		if m.authorizer != nil {
+			if err := m.authorizer.authorize(request.Context(), d); err != nil {
+				return nil, err
+			}
+		}
+
 		return d.Send(request)
+	} else if m.offline != nil && m.offline.accepts(request) {
+		return nil, m.enqueueOffline(destination, request)
 	} else {
 		return nil, ErrorDeviceNotFound
 	}
 }
+
+// enqueueOffline holds a request for a device that is not connected.  If the device connected
+// while the request was being stored, a flush is started so the message isn't stranded.
+func (m *manager) enqueueOffline(id ID, request *Request) error {
+	expired, err := m.offline.enqueue(id, request)
+	for _, om := range expired {
+		m.dispatch(&Event{
+			Type:     OfflineMessageExpired,
+			Message:  om.Message,
+			Format:   wrp.Msgpack,
+			Contents: om.Contents,
+		})
+	}
+
+	if err != nil {
+		m.errorLog.Log(logging.MessageKey(), "unable to hold message for offline device", "id", id, logging.ErrorKey(), err)
+		return err
+	}
+
+	m.dispatch(&Event{
+		Type:     OfflineMessageQueued,
+		Message:  request.Message,
+		Format:   request.Format,
+		Contents: request.Contents,
+	})
+
+	if d, ok := m.devices.get(id); ok {
+		go m.flushOffline(d)
+	}
+
+	return nil
+}
+
+// flushOffline delivers any messages held for a device through the normal Send path.  If the device
+// disconnects during the flush, the undelivered messages are held again.
+func (m *manager) flushOffline(d *device) {
+	live, expired, err := m.offline.take(d.id)
+	if err != nil {
+		d.errorLog.Log(logging.MessageKey(), "unable to retrieve offline messages", logging.ErrorKey(), err)
+		return
+	}
+
+	for _, om := range expired {
+		m.dispatch(&Event{
+			Type:     OfflineMessageExpired,
+			Device:   d,
+			Message:  om.Message,
+			Format:   wrp.Msgpack,
+			Contents: om.Contents,
+		})
+	}
+
+	for i, om := range live {
+		request := &Request{
+			Message:  om.Message,
+			Format:   wrp.Msgpack,
+			Contents: om.Contents,
+		}
+
+		if om.Caller != nil {
+			request = request.WithContext(handler.NewContextWithValue(context.Background(), om.Caller))
+		}
+
+		if m.authorizer != nil {
+			if err := m.authorizer.authorize(request.Context(), d); err != nil {
+				d.errorLog.Log(logging.MessageKey(), "dropping unauthorized offline message", logging.ErrorKey(), err)
+				m.dispatch(&Event{
+					Type:     MessageFailed,
+					Device:   d,
+					Message:  om.Message,
+					Format:   wrp.Msgpack,
+					Contents: om.Contents,
+					Error:    err,
+				})
+
+				continue
+			}
+		}
+
+		_, err := d.Send(request)
+
+		if err != nil {
+			d.errorLog.Log(logging.MessageKey(), "unable to flush offline messages", "remaining", len(live)-i, logging.ErrorKey(), err)
+			expired, rejected, err := m.offline.requeue(d.id, live[i:])
+			if err != nil {
+				d.errorLog.Log(logging.MessageKey(), "unable to hold offline messages again", logging.ErrorKey(), err)
+			}
+
+			for _, om := range expired {
+				m.dispatch(&Event{
+					Type:     OfflineMessageExpired,
+					Device:   d,
+					Message:  om.Message,
+					Format:   wrp.Msgpack,
+					Contents: om.Contents,
+				})
+			}
+
+			for _, om := range rejected {
+				m.dispatch(&Event{
+					Type:     MessageFailed,
+					Device:   d,
+					Message:  om.Message,
+					Format:   wrp.Msgpack,
+					Contents: om.Contents,
+					Error:    ErrorOfflineQueueFull,
+				})
+			}
+
+			return
+		}
+
+		m.offline.flushed.Inc()
+		m.dispatch(&Event{
+			Type:     OfflineMessageFlushed,
+			Device:   d,
+			Message:  om.Message,
+			Format:   wrp.Msgpack,
+			Contents: om.Contents,
+		})
+	}
+}
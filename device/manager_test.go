@@ -3,6 +3,7 @@ package device
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -15,6 +16,9 @@ import (
 
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
 	"github.com/justinas/alice"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -259,6 +263,57 @@ func testManagerDisconnectIf(t *testing.T) {
 	}
 }
 
+func testManagerDisconnectDeviceIf(t *testing.T) {
+	assert := assert.New(t)
+	connectWait := new(sync.WaitGroup)
+	connectWait.Add(len(testDeviceIDs))
+	disconnections := make(chan Interface, len(testDeviceIDs))
+
+	options := &Options{
+		Logger: logging.NewTestLogger(nil, t),
+		Listeners: []Listener{
+			func(event *Event) {
+				switch event.Type {
+				case Connect:
+					connectWait.Done()
+				case Disconnect:
+					assert.True(event.Device.Closed())
+					disconnections <- event.Device
+				}
+			},
+		},
+	}
+
+	manager, server, connectURL := startWebsocketServer(options)
+	defer server.Close()
+
+	testDevices := connectTestDevices(t, DefaultDialer(), connectURL)
+	defer closeTestDevices(assert, testDevices)
+
+	connectWait.Wait()
+	noMatch := MustParseQuery("id ^= uuid:")
+	assert.Zero(manager.DisconnectDeviceIf(func(d Interface) (CloseReason, bool) { return CloseReason{}, noMatch.Matches(d) }))
+	select {
+	case <-disconnections:
+		assert.Fail("No disconnections should have occurred")
+	default:
+		// the passing case
+	}
+
+	for _, id := range testDeviceIDs {
+		q := MustParseQuery(fmt.Sprintf(`id = "%s"`, id))
+		assert.Equal(1, manager.DisconnectDeviceIf(func(d Interface) (CloseReason, bool) { return CloseReason{Text: "query"}, q.Matches(d) }))
+		select {
+		case actual := <-disconnections:
+			assert.Equal(id, actual.ID())
+			assert.True(actual.Closed())
+			assert.Equal("query", actual.CloseReason().Text)
+		case <-time.After(10 * time.Second):
+			assert.Fail("No disconnection occurred within the timeout")
+		}
+	}
+}
+
 func testManagerRouteBadDestination(t *testing.T) {
 	var (
 		assert  = assert.New(t)
@@ -371,6 +426,7 @@ func TestManager(t *testing.T) {
 
 	t.Run("Disconnect", testManagerDisconnect)
 	t.Run("DisconnectIf", testManagerDisconnectIf)
+	t.Run("DisconnectDeviceIf", testManagerDisconnectDeviceIf)
 }
 
 func TestGaugeCardinality(t *testing.T) {
@@ -393,3 +449,243 @@ func TestGaugeCardinality(t *testing.T) {
 		m.(*manager).measures.Models.With("neat", "bad").Add(-1)
 	})
 }
+
+func TestManagerValidation(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		p        = xmetricstest.NewProvider(nil, Metrics)
+		listener = newSessionTestListener()
+		received = make(chan *wrp.Message, 10)
+
+		options = &Options{
+			Validator:       wrp.DefaultValidator(),
+			MetricsProvider: p,
+			Listeners: []Listener{
+				listener.OnDeviceEvent,
+				func(e *Event) {
+					if e.Type == MessageReceived {
+						received <- e.Message.(*wrp.Message)
+					}
+				},
+			},
+		}
+
+		_, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer func() {
+		connection.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	// an event without a destination is dropped, while the valid event that follows it is received
+	require.NoError(connection.WriteMessage(websocket.BinaryMessage, wrp.MustEncode(&wrp.SimpleEvent{Source: string(testDeviceIDs[0])}, wrp.Msgpack)))
+	require.NoError(connection.WriteMessage(websocket.BinaryMessage, wrp.MustEncode(&wrp.SimpleEvent{Source: string(testDeviceIDs[0]), Destination: "event:valid"}, wrp.Msgpack)))
+
+	select {
+	case message := <-received:
+		assert.Equal("event:valid", message.Destination)
+	case <-time.After(10 * time.Second):
+		assert.Fail("No message was received")
+	}
+
+	p.Assert(t, InvalidMessageCounter)(xmetricstest.Value(1.0))
+}
+
+func TestManagerPooledMessages(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		listener = newSessionTestListener()
+		received = make(chan *wrp.Message, 10)
+
+		options = &Options{
+			PooledMessages: true,
+			Listeners: []Listener{
+				listener.OnDeviceEvent,
+				func(e *Event) {
+					if e.Type == MessageReceived {
+						// a pooled message must be cloned to be retained beyond the listener
+						received <- e.Message.(*wrp.Message).Clone()
+					}
+				},
+			},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+
+		responses = make(chan *Response, 1)
+		errs      = make(chan error, 1)
+
+		events = []wrp.Message{
+			{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      string(testDeviceIDs[0]),
+				Destination: "event:first",
+				Headers:     []string{"X-First: true"},
+				Metadata:    map[string]string{"/first": "true"},
+				Payload:     []byte("a rather long payload for the first event"),
+				PartnerIDs:  []string{"comcast"},
+			},
+			{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      string(testDeviceIDs[0]),
+				Destination: "event:second",
+			},
+			{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      string(testDeviceIDs[0]),
+				Destination: "event:third",
+				Payload:     []byte("third"),
+			},
+		}
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer func() {
+		connection.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	// each message decoded into a reused message must carry nothing over from earlier messages
+	for _, event := range events {
+		require.NoError(connection.WriteMessage(websocket.BinaryMessage, wrp.MustEncode(&event, wrp.Msgpack)))
+	}
+
+	for _, event := range events {
+		select {
+		case message := <-received:
+			assert.Equal(event, *message)
+		case <-time.After(10 * time.Second):
+			assert.Fail("No message was received")
+		}
+	}
+
+	go func() {
+		response, err := manager.Route(&Request{
+			Message: &wrp.SimpleRequestResponse{
+				Source:          "test",
+				Destination:     string(testDeviceIDs[0]),
+				TransactionUUID: "pooled",
+				Payload:         []byte("request"),
+			},
+		})
+
+		responses <- response
+		errs <- err
+	}()
+
+	request := readTestMessage(require, connection)
+	assert.Equal("pooled", request.TransactionUUID)
+
+	require.NoError(connection.WriteMessage(
+		websocket.BinaryMessage,
+		wrp.MustEncode(
+			&wrp.SimpleRequestResponse{
+				Source:          string(testDeviceIDs[0]),
+				Destination:     "test",
+				TransactionUUID: "pooled",
+				Payload:         []byte("response"),
+			},
+			wrp.Msgpack,
+		),
+	))
+
+	// a transaction's response is retained, so later messages must not be decoded into it
+	for _, event := range events {
+		require.NoError(connection.WriteMessage(websocket.BinaryMessage, wrp.MustEncode(&event, wrp.Msgpack)))
+	}
+
+	for range events {
+		select {
+		case <-received:
+		case <-time.After(10 * time.Second):
+			assert.Fail("No message was received")
+		}
+	}
+
+	select {
+	case response := <-responses:
+		require.NotNil(response)
+		assert.NoError(<-errs)
+		assert.Equal("pooled", response.Message.TransactionUUID)
+		assert.Equal("response", string(response.Message.Payload))
+	case <-time.After(10 * time.Second):
+		assert.Fail("The transaction did not complete")
+	}
+}
+
+// benchmarkReader supplies the same frame a fixed number of times, then fails as a closed connection would
+type benchmarkReader struct {
+	frame     []byte
+	remaining int
+}
+
+func (br *benchmarkReader) ReadMessage() (int, []byte, error) {
+	if br.remaining < 1 {
+		return -1, nil, io.EOF
+	}
+
+	br.remaining--
+	return websocket.BinaryMessage, br.frame, nil
+}
+
+func (br *benchmarkReader) SetReadDeadline(time.Time) error   { return nil }
+func (br *benchmarkReader) SetPongHandler(func(string) error) {}
+func (br *benchmarkReader) Close() error                      { return nil }
+
+func benchmarkManagerReadPump(b *testing.B, pooledMessages bool) {
+	var (
+		frame = wrp.MustEncode(
+			&wrp.SimpleEvent{
+				Source:      string(testDeviceIDs[0]),
+				Destination: "event:device-status/" + string(testDeviceIDs[0]) + "/online",
+				ContentType: "application/json",
+				Headers:     []string{"X-Benchmark: true"},
+				Metadata:    map[string]string{"/boot-time": "1234", "/trust": "1000"},
+				Payload:     []byte(`{"id": "mac:112233445566", "ts": "2018-08-13T09:23:08Z", "bytes-sent": 1234, "messages-sent": 56}`),
+				PartnerIDs:  []string{"comcast"},
+			},
+			wrp.Msgpack,
+		)
+
+		m = NewManager(&Options{
+			PooledMessages: pooledMessages,
+			Logger:         log.NewNopLogger(),
+			Listeners: []Listener{
+				func(e *Event) {
+					if e.Type == MessageReceived && len(e.Message.(*wrp.Message).Destination) == 0 {
+						b.Fatal("the message was not decoded")
+					}
+				},
+			},
+		}).(*manager)
+
+		d         = newDevice(deviceOptions{ID: testDeviceIDs[0], Logger: log.NewNopLogger()})
+		closeOnce = new(sync.Once)
+	)
+
+	// the device was never connected, so there is nothing for the read pump to clean up
+	closeOnce.Do(func() {})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	m.readPump(d, &benchmarkReader{frame: frame, remaining: b.N}, closeOnce)
+}
+
+func BenchmarkManagerReadPump(b *testing.B) {
+	b.Run("New", func(b *testing.B) { benchmarkManagerReadPump(b, false) })
+	b.Run("Pooled", func(b *testing.B) { benchmarkManagerReadPump(b, true) })
+}
@@ -7,17 +7,46 @@ import (
 )
 
 const (
-	DeviceCounter             = "device_count"
-	DuplicatesCounter         = "duplicate_count"
-	RequestResponseCounter    = "request_response_count"
-	PingCounter               = "ping_count"
-	PongCounter               = "pong_count"
-	ConnectCounter            = "connect_count"
-	DisconnectCounter         = "disconnect_count"
-	DeviceLimitReachedCounter = "device_limit_reached_count"
-	ModelGauge                = "hardware_model"
+	DeviceCounter                = "device_count"
+	DuplicatesCounter            = "duplicate_count"
+	RequestResponseCounter       = "request_response_count"
+	PingCounter                  = "ping_count"
+	PongCounter                  = "pong_count"
+	ConnectCounter               = "connect_count"
+	DisconnectCounter            = "disconnect_count"
+	DeviceLimitReachedCounter    = "device_limit_reached_count"
+	ModelGauge                   = "hardware_model"
+	OfflineQueuedCounter         = "offline_queued_count"
+	OfflineExpiredCounter        = "offline_expired_count"
+	OfflineFlushedCounter        = "offline_flushed_count"
+	OfflineRejectedCounter       = "offline_rejected_count"
+	OfflineCorruptCounter        = "offline_corrupt_count"
+	RateLimitCounter             = "rate_limit_count"
+	EventQueueDepthGauge         = "event_queue_depth"
+	EventDroppedCounter          = "event_dropped_count"
+	AdmittedCounter              = "admission_admitted_count"
+	AdmissionRejectedCounter     = "admission_rejected_count"
+	TransactionLatency           = "transaction_latency_seconds"
+	TransactionTimeoutCounter    = "transaction_timeout_count"
+	TransactionRetryCounter      = "transaction_retry_count"
+	TransactionLateCounter       = "transaction_late_count"
+	TransactionDuplicateCounter  = "transaction_duplicate_count"
+	AuthorizationRejectedCounter = "authorization_rejected_count"
+	InvalidMessageCounter        = "invalid_message_count"
+
+	// TransactionOutcomeLabel is the label of TransactionLatency which distinguishes on-time from late responses
+	TransactionOutcomeLabel    = "outcome"
+	TransactionOutcomeComplete = "complete"
+	TransactionOutcomeLate     = "late"
 )
 
+// TransactionLatencyBuckets are the upper bounds, in seconds, of the buckets for transaction latencies.  These
+// apply both to TransactionLatency and to the per-device latencies exported for watched devices.
+//
+// TransactionLatency is deliberately not labeled by device, as that would create a series for every device
+// ever connected.  Use a WatchList to see the transaction latencies of specific devices.
+var TransactionLatencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
 // Metrics is the device module function that adds default device metrics
 func Metrics() []xmetrics.Metric {
 	return []xmetrics.Metric{
@@ -58,6 +87,81 @@ func Metrics() []xmetrics.Metric {
 			Type:       "gauge",
 			LabelNames: []string{"model"},
 		},
+		{
+			Name: OfflineQueuedCounter,
+			Type: "counter",
+		},
+		{
+			Name: OfflineExpiredCounter,
+			Type: "counter",
+		},
+		{
+			Name: OfflineFlushedCounter,
+			Type: "counter",
+		},
+		{
+			Name: OfflineRejectedCounter,
+			Type: "counter",
+		},
+		{
+			Name: OfflineCorruptCounter,
+			Type: "counter",
+		},
+		{
+			Name:       RateLimitCounter,
+			Type:       "counter",
+			LabelNames: []string{"limit", "decision"},
+		},
+		{
+			Name:       EventQueueDepthGauge,
+			Type:       "gauge",
+			LabelNames: []string{"listener"},
+		},
+		{
+			Name:       EventDroppedCounter,
+			Type:       "counter",
+			LabelNames: []string{"listener"},
+		},
+		{
+			Name: AdmittedCounter,
+			Type: "counter",
+		},
+		{
+			Name:       AdmissionRejectedCounter,
+			Type:       "counter",
+			LabelNames: []string{"reason"},
+		},
+		{
+			Name:       TransactionLatency,
+			Type:       "histogram",
+			LabelNames: []string{TransactionOutcomeLabel},
+			Buckets:    TransactionLatencyBuckets,
+		},
+		{
+			Name: TransactionTimeoutCounter,
+			Type: "counter",
+		},
+		{
+			Name: TransactionRetryCounter,
+			Type: "counter",
+		},
+		{
+			Name: TransactionLateCounter,
+			Type: "counter",
+		},
+		{
+			Name: TransactionDuplicateCounter,
+			Type: "counter",
+		},
+		{
+			Name:       AuthorizationRejectedCounter,
+			Type:       "counter",
+			LabelNames: []string{"reason"},
+		},
+		{
+			Name: InvalidMessageCounter,
+			Type: "counter",
+		},
 	}
 }
 
@@ -72,6 +176,26 @@ type Measures struct {
 	Connect         xmetrics.Incrementer
 	Disconnect      xmetrics.Adder
 	Models          metrics.Gauge
+	OfflineQueued   xmetrics.Incrementer
+	OfflineExpired  xmetrics.Incrementer
+	OfflineFlushed  xmetrics.Incrementer
+	OfflineRejected xmetrics.Incrementer
+	OfflineCorrupt  xmetrics.Incrementer
+	RateLimit       metrics.Counter
+	EventQueueDepth metrics.Gauge
+	EventDropped    metrics.Counter
+
+	Admitted          xmetrics.Incrementer
+	AdmissionRejected metrics.Counter
+
+	TransactionLatency   metrics.Histogram
+	TransactionTimeout   xmetrics.Incrementer
+	TransactionRetry     xmetrics.Incrementer
+	TransactionLate      xmetrics.Incrementer
+	TransactionDuplicate xmetrics.Incrementer
+
+	AuthorizationRejected metrics.Counter
+	InvalidMessage        xmetrics.Incrementer
 }
 
 // NewMeasures constructs a Measures given a go-kit metrics Provider
@@ -86,5 +210,25 @@ func NewMeasures(p provider.Provider) Measures {
 		Connect:         xmetrics.NewIncrementer(p.NewCounter(ConnectCounter)),
 		Disconnect:      p.NewCounter(DisconnectCounter),
 		Models:          p.NewGauge(ModelGauge),
+		OfflineQueued:   xmetrics.NewIncrementer(p.NewCounter(OfflineQueuedCounter)),
+		OfflineExpired:  xmetrics.NewIncrementer(p.NewCounter(OfflineExpiredCounter)),
+		OfflineFlushed:  xmetrics.NewIncrementer(p.NewCounter(OfflineFlushedCounter)),
+		OfflineRejected: xmetrics.NewIncrementer(p.NewCounter(OfflineRejectedCounter)),
+		OfflineCorrupt:  xmetrics.NewIncrementer(p.NewCounter(OfflineCorruptCounter)),
+		RateLimit:       p.NewCounter(RateLimitCounter),
+		EventQueueDepth: p.NewGauge(EventQueueDepthGauge),
+		EventDropped:    p.NewCounter(EventDroppedCounter),
+
+		Admitted:          xmetrics.NewIncrementer(p.NewCounter(AdmittedCounter)),
+		AdmissionRejected: p.NewCounter(AdmissionRejectedCounter),
+
+		TransactionLatency:   p.NewHistogram(TransactionLatency, 0),
+		TransactionTimeout:   xmetrics.NewIncrementer(p.NewCounter(TransactionTimeoutCounter)),
+		TransactionRetry:     xmetrics.NewIncrementer(p.NewCounter(TransactionRetryCounter)),
+		TransactionLate:      xmetrics.NewIncrementer(p.NewCounter(TransactionLateCounter)),
+		TransactionDuplicate: xmetrics.NewIncrementer(p.NewCounter(TransactionDuplicateCounter)),
+
+		AuthorizationRejected: p.NewCounter(AuthorizationRejectedCounter),
+		InvalidMessage:        xmetrics.NewIncrementer(p.NewCounter(InvalidMessageCounter)),
 	}
 }
@@ -27,6 +27,10 @@ func (m *MockConnector) DisconnectIf(predicate func(ID) (CloseReason, bool)) int
 	return m.Called(predicate).Int(0)
 }
 
+func (m *MockConnector) DisconnectDeviceIf(predicate func(Interface) (CloseReason, bool)) int {
+	return m.Called(predicate).Int(0)
+}
+
 func (m *MockConnector) DisconnectAll(reason CloseReason) int {
 	return m.Called(reason).Int(0)
 }
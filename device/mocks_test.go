@@ -187,6 +187,12 @@ func TestMockConnector(t *testing.T) {
 			predicateCalled = true
 			return CloseReason{}, false
 		}
+
+		devicePredicateCalled = false
+		devicePredicate       = func(candidate Interface) (CloseReason, bool) {
+			devicePredicateCalled = true
+			return CloseReason{}, false
+		}
 	)
 
 	c.On("Connect", response, request, header).Return(expectedDevice, expectedConnectError).Once()
@@ -196,6 +202,10 @@ func TestMockConnector(t *testing.T) {
 		Run(func(arguments mock.Arguments) {
 			arguments.Get(0).(func(ID) (CloseReason, bool))(id1)
 		}).Once()
+	c.On("DisconnectDeviceIf", mock.MatchedBy(func(func(Interface) (CloseReason, bool)) bool { return true })).Return(3).
+		Run(func(arguments mock.Arguments) {
+			arguments.Get(0).(func(Interface) (CloseReason, bool))(expectedDevice)
+		}).Once()
 	c.On("DisconnectAll", CloseReason{}).Return(12).Once()
 
 	actualDevice, actualConnectError := c.Connect(response, request, header)
@@ -208,6 +218,9 @@ func TestMockConnector(t *testing.T) {
 	assert.Equal(5, c.DisconnectIf(predicate))
 	assert.True(predicateCalled)
 
+	assert.Equal(3, c.DisconnectDeviceIf(devicePredicate))
+	assert.True(devicePredicateCalled)
+
 	assert.Equal(12, c.DisconnectAll(CloseReason{}))
 
 	c.AssertExpectations(t)
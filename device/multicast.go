@@ -0,0 +1,277 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/semaphore"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/go-kit/kit/metrics/provider"
+)
+
+const (
+	DefaultMulticastConcurrency               = 100
+	DefaultMulticastTimeout     time.Duration = 30 * time.Second
+)
+
+var (
+	ErrorNoMulticastTarget = errors.New("A multicast requires a pattern, a list of device IDs, or a query")
+	ErrorInvalidPattern    = errors.New("The multicast destination pattern is invalid")
+)
+
+// MulticastTarget selects the connected devices that receive a multicast message.  At least one
+// field must be set.  When more than one field is set, a device must satisfy all of them.
+type MulticastTarget struct {
+	// IDs is an explicit set of device identifiers.  Devices in this list which are not connected are ignored.
+	IDs []ID
+
+	// Pattern is a glob matched against each device ID using the syntax of path.Match, e.g. mac:112233*
+	Pattern string
+
+	// Query is a device query that each device must satisfy
+	Query *Query
+}
+
+// MulticastResult is the outcome of sending a multicast message to a single device
+type MulticastResult struct {
+	// ID is the identifier of the device
+	ID ID
+
+	// Response is the device's response, if the message was part of a transaction
+	Response *Response
+
+	// Error is the error that occurred sending to this device, if any
+	Error error
+}
+
+// MulticastReport is the aggregated result of a multicast
+type MulticastReport struct {
+	// Results holds one entry for each device that was sent the message
+	Results []MulticastResult
+
+	// Succeeded is the count of devices to which the message was successfully delivered
+	Succeeded int
+
+	// Failed is the count of devices for which an error occurred
+	Failed int
+}
+
+// MulticastOptions configures a MulticastRouter
+type MulticastOptions struct {
+	// MaxConcurrency is the maximum number of devices sent to at the same time.  If nonpositive,
+	// DefaultMulticastConcurrency is used.
+	MaxConcurrency int
+
+	// Timeout is the per-device time limit for sending a message and, for transactions, receiving
+	// the response.  If nonpositive, DefaultMulticastTimeout is used.
+	Timeout time.Duration
+
+	// Authorization is the set of checks made, against the caller in the Multicast context, before each selected
+	// device is sent the message.  If no checks are enabled and the Registry is a Manager created by NewManager,
+	// that Manager's authorization checks are used instead.
+	Authorization AuthorizationOptions
+
+	// MetricsProvider is used to report authorization rejections.  If unset, a discard provider is used.
+	MetricsProvider provider.Provider
+}
+
+func (o *MulticastOptions) maxConcurrency() int {
+	if o != nil && o.MaxConcurrency > 0 {
+		return o.MaxConcurrency
+	}
+
+	return DefaultMulticastConcurrency
+}
+
+func (o *MulticastOptions) timeout() time.Duration {
+	if o != nil && o.Timeout > 0 {
+		return o.Timeout
+	}
+
+	return DefaultMulticastTimeout
+}
+
+func (o *MulticastOptions) authorization() *AuthorizationOptions {
+	if o != nil {
+		return &o.Authorization
+	}
+
+	return nil
+}
+
+func (o *MulticastOptions) metricsProvider() provider.Provider {
+	if o != nil && o.MetricsProvider != nil {
+		return o.MetricsProvider
+	}
+
+	return provider.NewDiscardProvider()
+}
+
+// MulticastRouter dispatches a single WRP message to each of a set of connected devices.
+type MulticastRouter interface {
+	// Multicast sends a copy of the given message to each connected device selected by the target.  Each copy's
+	// Destination is the device's ID, followed by any service path from the original message's Destination.  For
+	// example, a Destination of mac:*/config results in mac:112233445566/config for that device.
+	//
+	// This method blocks until every device has been sent the message or the per-device timeout has elapsed.
+	// Cancelling the given context halts any sends that have not yet completed.  No registry locks are held
+	// while messages are being sent.
+	//
+	// When authorization is configured, each device is checked against the caller in the given context.  Devices
+	// the caller may not message are not sent the message, and their results hold ErrorUnauthorized.
+	Multicast(context.Context, MulticastTarget, *wrp.Message) (MulticastReport, error)
+}
+
+// NewMulticastRouter creates a MulticastRouter which selects devices from the given Registry.
+func NewMulticastRouter(r Registry, o *MulticastOptions) MulticastRouter {
+	if r == nil {
+		panic("A Registry is required")
+	}
+
+	a := newAuthorizer(o.authorization(), NewMeasures(o.metricsProvider()))
+	if m, ok := r.(*manager); ok && a == nil {
+		a = m.authorizer
+	}
+
+	return &multicastRouter{
+		registry:       r,
+		maxConcurrency: o.maxConcurrency(),
+		timeout:        o.timeout(),
+		authorizer:     a,
+	}
+}
+
+type multicastRouter struct {
+	registry       Registry
+	maxConcurrency int
+	timeout        time.Duration
+	authorizer     *authorizer
+}
+
+// selectDevices gathers the devices which satisfy a target.  Visiting only collects devices, so that
+// no locks are held during sends.
+func (mr *multicastRouter) selectDevices(target MulticastTarget) ([]Interface, error) {
+	if len(target.IDs) == 0 && len(target.Pattern) == 0 && target.Query == nil {
+		return nil, ErrorNoMulticastTarget
+	}
+
+	if len(target.Pattern) > 0 {
+		if _, err := path.Match(target.Pattern, ""); err != nil {
+			return nil, ErrorInvalidPattern
+		}
+	}
+
+	matches := func(d Interface) bool {
+		if len(target.Pattern) > 0 {
+			if matched, _ := path.Match(target.Pattern, string(d.ID())); !matched {
+				return false
+			}
+		}
+
+		return target.Query == nil || target.Query.Matches(d)
+	}
+
+	var selected []Interface
+	if len(target.IDs) > 0 {
+		seen := make(map[ID]bool, len(target.IDs))
+		for _, id := range target.IDs {
+			if seen[id] {
+				continue
+			}
+
+			seen[id] = true
+			if d, ok := mr.registry.Get(id); ok && matches(d) {
+				selected = append(selected, d)
+			}
+		}
+	} else {
+		mr.registry.VisitAll(func(d Interface) bool {
+			if matches(d) {
+				selected = append(selected, d)
+			}
+
+			return true
+		})
+	}
+
+	return selected, nil
+}
+
+// deviceMessage creates the copy of a multicast message addressed to a single device
+func deviceMessage(id ID, original *wrp.Message) *wrp.Message {
+	message := *original
+	if i := strings.IndexByte(original.Destination, '/'); i >= 0 {
+		message.Destination = string(id) + original.Destination[i:]
+	} else {
+		message.Destination = string(id)
+	}
+
+	return &message
+}
+
+func (mr *multicastRouter) Multicast(ctx context.Context, target MulticastTarget, message *wrp.Message) (MulticastReport, error) {
+	selected, err := mr.selectDevices(target)
+	if err != nil {
+		return MulticastReport{}, err
+	}
+
+	var (
+		report = MulticastReport{
+			Results: make([]MulticastResult, len(selected)),
+		}
+
+		s  = semaphore.New(mr.maxConcurrency)
+		wg sync.WaitGroup
+	)
+
+	for i, d := range selected {
+		report.Results[i].ID = d.ID()
+		if mr.authorizer != nil {
+			if err := mr.authorizer.authorize(ctx, d); err != nil {
+				report.Results[i].Error = err
+				continue
+			}
+		}
+
+		err := ctx.Err()
+		if err == nil {
+			err = s.AcquireCtx(ctx)
+		}
+
+		if err != nil {
+			// the context was cancelled, so none of the remaining devices will be sent the message
+			for j := i; j < len(selected); j++ {
+				report.Results[j] = MulticastResult{ID: selected[j].ID(), Error: ctx.Err()}
+			}
+
+			break
+		}
+
+		wg.Add(1)
+		go func(result *MulticastResult, d Interface) {
+			defer wg.Done()
+			defer s.Release()
+
+			sendCtx, cancel := context.WithTimeout(ctx, mr.timeout)
+			defer cancel()
+
+			request := (&Request{Message: deviceMessage(result.ID, message), Format: wrp.Msgpack}).WithContext(sendCtx)
+			result.Response, result.Error = d.Send(request)
+		}(&report.Results[i], d)
+	}
+
+	wg.Wait()
+	for _, result := range report.Results {
+		if result.Error != nil {
+			report.Failed++
+		} else {
+			report.Succeeded++
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,332 @@
+package device
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// multicastTestDevice is a device with a fake write pump that records the destinations it was sent
+type multicastTestDevice struct {
+	*device
+
+	lock         sync.Mutex
+	destinations []string
+}
+
+func (mtd *multicastTestDevice) pump(inFlight, maxInFlight *int32, delay time.Duration) {
+	for {
+		select {
+		case <-mtd.shutdown:
+			return
+		case e := <-mtd.messages:
+			current := atomic.AddInt32(inFlight, 1)
+			for {
+				max := atomic.LoadInt32(maxInFlight)
+				if current <= max || atomic.CompareAndSwapInt32(maxInFlight, max, current) {
+					break
+				}
+			}
+
+			time.Sleep(delay)
+			mtd.lock.Lock()
+			mtd.destinations = append(mtd.destinations, e.request.Message.(*wrp.Message).Destination)
+			mtd.lock.Unlock()
+
+			atomic.AddInt32(inFlight, -1)
+			e.complete <- nil
+		}
+	}
+}
+
+func (mtd *multicastTestDevice) sent() []string {
+	mtd.lock.Lock()
+	defer mtd.lock.Unlock()
+	return append([]string{}, mtd.destinations...)
+}
+
+func newMulticastTestDevices(t *testing.T, ids ...ID) ([]*multicastTestDevice, *MockRegistry) {
+	var (
+		devices  []*multicastTestDevice
+		registry = new(MockRegistry)
+	)
+
+	for _, id := range ids {
+		d := &multicastTestDevice{
+			device: newDevice(deviceOptions{ID: id, QueueSize: 1, Logger: logging.NewTestLogger(nil, t)}),
+		}
+
+		devices = append(devices, d)
+		registry.On("Get", id).Return(d.device, true).Maybe()
+	}
+
+	registry.On("Get", mock.AnythingOfType("device.ID")).Return(nil, false).Maybe()
+	registry.On("VisitAll", mock.MatchedBy(func(func(Interface) bool) bool { return true })).
+		Run(func(arguments mock.Arguments) {
+			visitor := arguments.Get(0).(func(Interface) bool)
+			for _, d := range devices {
+				if !visitor(d.device) {
+					break
+				}
+			}
+		}).
+		Return(len(devices)).Maybe()
+
+	return devices, registry
+}
+
+func closeMulticastTestDevices(devices []*multicastTestDevice) {
+	for _, d := range devices {
+		d.requestClose(CloseReason{})
+	}
+}
+
+func testMulticastRouterNilRegistry(t *testing.T) {
+	assert := assert.New(t)
+	assert.Panics(func() {
+		NewMulticastRouter(nil, nil)
+	})
+}
+
+func testMulticastRouterBadTarget(t *testing.T) {
+	var (
+		assert     = assert.New(t)
+		devices, r = newMulticastTestDevices(t, "mac:112233445566")
+		router     = NewMulticastRouter(r, nil)
+	)
+
+	defer closeMulticastTestDevices(devices)
+
+	report, err := router.Multicast(context.Background(), MulticastTarget{}, &wrp.Message{Type: wrp.SimpleEventMessageType})
+	assert.Empty(report.Results)
+	assert.Equal(ErrorNoMulticastTarget, err)
+
+	report, err = router.Multicast(context.Background(), MulticastTarget{Pattern: "mac:["}, &wrp.Message{Type: wrp.SimpleEventMessageType})
+	assert.Empty(report.Results)
+	assert.Equal(ErrorInvalidPattern, err)
+}
+
+func testMulticastRouterPattern(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		inFlight, maxInFlight int32
+		devices, r            = newMulticastTestDevices(t, "mac:112233445566", "uuid:1234", "mac:112233445567", "mac:ffffffffffff")
+		router                = NewMulticastRouter(r, nil)
+	)
+
+	defer closeMulticastTestDevices(devices)
+	for _, d := range devices {
+		go d.pump(&inFlight, &maxInFlight, 0)
+	}
+
+	report, err := router.Multicast(
+		context.Background(),
+		MulticastTarget{Pattern: "mac:11223344556?"},
+		&wrp.Message{Type: wrp.SimpleEventMessageType, Source: "test", Destination: "mac:*/config"},
+	)
+
+	require.NoError(err)
+	require.Len(report.Results, 2)
+	assert.Equal(2, report.Succeeded)
+	assert.Zero(report.Failed)
+	assert.Equal(ID("mac:112233445566"), report.Results[0].ID)
+	assert.Equal(ID("mac:112233445567"), report.Results[1].ID)
+
+	assert.Equal([]string{"mac:112233445566/config"}, devices[0].sent())
+	assert.Empty(devices[1].sent())
+	assert.Equal([]string{"mac:112233445567/config"}, devices[2].sent())
+	assert.Empty(devices[3].sent())
+}
+
+func testMulticastRouterIDsAndQuery(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		inFlight, maxInFlight int32
+		devices, r            = newMulticastTestDevices(t, "mac:112233445566", "uuid:1234", "mac:ffffffffffff")
+		router                = NewMulticastRouter(r, nil)
+	)
+
+	defer closeMulticastTestDevices(devices)
+	for _, d := range devices {
+		go d.pump(&inFlight, &maxInFlight, 0)
+	}
+
+	report, err := router.Multicast(
+		context.Background(),
+		MulticastTarget{
+			IDs:   []ID{"mac:112233445566", "mac:000000000000", "uuid:1234", "mac:112233445566"},
+			Query: MustParseQuery("id ^= mac:"),
+		},
+		&wrp.Message{Type: wrp.SimpleEventMessageType, Source: "test", Destination: "event:device-status"},
+	)
+
+	require.NoError(err)
+	require.Len(report.Results, 1)
+	assert.Equal(1, report.Succeeded)
+	assert.Equal(ID("mac:112233445566"), report.Results[0].ID)
+	assert.Equal([]string{"mac:112233445566"}, devices[0].sent())
+	assert.Empty(devices[1].sent())
+	assert.Empty(devices[2].sent())
+
+	r.AssertNotCalled(t, "VisitAll", mock.Anything)
+}
+
+func testMulticastRouterConcurrency(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		inFlight, maxInFlight int32
+		devices, r            = newMulticastTestDevices(t, "mac:000000000001", "mac:000000000002", "mac:000000000003", "mac:000000000004", "mac:000000000005", "mac:000000000006")
+		router                = NewMulticastRouter(r, &MulticastOptions{MaxConcurrency: 2})
+	)
+
+	defer closeMulticastTestDevices(devices)
+	for _, d := range devices {
+		go d.pump(&inFlight, &maxInFlight, 20*time.Millisecond)
+	}
+
+	report, err := router.Multicast(
+		context.Background(),
+		MulticastTarget{Pattern: "mac:*"},
+		&wrp.Message{Type: wrp.SimpleEventMessageType, Source: "test", Destination: "mac:*"},
+	)
+
+	require.NoError(err)
+	assert.Equal(len(devices), report.Succeeded)
+	assert.True(atomic.LoadInt32(&maxInFlight) <= 2, "no more than 2 sends should be in flight at once")
+}
+
+func testMulticastRouterTimeout(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		inFlight, maxInFlight int32
+		devices, r            = newMulticastTestDevices(t, "mac:112233445566", "mac:ffffffffffff")
+		router                = NewMulticastRouter(r, &MulticastOptions{Timeout: 50 * time.Millisecond})
+	)
+
+	defer closeMulticastTestDevices(devices)
+
+	// only the first device has a write pump, so sends to the second will time out
+	go devices[0].pump(&inFlight, &maxInFlight, 0)
+
+	report, err := router.Multicast(
+		context.Background(),
+		MulticastTarget{Pattern: "mac:*"},
+		&wrp.Message{Type: wrp.SimpleEventMessageType, Source: "test", Destination: "mac:*"},
+	)
+
+	require.NoError(err)
+	require.Len(report.Results, 2)
+	assert.Equal(1, report.Succeeded)
+	assert.Equal(1, report.Failed)
+	assert.NoError(report.Results[0].Error)
+	assert.Equal(context.DeadlineExceeded, report.Results[1].Error)
+}
+
+func testMulticastRouterCancelled(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		devices, r = newMulticastTestDevices(t, "mac:112233445566", "mac:ffffffffffff")
+		router     = NewMulticastRouter(r, nil)
+
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+
+	defer closeMulticastTestDevices(devices)
+	cancel()
+
+	report, err := router.Multicast(
+		ctx,
+		MulticastTarget{IDs: []ID{"mac:112233445566", "mac:ffffffffffff"}},
+		&wrp.Message{Type: wrp.SimpleEventMessageType, Source: "test", Destination: "mac:*"},
+	)
+
+	require.NoError(err)
+	require.Len(report.Results, 2)
+	assert.Zero(report.Succeeded)
+	assert.Equal(2, report.Failed)
+	for _, result := range report.Results {
+		assert.Equal(context.Canceled, result.Error)
+	}
+}
+
+func testMulticastRouterAuthorization(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		p       = xmetricstest.NewProvider(nil, Metrics)
+
+		inFlight, maxInFlight int32
+		devices, r            = newMulticastTestDevices(t, "mac:112233445566", "mac:ffffffffffff")
+		router                = NewMulticastRouter(r, &MulticastOptions{
+			Authorization:   AuthorizationOptions{PartnerOverlap: true},
+			MetricsProvider: p,
+		})
+	)
+
+	defer closeMulticastTestDevices(devices)
+	devices[0].partnerIDs = []string{"comcast"}
+	devices[1].partnerIDs = []string{"cox"}
+	for _, d := range devices {
+		go d.pump(&inFlight, &maxInFlight, 0)
+	}
+
+	report, err := router.Multicast(
+		handler.NewContextWithValue(context.Background(), &handler.ContextValues{PartnerIDs: []string{"comcast"}}),
+		MulticastTarget{Pattern: "mac:*"},
+		&wrp.Message{Type: wrp.SimpleEventMessageType, Source: "test", Destination: "mac:*"},
+	)
+
+	require.NoError(err)
+	require.Len(report.Results, 2)
+	assert.Equal(1, report.Succeeded)
+	assert.Equal(1, report.Failed)
+	assert.NoError(report.Results[0].Error)
+	assert.Equal(ErrorUnauthorized, report.Results[1].Error)
+	assert.Equal([]string{"mac:112233445566"}, devices[0].sent())
+	assert.Empty(devices[1].sent())
+	p.Assert(t, AuthorizationRejectedCounter, "reason", authorizationPartner)(xmetricstest.Value(1.0))
+}
+
+func testMulticastRouterManagerAuthorization(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		m      = NewManager(&Options{Authorization: AuthorizationOptions{PartnerOverlap: true}})
+		router = NewMulticastRouter(m, nil).(*multicastRouter)
+	)
+
+	assert.NotNil(router.authorizer)
+	assert.Equal(m.(*manager).authorizer, router.authorizer)
+	assert.Nil(NewMulticastRouter(NewManager(nil), nil).(*multicastRouter).authorizer)
+}
+
+func TestMulticastRouter(t *testing.T) {
+	t.Run("NilRegistry", testMulticastRouterNilRegistry)
+	t.Run("BadTarget", testMulticastRouterBadTarget)
+	t.Run("Pattern", testMulticastRouterPattern)
+	t.Run("IDsAndQuery", testMulticastRouterIDsAndQuery)
+	t.Run("Concurrency", testMulticastRouterConcurrency)
+	t.Run("Timeout", testMulticastRouterTimeout)
+	t.Run("Cancelled", testMulticastRouterCancelled)
+	t.Run("Authorization", testMulticastRouterAuthorization)
+	t.Run("ManagerAuthorization", testMulticastRouterManagerAuthorization)
+}
@@ -0,0 +1,297 @@
+package device
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics"
+)
+
+const (
+	// DefaultOfflineTTL is the length of time a message is held for a disconnected device
+	// when no TTL is configured.
+	DefaultOfflineTTL time.Duration = 10 * time.Minute
+)
+
+var (
+	ErrorOfflineQueueFull       = errors.New("The offline message queue for that device is full")
+	ErrorOfflineMessageTooLarge = errors.New("The message is too large to be held for an offline device")
+)
+
+// OfflineMessage is a WRP message held on behalf of a device that is not currently connected.
+type OfflineMessage struct {
+	// Message is the decoded WRP message
+	Message *wrp.Message
+
+	// Contents is the Msgpack encoding of Message.  This is the form that is sent to the device.
+	Contents []byte
+
+	// Enqueued is the time at which this message was stored
+	Enqueued time.Time
+
+	// Expires is the time after which this message will no longer be delivered
+	Expires time.Time
+
+	// Caller is the authenticated caller that routed this message, if any.  Since a disconnected device's
+	// attributes are unknown, the caller is authorized against the device when the message is delivered.
+	Caller *handler.ContextValues
+}
+
+// OfflineStore is the storage strategy for messages held for disconnected devices.  Implementations
+// only store messages.  Limits and expiration are enforced by the Manager.
+//
+// Implementations must be safe for concurrent use.
+type OfflineStore interface {
+	// Append adds a message to the end of the given device's queue.
+	Append(ID, OfflineMessage) error
+
+	// Size returns the count of messages and the total length of their Contents held for a device.
+	Size(ID) (int, int, error)
+
+	// Take atomically removes and returns all messages held for a device, oldest first.
+	Take(ID) ([]OfflineMessage, error)
+}
+
+// OfflineQueueOptions configures store-and-forward delivery of messages routed to devices which are
+// not connected.  Only non-transactional messages are ever held, since there is nothing waiting on a response.
+type OfflineQueueOptions struct {
+	// MaxMessages is the maximum number of messages held for any one device.  If nonpositive,
+	// offline queueing is disabled and routing to a disconnected device fails immediately.
+	MaxMessages int
+
+	// MaxBytes is the maximum total size of the encoded messages held for any one device.
+	// If nonpositive, there is no limit on bytes.
+	MaxBytes int
+
+	// TTL is the length of time a message is held.  If nonpositive, DefaultOfflineTTL is used.
+	TTL time.Duration
+
+	// Directory is an optional filesystem directory in which to hold messages.  If unset,
+	// messages are held in memory.
+	Directory string
+
+	// Store is an optional custom OfflineStore.  If set, Directory is ignored.
+	Store OfflineStore
+}
+
+func (o *OfflineQueueOptions) enabled() bool {
+	return o != nil && o.MaxMessages > 0
+}
+
+func (o *OfflineQueueOptions) ttl() time.Duration {
+	if o != nil && o.TTL > 0 {
+		return o.TTL
+	}
+
+	return DefaultOfflineTTL
+}
+
+func (o *OfflineQueueOptions) store(m Measures) OfflineStore {
+	switch {
+	case o != nil && o.Store != nil:
+		return o.Store
+	case o != nil && len(o.Directory) > 0:
+		return NewOfflineFileStore(o.Directory, m.OfflineCorrupt)
+	default:
+		return NewOfflineMemoryStore()
+	}
+}
+
+// offlineQueue enforces the limits and expiration policy for an OfflineStore
+type offlineQueue struct {
+	lock        sync.Mutex
+	store       OfflineStore
+	maxMessages int
+	maxBytes    int
+	ttl         time.Duration
+	now         func() time.Time
+
+	queued   xmetrics.Incrementer
+	expired  xmetrics.Incrementer
+	flushed  xmetrics.Incrementer
+	rejected xmetrics.Incrementer
+}
+
+// newOfflineQueue creates the offline queue described by the given options.  If offline
+// queueing is not enabled, this function returns nil.
+func newOfflineQueue(o *OfflineQueueOptions, now func() time.Time, m Measures) *offlineQueue {
+	if !o.enabled() {
+		return nil
+	}
+
+	if now == nil {
+		now = time.Now
+	}
+
+	return &offlineQueue{
+		store:       o.store(m),
+		maxMessages: o.MaxMessages,
+		maxBytes:    o.MaxBytes,
+		ttl:         o.ttl(),
+		now:         now,
+		queued:      m.OfflineQueued,
+		expired:     m.OfflineExpired,
+		flushed:     m.OfflineFlushed,
+		rejected:    m.OfflineRejected,
+	}
+}
+
+// accepts tests if the given request is eligible to be held for an offline device.
+func (q *offlineQueue) accepts(request *Request) bool {
+	routable, ok := request.Message.(wrp.Routable)
+	return ok && !routable.IsTransactionPart()
+}
+
+// newOfflineMessage produces the stored form of a device request
+func (q *offlineQueue) newOfflineMessage(request *Request) (OfflineMessage, error) {
+	var (
+		om = OfflineMessage{
+			Enqueued: q.now(),
+		}
+
+		message, isMessage = request.Message.(*wrp.Message)
+	)
+
+	om.Expires = om.Enqueued.Add(q.ttl)
+	if caller, ok := handler.FromContext(request.Context()); ok {
+		om.Caller = caller
+	}
+
+	if request.Format == wrp.Msgpack && len(request.Contents) > 0 {
+		om.Contents = request.Contents
+	} else if err := wrp.NewEncoderBytes(&om.Contents, wrp.Msgpack).Encode(request.Message); err != nil {
+		return OfflineMessage{}, err
+	}
+
+	if isMessage {
+		om.Message = message
+	} else {
+		om.Message = new(wrp.Message)
+		if err := wrp.NewDecoderBytes(om.Contents, wrp.Msgpack).Decode(om.Message); err != nil {
+			return OfflineMessage{}, err
+		}
+	}
+
+	return om, nil
+}
+
+// enqueue holds the given request for the device.  If the device's queue is at a limit, expired messages
+// are discarded and returned before the limits are checked again.
+func (q *offlineQueue) enqueue(id ID, request *Request) ([]OfflineMessage, error) {
+	om, err := q.newOfflineMessage(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.maxBytes > 0 && len(om.Contents) > q.maxBytes {
+		q.rejected.Inc()
+		return nil, ErrorOfflineMessageTooLarge
+	}
+
+	// serialize enqueues, so that concurrent routing can't exceed the limits
+	defer q.lock.Unlock()
+	q.lock.Lock()
+
+	count, bytes, err := q.store.Size(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []OfflineMessage
+	if q.full(count, bytes, len(om.Contents)) {
+		var live []OfflineMessage
+		live, expired, err = q.take(id)
+		if err != nil {
+			return nil, err
+		}
+
+		count, bytes = 0, 0
+		for _, m := range live {
+			if err := q.store.Append(id, m); err != nil {
+				return expired, err
+			}
+
+			count++
+			bytes += len(m.Contents)
+		}
+
+		if q.full(count, bytes, len(om.Contents)) {
+			q.rejected.Inc()
+			return expired, ErrorOfflineQueueFull
+		}
+	}
+
+	if err := q.store.Append(id, om); err != nil {
+		return expired, err
+	}
+
+	q.queued.Inc()
+	return expired, nil
+}
+
+// requeue holds messages for a device again after an unsuccessful flush.  The given messages are placed ahead of
+// any held since the flush began, so that delivery order is preserved.  Expired messages are discarded, and messages
+// which do not fit within the limits are rejected, starting with the newest.  Both are returned.
+func (q *offlineQueue) requeue(id ID, messages []OfflineMessage) (expired []OfflineMessage, rejected []OfflineMessage, err error) {
+	defer q.lock.Unlock()
+	q.lock.Lock()
+
+	var held []OfflineMessage
+	held, expired, err = q.take(id)
+	if err != nil {
+		return
+	}
+
+	now := q.now()
+	count, bytes := 0, 0
+	for _, m := range append(messages, held...) {
+		switch {
+		case now.After(m.Expires):
+			expired = append(expired, m)
+			q.expired.Inc()
+
+		case len(rejected) > 0 || q.full(count, bytes, len(m.Contents)):
+			rejected = append(rejected, m)
+			q.rejected.Inc()
+
+		default:
+			if err = q.store.Append(id, m); err != nil {
+				return
+			}
+
+			count++
+			bytes += len(m.Contents)
+		}
+	}
+
+	return
+}
+
+func (q *offlineQueue) full(count, bytes, size int) bool {
+	return count+1 > q.maxMessages || (q.maxBytes > 0 && bytes+size > q.maxBytes)
+}
+
+// take removes all messages held for a device, partitioning them into those that can still be
+// delivered and those that have expired.
+func (q *offlineQueue) take(id ID) (live []OfflineMessage, expired []OfflineMessage, err error) {
+	var messages []OfflineMessage
+	messages, err = q.store.Take(id)
+	if err != nil {
+		return
+	}
+
+	now := q.now()
+	for _, m := range messages {
+		if now.After(m.Expires) {
+			expired = append(expired, m)
+			q.expired.Inc()
+		} else {
+			live = append(live, m)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,328 @@
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// offlineMemoryQueue holds the messages for a single device in an offlineMemoryStore
+type offlineMemoryQueue struct {
+	messages []OfflineMessage
+	bytes    int
+}
+
+// offlineMemoryStore is an OfflineStore that holds messages in process memory
+type offlineMemoryStore struct {
+	lock   sync.Mutex
+	queues map[ID]*offlineMemoryQueue
+}
+
+// NewOfflineMemoryStore creates an OfflineStore that holds messages in memory.  Messages
+// held by the returned store do not survive a process restart.
+func NewOfflineMemoryStore() OfflineStore {
+	return &offlineMemoryStore{
+		queues: make(map[ID]*offlineMemoryQueue),
+	}
+}
+
+func (s *offlineMemoryStore) Append(id ID, m OfflineMessage) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	q := s.queues[id]
+	if q == nil {
+		q = new(offlineMemoryQueue)
+		s.queues[id] = q
+	}
+
+	q.messages = append(q.messages, m)
+	q.bytes += len(m.Contents)
+	return nil
+}
+
+func (s *offlineMemoryStore) Size(id ID) (int, int, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	if q := s.queues[id]; q != nil {
+		return len(q.messages), q.bytes, nil
+	}
+
+	return 0, 0, nil
+}
+
+func (s *offlineMemoryStore) Take(id ID) ([]OfflineMessage, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	if q := s.queues[id]; q != nil {
+		delete(s.queues, id)
+		return q.messages, nil
+	}
+
+	return nil, nil
+}
+
+// offlineRecordHeaderSize is the size of the fixed portion of each record in an offline file:
+// the enqueued time, the expiry time, the length of the contents, and the length of the caller.
+const offlineRecordHeaderSize = 8 + 8 + 4 + 4
+
+// errTruncatedRecord indicates that an offline file ended partway through a record, as happens when
+// a write is interrupted
+var errTruncatedRecord = errors.New("The offline file ends with a partial record")
+
+// offlineFileStore is an OfflineStore that holds each device's messages in an append-only file.
+// Each record in a file is a fixed-size header followed by the Msgpack contents of the message and
+// then the JSON form of the message's caller, if any.
+type offlineFileStore struct {
+	lock      sync.Mutex
+	directory string
+	corrupt   xmetrics.Incrementer
+
+	// sizes caches the count and total bytes of the records in each device's file, so that the limits
+	// checked on every enqueue don't require reading the file.  An entry is built from the file the first
+	// time a device's queue is used, and is discarded whenever the file may no longer match it.
+	sizes map[ID]offlineFileSize
+}
+
+// offlineFileSize is the cached size of one device's file in an offlineFileStore
+type offlineFileSize struct {
+	count int
+	bytes int
+}
+
+// NewOfflineFileStore creates an OfflineStore that holds messages in files under the given directory,
+// one file per device.  The directory is created as needed.  Messages held by the returned store
+// survive a process restart.  Since the size of each device's queue is kept in memory once it has been read,
+// the returned store must be the only one using the directory.
+//
+// Records which cannot be read are skipped, so that a damaged file never strands a device's queue.  Each
+// skipped record is counted with the given Incrementer, which may be nil.
+func NewOfflineFileStore(directory string, corrupt xmetrics.Incrementer) OfflineStore {
+	if corrupt == nil {
+		corrupt = xmetrics.NewIncrementer(discard.NewCounter())
+	}
+
+	return &offlineFileStore{
+		directory: directory,
+		corrupt:   corrupt,
+		sizes:     make(map[ID]offlineFileSize),
+	}
+}
+
+func (s *offlineFileStore) path(id ID) string {
+	return filepath.Join(s.directory, hex.EncodeToString(id.Bytes())+".wrp")
+}
+
+func (s *offlineFileStore) Append(id ID, m OfflineMessage) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	size, err := s.size(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.directory, 0755); err != nil {
+		return err
+	}
+
+	var caller []byte
+	if m.Caller != nil {
+		var err error
+		if caller, err = json.Marshal(m.Caller); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	var header [offlineRecordHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(m.Enqueued.UnixNano()))
+	binary.BigEndian.PutUint64(header[8:16], uint64(m.Expires.UnixNano()))
+	binary.BigEndian.PutUint32(header[16:20], uint32(len(m.Contents)))
+	binary.BigEndian.PutUint32(header[20:24], uint32(len(caller)))
+
+	// write the record in one call, so that a partial record is unlikely on failure
+	record := make([]byte, 0, len(header)+len(m.Contents)+len(caller))
+	record = append(record, header[:]...)
+	record = append(record, m.Contents...)
+	record = append(record, caller...)
+
+	_, err = f.Write(record)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		// the file may hold part of the record, so the next use of this device's queue rereads it
+		delete(s.sizes, id)
+		return err
+	}
+
+	size.count++
+	size.bytes += len(m.Contents)
+	s.sizes[id] = size
+	return nil
+}
+
+// readRecords visits each record in a device's file.  A missing file is treated as an empty queue.
+// If the file ends with a partial record, the complete records are visited and errTruncatedRecord is returned.
+func (s *offlineFileStore) readRecords(id ID, f func(enqueued, expires time.Time, contents, caller []byte) error) error {
+	file, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var (
+		reader    = bufio.NewReader(file)
+		header    [offlineRecordHeaderSize]byte
+		remaining = info.Size()
+	)
+
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return errTruncatedRecord
+		} else if err != nil {
+			return err
+		}
+
+		var (
+			contentsLength = int64(binary.BigEndian.Uint32(header[16:20]))
+			callerLength   = int64(binary.BigEndian.Uint32(header[20:24]))
+		)
+
+		// a damaged header must not cause reads, or allocations, past the end of the file
+		remaining -= offlineRecordHeaderSize + contentsLength + callerLength
+		if remaining < 0 {
+			return errTruncatedRecord
+		}
+
+		contents := make([]byte, contentsLength)
+		caller := make([]byte, callerLength)
+		for _, b := range [][]byte{contents, caller} {
+			if _, err := io.ReadFull(reader, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errTruncatedRecord
+			} else if err != nil {
+				return err
+			}
+		}
+
+		err := f(
+			time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8]))),
+			time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16]))),
+			contents,
+			caller,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *offlineFileStore) Size(id ID) (int, int, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	size, err := s.size(id)
+	return size.count, size.bytes, err
+}
+
+// size returns the cached size of a device's file, reading the file if there is no cached size.
+// This method must be invoked under the lock.
+func (s *offlineFileStore) size(id ID) (offlineFileSize, error) {
+	if size, ok := s.sizes[id]; ok {
+		return size, nil
+	}
+
+	var size offlineFileSize
+	err := s.readRecords(id, func(_, _ time.Time, contents, _ []byte) error {
+		size.count++
+		size.bytes += len(contents)
+		return nil
+	})
+
+	if err == errTruncatedRecord {
+		// the partial record will be discarded by Take
+		err = nil
+	}
+
+	if err != nil {
+		return offlineFileSize{}, err
+	}
+
+	s.sizes[id] = size
+	return size, nil
+}
+
+func (s *offlineFileStore) Take(id ID) ([]OfflineMessage, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	var messages []OfflineMessage
+	err := s.readRecords(id, func(enqueued, expires time.Time, contents, caller []byte) error {
+		message := new(wrp.Message)
+		if err := wrp.NewDecoderBytes(contents, wrp.Msgpack).Decode(message); err != nil {
+			s.corrupt.Inc()
+			return nil
+		}
+
+		om := OfflineMessage{
+			Message:  message,
+			Contents: contents,
+			Enqueued: enqueued,
+			Expires:  expires,
+		}
+
+		if len(caller) > 0 {
+			om.Caller = new(handler.ContextValues)
+			if err := json.Unmarshal(caller, om.Caller); err != nil {
+				s.corrupt.Inc()
+				return nil
+			}
+		}
+
+		messages = append(messages, om)
+		return nil
+	})
+
+	if err == errTruncatedRecord {
+		s.corrupt.Inc()
+	} else if err != nil {
+		return nil, err
+	}
+
+	delete(s.sizes, id)
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return messages, nil
+}
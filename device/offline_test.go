@@ -0,0 +1,512 @@
+package device
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/go-kit/kit/metrics/provider"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOfflineMessage(payload string, enqueued time.Time) OfflineMessage {
+	message := &wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "test",
+		Destination: "mac:112233445566/service",
+		Payload:     []byte(payload),
+	}
+
+	return OfflineMessage{
+		Message:  message,
+		Contents: wrp.MustEncode(message, wrp.Msgpack),
+		Enqueued: enqueued,
+		Expires:  enqueued.Add(time.Minute),
+	}
+}
+
+func testOfflineStore(t *testing.T, s OfflineStore) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		id       = ID("mac:112233445566")
+		enqueued = time.Unix(1550000000, 0)
+		first    = newTestOfflineMessage("first", enqueued)
+		second   = newTestOfflineMessage("second", enqueued.Add(time.Second))
+	)
+
+	second.Caller = &handler.ContextValues{SatClientID: "test", PartnerIDs: []string{"comcast"}, Trust: "1000"}
+
+	count, bytes, err := s.Size(id)
+	assert.Zero(count)
+	assert.Zero(bytes)
+	assert.NoError(err)
+
+	messages, err := s.Take(id)
+	assert.Empty(messages)
+	assert.NoError(err)
+
+	require.NoError(s.Append(id, first))
+	require.NoError(s.Append(id, second))
+	require.NoError(s.Append(ID("mac:ffffffffffff"), first))
+
+	count, bytes, err = s.Size(id)
+	assert.Equal(2, count)
+	assert.Equal(len(first.Contents)+len(second.Contents), bytes)
+	assert.NoError(err)
+
+	messages, err = s.Take(id)
+	require.NoError(err)
+	require.Len(messages, 2)
+	for i, expected := range []OfflineMessage{first, second} {
+		assert.Equal(expected.Message, messages[i].Message)
+		assert.Equal(expected.Contents, messages[i].Contents)
+		assert.True(expected.Enqueued.Equal(messages[i].Enqueued))
+		assert.True(expected.Expires.Equal(messages[i].Expires))
+		assert.Equal(expected.Caller, messages[i].Caller)
+	}
+
+	count, bytes, err = s.Size(id)
+	assert.Zero(count)
+	assert.Zero(bytes)
+	assert.NoError(err)
+
+	count, _, err = s.Size(ID("mac:ffffffffffff"))
+	assert.Equal(1, count)
+	assert.NoError(err)
+}
+
+func TestOfflineMemoryStore(t *testing.T) {
+	testOfflineStore(t, NewOfflineMemoryStore())
+}
+
+func TestOfflineFileStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "offline")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	testOfflineStore(t, NewOfflineFileStore(directory, nil))
+}
+
+func TestOfflineFileStoreCorrupt(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		id       = ID("mac:112233445566")
+		enqueued = time.Unix(1550000000, 0)
+		p        = xmetricstest.NewProvider(nil, Metrics)
+	)
+
+	directory, err := ioutil.TempDir("", "offline")
+	require.NoError(err)
+	defer os.RemoveAll(directory)
+
+	s := NewOfflineFileStore(directory, NewMeasures(p).OfflineCorrupt)
+	require.NoError(s.Append(id, newTestOfflineMessage("first", enqueued)))
+	require.NoError(s.Append(id, OfflineMessage{Contents: []byte{0xc1}, Enqueued: enqueued, Expires: enqueued.Add(time.Minute)}))
+	require.NoError(s.Append(id, newTestOfflineMessage("second", enqueued)))
+
+	// simulate an interrupted write, with a header that claims more than the file holds
+	path := s.(*offlineFileStore).path(id)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	count, _, err := s.Size(id)
+	assert.Equal(3, count)
+	assert.NoError(err)
+
+	messages, err := s.Take(id)
+	require.NoError(err)
+	require.Len(messages, 2)
+	assert.Equal("first", string(messages[0].Message.Payload))
+	assert.Equal("second", string(messages[1].Message.Payload))
+	p.Assert(t, OfflineCorruptCounter)(xmetricstest.Value(2.0))
+
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	// the queue is usable again
+	require.NoError(s.Append(id, newTestOfflineMessage("third", enqueued)))
+	count, _, err = s.Size(id)
+	assert.Equal(1, count)
+	assert.NoError(err)
+}
+
+func TestOfflineFileStoreSize(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		id       = ID("mac:112233445566")
+		enqueued = time.Unix(1550000000, 0)
+	)
+
+	directory, err := ioutil.TempDir("", "offline")
+	require.NoError(err)
+	defer os.RemoveAll(directory)
+
+	s := NewOfflineFileStore(directory, nil)
+	require.NoError(s.Append(id, newTestOfflineMessage("first", enqueued)))
+	require.NoError(s.Append(id, newTestOfflineMessage("second", enqueued)))
+
+	count, bytes, err := s.Size(id)
+	require.NoError(err)
+	assert.Equal(2, count)
+	assert.True(bytes > 0)
+
+	// a new store, as after a restart, rebuilds the size from the file
+	restarted := NewOfflineFileStore(directory, nil)
+	restartedCount, restartedBytes, err := restarted.Size(id)
+	require.NoError(err)
+	assert.Equal(count, restartedCount)
+	assert.Equal(bytes, restartedBytes)
+
+	// once known, the size is maintained without reading the file again
+	require.NoError(s.Append(id, newTestOfflineMessage("third", enqueued)))
+	contents, err := ioutil.ReadFile(s.(*offlineFileStore).path(id))
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(s.(*offlineFileStore).path(id), contents[:len(contents)/2], 0644))
+
+	count, bytes, err = s.Size(id)
+	require.NoError(err)
+	assert.Equal(3, count)
+	assert.True(bytes > restartedBytes)
+
+	_, err = s.Take(id)
+	require.NoError(err)
+
+	count, bytes, err = s.Size(id)
+	require.NoError(err)
+	assert.Zero(count)
+	assert.Zero(bytes)
+}
+
+func testOfflineQueueDisabled(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(newOfflineQueue(nil, nil, NewMeasures(provider.NewDiscardProvider())))
+	assert.Nil(newOfflineQueue(new(OfflineQueueOptions), nil, NewMeasures(provider.NewDiscardProvider())))
+}
+
+func testOfflineQueueAccepts(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		q      = newOfflineQueue(&OfflineQueueOptions{MaxMessages: 1}, nil, NewMeasures(provider.NewDiscardProvider()))
+	)
+
+	assert.True(q.accepts(&Request{Message: &wrp.SimpleEvent{Destination: "mac:112233445566"}}))
+	assert.True(q.accepts(&Request{Message: &wrp.Message{Type: wrp.UpdateMessageType, Destination: "mac:112233445566"}}))
+	assert.False(q.accepts(&Request{Message: &wrp.Message{Type: wrp.UpdateMessageType, Destination: "mac:112233445566", TransactionUUID: "123"}}))
+	assert.False(q.accepts(&Request{Message: &wrp.SimpleRequestResponse{Destination: "mac:112233445566", TransactionUUID: "123"}}))
+	assert.False(q.accepts(&Request{}))
+}
+
+func testOfflineQueueLimits(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		id      = ID("mac:112233445566")
+		now     = time.Now()
+		p       = xmetricstest.NewProvider(nil, Metrics)
+		message = &wrp.SimpleEvent{Source: "test", Destination: string(id), Payload: []byte("payload")}
+		size    = len(wrp.MustEncode(message, wrp.Msgpack))
+
+		q = newOfflineQueue(
+			&OfflineQueueOptions{MaxMessages: 3, MaxBytes: 2 * size, TTL: time.Minute},
+			func() time.Time { return now },
+			NewMeasures(p),
+		)
+	)
+
+	require.NotNil(q)
+	for i := 0; i < 2; i++ {
+		expired, err := q.enqueue(id, &Request{Message: message, Format: wrp.JSON})
+		assert.Empty(expired)
+		assert.NoError(err)
+	}
+
+	// the byte limit is reached before the message limit
+	expired, err := q.enqueue(id, &Request{Message: message})
+	assert.Empty(expired)
+	assert.Equal(ErrorOfflineQueueFull, err)
+	p.Assert(t, OfflineQueuedCounter)(xmetricstest.Value(2.0))
+	p.Assert(t, OfflineRejectedCounter)(xmetricstest.Value(1.0))
+
+	// once the held messages expire, room is made for new ones
+	now = now.Add(2 * time.Minute)
+	expired, err = q.enqueue(id, &Request{Message: message})
+	assert.Len(expired, 2)
+	assert.NoError(err)
+	p.Assert(t, OfflineQueuedCounter)(xmetricstest.Value(3.0))
+	p.Assert(t, OfflineExpiredCounter)(xmetricstest.Value(2.0))
+
+	live, expired, err := q.take(id)
+	assert.Len(live, 1)
+	assert.Empty(expired)
+	assert.NoError(err)
+	assert.Equal(message.Payload, live[0].Message.Payload)
+
+	expired, err = q.enqueue(id, &Request{Message: &wrp.SimpleEvent{Destination: string(id), Payload: make([]byte, 3*size)}})
+	assert.Empty(expired)
+	assert.Equal(ErrorOfflineMessageTooLarge, err)
+}
+
+func testOfflineQueueRequeue(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		id  = ID("mac:112233445566")
+		now = time.Now()
+		p   = xmetricstest.NewProvider(nil, Metrics)
+
+		q = newOfflineQueue(
+			&OfflineQueueOptions{MaxMessages: 3, TTL: time.Minute},
+			func() time.Time { return now },
+			NewMeasures(p),
+		)
+
+		stale  = newTestOfflineMessage("stale", now.Add(-2*time.Minute))
+		first  = newTestOfflineMessage("first", now)
+		second = newTestOfflineMessage("second", now)
+	)
+
+	require.NotNil(q)
+
+	// a message held while the flush was in progress
+	_, err := q.enqueue(id, &Request{Message: &wrp.SimpleEvent{Source: "test", Destination: string(id), Payload: []byte("during")}})
+	require.NoError(err)
+
+	expired, rejected, err := q.requeue(id, []OfflineMessage{stale, first, second})
+	require.NoError(err)
+	require.Len(expired, 1)
+	assert.Equal("stale", string(expired[0].Message.Payload))
+	assert.Empty(rejected)
+
+	count, _, err := q.store.Size(id)
+	assert.Equal(3, count)
+	assert.NoError(err)
+
+	// the requeued messages go ahead of the held message, and the newest messages are rejected at the limit
+	expired, rejected, err = q.requeue(id, []OfflineMessage{newTestOfflineMessage("third", now)})
+	require.NoError(err)
+	assert.Empty(expired)
+	require.Len(rejected, 1)
+	assert.Equal("during", string(rejected[0].Message.Payload))
+
+	live, _, err := q.take(id)
+	require.NoError(err)
+	require.Len(live, 3)
+	for i, expected := range []string{"third", "first", "second"} {
+		assert.Equal(expected, string(live[i].Message.Payload))
+	}
+
+	p.Assert(t, OfflineExpiredCounter)(xmetricstest.Value(1.0))
+	p.Assert(t, OfflineRejectedCounter)(xmetricstest.Value(1.0))
+}
+
+func TestOfflineQueue(t *testing.T) {
+	t.Run("Disabled", testOfflineQueueDisabled)
+	t.Run("Accepts", testOfflineQueueAccepts)
+	t.Run("Limits", testOfflineQueueLimits)
+	t.Run("Requeue", testOfflineQueueRequeue)
+}
+
+func testManagerOfflineDisabled(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		manager = NewManager(&Options{Logger: logging.NewTestLogger(nil, t)})
+	)
+
+	response, err := manager.Route(&Request{Message: &wrp.SimpleEvent{Destination: string(testDeviceIDs[0])}})
+	assert.Nil(response)
+	assert.Equal(ErrorDeviceNotFound, err)
+}
+
+func testManagerOfflineFlush(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		eventLock sync.Mutex
+		events    = make(map[EventType]int)
+		flushed   = make(chan struct{}, 2)
+		closed    = make(chan struct{})
+
+		options = &Options{
+			Logger:       logging.NewTestLogger(nil, t),
+			OfflineQueue: OfflineQueueOptions{MaxMessages: 10},
+			Listeners: []Listener{
+				func(e *Event) {
+					eventLock.Lock()
+					events[e.Type]++
+					eventLock.Unlock()
+
+					switch e.Type {
+					case OfflineMessageFlushed:
+						assert.Equal(testDeviceIDs[0], e.Device.ID())
+						flushed <- struct{}{}
+					case Disconnect:
+						close(closed)
+					}
+				},
+			},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	for _, payload := range []string{"first", "second"} {
+		response, err := manager.Route(&Request{
+			Message: &wrp.SimpleEvent{Source: "test", Destination: string(testDeviceIDs[0]), Payload: []byte(payload)},
+			Format:  wrp.Msgpack,
+		})
+
+		assert.Nil(response)
+		require.NoError(err)
+	}
+
+	// transactional messages are never held
+	response, err := manager.Route(&Request{
+		Message: &wrp.SimpleRequestResponse{Source: "test", Destination: string(testDeviceIDs[0]), TransactionUUID: "123"},
+	})
+
+	assert.Nil(response)
+	assert.Equal(ErrorDeviceNotFound, err)
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+
+	for _, expected := range []string{"first", "second"} {
+		require.NoError(connection.SetReadDeadline(time.Now().Add(10 * time.Second)))
+		messageType, data, err := connection.ReadMessage()
+		require.NoError(err)
+		assert.Equal(websocket.BinaryMessage, messageType)
+
+		var actual wrp.Message
+		require.NoError(wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&actual))
+		assert.Equal(expected, string(actual.Payload))
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-flushed:
+		case <-time.After(10 * time.Second):
+			assert.Fail("No flush event was dispatched")
+		}
+	}
+
+	assert.NoError(connection.Close())
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		assert.Fail("The device did not disconnect")
+	}
+
+	eventLock.Lock()
+	assert.Equal(2, events[OfflineMessageQueued])
+	assert.Equal(2, events[OfflineMessageFlushed])
+	assert.Zero(events[OfflineMessageExpired])
+	eventLock.Unlock()
+}
+
+func testManagerOfflineAuthorization(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		p       = xmetricstest.NewProvider(nil, Metrics)
+
+		failed  = make(chan error, 1)
+		flushed = make(chan struct{}, 1)
+		closed  = make(chan struct{})
+
+		options = &Options{
+			Authorization:   AuthorizationOptions{PartnerOverlap: true},
+			OfflineQueue:    OfflineQueueOptions{MaxMessages: 10},
+			MetricsProvider: p,
+			Listeners: []Listener{
+				func(e *Event) {
+					switch e.Type {
+					case MessageFailed:
+						failed <- e.Error
+					case OfflineMessageFlushed:
+						flushed <- struct{}{}
+					case Disconnect:
+						close(closed)
+					}
+				},
+			},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	// the test device connects without partner IDs, so only a wildcard caller may message it
+	for _, caller := range []*handler.ContextValues{{PartnerIDs: []string{"comcast"}}, {PartnerIDs: []string{WildcardPartnerID}}} {
+		response, err := manager.Route((&Request{
+			Message: &wrp.SimpleEvent{Source: "test", Destination: string(testDeviceIDs[0]), Payload: []byte(caller.PartnerIDs[0])},
+			Format:  wrp.Msgpack,
+		}).WithContext(handler.NewContextWithValue(context.Background(), caller)))
+
+		assert.Nil(response)
+		require.NoError(err)
+	}
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+
+	require.NoError(connection.SetReadDeadline(time.Now().Add(10 * time.Second)))
+	_, data, err := connection.ReadMessage()
+	require.NoError(err)
+
+	var actual wrp.Message
+	require.NoError(wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&actual))
+	assert.Equal(WildcardPartnerID, string(actual.Payload))
+
+	select {
+	case err := <-failed:
+		assert.Equal(ErrorUnauthorized, err)
+	case <-time.After(10 * time.Second):
+		assert.Fail("No failure event was dispatched for the unauthorized message")
+	}
+
+	select {
+	case <-flushed:
+	case <-time.After(10 * time.Second):
+		assert.Fail("No flush event was dispatched")
+	}
+
+	assert.NoError(connection.Close())
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		assert.Fail("The device did not disconnect")
+	}
+
+	p.Assert(t, AuthorizationRejectedCounter, "reason", authorizationPartner)(xmetricstest.Value(1.0))
+	p.Assert(t, OfflineFlushedCounter)(xmetricstest.Value(1.0))
+}
+
+func TestManagerOffline(t *testing.T) {
+	t.Run("Disabled", testManagerOfflineDisabled)
+	t.Run("Flush", testManagerOfflineFlush)
+	t.Run("Authorization", testManagerOfflineAuthorization)
+}
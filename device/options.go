@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics/provider"
 	"github.com/gorilla/websocket"
@@ -33,10 +34,19 @@ type Options struct {
 	// Upgrader is the gorilla websocket.Upgrader injected into these options.
 	Upgrader websocket.Upgrader
 
+	// Compression configures permessage-deflate compression with devices that support it.  Enabling
+	// compression here is equivalent to setting Upgrader.EnableCompression, but also allows the compression
+	// level and minimum frame size to be configured.
+	Compression CompressionOptions
+
 	// MaxDevices is the maximum number of devices allowed to connect to any one Manager.
 	// If unset (i.e. zero), math.MaxUint32 is used as the maximum.
 	MaxDevices int
 
+	// RegistryShards is the number of lock-striped partitions used to hold connected devices.
+	// If unset or less than 2, all devices are held in a single map guarded by one lock.
+	RegistryShards int
+
 	// DeviceMessageQueueSize is the capacity of the channel which stores messages waiting
 	// to be transmitted to a device.  If not supplied, DefaultDeviceMessageQueueSize is used.
 	DeviceMessageQueueSize int
@@ -55,9 +65,48 @@ type Options struct {
 	// DefaultWriteTimeout is used.
 	WriteTimeout time.Duration
 
+	// OfflineQueue configures the optional holding of messages for devices that are not connected.
+	// By default, offline queueing is disabled.
+	OfflineQueue OfflineQueueOptions
+
+	// Sessions configures the optional resumption of a device's session when it reconnects shortly
+	// after losing its connection.  By default, sessions are not resumable.
+	Sessions SessionOptions
+
+	// Transactions configures the retrying of idempotent requests and how long timed out transactions are
+	// remembered in order to recognize late responses.  By default, requests are never resent.
+	Transactions TransactionOptions
+
+	// RateLimits configures optional token bucket limits on the messages sent to and received from
+	// devices.  By default, device traffic is not rate limited.
+	RateLimits RateLimitOptions
+
+	// Authorization configures the checks which compare a caller's security context with the attributes of the
+	// device being messaged.  By default, any caller may message any device.
+	Authorization AuthorizationOptions
+
+	// Validator checks each message received from devices, which are dropped if invalid.  wrp.DefaultValidator()
+	// enforces the WRP specification.  By default, messages are not validated.
+	Validator wrp.Validator
+
+	// PooledMessages enables pooled decoding of the messages received from devices, which greatly reduces
+	// garbage at high message rates.  Each message is released back to the pool once it has been dispatched,
+	// so listeners must strictly honor the Event contract and never retain an event's Message or Contents.
+	// Listeners that need to retain them must copy them, e.g. via wrp.Message.Clone, or be delivered via an EventBus.
+	PooledMessages bool
+
+	// CloseCodes overrides entries in DefaultCloseCodes, which determine the close code sent to a device
+	// along with the text of the reason it was disconnected.
+	CloseCodes CloseCodes
+
 	// Listeners contains the event sinks for managers created using these options
 	Listeners []Listener
 
+	// EventBus configures the optional asynchronous delivery of events to Listeners.  By default,
+	// listeners are invoked synchronously by each device's read and write goroutines.  An EventBus
+	// is stopped via the Manager's Closer implementation.
+	EventBus EventBusOptions
+
 	// Logger is the output sink for log messages.  If not supplied, log output
 	// is sent to a NOP logger.
 	Logger log.Logger
@@ -73,11 +122,22 @@ func (o *Options) upgrader() *websocket.Upgrader {
 	upgrader := new(websocket.Upgrader)
 	if o != nil {
 		*upgrader = o.Upgrader
+		if o.Compression.enabled() {
+			upgrader.EnableCompression = true
+		}
 	}
 
 	return upgrader
 }
 
+func (o *Options) compression() *CompressionOptions {
+	if o != nil {
+		return &o.Compression
+	}
+
+	return nil
+}
+
 func (o *Options) deviceMessageQueueSize() int {
 	if o != nil && o.DeviceMessageQueueSize > 0 {
 		return o.DeviceMessageQueueSize
@@ -94,6 +154,14 @@ func (o *Options) maxDevices() int {
 	return 0
 }
 
+func (o *Options) registryShards() int {
+	if o != nil && o.RegistryShards > 1 {
+		return o.RegistryShards
+	}
+
+	return 1
+}
+
 func (o *Options) idlePeriod() time.Duration {
 	if o != nil && o.IdlePeriod > 0 {
 		return o.IdlePeriod
@@ -126,6 +194,70 @@ func (o *Options) writeTimeout() time.Duration {
 	return DefaultWriteTimeout
 }
 
+func (o *Options) offlineQueue() *OfflineQueueOptions {
+	if o != nil {
+		return &o.OfflineQueue
+	}
+
+	return nil
+}
+
+func (o *Options) sessions() *SessionOptions {
+	if o != nil {
+		return &o.Sessions
+	}
+
+	return nil
+}
+
+func (o *Options) transactions() *TransactionOptions {
+	if o != nil {
+		return &o.Transactions
+	}
+
+	return nil
+}
+
+func (o *Options) rateLimits() *RateLimitOptions {
+	if o != nil {
+		return &o.RateLimits
+	}
+
+	return nil
+}
+
+func (o *Options) authorization() *AuthorizationOptions {
+	if o != nil {
+		return &o.Authorization
+	}
+
+	return nil
+}
+
+func (o *Options) validator() wrp.Validator {
+	if o != nil {
+		return o.Validator
+	}
+
+	return nil
+}
+
+func (o *Options) pooledMessages() bool {
+	if o != nil {
+		return o.PooledMessages
+	}
+
+	return false
+}
+
+func (o *Options) closeCodes() CloseCodes {
+	if o != nil {
+		return DefaultCloseCodes().merge(o.CloseCodes)
+	}
+
+	return DefaultCloseCodes()
+}
+
 func (o *Options) logger() log.Logger {
 	if o != nil && o.Logger != nil {
 		return o.Logger
@@ -142,6 +274,14 @@ func (o *Options) listeners() []Listener {
 	return nil
 }
 
+func (o *Options) eventBus() *EventBusOptions {
+	if o != nil {
+		return &o.EventBus
+	}
+
+	return nil
+}
+
 func (o *Options) metricsProvider() provider.Provider {
 	if o != nil && o.MetricsProvider != nil {
 		return o.MetricsProvider
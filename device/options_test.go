@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
 	"github.com/go-kit/kit/metrics/provider"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -19,9 +20,21 @@ func TestOptionsDefault(t *testing.T) {
 		assert.Equal(DefaultDeviceMessageQueueSize, o.deviceMessageQueueSize())
 		assert.NotNil(o.upgrader())
 		assert.Equal(0, o.maxDevices())
+		assert.Equal(1, o.registryShards())
 		assert.Equal(DefaultIdlePeriod, o.idlePeriod())
 		assert.Equal(DefaultPingPeriod, o.pingPeriod())
 		assert.Equal(DefaultWriteTimeout, o.writeTimeout())
+		assert.False(o.sessions().enabled())
+		assert.False(o.transactions().retryable(wrp.RetrieveMessageType))
+		assert.Equal(DefaultLateWindow, o.transactions().lateWindow())
+		assert.False(o.rateLimits().enabled())
+		assert.False(o.authorization().enabled())
+		assert.Equal(DefaultCloseCodes(), o.closeCodes())
+		assert.Nil(o.validator())
+		assert.False(o.pooledMessages())
+		assert.False(o.eventBus().enabled())
+		assert.False(o.compression().enabled())
+		assert.False(o.upgrader().EnableCompression)
 		assert.NotNil(o.logger())
 		assert.Empty(o.listeners())
 		assert.Equal(provider.NewDiscardProvider(), o.metricsProvider())
@@ -42,12 +55,22 @@ func TestOptions(t *testing.T) {
 				Subprotocols:     []string{"foobar"},
 			},
 			MaxDevices:             20000,
+			RegistryShards:         16,
 			DeviceMessageQueueSize: DefaultDeviceMessageQueueSize + 287342,
 			IdlePeriod:             DefaultIdlePeriod + 3472*time.Minute,
 			PingPeriod:             DefaultPingPeriod + 384*time.Millisecond,
 			WriteTimeout:           DefaultWriteTimeout + 327193*time.Second,
+			Sessions:               SessionOptions{GracePeriod: 15 * time.Second, KeepMessages: true},
+			Transactions:           TransactionOptions{AttemptTimeout: time.Second, MaxRetries: 2, LateWindow: time.Hour},
+			RateLimits:             RateLimitOptions{Inbound: RateLimit{Rate: 10.0, Burst: 20, Action: RateLimitDelay}},
+			Authorization:          AuthorizationOptions{PartnerOverlap: true, MinimumTrust: 1000},
+			CloseCodes:             CloseCodes{DuplicateCloseReason: 4100, "custom": 4200},
+			Validator:              wrp.DefaultValidator(),
+			PooledMessages:         true,
 			Logger:                 expectedLogger,
 			Listeners:              []Listener{func(*Event) {}},
+			EventBus:               EventBusOptions{QueueSize: 1000, Overflow: OverflowDropNewest},
+			Compression:            CompressionOptions{Enabled: true, Level: 6, MinSize: 256},
 			MetricsProvider:        expectedMetricsProvider,
 		}
 	)
@@ -55,19 +78,39 @@ func TestOptions(t *testing.T) {
 	assert.Equal(o.DeviceMessageQueueSize, o.deviceMessageQueueSize())
 	assert.Equal(
 		websocket.Upgrader{
-			HandshakeTimeout: 12377123 * time.Second,
-			ReadBufferSize:   DefaultReadBufferSize + 48729,
-			WriteBufferSize:  DefaultWriteBufferSize + 926,
-			Subprotocols:     []string{"foobar"},
+			HandshakeTimeout:  12377123 * time.Second,
+			ReadBufferSize:    DefaultReadBufferSize + 48729,
+			WriteBufferSize:   DefaultWriteBufferSize + 926,
+			Subprotocols:      []string{"foobar"},
+			EnableCompression: true,
 		},
 		*o.upgrader(),
 	)
 
 	assert.Equal(20000, o.maxDevices())
+	assert.Equal(16, o.registryShards())
 	assert.Equal(o.IdlePeriod, o.idlePeriod())
 	assert.Equal(o.PingPeriod, o.pingPeriod())
 	assert.Equal(o.WriteTimeout, o.writeTimeout())
+	assert.True(o.sessions().enabled())
+	assert.Equal(o.Sessions, *o.sessions())
+	assert.Equal(o.Transactions, *o.transactions())
+	assert.True(o.transactions().retryable(wrp.RetrieveMessageType))
+	assert.Equal(time.Hour, o.transactions().lateWindow())
+	assert.True(o.rateLimits().enabled())
+	assert.Equal(o.RateLimits, *o.rateLimits())
+	assert.True(o.authorization().enabled())
+	assert.Equal(o.Authorization, *o.authorization())
+	assert.Equal(o.Validator, o.validator())
+	assert.True(o.pooledMessages())
+	assert.Equal(4100, o.closeCodes().Code(DuplicateCloseReason))
+	assert.Equal(4200, o.closeCodes().Code("custom"))
+	assert.Equal(DefaultCloseCodes().Code(RateLimitedCloseReason), o.closeCodes().Code(RateLimitedCloseReason))
 	assert.Equal(expectedLogger, o.logger())
 	assert.Equal(o.Listeners, o.listeners())
+	assert.True(o.eventBus().enabled())
+	assert.Equal(o.EventBus, *o.eventBus())
+	assert.True(o.compression().enabled())
+	assert.Equal(o.Compression, *o.compression())
 	assert.Equal(expectedMetricsProvider, o.metricsProvider())
 }
@@ -0,0 +1,505 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrorEmptyQuery = errors.New("A device query cannot be empty")
+)
+
+// Query is a compiled filter expression over device metadata.  Queries are created with ParseQuery,
+// and are safe for concurrent use.
+//
+// The query language is a set of comparisons joined with the keywords and, or, and not.  Parentheses
+// may be used for grouping.  Keywords are case-insensitive, and and binds more tightly than or.  For example:
+//
+//	id ^= "mac:" and (convey.hw-model = "XB3" or partner = comcast) and uptime > 1h
+//
+// The fields available for comparison are:
+//
+//	id                                  the canonical device ID
+//	trust                               the trust level of the device
+//	partner                             any one of the device's partner IDs
+//	convey.<key>                        the value of the given key in the device's convey
+//	uptime                              the length of time the device has been connected, e.g. 90s or 2h
+//	duplications, pending               integer device counters
+//	bytesSent, bytesReceived,
+//	messagesSent, messagesReceived      integer device statistics
+//
+// String fields support = (equals), != (does not equal), ^= (starts with), $= (ends with), and *= (contains).
+// Numeric fields support =, !=, <, <=, >, and >=.  Values may be double-quoted, and must be quoted if they
+// contain whitespace, parentheses, or operator characters.
+//
+// A comparison against partner matches if any partner ID satisfies it, with != matching only when no partner
+// ID is equal.  A comparison against a convey key that the device does not have only matches with !=.
+type Query struct {
+	expression string
+	root       queryNode
+}
+
+// ParseQuery compiles a device query expression.
+func ParseQuery(expression string) (*Query, error) {
+	tokens, err := lexQuery(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, ErrorEmptyQuery
+	}
+
+	p := &queryParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, p.unexpected(t)
+	}
+
+	return &Query{expression: expression, root: root}, nil
+}
+
+// MustParseQuery is like ParseQuery, except that it panics if the expression is invalid.
+func MustParseQuery(expression string) *Query {
+	q, err := ParseQuery(expression)
+	if err != nil {
+		panic(err)
+	}
+
+	return q
+}
+
+// Matches tests if the given device satisfies this query
+func (q *Query) Matches(d Interface) bool {
+	return q.root.matches(d)
+}
+
+// String returns the original expression used to create this query
+func (q *Query) String() string {
+	return q.expression
+}
+
+// queryNode is a compiled element of a query's syntax tree
+type queryNode interface {
+	matches(Interface) bool
+}
+
+type andNode []queryNode
+
+func (n andNode) matches(d Interface) bool {
+	for _, child := range n {
+		if !child.matches(d) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type orNode []queryNode
+
+func (n orNode) matches(d Interface) bool {
+	for _, child := range n {
+		if child.matches(d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type notNode struct {
+	child queryNode
+}
+
+func (n notNode) matches(d Interface) bool {
+	return !n.child.matches(d)
+}
+
+// stringNode matches if any of the values extracted from a device pass its test
+type stringNode struct {
+	values func(Interface) []string
+	test   func(string) bool
+}
+
+func (n stringNode) matches(d Interface) bool {
+	for _, v := range n.values(d) {
+		if n.test(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type numericNode struct {
+	value   func(Interface) int64
+	compare func(int64) bool
+}
+
+func (n numericNode) matches(d Interface) bool {
+	return n.compare(n.value(d))
+}
+
+// queryField describes a device attribute that can appear on the left side of a comparison
+type queryField struct {
+	strings  func(Interface) []string
+	integer  func(Interface) int64
+	duration bool
+}
+
+func statisticsField(f func(Statistics) int) queryField {
+	return queryField{
+		integer: func(d Interface) int64 { return int64(f(d.Statistics())) },
+	}
+}
+
+var queryFields = map[string]queryField{
+	"id": {
+		strings: func(d Interface) []string { return []string{string(d.ID())} },
+	},
+	"trust": {
+		strings: func(d Interface) []string { return []string{d.Trust()} },
+	},
+	"partner": {
+		strings: func(d Interface) []string { return d.PartnerIDs() },
+	},
+	"uptime": {
+		integer:  func(d Interface) int64 { return int64(d.Statistics().UpTime()) },
+		duration: true,
+	},
+	"pending": {
+		integer: func(d Interface) int64 { return int64(d.Pending()) },
+	},
+	"duplications":     statisticsField(Statistics.Duplications),
+	"bytesSent":        statisticsField(Statistics.BytesSent),
+	"bytesReceived":    statisticsField(Statistics.BytesReceived),
+	"messagesSent":     statisticsField(Statistics.MessagesSent),
+	"messagesReceived": statisticsField(Statistics.MessagesReceived),
+}
+
+// conveyPrefix is the prefix of field names that refer to convey keys
+const conveyPrefix = "convey."
+
+func lookupQueryField(name string) (queryField, bool) {
+	if strings.HasPrefix(name, conveyPrefix) && len(name) > len(conveyPrefix) {
+		key := name[len(conveyPrefix):]
+		return queryField{
+			strings: func(d Interface) []string {
+				if c := d.Convey(); c != nil {
+					if v, ok := c.Get(key); ok {
+						return []string{fmt.Sprint(v)}
+					}
+				}
+
+				return nil
+			},
+		}, true
+	}
+
+	f, ok := queryFields[name]
+	return f, ok
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOperator
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind     tokenKind
+	text     string
+	position int
+}
+
+// isOperatorRune tests if a character can begin or continue a comparison operator
+func isOperatorRune(r rune) bool {
+	return strings.ContainsRune("=!<>^$*", r)
+}
+
+func lexQuery(expression string) ([]queryToken, error) {
+	var (
+		tokens []queryToken
+		runes  = []rune(expression)
+	)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen, text: "(", position: i})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose, text: ")", position: i})
+			i++
+
+		case r == '"':
+			start := i
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+
+			if i >= len(runes) {
+				return nil, fmt.Errorf("Unterminated string at position %d", start)
+			}
+
+			i++
+			value, err := strconv.Unquote(string(runes[start:i]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid string at position %d: %s", start, err)
+			}
+
+			tokens = append(tokens, queryToken{kind: tokenString, text: value, position: start})
+
+		case isOperatorRune(r):
+			start := i
+			for i < len(runes) && isOperatorRune(runes[i]) {
+				i++
+			}
+
+			tokens = append(tokens, queryToken{kind: tokenOperator, text: string(runes[start:i]), position: start})
+
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !isOperatorRune(runes[i]) && !strings.ContainsRune(`()"`, runes[i]) {
+				i++
+			}
+
+			tokens = append(tokens, queryToken{kind: tokenWord, text: string(runes[start:i]), position: start})
+		}
+	}
+
+	return tokens, nil
+}
+
+// queryParser is a recursive descent parser for the grammar:
+//
+//	or         := and ( "or" and )*
+//	and        := unary ( "and" unary )*
+//	unary      := "not" unary | "(" or ")" | comparison
+//	comparison := field operator value
+type queryParser struct {
+	tokens []queryToken
+	next   int
+}
+
+func (p *queryParser) peek() queryToken {
+	if p.next < len(p.tokens) {
+		return p.tokens[p.next]
+	}
+
+	return queryToken{kind: tokenEnd, position: -1}
+}
+
+func (p *queryParser) take() queryToken {
+	t := p.peek()
+	if t.kind != tokenEnd {
+		p.next++
+	}
+
+	return t
+}
+
+func (p *queryParser) isKeyword(t queryToken, keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *queryParser) unexpected(t queryToken) error {
+	if t.kind == tokenEnd {
+		return errors.New("Unexpected end of query")
+	}
+
+	return fmt.Errorf("Unexpected '%s' at position %d", t.text, t.position)
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := orNode{first}
+	for p.isKeyword(p.peek(), "or") {
+		p.take()
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, next)
+	}
+
+	if len(nodes) == 1 {
+		return first, nil
+	}
+
+	return nodes, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := andNode{first}
+	for p.isKeyword(p.peek(), "and") {
+		p.take()
+		next, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, next)
+	}
+
+	if len(nodes) == 1 {
+		return first, nil
+	}
+
+	return nodes, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	t := p.peek()
+	switch {
+	case p.isKeyword(t, "not"):
+		p.take()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return notNode{child}, nil
+
+	case t.kind == tokenOpen:
+		p.take()
+		child, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if closing := p.take(); closing.kind != tokenClose {
+			return nil, p.unexpected(closing)
+		}
+
+		return child, nil
+
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *queryParser) parseComparison() (queryNode, error) {
+	name := p.take()
+	if name.kind != tokenWord {
+		return nil, p.unexpected(name)
+	}
+
+	field, ok := lookupQueryField(name.text)
+	if !ok {
+		return nil, fmt.Errorf("Unknown field '%s' at position %d", name.text, name.position)
+	}
+
+	operator := p.take()
+	if operator.kind != tokenOperator {
+		return nil, p.unexpected(operator)
+	}
+
+	value := p.take()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, p.unexpected(value)
+	}
+
+	if field.strings != nil {
+		return newStringComparison(field, operator, value)
+	}
+
+	return newNumericComparison(field, operator, value)
+}
+
+func newStringComparison(field queryField, operator, value queryToken) (queryNode, error) {
+	var (
+		v    = value.text
+		test func(string) bool
+	)
+
+	switch operator.text {
+	case "=", "!=":
+		test = func(actual string) bool { return actual == v }
+	case "^=":
+		test = func(actual string) bool { return strings.HasPrefix(actual, v) }
+	case "$=":
+		test = func(actual string) bool { return strings.HasSuffix(actual, v) }
+	case "*=":
+		test = func(actual string) bool { return strings.Contains(actual, v) }
+	default:
+		return nil, fmt.Errorf("Operator '%s' at position %d cannot be used with a string field", operator.text, operator.position)
+	}
+
+	node := stringNode{values: field.strings, test: test}
+	if operator.text == "!=" {
+		return notNode{node}, nil
+	}
+
+	return node, nil
+}
+
+func newNumericComparison(field queryField, operator, value queryToken) (queryNode, error) {
+	var v int64
+	if field.duration {
+		d, err := time.ParseDuration(value.text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duration '%s' at position %d", value.text, value.position)
+		}
+
+		v = int64(d)
+	} else {
+		i, err := strconv.ParseInt(value.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid integer '%s' at position %d", value.text, value.position)
+		}
+
+		v = i
+	}
+
+	var compare func(int64) bool
+	switch operator.text {
+	case "=":
+		compare = func(actual int64) bool { return actual == v }
+	case "!=":
+		compare = func(actual int64) bool { return actual != v }
+	case "<":
+		compare = func(actual int64) bool { return actual < v }
+	case "<=":
+		compare = func(actual int64) bool { return actual <= v }
+	case ">":
+		compare = func(actual int64) bool { return actual > v }
+	case ">=":
+		compare = func(actual int64) bool { return actual >= v }
+	default:
+		return nil, fmt.Errorf("Operator '%s' at position %d cannot be used with a numeric field", operator.text, operator.position)
+	}
+
+	return numericNode{value: field.integer, compare: compare}, nil
+}
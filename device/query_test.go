@@ -0,0 +1,153 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/convey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQueryDevice() *device {
+	connectedAt := time.Now().Add(-2 * time.Hour)
+	d := newDevice(deviceOptions{
+		ID:          ID("mac:112233445566"),
+		C:           convey.C{"hw-model": "XB3", "fw-name": "PROD-1.2", "boot-time": 12345},
+		PartnerIDs:  []string{"comcast", "sky"},
+		Trust:       "1000",
+		ConnectedAt: connectedAt,
+	})
+
+	d.statistics.AddDuplications(2)
+	d.statistics.AddBytesSent(1024)
+	d.statistics.AddMessagesReceived(7)
+	return d
+}
+
+func testParseQueryValid(t *testing.T) {
+	testData := []struct {
+		expression string
+		expected   bool
+	}{
+		{`id = mac:112233445566`, true},
+		{`id = "mac:112233445566"`, true},
+		{`id != mac:112233445566`, false},
+		{`id ^= mac:`, true},
+		{`id ^= uuid:`, false},
+		{`id $= 5566`, true},
+		{`id *= 2233`, true},
+		{`trust = 1000`, true},
+		{`partner = sky`, true},
+		{`partner = foo`, false},
+		{`partner != comcast`, false},
+		{`partner != foo`, true},
+		{`partner ^= com`, true},
+		{`convey.hw-model = XB3`, true},
+		{`convey.hw-model = XB6`, false},
+		{`convey.boot-time = 12345`, true},
+		{`convey.fw-name ^= "PROD-"`, true},
+		{`convey.missing = XB3`, false},
+		{`convey.missing != XB3`, true},
+		{`uptime > 1h`, true},
+		{`uptime >= 3h`, false},
+		{`uptime < 90m`, false},
+		{`uptime<=3h`, true},
+		{`duplications = 2`, true},
+		{`duplications != 2`, false},
+		{`bytesSent > 1000`, true},
+		{`bytesReceived > 0`, false},
+		{`messagesReceived >= 7`, true},
+		{`messagesSent = 0`, true},
+		{`pending = 0`, true},
+		{`id ^= mac: and convey.hw-model = XB3`, true},
+		{`id ^= mac: AND convey.hw-model = XB6`, false},
+		{`id ^= uuid: or convey.hw-model = XB3`, true},
+		{`not id ^= uuid:`, true},
+		{`NOT (id ^= mac: and trust = 1000)`, false},
+		{`id ^= uuid: or partner = foo or uptime > 1m`, true},
+		{`(id ^= uuid: or partner = sky) and (convey.hw-model = XB3 and not duplications > 5)`, true},
+		{`id ^= uuid: and partner = sky or trust = 1000`, true},
+		{`id ^= uuid: and (partner = sky or trust = 1000)`, false},
+		{`convey.fw-name = "PROD \"1.2\""`, false},
+	}
+
+	d := newTestQueryDevice()
+	for _, record := range testData {
+		t.Run(record.expression, func(t *testing.T) {
+			var (
+				assert  = assert.New(t)
+				require = require.New(t)
+			)
+
+			q, err := ParseQuery(record.expression)
+			require.NoError(err)
+			require.NotNil(q)
+
+			assert.Equal(record.expression, q.String())
+			assert.Equal(record.expected, q.Matches(d))
+		})
+	}
+}
+
+func testParseQueryInvalid(t *testing.T) {
+	testData := []string{
+		``,
+		`   `,
+		`id`,
+		`id =`,
+		`= foo`,
+		`nosuch = foo`,
+		`convey. = foo`,
+		`id < foo`,
+		`id =! foo`,
+		`uptime = foo`,
+		`uptime ^= 1h`,
+		`duplications = 1.5`,
+		`id = foo and`,
+		`id = foo or or id = bar`,
+		`(id = foo`,
+		`id = foo)`,
+		`id = "foo`,
+		`id = foo id = bar`,
+		`not`,
+		`()`,
+	}
+
+	for _, expression := range testData {
+		t.Run(expression, func(t *testing.T) {
+			assert := assert.New(t)
+
+			q, err := ParseQuery(expression)
+			assert.Nil(q)
+			assert.Error(err)
+		})
+	}
+}
+
+func testParseQueryEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	q, err := ParseQuery("")
+	assert.Nil(q)
+	assert.Equal(ErrorEmptyQuery, err)
+}
+
+func testMustParseQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NotPanics(func() {
+		assert.NotNil(MustParseQuery("id = foo"))
+	})
+
+	assert.Panics(func() {
+		MustParseQuery("id = ")
+	})
+}
+
+func TestParseQuery(t *testing.T) {
+	t.Run("Valid", testParseQueryValid)
+	t.Run("Invalid", testParseQueryInvalid)
+	t.Run("Empty", testParseQueryEmpty)
+	t.Run("Must", testMustParseQuery)
+}
@@ -0,0 +1,436 @@
+package device
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// RateLimitAction is the response to a message which exceeds a rate limit
+type RateLimitAction string
+
+const (
+	// RateLimitDrop discards inbound messages and fails outbound sends with ErrorRateLimited.
+	// This is the default action.
+	RateLimitDrop RateLimitAction = "drop"
+
+	// RateLimitDelay holds a message until the limit allows it.  Outbound sends wait no longer than
+	// their request context allows, while inbound delays apply backpressure by pausing reads from the device.
+	RateLimitDelay RateLimitAction = "delay"
+
+	// RateLimitDisconnect closes the device's connection with a CloseReason whose Text is RateLimitedCloseReason.
+	// Outbound sends which trigger a disconnect fail with ErrorRateLimited.
+	RateLimitDisconnect RateLimitAction = "disconnect"
+
+	// RateLimitedCloseReason is the CloseReason text used when a device is disconnected for exceeding a rate limit
+	RateLimitedCloseReason = "rate-limited"
+)
+
+// the label values used with the RateLimitCounter metric
+const (
+	rateLimitInbound         = "inbound"
+	rateLimitOutbound        = "outbound"
+	rateLimitPartnerOutbound = "partner-outbound"
+
+	rateLimitAllowed      = "allowed"
+	rateLimitDropped      = "dropped"
+	rateLimitDelayed      = "delayed"
+	rateLimitDisconnected = "disconnected"
+)
+
+var ErrorRateLimited = errors.New("The rate limit for that device has been exceeded")
+
+// RateLimit describes a single token bucket
+type RateLimit struct {
+	// Rate is the sustained number of messages allowed per second.  If nonpositive, this limit is disabled.
+	Rate float64
+
+	// Burst is the number of messages allowed in excess of Rate over short periods.  If nonpositive,
+	// the ceiling of Rate is used, with a minimum of 1.
+	Burst int
+
+	// Action is what happens to a message that exceeds this limit.  If unset or unrecognized, RateLimitDrop is used.
+	Action RateLimitAction
+}
+
+func (rl *RateLimit) enabled() bool {
+	return rl != nil && rl.Rate > 0
+}
+
+func (rl *RateLimit) burst() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+
+	return math.Max(1.0, math.Ceil(rl.Rate))
+}
+
+func (rl *RateLimit) action() RateLimitAction {
+	switch rl.Action {
+	case RateLimitDelay, RateLimitDisconnect:
+		return rl.Action
+	default:
+		return RateLimitDrop
+	}
+}
+
+// RateLimitOptions configures the token bucket limits applied to device traffic.  By default, no limits apply.
+type RateLimitOptions struct {
+	// Inbound limits the WRP messages read from each device
+	Inbound RateLimit
+
+	// Outbound limits the messages sent to each device
+	Outbound RateLimit
+
+	// PartnerOutbound limits the messages sent to all devices sharing a partner ID.  Each partner ID
+	// has its own bucket.  A device with several partner IDs must be allowed by all of their buckets,
+	// while a device with no partner IDs is not subject to this limit.
+	PartnerOutbound RateLimit
+}
+
+func (o *RateLimitOptions) enabled() bool {
+	return o != nil && (o.Inbound.enabled() || o.Outbound.enabled() || o.PartnerOutbound.enabled())
+}
+
+// tokenBucket is a classic token bucket.  Tokens may go negative, which represents
+// reservations made by delayed messages.
+type tokenBucket struct {
+	lock   sync.Mutex
+	now    func() time.Time
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rl *RateLimit, now func() time.Time) *tokenBucket {
+	burst := rl.burst()
+	return &tokenBucket{
+		now:    now,
+		rate:   rl.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now(),
+	}
+}
+
+// refill must be invoked under the lock
+func (tb *tokenBucket) refill() {
+	now := tb.now()
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens = math.Min(tb.burst, tb.tokens+elapsed.Seconds()*tb.rate)
+		tb.last = now
+	}
+}
+
+// allow takes a token if one is available
+func (tb *tokenBucket) allow() bool {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill()
+	if tb.tokens >= 1.0 {
+		tb.tokens -= 1.0
+		return true
+	}
+
+	return false
+}
+
+// reserve unconditionally takes a token and returns how long the caller must wait before the
+// token is actually available.  A zero return means the token is available immediately.
+func (tb *tokenBucket) reserve() time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill()
+	tb.tokens -= 1.0
+	if tb.tokens >= 0.0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// setLimit changes the rate and burst of this bucket, preserving any accumulated tokens up to the new burst
+func (tb *tokenBucket) setLimit(rate, burst float64) {
+	tb.lock.Lock()
+	tb.refill()
+	tb.rate = rate
+	tb.burst = burst
+	tb.tokens = math.Min(tb.burst, tb.tokens)
+	tb.lock.Unlock()
+}
+
+// unreserve returns a token taken by reserve which ended up not being used
+func (tb *tokenBucket) unreserve() {
+	tb.lock.Lock()
+	tb.tokens = math.Min(tb.burst, tb.tokens+1.0)
+	tb.lock.Unlock()
+}
+
+// full tests if this bucket has refilled to its burst, i.e. if discarding it and later starting
+// over with a new bucket would make no difference
+func (tb *tokenBucket) full() bool {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill()
+	return tb.tokens >= tb.burst
+}
+
+// limitedBucket is a token bucket together with its configured action and metric label
+type limitedBucket struct {
+	*tokenBucket
+	action RateLimitAction
+	limit  string
+
+	// partnerID and refs are only used by partner buckets.  refs is the number of devices
+	// using the bucket, and is guarded by the rateLimits lock.
+	partnerID string
+	refs      int
+}
+
+// rateLimits holds the shared state of a manager's rate limits, in particular the per-partner buckets
+type rateLimits struct {
+	options RateLimitOptions
+	now     func() time.Time
+	counter metrics.Counter
+
+	lock     sync.Mutex
+	partners map[string]*limitedBucket
+}
+
+// newRateLimits creates the rate limiting state for the given options.  If no limits are enabled,
+// this function returns nil.
+func newRateLimits(o *RateLimitOptions, now func() time.Time, m Measures) *rateLimits {
+	if !o.enabled() {
+		return nil
+	}
+
+	return &rateLimits{
+		options:  *o,
+		now:      now,
+		counter:  m.RateLimit,
+		partners: make(map[string]*limitedBucket),
+	}
+}
+
+func (rls *rateLimits) newBucket(rl *RateLimit, limit string) *limitedBucket {
+	return &limitedBucket{
+		tokenBucket: newTokenBucket(rl, rls.now),
+		action:      rl.action(),
+		limit:       limit,
+	}
+}
+
+// partner returns the shared bucket for a partner ID, adding a reference to it.  Each call must
+// eventually be matched by a release of the device's limiter.
+func (rls *rateLimits) partner(partnerID string) *limitedBucket {
+	rls.lock.Lock()
+	defer rls.lock.Unlock()
+
+	b, ok := rls.partners[partnerID]
+	if !ok {
+		// buckets which were not yet full when released are evicted here, before the map grows
+		rls.evictIdle()
+		b = rls.newBucket(&rls.options.PartnerOutbound, rateLimitPartnerOutbound)
+		b.partnerID = partnerID
+		rls.partners[partnerID] = b
+	}
+
+	b.refs++
+	return b
+}
+
+// evictIdle removes the partner buckets which no device is using and which have refilled.  Buckets that
+// are still short of tokens are kept, so that reconnecting devices cannot be used to reset a partner's limit.
+// This method must be invoked under the lock.
+func (rls *rateLimits) evictIdle() {
+	for partnerID, b := range rls.partners {
+		if b.refs < 1 && b.full() {
+			delete(rls.partners, partnerID)
+		}
+	}
+}
+
+// release drops the references a device's limiter holds on partner buckets, evicting any bucket
+// which is no longer used and has refilled.  This method must be invoked once the device is disconnected.
+func (rls *rateLimits) release(rl *rateLimiter) {
+	if rl == nil {
+		return
+	}
+
+	rls.lock.Lock()
+	defer rls.lock.Unlock()
+
+	for _, b := range rl.outbound {
+		if len(b.partnerID) == 0 {
+			continue
+		}
+
+		b.refs--
+		if b.refs < 1 && b.full() && rls.partners[b.partnerID] == b {
+			delete(rls.partners, b.partnerID)
+		}
+	}
+}
+
+// forDevice creates the limiter for a newly connected device
+func (rls *rateLimits) forDevice(d *device) *rateLimiter {
+	rl := &rateLimiter{
+		counter: rls.counter,
+	}
+
+	if rls.options.Inbound.enabled() {
+		rl.inbound = rls.newBucket(&rls.options.Inbound, rateLimitInbound)
+	}
+
+	if rls.options.Outbound.enabled() {
+		rl.outbound = append(rl.outbound, rls.newBucket(&rls.options.Outbound, rateLimitOutbound))
+	}
+
+	if rls.options.PartnerOutbound.enabled() {
+		for _, partnerID := range d.PartnerIDs() {
+			if len(partnerID) > 0 {
+				rl.outbound = append(rl.outbound, rls.partner(partnerID))
+			}
+		}
+	}
+
+	return rl
+}
+
+// rateLimiter applies rate limits to a single device's traffic.  A nil rateLimiter allows everything.
+type rateLimiter struct {
+	counter  metrics.Counter
+	inbound  *limitedBucket
+	outbound []*limitedBucket
+}
+
+func (rl *rateLimiter) record(b *limitedBucket, decision string) {
+	rl.counter.With("limit", b.limit, "decision", decision).Add(1.0)
+}
+
+// wait blocks for the given duration, returning false if the cancel channel is closed first
+func wait(delay time.Duration, cancel <-chan struct{}) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// check applies a single bucket.  The returned action is the empty string if the message may proceed.
+func (rl *rateLimiter) check(b *limitedBucket, cancel <-chan struct{}) RateLimitAction {
+	if b.action == RateLimitDelay {
+		delay := b.reserve()
+		if delay <= 0 {
+			rl.record(b, rateLimitAllowed)
+			return ""
+		}
+
+		rl.record(b, rateLimitDelayed)
+		if !wait(delay, cancel) {
+			b.unreserve()
+			return RateLimitDelay
+		}
+
+		return ""
+	}
+
+	if b.allow() {
+		rl.record(b, rateLimitAllowed)
+		return ""
+	}
+
+	if b.action == RateLimitDisconnect {
+		rl.record(b, rateLimitDisconnected)
+	} else {
+		rl.record(b, rateLimitDropped)
+	}
+
+	return b.action
+}
+
+// checkInbound applies the inbound limit to a message read from the device.  The returned action
+// is the empty string if the message should be processed.
+func (rl *rateLimiter) checkInbound(cancel <-chan struct{}) RateLimitAction {
+	if rl == nil || rl.inbound == nil {
+		return ""
+	}
+
+	return rl.check(rl.inbound, cancel)
+}
+
+// checkOutbound applies all outbound limits to a message being sent to the device.  The returned action
+// is the empty string if the message may be sent.
+//
+// A token is taken from every bucket before any decision is made, so that a message refused by one bucket
+// does not consume the tokens of the others.  If any bucket refuses the message, or a delay is cancelled,
+// the tokens already taken are returned.  A message delayed by several buckets waits for the longest delay.
+func (rl *rateLimiter) checkOutbound(cancel <-chan struct{}) RateLimitAction {
+	if rl == nil || len(rl.outbound) == 0 {
+		return ""
+	}
+
+	var (
+		delays   = make([]time.Duration, 0, len(rl.outbound))
+		maxDelay time.Duration
+	)
+
+	for i, b := range rl.outbound {
+		if b.action == RateLimitDelay {
+			delay := b.reserve()
+			delays = append(delays, delay)
+			if delay > maxDelay {
+				maxDelay = delay
+			}
+
+			continue
+		}
+
+		if b.allow() {
+			delays = append(delays, 0)
+			continue
+		}
+
+		rl.unreserve(rl.outbound[:i])
+		if b.action == RateLimitDisconnect {
+			rl.record(b, rateLimitDisconnected)
+		} else {
+			rl.record(b, rateLimitDropped)
+		}
+
+		return b.action
+	}
+
+	for i, b := range rl.outbound {
+		if delays[i] > 0 {
+			rl.record(b, rateLimitDelayed)
+		} else {
+			rl.record(b, rateLimitAllowed)
+		}
+	}
+
+	if maxDelay > 0 && !wait(maxDelay, cancel) {
+		rl.unreserve(rl.outbound)
+		return RateLimitDelay
+	}
+
+	return ""
+}
+
+// unreserve returns the tokens taken from each of the given buckets
+func (rl *rateLimiter) unreserve(buckets []*limitedBucket) {
+	for _, b := range buckets {
+		b.unreserve()
+	}
+}
@@ -0,0 +1,431 @@
+package device
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClock is a manually advanced clock
+type testClock struct {
+	lock    sync.Mutex
+	current time.Time
+}
+
+func (tc *testClock) now() time.Time {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.current
+}
+
+func (tc *testClock) advance(d time.Duration) {
+	tc.lock.Lock()
+	tc.current = tc.current.Add(d)
+	tc.lock.Unlock()
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	var disabled *RateLimit
+	assert.False(disabled.enabled())
+	assert.False((&RateLimit{}).enabled())
+
+	rl := RateLimit{Rate: 2.5}
+	assert.True(rl.enabled())
+	assert.Equal(3.0, rl.burst())
+	assert.Equal(RateLimitDrop, rl.action())
+
+	rl = RateLimit{Rate: 0.1, Burst: 5, Action: RateLimitDisconnect}
+	assert.Equal(5.0, rl.burst())
+	assert.Equal(RateLimitDisconnect, rl.action())
+
+	rl = RateLimit{Rate: 0.1, Action: "nosuch"}
+	assert.Equal(1.0, rl.burst())
+	assert.Equal(RateLimitDrop, rl.action())
+}
+
+func testTokenBucketAllow(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		clock  = &testClock{current: time.Now()}
+		tb     = newTokenBucket(&RateLimit{Rate: 2.0, Burst: 2}, clock.now)
+	)
+
+	assert.True(tb.allow())
+	assert.True(tb.allow())
+	assert.False(tb.allow())
+
+	clock.advance(250 * time.Millisecond)
+	assert.False(tb.allow())
+
+	clock.advance(250 * time.Millisecond)
+	assert.True(tb.allow())
+	assert.False(tb.allow())
+
+	// the bucket never holds more than its burst
+	clock.advance(time.Hour)
+	assert.True(tb.allow())
+	assert.True(tb.allow())
+	assert.False(tb.allow())
+}
+
+func testTokenBucketReserve(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		clock  = &testClock{current: time.Now()}
+		tb     = newTokenBucket(&RateLimit{Rate: 4.0, Burst: 1}, clock.now)
+	)
+
+	assert.Zero(tb.reserve())
+	assert.Equal(250*time.Millisecond, tb.reserve())
+	assert.Equal(500*time.Millisecond, tb.reserve())
+
+	tb.unreserve()
+	assert.Equal(500*time.Millisecond, tb.reserve())
+
+	clock.advance(time.Second)
+	assert.Zero(tb.reserve())
+}
+
+func TestTokenBucket(t *testing.T) {
+	t.Run("Allow", testTokenBucketAllow)
+	t.Run("Reserve", testTokenBucketReserve)
+}
+
+func testRateLimiterDisabled(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		limiter *rateLimiter
+	)
+
+	assert.Nil(newRateLimits(nil, time.Now, NewMeasures(xmetricstest.NewProvider(nil, Metrics))))
+	assert.Nil(newRateLimits(new(RateLimitOptions), time.Now, NewMeasures(xmetricstest.NewProvider(nil, Metrics))))
+	assert.Empty(limiter.checkInbound(nil))
+	assert.Empty(limiter.checkOutbound(nil))
+}
+
+func testRateLimiterDrop(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		p     = xmetricstest.NewProvider(nil, Metrics)
+		clock = &testClock{current: time.Now()}
+		rls   = newRateLimits(
+			&RateLimitOptions{
+				Inbound:  RateLimit{Rate: 1.0},
+				Outbound: RateLimit{Rate: 1.0, Burst: 2, Action: RateLimitDisconnect},
+			},
+			clock.now,
+			NewMeasures(p),
+		)
+	)
+
+	require.NotNil(rls)
+	limiter := rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445566", Logger: logging.NewTestLogger(nil, t)}))
+
+	assert.Empty(limiter.checkInbound(nil))
+	assert.Equal(RateLimitDrop, limiter.checkInbound(nil))
+	clock.advance(time.Second)
+	assert.Empty(limiter.checkInbound(nil))
+
+	assert.Empty(limiter.checkOutbound(nil))
+	assert.Empty(limiter.checkOutbound(nil))
+	assert.Equal(RateLimitDisconnect, limiter.checkOutbound(nil))
+
+	p.Assert(t, RateLimitCounter, "limit", rateLimitInbound, "decision", rateLimitAllowed)(xmetricstest.Value(2.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitInbound, "decision", rateLimitDropped)(xmetricstest.Value(1.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitOutbound, "decision", rateLimitAllowed)(xmetricstest.Value(2.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitOutbound, "decision", rateLimitDisconnected)(xmetricstest.Value(1.0))
+}
+
+func testRateLimiterDelay(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		p     = xmetricstest.NewProvider(nil, Metrics)
+		clock = &testClock{current: time.Now()}
+		rls   = newRateLimits(
+			&RateLimitOptions{
+				Inbound: RateLimit{Rate: 100.0, Burst: 1, Action: RateLimitDelay},
+			},
+			clock.now,
+			NewMeasures(p),
+		)
+	)
+
+	require.NotNil(rls)
+	limiter := rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445566", Logger: logging.NewTestLogger(nil, t)}))
+
+	start := time.Now()
+	assert.Empty(limiter.checkInbound(nil))
+	assert.Empty(limiter.checkInbound(nil))
+	assert.True(time.Since(start) >= 10*time.Millisecond)
+
+	// a delay is abandoned when its cancellation channel is closed
+	cancel := make(chan struct{})
+	close(cancel)
+	assert.Equal(RateLimitDelay, limiter.checkInbound(cancel))
+
+	p.Assert(t, RateLimitCounter, "limit", rateLimitInbound, "decision", rateLimitAllowed)(xmetricstest.Value(1.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitInbound, "decision", rateLimitDelayed)(xmetricstest.Value(2.0))
+}
+
+func testRateLimiterPartner(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		p     = xmetricstest.NewProvider(nil, Metrics)
+		clock = &testClock{current: time.Now()}
+		rls   = newRateLimits(
+			&RateLimitOptions{
+				PartnerOutbound: RateLimit{Rate: 1.0, Burst: 2},
+			},
+			clock.now,
+			NewMeasures(p),
+		)
+	)
+
+	require.NotNil(rls)
+
+	var (
+		comcast     = rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445566", PartnerIDs: []string{"comcast"}, Logger: logging.NewTestLogger(nil, t)}))
+		comcastSky  = rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445567", PartnerIDs: []string{"comcast", "sky"}, Logger: logging.NewTestLogger(nil, t)}))
+		sky         = rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445568", PartnerIDs: []string{"sky"}, Logger: logging.NewTestLogger(nil, t)}))
+		noPartners  = rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445569", Logger: logging.NewTestLogger(nil, t)}))
+		emptyBucket = rls.partner("comcast")
+	)
+
+	assert.Nil(noPartners.inbound)
+	assert.Empty(noPartners.outbound)
+	assert.Empty(noPartners.checkOutbound(nil))
+
+	// the comcast bucket is shared by every device with that partner ID
+	assert.Empty(comcast.checkOutbound(nil))
+	assert.Empty(comcastSky.checkOutbound(nil))
+	assert.Equal(RateLimitDrop, comcast.checkOutbound(nil))
+	assert.Equal(RateLimitDrop, comcastSky.checkOutbound(nil))
+	assert.False(emptyBucket.allow())
+
+	assert.Empty(sky.checkOutbound(nil))
+	assert.Equal(RateLimitDrop, sky.checkOutbound(nil))
+
+	p.Assert(t, RateLimitCounter, "limit", rateLimitPartnerOutbound, "decision", rateLimitAllowed)(xmetricstest.Value(4.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitPartnerOutbound, "decision", rateLimitDropped)(xmetricstest.Value(3.0))
+}
+
+func testRateLimiterRollback(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		p     = xmetricstest.NewProvider(nil, Metrics)
+		clock = &testClock{current: time.Now()}
+		rls   = newRateLimits(
+			&RateLimitOptions{
+				Outbound:        RateLimit{Rate: 1.0, Burst: 5},
+				PartnerOutbound: RateLimit{Rate: 1.0, Burst: 1},
+			},
+			clock.now,
+			NewMeasures(p),
+		)
+	)
+
+	require.NotNil(rls)
+	limiter := rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445566", PartnerIDs: []string{"comcast"}, Logger: logging.NewTestLogger(nil, t)}))
+	require.Len(limiter.outbound, 2)
+
+	assert.Empty(limiter.checkOutbound(nil))
+	assert.Equal(4.0, limiter.outbound[0].tokens)
+
+	// a message refused by the partner bucket does not consume a token from the device's bucket
+	assert.Equal(RateLimitDrop, limiter.checkOutbound(nil))
+	assert.Equal(RateLimitDrop, limiter.checkOutbound(nil))
+	assert.Equal(4.0, limiter.outbound[0].tokens)
+
+	p.Assert(t, RateLimitCounter, "limit", rateLimitOutbound, "decision", rateLimitAllowed)(xmetricstest.Value(1.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitPartnerOutbound, "decision", rateLimitAllowed)(xmetricstest.Value(1.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitPartnerOutbound, "decision", rateLimitDropped)(xmetricstest.Value(2.0))
+
+	// a cancelled delay returns the tokens taken from every bucket
+	delayed := newRateLimits(
+		&RateLimitOptions{
+			Outbound:        RateLimit{Rate: 1.0, Burst: 5, Action: RateLimitDelay},
+			PartnerOutbound: RateLimit{Rate: 1.0, Burst: 1, Action: RateLimitDelay},
+		},
+		clock.now,
+		NewMeasures(p),
+	).forDevice(newDevice(deviceOptions{ID: "mac:112233445566", PartnerIDs: []string{"comcast"}, Logger: logging.NewTestLogger(nil, t)}))
+
+	assert.Empty(delayed.checkOutbound(nil))
+
+	cancel := make(chan struct{})
+	close(cancel)
+	assert.Equal(RateLimitDelay, delayed.checkOutbound(cancel))
+	assert.Equal(4.0, delayed.outbound[0].tokens)
+	assert.Equal(0.0, delayed.outbound[1].tokens)
+}
+
+func testRateLimiterRelease(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		clock = &testClock{current: time.Now()}
+		rls   = newRateLimits(
+			&RateLimitOptions{
+				PartnerOutbound: RateLimit{Rate: 1.0, Burst: 2},
+			},
+			clock.now,
+			NewMeasures(xmetricstest.NewProvider(nil, Metrics)),
+		)
+	)
+
+	require.NotNil(rls)
+
+	var (
+		first  = rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445566", PartnerIDs: []string{"comcast"}, Logger: logging.NewTestLogger(nil, t)}))
+		second = rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445567", PartnerIDs: []string{"comcast", "sky"}, Logger: logging.NewTestLogger(nil, t)}))
+	)
+
+	assert.Len(rls.partners, 2)
+	assert.Equal(2, rls.partners["comcast"].refs)
+
+	// a full bucket is evicted as soon as no device references it
+	rls.release(second)
+	assert.Len(rls.partners, 1)
+	assert.Equal(1, rls.partners["comcast"].refs)
+
+	// a bucket short of tokens is kept, so that reconnecting does not reset the partner's limit
+	assert.Empty(first.checkOutbound(nil))
+	rls.release(first)
+	require.Contains(rls.partners, "comcast")
+	assert.Zero(rls.partners["comcast"].refs)
+
+	third := rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445568", PartnerIDs: []string{"comcast"}, Logger: logging.NewTestLogger(nil, t)}))
+	assert.True(first.outbound[0] == third.outbound[0])
+	rls.release(third)
+
+	// once refilled, an unreferenced bucket is evicted when a new partner is seen
+	clock.advance(time.Second)
+	rls.forDevice(newDevice(deviceOptions{ID: "mac:112233445569", PartnerIDs: []string{"sky"}, Logger: logging.NewTestLogger(nil, t)}))
+	assert.Len(rls.partners, 1)
+	assert.Contains(rls.partners, "sky")
+
+	rls.release(nil)
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("Disabled", testRateLimiterDisabled)
+	t.Run("Drop", testRateLimiterDrop)
+	t.Run("Delay", testRateLimiterDelay)
+	t.Run("Partner", testRateLimiterPartner)
+	t.Run("Rollback", testRateLimiterRollback)
+	t.Run("Release", testRateLimiterRelease)
+}
+
+func testManagerRateLimitInbound(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		p        = xmetricstest.NewProvider(nil, Metrics)
+		listener = newSessionTestListener()
+		options  = &Options{
+			Logger:          logging.NewTestLogger(nil, t),
+			RateLimits:      RateLimitOptions{Inbound: RateLimit{Rate: 0.001}},
+			Listeners:       []Listener{listener.OnDeviceEvent},
+			MetricsProvider: p,
+		}
+
+		_, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+
+	message := wrp.MustEncode(
+		&wrp.SimpleEvent{Source: string(testDeviceIDs[0]), Destination: "event:test"},
+		wrp.Msgpack,
+	)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(connection.WriteMessage(websocket.BinaryMessage, message))
+	}
+
+	require.NoError(connection.Close())
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+
+	assert.Equal(1, listener.count(MessageReceived))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitInbound, "decision", rateLimitAllowed)(xmetricstest.Value(1.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitInbound, "decision", rateLimitDropped)(xmetricstest.Value(2.0))
+}
+
+func testManagerRateLimitOutbound(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		p        = xmetricstest.NewProvider(nil, Metrics)
+		listener = newSessionTestListener()
+		// the read pump logs after the Disconnect event in this case, so a test logger cannot be used
+		options = &Options{
+			Logger:          logging.DefaultLogger(),
+			RateLimits:      RateLimitOptions{Outbound: RateLimit{Rate: 0.001, Action: RateLimitDisconnect}},
+			Listeners:       []Listener{listener.OnDeviceEvent},
+			MetricsProvider: p,
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer connection.Close()
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	newRequest := func() *Request {
+		return (&Request{
+			Message: &wrp.SimpleEvent{Source: "test", Destination: string(testDeviceIDs[0])},
+			Format:  wrp.Msgpack,
+		}).WithContext(context.Background())
+	}
+
+	d, ok := manager.Get(testDeviceIDs[0])
+	require.True(ok)
+
+	_, err = manager.Route(newRequest())
+	assert.NoError(err)
+	readTestMessage(require, connection)
+
+	_, err = manager.Route(newRequest())
+	assert.Equal(ErrorRateLimited, err)
+
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	assert.True(d.Closed())
+	assert.Equal(RateLimitedCloseReason, d.CloseReason().Text)
+	assert.Equal(ErrorRateLimited, d.CloseReason().Err)
+
+	p.Assert(t, RateLimitCounter, "limit", rateLimitOutbound, "decision", rateLimitAllowed)(xmetricstest.Value(1.0))
+	p.Assert(t, RateLimitCounter, "limit", rateLimitOutbound, "decision", rateLimitDisconnected)(xmetricstest.Value(1.0))
+}
+
+func TestManagerRateLimit(t *testing.T) {
+	t.Run("Inbound", testManagerRateLimitInbound)
+	t.Run("Outbound", testManagerRateLimitOutbound)
+}
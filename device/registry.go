@@ -14,9 +14,32 @@ type registryOptions struct {
 	Logger          log.Logger
 	Limit           int
 	InitialCapacity int
+	Shards          int
 	Measures        Measures
 }
 
+// deviceRegistry is the internal strategy for tracking connected devices.  All implementations
+// share the same semantics for duplicates, limits, and metrics.
+type deviceRegistry interface {
+	len() int
+	add(*device) error
+	remove(ID, CloseReason) (*device, bool)
+	removeIf(func(*device) (CloseReason, bool)) int
+	removeAll(CloseReason) int
+	visit(func(*device) bool) int
+	get(ID) (*device, bool)
+}
+
+// newDeviceRegistry selects the deviceRegistry implementation appropriate for the given options.
+// A sharded registry is used when more than (1) shard is configured.
+func newDeviceRegistry(o registryOptions) deviceRegistry {
+	if o.Shards > 1 {
+		return newShardedRegistry(o)
+	}
+
+	return newRegistry(o)
+}
+
 // registry is the internal lookup map for devices.  it is bounded by an optional maximum number
 // of connected devices.
 type registry struct {
@@ -72,7 +95,7 @@ func (r *registry) add(newDevice *device) error {
 		r.lock.Unlock()
 		r.limitReached.Inc()
 		r.disconnect.Add(1.0)
-		newDevice.requestClose(CloseReason{Err: errDeviceLimitReached, Text: "device-limit-reached"})
+		newDevice.requestClose(CloseReason{Err: errDeviceLimitReached, Text: DeviceLimitReachedCloseReason})
 		return errDeviceLimitReached
 	}
 
@@ -85,7 +108,7 @@ func (r *registry) add(newDevice *device) error {
 		r.disconnect.Add(1.0)
 		r.duplicates.Inc()
 		newDevice.Statistics().AddDuplications(existing.Statistics().Duplications() + 1)
-		existing.requestClose(CloseReason{Text: "duplicate"})
+		existing.requestClose(CloseReason{Text: DuplicateCloseReason})
 	}
 
 	r.connect.Inc()
@@ -12,6 +12,10 @@ const (
 	RehashTimestamp            = "rehash_timestamp"
 	RehashDurationMilliseconds = "rehash_duration_ms"
 
+	RehashStagedRemainingDevice   = "rehash_staged_remaining_device"
+	RehashStagedDisconnectCounter = "rehash_staged_disconnect_count"
+	RehashCoalescedCounter        = "rehash_coalesced_count"
+
 	ReasonLabel = "reason"
 
 	DisconnectAllServiceDiscoveryError       = "sd_error"
@@ -47,5 +51,20 @@ func Metrics() []xmetrics.Metric {
 			Type:       "gauge",
 			LabelNames: []string{service.ServiceLabel},
 		},
+		{
+			Name:       RehashStagedRemainingDevice,
+			Type:       "gauge",
+			LabelNames: []string{service.ServiceLabel},
+		},
+		{
+			Name:       RehashStagedDisconnectCounter,
+			Type:       "counter",
+			LabelNames: []string{service.ServiceLabel},
+		},
+		{
+			Name:       RehashCoalescedCounter,
+			Type:       "counter",
+			LabelNames: []string{service.ServiceLabel},
+		},
 	}
 }
@@ -1,6 +1,7 @@
 package rehasher
 
 import (
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -8,6 +9,8 @@ import (
 	"github.com/go-kit/kit/metrics"
 	"github.com/go-kit/kit/metrics/provider"
 
+	"github.com/Comcast/webpa-common/capacitor"
+	"github.com/Comcast/webpa-common/clock"
 	"github.com/Comcast/webpa-common/device"
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/Comcast/webpa-common/service"
@@ -70,16 +73,65 @@ func WithMetricsProvider(p provider.Provider) Option {
 		r.disconnectAllCounter = p.NewCounter(RehashDisconnectAllCounter)
 		r.timestamp = p.NewGauge(RehashTimestamp)
 		r.duration = p.NewGauge(RehashDurationMilliseconds)
+		r.stagedRemaining = p.NewGauge(RehashStagedRemainingDevice)
+		r.stagedDisconnectCounter = p.NewCounter(RehashStagedDisconnectCounter)
+		r.coalescedCounter = p.NewCounter(RehashCoalescedCounter)
 	}
 }
 
+// WithRegistry configures the device.Registry used to find moved devices for a staged rehash.  If the
+// Connector passed to New is also a device.Registry, as a device.Manager is, this option is unnecessary.
+func WithRegistry(reg device.Registry) Option {
+	return func(r *rehasher) {
+		r.registry = reg
+	}
+}
+
+// WithStaging configures a rehasher to disconnect moved devices gradually rather than all at once.
+// Staging requires a device.Registry.
+func WithStaging(s Staging) Option {
+	return func(r *rehasher) {
+		r.staging = s
+	}
+}
+
+// WithDebounce configures a rehasher to wait for service discovery to settle before rehashing.  A rehash
+// happens only once no updated instances have arrived for the given delay, and uses the most recent
+// instances.  A nonpositive delay disables debouncing, which is the default.
+func WithDebounce(d time.Duration) Option {
+	return func(r *rehasher) {
+		r.debounce = d
+	}
+}
+
+// WithClock configures the clock used for debouncing and staged rehashes.  If c is nil, the system clock is used.
+func WithClock(c clock.Interface) Option {
+	return func(r *rehasher) {
+		if c == nil {
+			r.clock = clock.System()
+		} else {
+			r.clock = c
+		}
+	}
+}
+
+// Interface is the behavior of a rehasher.  In addition to listening for service discovery events,
+// a rehasher reports on its work.
+type Interface interface {
+	monitor.Listener
+
+	// Status returns the status of the most recent rehash for each service, keyed by service
+	Status() map[string]Status
+}
+
 // New creates a monitor Listener which will rehash and disconnect devices in response to service discovery events.
-// This function panics if the connector is nil or if no IsRegistered strategy is configured.
+// This function panics if the connector is nil, if no IsRegistered strategy is configured, or if staging is configured
+// without a device.Registry.
 //
 // If the returned listener encounters any service discovery error, all devices are disconnected.  Otherwise,
 // the IsRegistered strategy is used to determine which devices should still be connected to the Connector.  Devices
-// that hash to instances not registered in this environment are disconnected.
-func New(connector device.Connector, options ...Option) monitor.Listener {
+// that hash to instances not registered in this environment are disconnected, either immediately or in stages.
+func New(connector device.Connector, options ...Option) Interface {
 	if connector == nil {
 		panic("A device Connector is required")
 	}
@@ -92,15 +144,27 @@ func New(connector device.Connector, options ...Option) monitor.Listener {
 			accessorFactory: service.DefaultAccessorFactory,
 			connector:       connector,
 			now:             time.Now,
+			clock:           clock.System(),
+			debouncers:      make(map[string]capacitor.Interface),
+			pending:         make(map[string]bool),
+			jobs:            make(map[string]*stagedJob),
 
 			keep:                 defaultProvider.NewGauge(RehashKeepDevice),
 			disconnect:           defaultProvider.NewGauge(RehashDisconnectDevice),
 			disconnectAllCounter: defaultProvider.NewCounter(RehashDisconnectAllCounter),
 			timestamp:            defaultProvider.NewGauge(RehashTimestamp),
 			duration:             defaultProvider.NewGauge(RehashDurationMilliseconds),
+
+			stagedRemaining:         defaultProvider.NewGauge(RehashStagedRemainingDevice),
+			stagedDisconnectCounter: defaultProvider.NewCounter(RehashStagedDisconnectCounter),
+			coalescedCounter:        defaultProvider.NewCounter(RehashCoalescedCounter),
 		}
 	)
 
+	if reg, ok := connector.(device.Registry); ok {
+		r.registry = reg
+	}
+
 	for _, o := range options {
 		o(r)
 	}
@@ -109,6 +173,10 @@ func New(connector device.Connector, options ...Option) monitor.Listener {
 		panic("No IsRegistered strategy configured.  Use WithIsRegistered or WithEnvironment.")
 	}
 
+	if r.staging.enabled() && r.registry == nil {
+		panic("Staged rehashing requires a device.Registry.  Use WithRegistry.")
+	}
+
 	return r
 }
 
@@ -119,13 +187,54 @@ type rehasher struct {
 	accessorFactory service.AccessorFactory
 	isRegistered    func(string) bool
 	connector       device.Connector
+	registry        device.Registry
+	staging         Staging
+	debounce        time.Duration
 	now             func() time.Time
+	clock           clock.Interface
 
 	keep                 metrics.Gauge
 	disconnect           metrics.Gauge
 	disconnectAllCounter metrics.Counter
 	timestamp            metrics.Gauge
 	duration             metrics.Gauge
+
+	stagedRemaining         metrics.Gauge
+	stagedDisconnectCounter metrics.Counter
+	coalescedCounter        metrics.Counter
+
+	lock       sync.Mutex
+	debouncers map[string]capacitor.Interface
+	pending    map[string]bool
+	jobs       map[string]*stagedJob
+}
+
+// check determines if a device should be disconnected because of a rehash
+func (r *rehasher) check(logger log.Logger, accessor service.Accessor, candidate device.ID) (device.CloseReason, bool) {
+	instance, err := accessor.Get(candidate.Bytes())
+	switch {
+	case err != nil:
+		logger.Log(level.Key(), level.ErrorValue(),
+			logging.MessageKey(), "disconnecting device: error during rehash",
+			logging.ErrorKey(), err,
+			"id", candidate,
+		)
+
+		return device.CloseReason{Err: err, Text: RehashError}, true
+
+	case !r.isRegistered(instance):
+		logger.Log(level.Key(), level.InfoValue(),
+			logging.MessageKey(), "disconnecting device: rehashed to another instance",
+			"instance", instance,
+			"id", candidate,
+		)
+
+		return device.CloseReason{Text: RehashOtherInstance}, true
+
+	default:
+		logger.Log(level.Key(), level.DebugValue(), logging.MessageKey(), "device hashed to this instance", "id", candidate)
+		return device.CloseReason{}, false
+	}
 }
 
 func (r *rehasher) rehash(key string, logger log.Logger, accessor service.Accessor) {
@@ -135,38 +244,44 @@ func (r *rehasher) rehash(key string, logger log.Logger, accessor service.Access
 	r.timestamp.With(service.ServiceLabel, key).Set(float64(start.UTC().Unix()))
 
 	var (
-		keepCount = 0
+		keepCount       = 0
+		disconnectCount = 0
+	)
+
+	if r.staging.enabled() {
+		// the moved devices are collected first, since the registry must not be modified while visiting
+		var moved []stagedDevice
+		r.registry.VisitAll(func(d device.Interface) bool {
+			if reason, disconnect := r.check(logger, accessor, d.ID()); disconnect {
+				moved = append(moved, stagedDevice{id: d.ID(), reason: reason})
+			} else {
+				keepCount++
+			}
+
+			return true
+		})
+
+		disconnectCount = len(moved)
+		r.lock.Lock()
+		if previous := r.jobs[key]; previous != nil {
+			// the new rehash supersedes any devices the previous one had yet to disconnect
+			previous.stop()
+		}
 
+		r.startStaged(key, logger, moved)
+		r.lock.Unlock()
+	} else {
 		disconnectCount = r.connector.DisconnectIf(func(candidate device.ID) (device.CloseReason, bool) {
-			instance, err := accessor.Get(candidate.Bytes())
-			switch {
-			case err != nil:
-				logger.Log(level.Key(), level.ErrorValue(),
-					logging.MessageKey(), "disconnecting device: error during rehash",
-					logging.ErrorKey(), err,
-					"id", candidate,
-				)
-
-				return device.CloseReason{Err: err, Text: RehashError}, true
-
-			case !r.isRegistered(instance):
-				logger.Log(level.Key(), level.InfoValue(),
-					logging.MessageKey(), "disconnecting device: rehashed to another instance",
-					"instance", instance,
-					"id", candidate,
-				)
-
-				return device.CloseReason{Text: RehashOtherInstance}, true
-
-			default:
-				logger.Log(level.Key(), level.DebugValue(), logging.MessageKey(), "device hashed to this instance", "id", candidate)
+			reason, disconnect := r.check(logger, accessor, candidate)
+			if !disconnect {
 				keepCount++
-				return device.CloseReason{}, false
 			}
+
+			return reason, disconnect
 		})
+	}
 
-		duration = r.now().Sub(start)
-	)
+	duration := r.now().Sub(start)
 
 	r.keep.With(service.ServiceLabel, key).Set(float64(keepCount))
 	r.disconnect.With(service.ServiceLabel, key).Set(float64(disconnectCount))
@@ -174,6 +289,70 @@ func (r *rehasher) rehash(key string, logger log.Logger, accessor service.Access
 	logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "rehash complete", "disconnectCount", disconnectCount, "duration", duration)
 }
 
+// submitRehash rehashes immediately or, if debouncing is configured, after service discovery for the given service settles
+func (r *rehasher) submitRehash(key string, logger log.Logger, accessor service.Accessor) {
+	if r.debounce <= 0 {
+		r.rehash(key, logger, accessor)
+		return
+	}
+
+	defer r.lock.Unlock()
+	r.lock.Lock()
+
+	c, ok := r.debouncers[key]
+	if !ok {
+		c = capacitor.New(capacitor.WithDelay(r.debounce), capacitor.WithClock(r.clock))
+		r.debouncers[key] = c
+	}
+
+	if r.pending[key] {
+		logger.Log(level.Key(), level.DebugValue(), logging.MessageKey(), "coalescing rehash with a pending rehash")
+		r.coalescedCounter.With(service.ServiceLabel, key).Add(1.0)
+	}
+
+	r.pending[key] = true
+	c.Submit(func() {
+		r.lock.Lock()
+		delete(r.pending, key)
+		r.lock.Unlock()
+
+		r.rehash(key, logger, accessor)
+	})
+}
+
+// cancelAll cancels any pending or staged rehashes, as when all devices are about to be disconnected
+func (r *rehasher) cancelAll() {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+
+	for key, c := range r.debouncers {
+		c.Cancel()
+		delete(r.pending, key)
+	}
+
+	for _, j := range r.jobs {
+		j.stop()
+	}
+}
+
+func (r *rehasher) Status() map[string]Status {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+
+	status := make(map[string]Status, len(r.jobs)+len(r.pending))
+	for key, j := range r.jobs {
+		status[key] = j.status()
+	}
+
+	for key := range r.pending {
+		s := status[key]
+		s.Pending = true
+		status[key] = s
+	}
+
+	return status
+}
+
 func (r *rehasher) MonitorEvent(e monitor.Event) {
 	logger := logging.Enrich(
 		log.With(
@@ -186,11 +365,13 @@ func (r *rehasher) MonitorEvent(e monitor.Event) {
 	switch {
 	case e.Err != nil:
 		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "disconnecting all devices: service discovery error", logging.ErrorKey(), e.Err)
+		r.cancelAll()
 		r.connector.DisconnectAll(device.CloseReason{Err: e.Err, Text: ServiceDiscoveryError})
 		r.disconnectAllCounter.With(service.ServiceLabel, e.Key, ReasonLabel, DisconnectAllServiceDiscoveryError).Add(1.0)
 
 	case e.Stopped:
 		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "disconnecting all devices: service discovery monitor being stopped")
+		r.cancelAll()
 		r.connector.DisconnectAll(device.CloseReason{Text: ServiceDiscoveryStopped})
 		r.disconnectAllCounter.With(service.ServiceLabel, e.Key, ReasonLabel, DisconnectAllServiceDiscoveryStopped).Add(1.0)
 
@@ -198,10 +379,11 @@ func (r *rehasher) MonitorEvent(e monitor.Event) {
 		logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "ignoring initial instances")
 
 	case len(e.Instances) > 0:
-		r.rehash(e.Key, logger, r.accessorFactory(e.Instances))
+		r.submitRehash(e.Key, logger, r.accessorFactory(e.Instances))
 
 	default:
 		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "disconnecting all devices: service discovery updated with no instances")
+		r.cancelAll()
 		r.connector.DisconnectAll(device.CloseReason{Text: ServiceDiscoveryNoInstances})
 		r.disconnectAllCounter.With(service.ServiceLabel, e.Key, ReasonLabel, DisconnectAllServiceDiscoveryNoInstances).Add(1.0)
 	}
@@ -0,0 +1,213 @@
+package rehasher
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/service"
+)
+
+// DefaultStagingTick is the time unit for Staging.Rate when no Tick is configured
+const DefaultStagingTick time.Duration = time.Second
+
+// Staging configures the gradual disconnection of devices that a rehash has moved to other instances.
+// Rather than dropping every moved device at once, which sends a reconnect storm to the new owners, devices
+// are disconnected at a fixed rate in the style of a drain job.
+type Staging struct {
+	// Rate is the number of moved devices disconnected per Tick.  If nonpositive, staging is disabled and moved
+	// devices are disconnected as soon as the rehash completes.
+	Rate int `json:"rate"`
+
+	// Tick is the time unit for Rate.  If nonpositive, DefaultStagingTick is used.
+	Tick time.Duration `json:"tick"`
+
+	// MaxDuration is the longest a staged rehash is allowed to take.  Once it elapses, any moved devices that
+	// are still connected are disconnected at once.  If nonpositive, there is no limit.
+	MaxDuration time.Duration `json:"maxDuration,omitempty"`
+}
+
+func (s Staging) enabled() bool {
+	return s.Rate > 0
+}
+
+func (s Staging) tick() time.Duration {
+	if s.Tick > 0 {
+		return s.Tick
+	}
+
+	return DefaultStagingTick
+}
+
+// Status describes the most recent rehash for a single service
+type Status struct {
+	// Pending indicates that a rehash is being delayed so that rapid service discovery events can be coalesced
+	Pending bool `json:"pending"`
+
+	// Active indicates that a staged rehash is disconnecting moved devices
+	Active bool `json:"active"`
+
+	// Total is the number of moved devices handed to the most recent staged rehash
+	Total int `json:"total"`
+
+	// Visited is the number of moved devices that the staged rehash has attempted to disconnect
+	Visited int `json:"visited"`
+
+	// Disconnected is the number of visited devices that were actually disconnected.  Devices that
+	// disconnected on their own in the meantime are not counted.
+	Disconnected int `json:"disconnected"`
+
+	// Started is the UTC time at which the staged rehash began.  This field is nil if no staged
+	// rehash has run for the service.
+	Started *time.Time `json:"started,omitempty"`
+
+	// Finished is the UTC time at which the staged rehash completed or was cancelled.  This field is nil
+	// if the staged rehash is still running.
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// stagedDevice is a moved device awaiting disconnection
+type stagedDevice struct {
+	id     device.ID
+	reason device.CloseReason
+}
+
+// stagedJob holds the runtime state of a single staged rehash
+type stagedJob struct {
+	key     string
+	logger  log.Logger
+	devices []stagedDevice
+	started time.Time
+
+	visited      int32
+	disconnected int32
+	finished     atomic.Value
+
+	cancelOnce sync.Once
+	cancel     chan struct{}
+	done       chan struct{}
+}
+
+func (j *stagedJob) stop() {
+	j.cancelOnce.Do(func() {
+		close(j.cancel)
+	})
+}
+
+func (j *stagedJob) status() Status {
+	var (
+		started = j.started
+		s       = Status{
+			Active:       true,
+			Total:        len(j.devices),
+			Visited:      int(atomic.LoadInt32(&j.visited)),
+			Disconnected: int(atomic.LoadInt32(&j.disconnected)),
+			Started:      &started,
+		}
+	)
+
+	if finished, ok := j.finished.Load().(time.Time); ok {
+		s.Active = false
+		s.Finished = &finished
+	}
+
+	return s
+}
+
+// startStaged begins disconnecting moved devices for a service.  This method must be invoked under the rehasher's lock.
+func (r *rehasher) startStaged(key string, logger log.Logger, devices []stagedDevice) *stagedJob {
+	j := &stagedJob{
+		key:     key,
+		logger:  logger,
+		devices: devices,
+		started: r.now().UTC(),
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	r.jobs[key] = j
+	r.stagedRemaining.With(service.ServiceLabel, key).Set(float64(len(devices)))
+	go r.runStaged(j)
+	return j
+}
+
+// disconnectStaged disconnects a batch of moved devices
+func (r *rehasher) disconnectStaged(j *stagedJob, batch []stagedDevice) {
+	disconnected := 0
+	for _, sd := range batch {
+		if r.connector.Disconnect(sd.id, sd.reason) {
+			disconnected++
+		}
+	}
+
+	visited := atomic.AddInt32(&j.visited, int32(len(batch)))
+	atomic.AddInt32(&j.disconnected, int32(disconnected))
+	r.stagedDisconnectCounter.With(service.ServiceLabel, j.key).Add(float64(disconnected))
+
+	r.lock.Lock()
+	if r.jobs[j.key] == j {
+		r.stagedRemaining.With(service.ServiceLabel, j.key).Set(float64(len(j.devices) - int(visited)))
+	}
+
+	r.lock.Unlock()
+	j.logger.Log(level.Key(), level.DebugValue(), logging.MessageKey(), "staged rehash batch", "visited", len(batch), "disconnected", disconnected)
+}
+
+// runStaged is run as a goroutine to disconnect a job's devices at the configured rate
+func (r *rehasher) runStaged(j *stagedJob) {
+	defer r.stagedFinished(j)
+	j.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "staged rehash starting",
+		"count", len(j.devices), "rate", r.staging.Rate, "tick", r.staging.tick(), "maxDuration", r.staging.MaxDuration)
+
+	ticker := r.clock.NewTicker(r.staging.tick())
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if r.staging.MaxDuration > 0 {
+		timer := r.clock.NewTimer(r.staging.MaxDuration)
+		defer timer.Stop()
+		deadline = timer.C()
+	}
+
+	for remaining := j.devices; len(remaining) > 0; {
+		select {
+		case <-ticker.C():
+			n := r.staging.Rate
+			if n > len(remaining) {
+				n = len(remaining)
+			}
+
+			r.disconnectStaged(j, remaining[:n])
+			remaining = remaining[n:]
+
+		case <-deadline:
+			j.logger.Log(level.Key(), level.WarnValue(), logging.MessageKey(), "staged rehash exceeded its maximum duration: disconnecting remaining devices", "remaining", len(remaining))
+			r.disconnectStaged(j, remaining)
+			remaining = nil
+
+		case <-j.cancel:
+			j.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "staged rehash cancelled", "remaining", len(remaining))
+			return
+		}
+	}
+}
+
+func (r *rehasher) stagedFinished(j *stagedJob) {
+	j.finished.Store(r.now().UTC())
+
+	r.lock.Lock()
+	if r.jobs[j.key] == j {
+		r.stagedRemaining.With(service.ServiceLabel, j.key).Set(0.0)
+	}
+
+	r.lock.Unlock()
+	close(j.done)
+
+	p := j.status()
+	j.logger.Log(level.Key(), level.InfoValue(), logging.MessageKey(), "staged rehash complete", "visited", p.Visited, "disconnected", p.Disconnected)
+}
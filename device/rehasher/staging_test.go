@@ -0,0 +1,338 @@
+package rehasher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/clock/clocktest"
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/service"
+	"github.com/Comcast/webpa-common/service/monitor"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	keepNode   = "keep.xfinity.net"
+	rehashNode = "rehash.xfinity.net"
+)
+
+// newTestRegistry produces a registry with one device that hashes to this instance and the given number that do not
+func newTestRegistry(moved int) (*device.MockRegistry, []device.ID) {
+	var (
+		registry = new(device.MockRegistry)
+		devices  []device.Interface
+		movedIDs []device.ID
+	)
+
+	keep := new(device.MockDevice)
+	keep.On("ID").Return(device.ID("keep"))
+	devices = append(devices, keep)
+
+	for i := 0; i < moved; i++ {
+		id := device.ID(fmt.Sprintf("moved-%d", i))
+		d := new(device.MockDevice)
+		d.On("ID").Return(id)
+		devices = append(devices, d)
+		movedIDs = append(movedIDs, id)
+	}
+
+	registry.On("VisitAll", mock.MatchedBy(func(func(device.Interface) bool) bool { return true })).
+		Run(func(arguments mock.Arguments) {
+			f := arguments.Get(0).(func(device.Interface) bool)
+			for _, d := range devices {
+				if !f(d) {
+					return
+				}
+			}
+		}).
+		Return(len(devices))
+
+	return registry, movedIDs
+}
+
+func testAccessorFactory([]string) service.Accessor {
+	return service.AccessorFunc(func(key []byte) (string, error) {
+		if string(key) == "keep" {
+			return keepNode, nil
+		}
+
+		return rehashNode, nil
+	})
+}
+
+func isKeepNode(v string) bool {
+	return v == keepNode
+}
+
+func currentJob(r Interface, key string) *stagedJob {
+	rh := r.(*rehasher)
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+	return rh.jobs[key]
+}
+
+func TestNewStagingWithoutRegistry(t *testing.T) {
+	assert.Panics(t, func() {
+		New(new(device.MockConnector), WithIsRegistered(isKeepNode), WithStaging(Staging{Rate: 10}))
+	})
+}
+
+func TestStaging(t *testing.T) {
+	assert := assert.New(t)
+
+	s := Staging{}
+	assert.False(s.enabled())
+	assert.Equal(DefaultStagingTick, s.tick())
+
+	s = Staging{Rate: 5, Tick: time.Minute}
+	assert.True(s.enabled())
+	assert.Equal(time.Minute, s.tick())
+}
+
+func testRehasherStaged(t *testing.T, maxDuration time.Duration) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		provider = xmetricstest.NewProvider(nil, Metrics)
+
+		registry, movedIDs = newTestRegistry(5)
+		connector          = new(device.MockConnector)
+
+		clk      = new(clocktest.Mock)
+		ticker   = new(clocktest.MockTicker)
+		tickerC  = make(chan time.Time)
+		timer    = new(clocktest.MockTimer)
+		deadline = make(chan time.Time)
+
+		r = New(
+			connector,
+			WithLogger(logging.NewTestLogger(nil, t)),
+			WithIsRegistered(isKeepNode),
+			WithAccessorFactory(testAccessorFactory),
+			WithMetricsProvider(provider),
+			WithRegistry(registry),
+			WithStaging(Staging{Rate: 2, MaxDuration: maxDuration}),
+			WithClock(clk),
+		)
+	)
+
+	clk.OnNewTicker(DefaultStagingTick, ticker).Once()
+	ticker.OnC(tickerC)
+	ticker.OnStop().Once()
+	if maxDuration > 0 {
+		clk.OnNewTimer(maxDuration, timer).Once()
+		timer.OnC(deadline)
+		timer.OnStop(true).Once()
+	}
+
+	for i, id := range movedIDs {
+		// the first device disconnects on its own before the staged rehash gets to it
+		connector.On("Disconnect", id, device.CloseReason{Text: RehashOtherInstance}).Return(i > 0).Once()
+	}
+
+	r.MonitorEvent(monitor.Event{Key: "test", EventCount: 10, Instances: []string{keepNode, rehashNode}})
+	j := currentJob(r, "test")
+	require.NotNil(j)
+
+	status := r.Status()["test"]
+	assert.True(status.Active)
+	assert.Equal(5, status.Total)
+	assert.NotNil(status.Started)
+	provider.Assert(t, RehashKeepDevice, service.ServiceLabel, "test")(xmetricstest.Value(1.0))
+	provider.Assert(t, RehashDisconnectDevice, service.ServiceLabel, "test")(xmetricstest.Value(5.0))
+	provider.Assert(t, RehashStagedRemainingDevice, service.ServiceLabel, "test")(xmetricstest.Value(5.0))
+
+	tickerC <- time.Now()
+	tickerC <- time.Now()
+	if maxDuration > 0 {
+		deadline <- time.Now()
+	} else {
+		tickerC <- time.Now()
+	}
+
+	select {
+	case <-j.done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("The staged rehash did not finish")
+	}
+
+	status = r.Status()["test"]
+	assert.False(status.Active)
+	assert.Equal(5, status.Total)
+	assert.Equal(5, status.Visited)
+	assert.Equal(4, status.Disconnected)
+	assert.NotNil(status.Finished)
+
+	provider.Assert(t, RehashStagedDisconnectCounter, service.ServiceLabel, "test")(xmetricstest.Value(4.0))
+	provider.Assert(t, RehashStagedRemainingDevice, service.ServiceLabel, "test")(xmetricstest.Value(0.0))
+
+	connector.AssertExpectations(t)
+	registry.AssertExpectations(t)
+	clk.AssertExpectations(t)
+	ticker.AssertExpectations(t)
+	timer.AssertExpectations(t)
+}
+
+func testRehasherStagedCancelled(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		registry, _ = newTestRegistry(3)
+		connector   = new(device.MockConnector)
+
+		clk     = new(clocktest.Mock)
+		ticker  = new(clocktest.MockTicker)
+		tickerC = make(chan time.Time)
+
+		r = New(
+			connector,
+			WithLogger(logging.NewTestLogger(nil, t)),
+			WithIsRegistered(isKeepNode),
+			WithAccessorFactory(testAccessorFactory),
+			WithRegistry(registry),
+			WithStaging(Staging{Rate: 1}),
+			WithClock(clk),
+		)
+	)
+
+	clk.OnNewTicker(DefaultStagingTick, ticker)
+	ticker.OnC(tickerC)
+	ticker.OnStop()
+
+	// a second rehash supersedes the first
+	r.MonitorEvent(monitor.Event{Key: "test", EventCount: 10, Instances: []string{keepNode, rehashNode}})
+	first := currentJob(r, "test")
+	require.NotNil(first)
+
+	r.MonitorEvent(monitor.Event{Key: "test", EventCount: 11, Instances: []string{keepNode, rehashNode}})
+	second := currentJob(r, "test")
+	require.NotNil(second)
+	assert.False(first == second)
+
+	select {
+	case <-first.done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("The superseded staged rehash was not cancelled")
+	}
+
+	// disconnecting all devices cancels any staged rehash
+	connector.On("DisconnectAll", device.CloseReason{Text: ServiceDiscoveryStopped}).Return(4).Once()
+	r.MonitorEvent(monitor.Event{Key: "test", EventCount: 12, Stopped: true})
+
+	select {
+	case <-second.done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("The staged rehash was not cancelled")
+	}
+
+	status := r.Status()["test"]
+	assert.False(status.Active)
+	assert.Equal(3, status.Total)
+	assert.Zero(status.Visited)
+
+	connector.AssertExpectations(t)
+}
+
+func testRehasherDebounce(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		provider = xmetricstest.NewProvider(nil, Metrics)
+
+		rehashed  = make(chan struct{}, 10)
+		rehashes  int32
+		connector = new(device.MockConnector)
+
+		r = New(
+			connector,
+			WithLogger(logging.NewTestLogger(nil, t)),
+			WithIsRegistered(isKeepNode),
+			WithAccessorFactory(testAccessorFactory),
+			WithMetricsProvider(provider),
+			WithDebounce(100*time.Millisecond),
+		)
+	)
+
+	connector.On("DisconnectIf", mock.MatchedBy(func(func(device.ID) (device.CloseReason, bool)) bool { return true })).
+		Run(func(mock.Arguments) {
+			atomic.AddInt32(&rehashes, 1)
+			rehashed <- struct{}{}
+		}).
+		Return(0)
+
+	// rapid successive events are coalesced into a single rehash
+	for i := 1; i <= 3; i++ {
+		r.MonitorEvent(monitor.Event{Key: "test", EventCount: 10 + i, Instances: []string{keepNode, rehashNode}})
+	}
+
+	assert.True(r.Status()["test"].Pending)
+
+	select {
+	case <-rehashed:
+	case <-time.After(5 * time.Second):
+		assert.Fail("No rehash occurred")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&rehashes))
+	assert.False(r.Status()["test"].Pending)
+	provider.Assert(t, RehashCoalescedCounter, service.ServiceLabel, "test")(xmetricstest.Value(2.0))
+
+	// a pending rehash is cancelled when all devices are disconnected
+	connector.On("DisconnectAll", device.CloseReason{Text: ServiceDiscoveryNoInstances}).Return(0).Once()
+	r.MonitorEvent(monitor.Event{Key: "test", EventCount: 20, Instances: []string{keepNode}})
+	r.MonitorEvent(monitor.Event{Key: "test", EventCount: 21})
+	assert.False(r.Status()["test"].Pending)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&rehashes))
+	connector.AssertExpectations(t)
+}
+
+func TestRehasherStaged(t *testing.T) {
+	t.Run("Rate", func(t *testing.T) { testRehasherStaged(t, 0) })
+	t.Run("MaxDuration", func(t *testing.T) { testRehasherStaged(t, time.Hour) })
+	t.Run("Cancelled", testRehasherStagedCancelled)
+	t.Run("Debounce", testRehasherDebounce)
+}
+
+func TestStatusHandler(t *testing.T) {
+	var (
+		assert      = assert.New(t)
+		registry, _ = newTestRegistry(0)
+		r           = New(
+			new(device.MockConnector),
+			WithIsRegistered(isKeepNode),
+			WithAccessorFactory(testAccessorFactory),
+			WithRegistry(registry),
+			WithStaging(Staging{Rate: 1}),
+		)
+
+		handler  = StatusHandler{Rehasher: r}
+		response = httptest.NewRecorder()
+	)
+
+	handler.ServeHTTP(response, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal("application/json", response.Header().Get("Content-Type"))
+	assert.JSONEq(`{}`, response.Body.String())
+
+	r.MonitorEvent(monitor.Event{Key: "test", EventCount: 10, Instances: []string{keepNode}})
+	j := currentJob(r, "test")
+	if assert.NotNil(j) {
+		<-j.done
+	}
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Contains(response.Body.String(), `"test":{"pending":false,"active":false,"total":0,"visited":0,"disconnected":0`)
+}
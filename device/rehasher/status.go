@@ -0,0 +1,25 @@
+package rehasher
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Comcast/webpa-common/xhttp"
+)
+
+// StatusHandler is an http.Handler that returns a JSON message describing the most recent rehash for each service
+type StatusHandler struct {
+	Rehasher Interface
+}
+
+func (sh *StatusHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	message, err := json.Marshal(sh.Rehasher.Status())
+	if err != nil {
+		xhttp.WriteError(response, http.StatusInternalServerError, err)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	response.Write(message)
+}
@@ -0,0 +1,157 @@
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionOptions configures resumption of device sessions.  A session is the state of a device that can
+// outlive a single websocket connection: its pending transactions and, optionally, its queued messages.
+// When a device's connection drops unexpectedly, its session is suspended for a grace period.  If a device
+// with the same ID connects within that period, the new connection resumes the session, and any responses to
+// pending transactions received on the new connection complete those transactions.
+//
+// Devices that are disconnected deliberately, e.g. by Disconnect or because of a duplicate connection,
+// never have their sessions suspended.
+type SessionOptions struct {
+	// GracePeriod is the length of time a suspended session is held.  If nonpositive, session resumption
+	// is disabled and a device's pending transactions are cancelled as soon as it disconnects.
+	GracePeriod time.Duration
+
+	// KeepMessages indicates whether messages that were queued for a device when it disconnected are
+	// held with its session and delivered if the session is resumed.  If false, such messages fail
+	// immediately, as they do without session resumption.
+	KeepMessages bool
+}
+
+func (o *SessionOptions) enabled() bool {
+	return o != nil && o.GracePeriod > 0
+}
+
+// session is the state shared by each connection of a device that resumes its session
+type session struct {
+	transactions *Transactions
+	done         chan struct{}
+	once         sync.Once
+}
+
+func newSession(o *TransactionOptions) *session {
+	return &session{
+		transactions: newTransactions(o),
+		done:         make(chan struct{}),
+	}
+}
+
+// close ends this session, cancelling any pending transactions.  This method is idempotent.
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.transactions.Close()
+	})
+}
+
+// closed tests if this session has ended
+func (s *session) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// suspendedSession is a disconnected device awaiting either resumption or expiry
+type suspendedSession struct {
+	device *device
+	timer  *time.Timer
+}
+
+// suspendedSessions tracks the sessions of disconnected devices which may be resumed
+type suspendedSessions struct {
+	lock         sync.Mutex
+	gracePeriod  time.Duration
+	keepMessages bool
+	sessions     map[ID]*suspendedSession
+	onExpire     func(*device)
+}
+
+// newSuspendedSessions creates the session store described by the given options.  If session resumption
+// is not enabled, this function returns nil.  The onExpire closure is invoked, without any locks held, for
+// each suspended device whose grace period elapses.
+func newSuspendedSessions(o *SessionOptions, onExpire func(*device)) *suspendedSessions {
+	if !o.enabled() {
+		return nil
+	}
+
+	return &suspendedSessions{
+		gracePeriod:  o.GracePeriod,
+		keepMessages: o.KeepMessages,
+		sessions:     make(map[ID]*suspendedSession),
+		onExpire:     onExpire,
+	}
+}
+
+// suspend holds the session of a disconnected device.  This method must be called before the device is closed.
+// If the device has already been closed deliberately, its session is not suspended and this method returns false.
+func (ss *suspendedSessions) suspend(d *device) bool {
+	if !d.suspend() {
+		return false
+	}
+
+	id := d.ID()
+	entry := &suspendedSession{device: d}
+
+	ss.lock.Lock()
+	previous := ss.sessions[id]
+	ss.sessions[id] = entry
+	entry.timer = time.AfterFunc(ss.gracePeriod, func() { ss.expire(id, entry) })
+	ss.lock.Unlock()
+
+	if previous != nil {
+		previous.timer.Stop()
+		ss.onExpire(previous.device)
+	}
+
+	return true
+}
+
+// expire ends a suspended session, provided that it hasn't been resumed or replaced
+func (ss *suspendedSessions) expire(id ID, entry *suspendedSession) {
+	ss.lock.Lock()
+	if ss.sessions[id] != entry {
+		ss.lock.Unlock()
+		return
+	}
+
+	delete(ss.sessions, id)
+	ss.lock.Unlock()
+	ss.onExpire(entry.device)
+}
+
+// resume removes and returns the suspended device with the given ID, if one exists and its session is still open
+func (ss *suspendedSessions) resume(id ID) (*device, bool) {
+	ss.lock.Lock()
+	entry, ok := ss.sessions[id]
+	if ok {
+		delete(ss.sessions, id)
+	}
+
+	ss.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	entry.timer.Stop()
+	if entry.device.session.closed() {
+		return nil, false
+	}
+
+	return entry.device, true
+}
+
+// len returns the count of currently suspended sessions
+func (ss *suspendedSessions) len() int {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return len(ss.sessions)
+}
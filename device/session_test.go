@@ -0,0 +1,464 @@
+package device
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func testSuspendedSessionsDisabled(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(newSuspendedSessions(nil, func(*device) {}))
+	assert.Nil(newSuspendedSessions(new(SessionOptions), func(*device) {}))
+}
+
+func testSuspendedSessionsResume(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		expired = make(chan *device, 1)
+		ss      = newSuspendedSessions(&SessionOptions{GracePeriod: time.Hour}, func(d *device) { expired <- d })
+		d       = newDevice(deviceOptions{ID: ID("mac:112233445566"), Logger: logging.NewTestLogger(nil, t)})
+	)
+
+	require.NotNil(ss)
+	_, err := d.session.transactions.Register("test")
+	require.NoError(err)
+
+	assert.True(ss.suspend(d))
+	assert.Equal(1, ss.len())
+	d.requestClose(CloseReason{Text: "readerror"})
+	assert.True(d.Closed())
+	assert.False(d.session.closed())
+	assert.Equal(1, d.session.transactions.Len())
+
+	previous, ok := ss.resume(ID("mac:ffffffffffff"))
+	assert.Nil(previous)
+	assert.False(ok)
+
+	previous, ok = ss.resume(d.ID())
+	assert.True(ok)
+	assert.Equal(d, previous)
+	assert.Zero(ss.len())
+
+	previous, ok = ss.resume(d.ID())
+	assert.Nil(previous)
+	assert.False(ok)
+
+	select {
+	case <-expired:
+		assert.Fail("The session should not have expired")
+	default:
+	}
+}
+
+func testSuspendedSessionsExpire(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		expired = make(chan *device, 1)
+		ss      = newSuspendedSessions(&SessionOptions{GracePeriod: 10 * time.Millisecond}, func(d *device) { expired <- d })
+		d       = newDevice(deviceOptions{ID: ID("mac:112233445566"), Logger: logging.NewTestLogger(nil, t)})
+	)
+
+	require.NotNil(ss)
+	assert.True(ss.suspend(d))
+
+	select {
+	case actual := <-expired:
+		assert.Equal(d, actual)
+	case <-time.After(5 * time.Second):
+		assert.Fail("The session did not expire")
+	}
+
+	assert.Zero(ss.len())
+	previous, ok := ss.resume(d.ID())
+	assert.Nil(previous)
+	assert.False(ok)
+}
+
+func testSuspendedSessionsClosed(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		ss = newSuspendedSessions(&SessionOptions{GracePeriod: time.Hour}, func(*device) {})
+		d  = newDevice(deviceOptions{ID: ID("mac:112233445566"), Logger: logging.NewTestLogger(nil, t)})
+	)
+
+	require.NotNil(ss)
+
+	// a deliberately closed device cannot have its session suspended
+	d.requestClose(CloseReason{Text: "disconnect"})
+	assert.True(d.session.closed())
+	assert.False(ss.suspend(d))
+	assert.Zero(ss.len())
+}
+
+func TestSuspendedSessions(t *testing.T) {
+	t.Run("Disabled", testSuspendedSessionsDisabled)
+	t.Run("Resume", testSuspendedSessionsResume)
+	t.Run("Expire", testSuspendedSessionsExpire)
+	t.Run("Closed", testSuspendedSessionsClosed)
+}
+
+// sessionTestListener captures the session and disconnect events dispatched by a manager
+type sessionTestListener struct {
+	lock         sync.Mutex
+	counts       map[EventType]int
+	connected    chan struct{}
+	disconnected chan struct{}
+	resumed      chan struct{}
+	expired      chan struct{}
+}
+
+func newSessionTestListener() *sessionTestListener {
+	return &sessionTestListener{
+		counts:       make(map[EventType]int),
+		connected:    make(chan struct{}, 10),
+		disconnected: make(chan struct{}, 10),
+		resumed:      make(chan struct{}, 10),
+		expired:      make(chan struct{}, 10),
+	}
+}
+
+func (stl *sessionTestListener) OnDeviceEvent(e *Event) {
+	stl.lock.Lock()
+	stl.counts[e.Type]++
+	stl.lock.Unlock()
+
+	switch e.Type {
+	case Connect:
+		stl.connected <- struct{}{}
+	case Disconnect:
+		stl.disconnected <- struct{}{}
+	case SessionResumed:
+		stl.resumed <- struct{}{}
+	case SessionExpired:
+		stl.expired <- struct{}{}
+	}
+}
+
+func (stl *sessionTestListener) count(t EventType) int {
+	stl.lock.Lock()
+	defer stl.lock.Unlock()
+	return stl.counts[t]
+}
+
+func awaitSessionEvent(assert *assert.Assertions, events <-chan struct{}, description string) {
+	select {
+	case <-events:
+	case <-time.After(10 * time.Second):
+		assert.Fail("No " + description + " event was dispatched")
+	}
+}
+
+// readTestMessage reads and decodes the next WRP message sent to a test device
+func readTestMessage(require *require.Assertions, connection Connection) *wrp.Message {
+	require.NoError(connection.SetReadDeadline(time.Now().Add(10 * time.Second)))
+	messageType, data, err := connection.ReadMessage()
+	require.NoError(err)
+	require.Equal(websocket.BinaryMessage, messageType)
+
+	message := new(wrp.Message)
+	require.NoError(wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(message))
+	return message
+}
+
+func testManagerSessionResumed(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		listener = newSessionTestListener()
+		options  = &Options{
+			Logger:    logging.NewTestLogger(nil, t),
+			Sessions:  SessionOptions{GracePeriod: time.Minute},
+			Listeners: []Listener{listener.OnDeviceEvent},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+
+		responses = make(chan *Response, 1)
+		errs      = make(chan error, 1)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+
+	go func() {
+		response, err := manager.Route(&Request{
+			Message: &wrp.SimpleRequestResponse{
+				Source:          "test",
+				Destination:     string(testDeviceIDs[0]),
+				TransactionUUID: "resume-me",
+				Payload:         []byte("request"),
+			},
+		})
+
+		responses <- response
+		errs <- err
+	}()
+
+	request := readTestMessage(require, connection)
+	assert.Equal("resume-me", request.TransactionUUID)
+
+	// drop the connection without responding
+	require.NoError(connection.Close())
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+
+	connection, _, err = DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	awaitSessionEvent(assert, listener.resumed, "session resumed")
+
+	require.NoError(connection.WriteMessage(
+		websocket.BinaryMessage,
+		wrp.MustEncode(
+			&wrp.SimpleRequestResponse{
+				Source:          string(testDeviceIDs[0]),
+				Destination:     "test",
+				TransactionUUID: "resume-me",
+				Payload:         []byte("response"),
+			},
+			wrp.Msgpack,
+		),
+	))
+
+	select {
+	case response := <-responses:
+		require.NotNil(response)
+		assert.Equal("response", string(response.Message.Payload))
+		assert.NoError(<-errs)
+	case <-time.After(10 * time.Second):
+		assert.Fail("The transaction did not complete on the resumed session")
+	}
+
+	require.NoError(connection.Close())
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	assert.Equal(1, listener.count(SessionResumed))
+	assert.Zero(listener.count(SessionExpired))
+}
+
+func testManagerSessionExpired(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		listener = newSessionTestListener()
+		options  = &Options{
+			Logger:    logging.NewTestLogger(nil, t),
+			Sessions:  SessionOptions{GracePeriod: 50 * time.Millisecond},
+			Listeners: []Listener{listener.OnDeviceEvent},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+		errs                        = make(chan error, 1)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+
+	go func() {
+		_, err := manager.Route(&Request{
+			Message: &wrp.SimpleRequestResponse{
+				Source:          "test",
+				Destination:     string(testDeviceIDs[0]),
+				TransactionUUID: "expire-me",
+			},
+		})
+
+		errs <- err
+	}()
+
+	readTestMessage(require, connection)
+	require.NoError(connection.Close())
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	awaitSessionEvent(assert, listener.expired, "session expired")
+
+	select {
+	case err := <-errs:
+		assert.Equal(ErrorDeviceClosed, err)
+	case <-time.After(10 * time.Second):
+		assert.Fail("The transaction did not fail when the session expired")
+	}
+
+	assert.Zero(listener.count(SessionResumed))
+}
+
+func testManagerSessionDisconnected(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		listener = newSessionTestListener()
+		options  = &Options{
+			Logger:    logging.NewTestLogger(nil, t),
+			Sessions:  SessionOptions{GracePeriod: time.Minute},
+			Listeners: []Listener{listener.OnDeviceEvent},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+		errs                        = make(chan error, 1)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	defer connection.Close()
+
+	go func() {
+		_, err := manager.Route(&Request{
+			Message: &wrp.SimpleRequestResponse{
+				Source:          "test",
+				Destination:     string(testDeviceIDs[0]),
+				TransactionUUID: "disconnect-me",
+			},
+		})
+
+		errs <- err
+	}()
+
+	readTestMessage(require, connection)
+
+	// a deliberate disconnect never suspends the session
+	assert.True(manager.Disconnect(testDeviceIDs[0], CloseReason{Text: "test"}))
+	select {
+	case err := <-errs:
+		assert.Equal(ErrorDeviceClosed, err)
+	case <-time.After(10 * time.Second):
+		assert.Fail("The transaction did not fail on disconnect")
+	}
+
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	assert.Zero(listener.count(SessionResumed))
+	assert.Zero(listener.count(SessionExpired))
+}
+
+func testManagerSessionDisconnectedKeepMessages(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		listener = newSessionTestListener()
+		m        = NewManager(&Options{
+			Logger:    logging.NewTestLogger(nil, t),
+			Sessions:  SessionOptions{GracePeriod: time.Minute, KeepMessages: true},
+			Listeners: []Listener{listener.OnDeviceEvent},
+		}).(*manager)
+
+		d        = newDevice(deviceOptions{ID: testDeviceIDs[0], QueueSize: 10, Logger: logging.NewTestLogger(nil, t)})
+		writer   = new(mockConnectionWriter)
+		complete = make([]chan error, 3)
+	)
+
+	d.conveyClosure = func() {}
+	require.NoError(m.devices.add(d))
+	for i := range complete {
+		complete[i] = make(chan error, 1)
+		d.messages <- &envelope{
+			request:  &Request{Message: &wrp.SimpleEvent{Source: "test", Destination: string(testDeviceIDs[0])}},
+			complete: complete[i],
+		}
+	}
+
+	// a deliberate disconnect ends the session, so queued messages fail rather than being held
+	assert.True(m.Disconnect(testDeviceIDs[0], CloseReason{Text: "test"}))
+	writer.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(errors.New("expected"))
+	writer.On("Close").Return(nil)
+	m.writePump(d, writer, func() error { return nil }, func(CloseReason) error { return nil }, new(sync.Once))
+
+	assert.False(d.isSuspended())
+	assert.Zero(m.sessions.len())
+	assert.True(listener.count(MessageFailed) >= len(complete))
+	for _, c := range complete {
+		select {
+		case err := <-c:
+			assert.Error(err)
+		default:
+			assert.Fail("A queued message was not failed")
+		}
+	}
+}
+
+func testManagerSessionLimitReached(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		listener = newSessionTestListener()
+		options  = &Options{
+			MaxDevices: 1,
+			Sessions:   SessionOptions{GracePeriod: time.Minute},
+			Listeners:  []Listener{listener.OnDeviceEvent},
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+		errs                        = make(chan error, 1)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	go func() {
+		_, err := manager.Route(&Request{
+			Message: &wrp.SimpleRequestResponse{
+				Source:          "test",
+				Destination:     string(testDeviceIDs[0]),
+				TransactionUUID: "limit-me",
+			},
+		})
+
+		errs <- err
+	}()
+
+	readTestMessage(require, connection)
+	require.NoError(connection.Close())
+	awaitSessionEvent(assert, listener.disconnected, "disconnect")
+
+	// another device takes the only slot, so the suspended device cannot reconnect
+	other, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[1]), connectURL, nil)
+	require.NoError(err)
+	defer other.Close()
+	awaitSessionEvent(assert, listener.connected, "connect")
+
+	if connection, _, err = DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil); err == nil {
+		connection.Close()
+	}
+
+	// the session taken for resumption must be ended, rather than abandoned
+	awaitSessionEvent(assert, listener.expired, "session expired")
+	select {
+	case err := <-errs:
+		assert.Equal(ErrorDeviceClosed, err)
+	case <-time.After(10 * time.Second):
+		assert.Fail("The transaction did not fail when the session could not be resumed")
+	}
+
+	assert.Zero(listener.count(SessionResumed))
+}
+
+func TestManagerSession(t *testing.T) {
+	t.Run("Resumed", testManagerSessionResumed)
+	t.Run("Expired", testManagerSessionExpired)
+	t.Run("Disconnected", testManagerSessionDisconnected)
+	t.Run("DisconnectedKeepMessages", testManagerSessionDisconnectedKeepMessages)
+	t.Run("LimitReached", testManagerSessionLimitReached)
+}
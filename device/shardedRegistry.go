@@ -0,0 +1,247 @@
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Comcast/webpa-common/xmetrics"
+	"github.com/go-kit/kit/log"
+)
+
+// registryShard is a single lock-striped partition of a shardedRegistry
+type registryShard struct {
+	lock sync.RWMutex
+	data map[ID]*device
+}
+
+// shardedRegistry is a deviceRegistry that partitions devices into a fixed number of shards,
+// each with its own lock.  Devices are assigned to shards by a hash of their ID.  This
+// reduces lock contention between connects, disconnects, and visitors when a large number
+// of devices are connected.
+//
+// The device limit is enforced across all shards using an atomic count.
+type shardedRegistry struct {
+	logger          log.Logger
+	limit           int64
+	initialCapacity int
+	size            int64
+	shards          []registryShard
+
+	count        xmetrics.Setter
+	limitReached xmetrics.Incrementer
+	connect      xmetrics.Incrementer
+	disconnect   xmetrics.Adder
+	duplicates   xmetrics.Incrementer
+}
+
+func newShardedRegistry(o registryOptions) *shardedRegistry {
+	if o.Shards < 1 {
+		o.Shards = 1
+	}
+
+	if o.InitialCapacity < 1 {
+		o.InitialCapacity = 10
+	}
+
+	shardCapacity := o.InitialCapacity / o.Shards
+	if shardCapacity < 1 {
+		shardCapacity = 1
+	}
+
+	sr := &shardedRegistry{
+		logger:          o.Logger,
+		limit:           int64(o.Limit),
+		initialCapacity: shardCapacity,
+		shards:          make([]registryShard, o.Shards),
+		count:           o.Measures.Device,
+		limitReached:    o.Measures.LimitReached,
+		connect:         o.Measures.Connect,
+		disconnect:      o.Measures.Disconnect,
+		duplicates:      o.Measures.Duplicates,
+	}
+
+	for i := range sr.shards {
+		sr.shards[i].data = make(map[ID]*device, shardCapacity)
+	}
+
+	return sr
+}
+
+// shardFor returns the shard responsible for the given device identifier.  An inlined
+// FNV-1a hash is used to avoid allocations.
+func (sr *shardedRegistry) shardFor(id ID) *registryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+
+	return &sr.shards[h%uint32(len(sr.shards))]
+}
+
+func (sr *shardedRegistry) len() int {
+	return int(atomic.LoadInt64(&sr.size))
+}
+
+func (sr *shardedRegistry) add(newDevice *device) error {
+	var (
+		id    = newDevice.ID()
+		shard = sr.shardFor(id)
+	)
+
+	shard.lock.Lock()
+	existing := shard.data[id]
+	if existing == nil {
+		if size := atomic.AddInt64(&sr.size, 1); sr.limit > 0 && size > sr.limit {
+			// adding this would result in exceeding the limit
+			atomic.AddInt64(&sr.size, -1)
+			shard.lock.Unlock()
+			sr.limitReached.Inc()
+			sr.disconnect.Add(1.0)
+			newDevice.requestClose(CloseReason{Err: errDeviceLimitReached, Text: DeviceLimitReachedCloseReason})
+			return errDeviceLimitReached
+		}
+	}
+
+	shard.data[id] = newDevice
+	sr.count.Set(float64(atomic.LoadInt64(&sr.size)))
+	shard.lock.Unlock()
+
+	if existing != nil {
+		sr.disconnect.Add(1.0)
+		sr.duplicates.Inc()
+		newDevice.Statistics().AddDuplications(existing.Statistics().Duplications() + 1)
+		existing.requestClose(CloseReason{Text: DuplicateCloseReason})
+	}
+
+	sr.connect.Inc()
+	return nil
+}
+
+func (sr *shardedRegistry) remove(id ID, reason CloseReason) (*device, bool) {
+	shard := sr.shardFor(id)
+	shard.lock.Lock()
+	existing, ok := shard.data[id]
+	if ok {
+		delete(shard.data, id)
+		atomic.AddInt64(&sr.size, -1)
+	}
+
+	sr.count.Set(float64(atomic.LoadInt64(&sr.size)))
+	shard.lock.Unlock()
+
+	if existing != nil {
+		sr.disconnect.Add(1.0)
+		existing.requestClose(reason)
+	}
+
+	return existing, ok
+}
+
+func (sr *shardedRegistry) removeIf(f func(d *device) (CloseReason, bool)) int {
+	count := 0
+	for i := range sr.shards {
+		shard := &sr.shards[i]
+
+		// gather up the devices in this shard that match the predicate.  only this
+		// shard is locked, so connections hashing to other shards can proceed.
+		var (
+			matched []*device
+			reasons []CloseReason
+		)
+
+		shard.lock.RLock()
+		for _, d := range shard.data {
+			if reason, ok := f(d); ok {
+				matched = append(matched, d)
+				reasons = append(reasons, reason)
+			}
+		}
+
+		shard.lock.RUnlock()
+
+		for j, d := range matched {
+			shard.lock.Lock()
+
+			// allow for barging
+			_, ok := shard.data[d.ID()]
+			if ok {
+				delete(shard.data, d.ID())
+				sr.count.Set(float64(atomic.AddInt64(&sr.size, -1)))
+			}
+
+			shard.lock.Unlock()
+
+			if ok {
+				count++
+				d.requestClose(reasons[j])
+			}
+		}
+	}
+
+	if count > 0 {
+		sr.disconnect.Add(float64(count))
+	}
+
+	return count
+}
+
+func (sr *shardedRegistry) removeAll(reason CloseReason) int {
+	var original []map[ID]*device
+	for i := range sr.shards {
+		shard := &sr.shards[i]
+		shard.lock.Lock()
+		original = append(original, shard.data)
+		shard.data = make(map[ID]*device, sr.initialCapacity)
+		atomic.AddInt64(&sr.size, -int64(len(original[i])))
+		shard.lock.Unlock()
+	}
+
+	sr.count.Set(float64(atomic.LoadInt64(&sr.size)))
+
+	count := 0
+	for _, data := range original {
+		count += len(data)
+		for _, d := range data {
+			d.requestClose(reason)
+		}
+	}
+
+	sr.disconnect.Add(float64(count))
+	return count
+}
+
+// visit applies the visitor to each device, holding the read lock for only one shard at a time.
+// As with the unsharded registry, visiting stops when the visitor returns false.
+func (sr *shardedRegistry) visit(f func(d *device) bool) int {
+	visited := 0
+	for i := range sr.shards {
+		more := true
+		shard := &sr.shards[i]
+
+		shard.lock.RLock()
+		for _, d := range shard.data {
+			visited++
+			if !f(d) {
+				more = false
+				break
+			}
+		}
+
+		shard.lock.RUnlock()
+		if !more {
+			break
+		}
+	}
+
+	return visited
+}
+
+func (sr *shardedRegistry) get(id ID) (*device, bool) {
+	shard := sr.shardFor(id)
+	shard.lock.RLock()
+	existing, ok := shard.data[id]
+	shard.lock.RUnlock()
+
+	return existing, ok
+}
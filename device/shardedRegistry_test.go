@@ -0,0 +1,392 @@
+package device
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/go-kit/kit/metrics/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testShardedRegistryAdd(t *testing.T) {
+	t.Run("Unlimited", func(t *testing.T) {
+		var (
+			assert  = assert.New(t)
+			require = require.New(t)
+			logger  = logging.NewTestLogger(nil, t)
+
+			p = xmetricstest.NewProvider(nil, Metrics)
+			r = newShardedRegistry(registryOptions{
+				Logger:   logger,
+				Shards:   4,
+				Measures: NewMeasures(p),
+			})
+		)
+
+		require.NotNil(r)
+		require.Len(r.shards, 4)
+
+		for i := 0; i < 10; i++ {
+			d := newDevice(deviceOptions{
+				ID:     ID(strconv.Itoa(i)),
+				Logger: logger,
+			})
+
+			require.NoError(r.add(d))
+			assert.False(d.Closed())
+			assert.Equal(i+1, r.len())
+			p.Assert(t, DeviceCounter)(xmetricstest.Value(float64(i + 1)))
+			p.Assert(t, ConnectCounter)(xmetricstest.Value(float64(i + 1)))
+			p.Assert(t, DisconnectCounter)(xmetricstest.Value(0.0))
+		}
+
+		existing, ok := r.get(ID("0"))
+		require.NotNil(existing)
+		assert.True(ok)
+
+		duplicate := newDevice(deviceOptions{
+			ID:     ID("0"),
+			Logger: logger,
+		})
+
+		require.NoError(r.add(duplicate))
+		assert.Equal(10, r.len())
+		assert.True(existing.Closed())
+		assert.False(duplicate.Closed())
+		assert.Equal(1, duplicate.Statistics().Duplications())
+		p.Assert(t, DeviceCounter)(xmetricstest.Value(10.0))
+		p.Assert(t, ConnectCounter)(xmetricstest.Value(11.0))
+		p.Assert(t, DisconnectCounter)(xmetricstest.Value(1.0))
+		p.Assert(t, DuplicatesCounter)(xmetricstest.Value(1.0))
+	})
+
+	t.Run("Limited", func(t *testing.T) {
+		var (
+			assert  = assert.New(t)
+			require = require.New(t)
+			logger  = logging.NewTestLogger(nil, t)
+
+			p = xmetricstest.NewProvider(nil, Metrics)
+			r = newShardedRegistry(registryOptions{
+				Logger:   logger,
+				Limit:    2,
+				Shards:   8,
+				Measures: NewMeasures(p),
+			})
+		)
+
+		require.NotNil(r)
+		for _, id := range []ID{"first", "second"} {
+			require.NoError(r.add(newDevice(deviceOptions{ID: id, Logger: logger})))
+		}
+
+		cantAdd := newDevice(deviceOptions{ID: ID("cantAdd"), Logger: logger})
+		assert.Equal(errDeviceLimitReached, r.add(cantAdd))
+		assert.True(cantAdd.Closed())
+		assert.Equal(2, r.len())
+		p.Assert(t, DeviceCounter)(xmetricstest.Value(2.0))
+		p.Assert(t, DeviceLimitReachedCounter)(xmetricstest.Value(1.0))
+		p.Assert(t, DisconnectCounter)(xmetricstest.Value(1.0))
+
+		// duplicates are always allowed, even at the limit
+		duplicate := newDevice(deviceOptions{ID: ID("first"), Logger: logger})
+		assert.NoError(r.add(duplicate))
+		assert.False(duplicate.Closed())
+		assert.Equal(2, r.len())
+		p.Assert(t, DeviceCounter)(xmetricstest.Value(2.0))
+		p.Assert(t, DuplicatesCounter)(xmetricstest.Value(1.0))
+	})
+}
+
+func testShardedRegistryRemoveAndGet(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		logger  = logging.NewTestLogger(nil, t)
+
+		p = xmetricstest.NewProvider(nil, Metrics)
+		r = newShardedRegistry(registryOptions{
+			Logger:   logger,
+			Shards:   4,
+			Measures: NewMeasures(p),
+		})
+
+		initial = newDevice(deviceOptions{ID: ID("test"), Logger: logger})
+	)
+
+	require.NoError(r.add(initial))
+
+	existing, ok := r.get(ID("test"))
+	assert.True(existing == initial)
+	assert.True(ok)
+
+	existing, ok = r.remove(ID("nosuch"), CloseReason{})
+	assert.Nil(existing)
+	assert.False(ok)
+	assert.False(initial.Closed())
+	assert.Equal(1, r.len())
+
+	existing, ok = r.remove(ID("test"), CloseReason{Text: "test"})
+	assert.True(existing == initial)
+	assert.True(ok)
+	assert.True(initial.Closed())
+	assert.Equal("test", initial.CloseReason().Text)
+	assert.Zero(r.len())
+	p.Assert(t, DeviceCounter)(xmetricstest.Value(0.0))
+	p.Assert(t, DisconnectCounter)(xmetricstest.Value(1.0))
+
+	existing, ok = r.get(ID("test"))
+	assert.Nil(existing)
+	assert.False(ok)
+}
+
+func testShardedRegistryRemoveIf(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		logger  = logging.NewTestLogger(nil, t)
+
+		p = xmetricstest.NewProvider(nil, Metrics)
+		r = newShardedRegistry(registryOptions{
+			Logger:   logger,
+			Shards:   4,
+			Measures: NewMeasures(p),
+		})
+	)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(r.add(newDevice(deviceOptions{ID: ID(strconv.Itoa(i)), Logger: logger})))
+	}
+
+	assert.Zero(r.removeIf(func(*device) (CloseReason, bool) { return CloseReason{}, false }))
+	assert.Equal(20, r.len())
+
+	assert.Equal(
+		10,
+		r.removeIf(func(d *device) (CloseReason, bool) {
+			i, _ := strconv.Atoi(string(d.ID()))
+			return CloseReason{Text: "odd"}, i%2 == 1
+		}),
+	)
+
+	assert.Equal(10, r.len())
+	p.Assert(t, DeviceCounter)(xmetricstest.Value(10.0))
+	p.Assert(t, DisconnectCounter)(xmetricstest.Value(10.0))
+
+	r.visit(func(d *device) bool {
+		i, _ := strconv.Atoi(string(d.ID()))
+		assert.Zero(i % 2)
+		return true
+	})
+}
+
+func testShardedRegistryRemoveAll(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		logger  = logging.NewTestLogger(nil, t)
+
+		devices = []*device{
+			newDevice(deviceOptions{ID: ID("1"), Logger: logger}),
+			newDevice(deviceOptions{ID: ID("2"), Logger: logger}),
+			newDevice(deviceOptions{ID: ID("3"), Logger: logger}),
+		}
+
+		p = xmetricstest.NewProvider(nil, Metrics)
+		r = newShardedRegistry(registryOptions{
+			Logger:   logger,
+			Shards:   2,
+			Measures: NewMeasures(p),
+		})
+	)
+
+	for _, d := range devices {
+		require.NoError(r.add(d))
+	}
+
+	assert.Equal(3, r.removeAll(CloseReason{}))
+	assert.Zero(r.len())
+	p.Assert(t, DeviceCounter)(xmetricstest.Value(0.0))
+	p.Assert(t, DisconnectCounter)(xmetricstest.Value(3.0))
+
+	for _, d := range devices {
+		assert.True(d.Closed())
+	}
+}
+
+func testShardedRegistryVisit(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		logger  = logging.NewTestLogger(nil, t)
+
+		r = newShardedRegistry(registryOptions{
+			Logger:   logger,
+			Shards:   4,
+			Measures: NewMeasures(provider.NewDiscardProvider()),
+		})
+	)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(r.add(newDevice(deviceOptions{ID: ID(strconv.Itoa(i)), Logger: logger})))
+	}
+
+	visited := make(map[ID]bool)
+	assert.Equal(10, r.visit(func(d *device) bool {
+		visited[d.ID()] = true
+		return true
+	}))
+
+	assert.Len(visited, 10)
+	assert.Equal(1, r.visit(func(*device) bool { return false }))
+}
+
+func testShardedRegistryConcurrency(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		logger = logging.NewTestLogger(nil, t)
+
+		r = newShardedRegistry(registryOptions{
+			Logger:   logger,
+			Limit:    50,
+			Shards:   8,
+			Measures: NewMeasures(provider.NewDiscardProvider()),
+		})
+
+		wg      = new(sync.WaitGroup)
+		results = make(chan error, 100)
+	)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- r.add(newDevice(deviceOptions{ID: IntToMAC(uint64(i)), Logger: logger}))
+		}(i)
+	}
+
+	wg.Wait()
+	close(results)
+
+	added := 0
+	for err := range results {
+		if err == nil {
+			added++
+		} else {
+			assert.Equal(errDeviceLimitReached, err)
+		}
+	}
+
+	assert.Equal(50, added)
+	assert.Equal(50, r.len())
+}
+
+func TestNewDeviceRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ok := newDeviceRegistry(registryOptions{Measures: NewMeasures(provider.NewDiscardProvider())}).(*registry)
+	assert.True(ok)
+
+	_, ok = newDeviceRegistry(registryOptions{Shards: 1, Measures: NewMeasures(provider.NewDiscardProvider())}).(*registry)
+	assert.True(ok)
+
+	_, ok = newDeviceRegistry(registryOptions{Shards: 16, Measures: NewMeasures(provider.NewDiscardProvider())}).(*shardedRegistry)
+	assert.True(ok)
+}
+
+func TestShardedRegistry(t *testing.T) {
+	t.Run("Add", testShardedRegistryAdd)
+	t.Run("RemoveAndGet", testShardedRegistryRemoveAndGet)
+	t.Run("RemoveIf", testShardedRegistryRemoveIf)
+	t.Run("RemoveAll", testShardedRegistryRemoveAll)
+	t.Run("Visit", testShardedRegistryVisit)
+	t.Run("Concurrency", testShardedRegistryConcurrency)
+}
+
+// benchmarkRegistryConnect measures concurrent add/remove traffic, which is what a
+// talaria sees as devices connect and disconnect.
+func benchmarkRegistryConnect(b *testing.B, shards int) {
+	var (
+		measures = NewMeasures(provider.NewDiscardProvider())
+		r        = newDeviceRegistry(registryOptions{Shards: shards, Measures: measures})
+		next     uint64
+		lock     sync.Mutex
+	)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock.Lock()
+			next++
+			id := IntToMAC(next)
+			lock.Unlock()
+
+			d := newDevice(deviceOptions{ID: id})
+			r.add(d)
+			r.get(id)
+			r.remove(id, CloseReason{})
+		}
+	})
+}
+
+// benchmarkRegistryConnectWhileVisiting measures connect traffic while another goroutine
+// continually visits every device, as DisconnectIf and ListHandler do.
+func benchmarkRegistryConnectWhileVisiting(b *testing.B, shards int) {
+	var (
+		measures = NewMeasures(provider.NewDiscardProvider())
+		r        = newDeviceRegistry(registryOptions{Shards: shards, Measures: measures})
+		next     = uint64(10000)
+		lock     sync.Mutex
+		stop     = make(chan struct{})
+		stopped  = make(chan struct{})
+	)
+
+	for i := uint64(0); i < next; i++ {
+		r.add(newDevice(deviceOptions{ID: IntToMAC(i)}))
+	}
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.visit(func(*device) bool { return true })
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock.Lock()
+			next++
+			id := IntToMAC(next)
+			lock.Unlock()
+
+			r.add(newDevice(deviceOptions{ID: id}))
+			r.remove(id, CloseReason{})
+		}
+	})
+
+	b.StopTimer()
+	close(stop)
+	<-stopped
+}
+
+func BenchmarkRegistry(b *testing.B) {
+	for _, shards := range []int{1, 16, 64} {
+		b.Run("Connect/shards="+strconv.Itoa(shards), func(b *testing.B) {
+			benchmarkRegistryConnect(b, shards)
+		})
+
+		b.Run("ConnectWhileVisiting/shards="+strconv.Itoa(shards), func(b *testing.B) {
+			benchmarkRegistryConnectWhileVisiting(b, shards)
+		})
+	}
+}
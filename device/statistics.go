@@ -1,6 +1,7 @@
 package device
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -36,6 +37,26 @@ type Statistics interface {
 	// AddMessagesSent increments the MessagesSent count
 	AddMessagesSent(int)
 
+	// WireBytesReceived returns the total bytes read from the device's network connection, including
+	// websocket framing.  When compression is in use, this is the compressed counterpart of BytesReceived.
+	WireBytesReceived() int
+
+	// AddWireBytesReceived increments the WireBytesReceived count
+	AddWireBytesReceived(int)
+
+	// WireBytesSent returns the total bytes written to the device's network connection, including
+	// websocket framing.  When compression is in use, this is the compressed counterpart of BytesSent.
+	WireBytesSent() int
+
+	// AddWireBytesSent increments the WireBytesSent count
+	AddWireBytesSent(int)
+
+	// Compressed tests if permessage-deflate compression was negotiated with the device
+	Compressed() bool
+
+	// SetCompressed records whether permessage-deflate compression was negotiated with the device
+	SetCompressed(bool)
+
 	// Duplications returns the number of times this device has had a duplicate connected, i.e.
 	// a device with the same device ID.
 	Duplications() int
@@ -46,8 +67,123 @@ type Statistics interface {
 	// ConnectedAt returns the connection time at which this statistics began tracking
 	ConnectedAt() time.Time
 
-	// UpTime computes the duration for which the device has been connected
+	// UpTime computes the duration for which the device has been connected.  Once the device
+	// disconnects, this is the final duration of its connection.
 	UpTime() time.Duration
+
+	// Rates returns the device's throughput averaged over the most recent DefaultRateWindow, or
+	// over the device's UpTime if it has been connected for less than that.
+	Rates() Rates
+
+	// LastMessageReceived returns the time at which a message was last received from the device.
+	// If no message has been received, this method returns the zero time.
+	LastMessageReceived() time.Time
+
+	// IdleTime computes the duration since a message was last received from the device.  If no message
+	// has been received, this is the same as UpTime.
+	IdleTime() time.Duration
+
+	// RecordPing notes that a ping was just sent to the device
+	RecordPing()
+
+	// RecordPong notes that a pong was just received from the device, which updates the PingLatency
+	RecordPong()
+
+	// LastPong returns the time at which a pong was last received from the device.  If no pong has been
+	// received, this method returns the zero time.
+	LastPong() time.Time
+
+	// PingLatency returns the round trip time between the most recent ping and the pong that followed it.
+	// If no pong has been received, this method returns zero.
+	PingLatency() time.Duration
+
+	// AddTransactionLatency records the time taken by the device to complete a transaction
+	AddTransactionLatency(time.Duration)
+
+	// TransactionLatency returns the distribution of the latencies of the transactions this device has completed
+	TransactionLatency() LatencyHistogram
+}
+
+// LatencyHistogram is a snapshot of a distribution of latencies, bucketed by TransactionLatencyBuckets
+type LatencyHistogram struct {
+	// Count is the number of latencies observed
+	Count uint64
+
+	// Sum is the total of the observed latencies, in seconds
+	Sum float64
+
+	// Buckets maps the upper bound, in seconds, of each bucket to the cumulative count of latencies
+	// less than or equal to that bound
+	Buckets map[float64]uint64
+}
+
+// DefaultRateWindow is the length of the sliding window over which device throughput rates are averaged
+const DefaultRateWindow = time.Minute
+
+// Rates holds a device's throughput, in units per second, averaged over a sliding window
+type Rates struct {
+	BytesSent        float64 `json:"bytesSent"`
+	MessagesSent     float64 `json:"messagesSent"`
+	BytesReceived    float64 `json:"bytesReceived"`
+	MessagesReceived float64 `json:"messagesReceived"`
+}
+
+// rateWindow tallies a quantity in one-second buckets over a sliding window.  This type is not safe
+// for concurrent use.
+type rateWindow struct {
+	seconds []int64
+	totals  []int
+}
+
+func newRateWindow(window time.Duration) rateWindow {
+	size := int(window / time.Second)
+	if size < 1 {
+		size = 1
+	}
+
+	return rateWindow{
+		seconds: make([]int64, size),
+		totals:  make([]int, size),
+	}
+}
+
+func (rw *rateWindow) add(now time.Time, delta int) {
+	var (
+		second = now.Unix()
+		i      = int(second % int64(len(rw.seconds)))
+	)
+
+	if rw.seconds[i] != second {
+		rw.seconds[i] = second
+		rw.totals[i] = 0
+	}
+
+	rw.totals[i] += delta
+}
+
+// rate computes the per-second average of this window's total over the given elapsed time, which
+// is capped at the window size and floored at one second
+func (rw *rateWindow) rate(now time.Time, elapsed time.Duration) float64 {
+	var (
+		second = now.Unix()
+		size   = int64(len(rw.seconds))
+		total  = 0
+	)
+
+	for i, s := range rw.seconds {
+		if s <= second && second-s < size {
+			total += rw.totals[i]
+		}
+	}
+
+	seconds := elapsed.Seconds()
+	if seconds > float64(size) {
+		seconds = float64(size)
+	} else if seconds < 1.0 {
+		seconds = 1.0
+	}
+
+	return float64(total) / seconds
 }
 
 // NewStatistics creates a Statistics instance with the given connection time
@@ -59,9 +195,14 @@ func NewStatistics(now func() time.Time, connectedAt time.Time) Statistics {
 
 	connectedAt = connectedAt.UTC()
 	return &statistics{
-		now:                  now,
-		connectedAt:          connectedAt,
-		formattedConnectedAt: connectedAt.Format(time.RFC3339Nano),
+		now:                    now,
+		connectedAt:            connectedAt,
+		formattedConnectedAt:   connectedAt.Format(time.RFC3339Nano),
+		bytesSentWindow:        newRateWindow(DefaultRateWindow),
+		messagesSentWindow:     newRateWindow(DefaultRateWindow),
+		bytesReceivedWindow:    newRateWindow(DefaultRateWindow),
+		messagesReceivedWindow: newRateWindow(DefaultRateWindow),
+		transactionBuckets:     make([]uint64, len(TransactionLatencyBuckets)),
 	}
 }
 
@@ -75,6 +216,26 @@ type statistics struct {
 	messagesSent     int
 	duplications     int
 
+	wireBytesReceived int
+	wireBytesSent     int
+	compressed        bool
+
+	bytesSentWindow        rateWindow
+	messagesSentWindow     rateWindow
+	bytesReceivedWindow    rateWindow
+	messagesReceivedWindow rateWindow
+
+	lastMessageReceived time.Time
+	lastPing            time.Time
+	lastPong            time.Time
+	pingLatency         time.Duration
+
+	transactionCount   uint64
+	transactionSum     time.Duration
+	transactionBuckets []uint64
+
+	disconnectedAt time.Time
+
 	now                  func() time.Time
 	connectedAt          time.Time
 	formattedConnectedAt string
@@ -89,8 +250,10 @@ func (s *statistics) BytesReceived() int {
 }
 
 func (s *statistics) AddBytesReceived(delta int) {
+	now := s.now()
 	s.lock.Lock()
 	s.bytesReceived += delta
+	s.bytesReceivedWindow.add(now, delta)
 	s.lock.Unlock()
 }
 
@@ -103,8 +266,10 @@ func (s *statistics) BytesSent() int {
 }
 
 func (s *statistics) AddBytesSent(delta int) {
+	now := s.now()
 	s.lock.Lock()
 	s.bytesSent += delta
+	s.bytesSentWindow.add(now, delta)
 	s.lock.Unlock()
 }
 
@@ -117,8 +282,11 @@ func (s *statistics) MessagesReceived() int {
 }
 
 func (s *statistics) AddMessagesReceived(delta int) {
+	now := s.now()
 	s.lock.Lock()
 	s.messagesReceived += delta
+	s.messagesReceivedWindow.add(now, delta)
+	s.lastMessageReceived = now.UTC()
 	s.lock.Unlock()
 }
 
@@ -131,8 +299,78 @@ func (s *statistics) MessagesSent() int {
 }
 
 func (s *statistics) AddMessagesSent(delta int) {
+	now := s.now()
 	s.lock.Lock()
 	s.messagesSent += delta
+	s.messagesSentWindow.add(now, delta)
+	s.lock.Unlock()
+}
+
+func (s *statistics) WireBytesReceived() int {
+	s.lock.RLock()
+	var result = s.wireBytesReceived
+	s.lock.RUnlock()
+
+	return result
+}
+
+func (s *statistics) AddWireBytesReceived(delta int) {
+	s.lock.Lock()
+	s.wireBytesReceived += delta
+	s.lock.Unlock()
+}
+
+func (s *statistics) WireBytesSent() int {
+	s.lock.RLock()
+	var result = s.wireBytesSent
+	s.lock.RUnlock()
+
+	return result
+}
+
+func (s *statistics) AddWireBytesSent(delta int) {
+	s.lock.Lock()
+	s.wireBytesSent += delta
+	s.lock.Unlock()
+}
+
+func (s *statistics) Compressed() bool {
+	s.lock.RLock()
+	var result = s.compressed
+	s.lock.RUnlock()
+
+	return result
+}
+
+func (s *statistics) SetCompressed(compressed bool) {
+	s.lock.Lock()
+	s.compressed = compressed
+	s.lock.Unlock()
+}
+
+// clock returns the time against which durations are computed, which stops at the time the device disconnected.
+// This method must not be invoked under the lock.
+func (s *statistics) clock() time.Time {
+	s.lock.RLock()
+	disconnectedAt := s.disconnectedAt
+	s.lock.RUnlock()
+
+	if !disconnectedAt.IsZero() {
+		return disconnectedAt
+	}
+
+	return s.now()
+}
+
+// freeze records that the device has disconnected, so that UpTime, IdleTime, and Rates no longer advance.
+// Only the first call has any effect.
+func (s *statistics) freeze() {
+	now := s.now()
+	s.lock.Lock()
+	if s.disconnectedAt.IsZero() {
+		s.disconnectedAt = now
+	}
+
 	s.lock.Unlock()
 }
 
@@ -155,7 +393,117 @@ func (s *statistics) ConnectedAt() time.Time {
 }
 
 func (s *statistics) UpTime() time.Duration {
-	return s.now().Sub(s.connectedAt)
+	return s.clock().Sub(s.connectedAt)
+}
+
+func (s *statistics) Rates() Rates {
+	now := s.clock()
+	s.lock.RLock()
+	result := s.rates(now)
+	s.lock.RUnlock()
+
+	return result
+}
+
+// rates computes the windowed rates.  This method must be invoked under the read lock.
+func (s *statistics) rates(now time.Time) Rates {
+	elapsed := now.Sub(s.connectedAt)
+	return Rates{
+		BytesSent:        s.bytesSentWindow.rate(now, elapsed),
+		MessagesSent:     s.messagesSentWindow.rate(now, elapsed),
+		BytesReceived:    s.bytesReceivedWindow.rate(now, elapsed),
+		MessagesReceived: s.messagesReceivedWindow.rate(now, elapsed),
+	}
+}
+
+func (s *statistics) LastMessageReceived() time.Time {
+	s.lock.RLock()
+	var result = s.lastMessageReceived
+	s.lock.RUnlock()
+
+	return result
+}
+
+func (s *statistics) IdleTime() time.Duration {
+	now := s.clock()
+	s.lock.RLock()
+	result := s.idleTime(now)
+	s.lock.RUnlock()
+
+	return result
+}
+
+// idleTime computes the time since the last message was received.  This method must be invoked under the read lock.
+func (s *statistics) idleTime(now time.Time) time.Duration {
+	if s.lastMessageReceived.IsZero() {
+		return now.Sub(s.connectedAt)
+	}
+
+	return now.Sub(s.lastMessageReceived)
+}
+
+func (s *statistics) RecordPing() {
+	now := s.now()
+	s.lock.Lock()
+	s.lastPing = now
+	s.lock.Unlock()
+}
+
+func (s *statistics) RecordPong() {
+	now := s.now()
+	s.lock.Lock()
+	s.lastPong = now.UTC()
+	if !s.lastPing.IsZero() && !now.Before(s.lastPing) {
+		s.pingLatency = now.Sub(s.lastPing)
+	}
+
+	s.lock.Unlock()
+}
+
+func (s *statistics) LastPong() time.Time {
+	s.lock.RLock()
+	var result = s.lastPong
+	s.lock.RUnlock()
+
+	return result
+}
+
+func (s *statistics) PingLatency() time.Duration {
+	s.lock.RLock()
+	var result = s.pingLatency
+	s.lock.RUnlock()
+
+	return result
+}
+
+func (s *statistics) AddTransactionLatency(latency time.Duration) {
+	seconds := latency.Seconds()
+	s.lock.Lock()
+	s.transactionCount++
+	s.transactionSum += latency
+	for i, bound := range TransactionLatencyBuckets {
+		if seconds <= bound {
+			s.transactionBuckets[i]++
+		}
+	}
+
+	s.lock.Unlock()
+}
+
+func (s *statistics) TransactionLatency() LatencyHistogram {
+	s.lock.RLock()
+	result := LatencyHistogram{
+		Count:   s.transactionCount,
+		Sum:     s.transactionSum.Seconds(),
+		Buckets: make(map[float64]uint64, len(TransactionLatencyBuckets)),
+	}
+
+	for i, bound := range TransactionLatencyBuckets {
+		result.Buckets[bound] = s.transactionBuckets[i]
+	}
+
+	s.lock.RUnlock()
+	return result
 }
 
 func (s *statistics) String() string {
@@ -167,17 +515,41 @@ func (s *statistics) String() string {
 }
 
 func (s *statistics) MarshalJSON() ([]byte, error) {
+	now := s.clock()
 	s.lock.RLock()
-	output := []byte(fmt.Sprintf(
-		`{"bytesSent": %d, "messagesSent": %d, "bytesReceived": %d, "messagesReceived": %d, "duplications": %d, "connectedAt": "%s", "upTime": "%s"}`,
+	defer s.lock.RUnlock()
+
+	rates, err := json.Marshal(s.rates(now))
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	fmt.Fprintf(
+		&output,
+		`{"bytesSent": %d, "messagesSent": %d, "bytesReceived": %d, "messagesReceived": %d, "wireBytesSent": %d, "wireBytesReceived": %d, "compressed": %t, "duplications": %d, "connectedAt": "%s", "upTime": "%s", "idleTime": "%s", "rates": %s`,
 		s.bytesSent,
 		s.messagesSent,
 		s.bytesReceived,
 		s.messagesReceived,
+		s.wireBytesSent,
+		s.wireBytesReceived,
+		s.compressed,
 		s.duplications,
 		s.formattedConnectedAt,
-		s.UpTime(),
-	))
-	s.lock.RUnlock()
-	return output, nil
+		now.Sub(s.connectedAt),
+		s.idleTime(now),
+		rates,
+	)
+
+	if !s.lastMessageReceived.IsZero() {
+		fmt.Fprintf(&output, `, "lastMessageReceived": "%s"`, s.lastMessageReceived.Format(time.RFC3339Nano))
+	}
+
+	if !s.lastPong.IsZero() {
+		fmt.Fprintf(&output, `, "lastPong": "%s", "pingLatency": "%s"`, s.lastPong.Format(time.RFC3339Nano), s.pingLatency)
+	}
+
+	output.WriteByte('}')
+	return output.Bytes(), nil
 }
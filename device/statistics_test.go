@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Comcast/webpa-common/logging"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -76,6 +77,9 @@ func testStatisticsInitialStateCustomNow(t *testing.T) {
 	assert.Zero(statistics.MessagesSent())
 	assert.Zero(statistics.MessagesReceived())
 	assert.Zero(statistics.Duplications())
+	assert.Zero(statistics.WireBytesSent())
+	assert.Zero(statistics.WireBytesReceived())
+	assert.False(statistics.Compressed())
 	assert.Equal(expectedConnectedAt.UTC(), statistics.ConnectedAt())
 	assert.Equal(expectedUpTime, statistics.UpTime())
 
@@ -85,9 +89,10 @@ func testStatisticsInitialStateCustomNow(t *testing.T) {
 
 	assert.JSONEq(
 		fmt.Sprintf(
-			`{"duplications": 0, "bytesSent": 0, "messagesSent": 0, "bytesReceived": 0, "messagesReceived": 0, "connectedAt": "%s", "upTime": "%s"}`,
+			`{"duplications": 0, "bytesSent": 0, "messagesSent": 0, "bytesReceived": 0, "messagesReceived": 0, "wireBytesSent": 0, "wireBytesReceived": 0, "compressed": false, "connectedAt": "%s", "upTime": "%s", "idleTime": "%s", "rates": {"bytesSent": 0, "messagesSent": 0, "bytesReceived": 0, "messagesReceived": 0}}`,
 			expectedConnectedAt.UTC().Format(time.RFC3339Nano),
 			expectedUpTime,
+			expectedUpTime,
 		),
 		string(data),
 	)
@@ -126,9 +131,12 @@ func testStatisticsConcurrency(t *testing.T) {
 			statistics.AddBytesReceived(v)
 			statistics.AddMessagesReceived(v)
 			statistics.AddDuplications(v)
+			statistics.AddWireBytesSent(v)
+			statistics.AddWireBytesReceived(v)
 		}(v)
 	}
 
+	statistics.SetCompressed(true)
 	gate.Done()
 	done.Wait()
 
@@ -137,8 +145,19 @@ func testStatisticsConcurrency(t *testing.T) {
 	assert.Equal(expectedValue, statistics.BytesReceived())
 	assert.Equal(expectedValue, statistics.MessagesReceived())
 	assert.Equal(expectedValue, statistics.Duplications())
+	assert.Equal(expectedValue, statistics.WireBytesSent())
+	assert.Equal(expectedValue, statistics.WireBytesReceived())
+	assert.True(statistics.Compressed())
 	assert.Equal(expectedConnectedAt.UTC(), statistics.ConnectedAt())
 	assert.Equal(expectedUpTime, statistics.UpTime())
+	assert.Equal(expectedConnectedAt.Add(expectedUpTime).UTC(), statistics.LastMessageReceived())
+	assert.Zero(statistics.IdleTime())
+
+	expectedRate := float64(expectedValue) / DefaultRateWindow.Seconds()
+	assert.Equal(
+		Rates{BytesSent: expectedRate, MessagesSent: expectedRate, BytesReceived: expectedRate, MessagesReceived: expectedRate},
+		statistics.Rates(),
+	)
 
 	data, err := statistics.MarshalJSON()
 	require.NotEmpty(data)
@@ -146,7 +165,9 @@ func testStatisticsConcurrency(t *testing.T) {
 
 	assert.JSONEq(
 		fmt.Sprintf(
-			`{"duplications": %d, "bytesSent": %d, "messagesSent": %d, "bytesReceived": %d, "messagesReceived": %d, "connectedAt": "%s", "upTime": "%s"}`,
+			`{"duplications": %d, "bytesSent": %d, "messagesSent": %d, "bytesReceived": %d, "messagesReceived": %d, "wireBytesSent": %d, "wireBytesReceived": %d, "compressed": true, "connectedAt": "%s", "upTime": "%s", "idleTime": "0s", "rates": {"bytesSent": %g, "messagesSent": %g, "bytesReceived": %g, "messagesReceived": %g}, "lastMessageReceived": "%s"}`,
+			expectedValue,
+			expectedValue,
 			expectedValue,
 			expectedValue,
 			expectedValue,
@@ -154,11 +175,146 @@ func testStatisticsConcurrency(t *testing.T) {
 			expectedValue,
 			expectedConnectedAt.UTC().Format(time.RFC3339Nano),
 			expectedUpTime,
+			expectedRate,
+			expectedRate,
+			expectedRate,
+			expectedRate,
+			expectedConnectedAt.Add(expectedUpTime).UTC().Format(time.RFC3339Nano),
 		),
 		string(data),
 	)
 }
 
+func testStatisticsRates(t *testing.T) {
+	var (
+		assert      = assert.New(t)
+		connectedAt = time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+		now         = connectedAt
+
+		statistics = NewStatistics(
+			func() time.Time {
+				return now
+			},
+			connectedAt,
+		)
+	)
+
+	// a device connected for less than a second is treated as having been connected for one second
+	statistics.AddMessagesReceived(3)
+	statistics.AddBytesReceived(300)
+	assert.Equal(Rates{MessagesReceived: 3.0, BytesReceived: 300.0}, statistics.Rates())
+
+	// within the window, rates are averaged over the device's up time
+	now = connectedAt.Add(10 * time.Second)
+	statistics.AddMessagesSent(5)
+	statistics.AddBytesSent(1000)
+	assert.Equal(Rates{MessagesSent: 0.5, BytesSent: 100.0, MessagesReceived: 0.3, BytesReceived: 30.0}, statistics.Rates())
+	assert.Equal(10*time.Second, statistics.IdleTime())
+
+	// activity older than the window no longer counts
+	now = connectedAt.Add(DefaultRateWindow + 5*time.Second)
+	statistics.AddMessagesReceived(6)
+	assert.Equal(Rates{MessagesSent: 5.0 / 60.0, BytesSent: 1000.0 / 60.0, MessagesReceived: 0.1}, statistics.Rates())
+	assert.Equal(now, statistics.LastMessageReceived())
+	assert.Zero(statistics.IdleTime())
+
+	now = connectedAt.Add(2*DefaultRateWindow + 10*time.Second)
+	assert.Equal(Rates{}, statistics.Rates())
+}
+
+func testStatisticsPingPong(t *testing.T) {
+	var (
+		assert      = assert.New(t)
+		require     = require.New(t)
+		connectedAt = time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+		now         = connectedAt
+
+		statistics = NewStatistics(
+			func() time.Time {
+				return now
+			},
+			connectedAt,
+		)
+	)
+
+	assert.Zero(statistics.LastPong())
+	assert.Zero(statistics.PingLatency())
+
+	// a pong without a ping does not produce a latency
+	statistics.RecordPong()
+	assert.Equal(connectedAt, statistics.LastPong())
+	assert.Zero(statistics.PingLatency())
+
+	now = connectedAt.Add(time.Minute)
+	statistics.RecordPing()
+	now = now.Add(35 * time.Millisecond)
+	statistics.RecordPong()
+	assert.Equal(now, statistics.LastPong())
+	assert.Equal(35*time.Millisecond, statistics.PingLatency())
+
+	data, err := statistics.MarshalJSON()
+	require.NoError(err)
+
+	var actualJSON map[string]interface{}
+	require.NoError(json.Unmarshal(data, &actualJSON))
+	assert.Equal(now.Format(time.RFC3339Nano), actualJSON["lastPong"])
+	assert.Equal("35ms", actualJSON["pingLatency"])
+	assert.NotContains(actualJSON, "lastMessageReceived")
+}
+
+func testStatisticsTransactionLatency(t *testing.T) {
+	var (
+		assert     = assert.New(t)
+		statistics = NewStatistics(nil, time.Now())
+	)
+
+	latency := statistics.TransactionLatency()
+	assert.Zero(latency.Count)
+	assert.Zero(latency.Sum)
+	assert.Len(latency.Buckets, len(TransactionLatencyBuckets))
+
+	statistics.AddTransactionLatency(75 * time.Millisecond)
+	statistics.AddTransactionLatency(2 * time.Second)
+	statistics.AddTransactionLatency(2 * time.Minute)
+
+	latency = statistics.TransactionLatency()
+	assert.Equal(uint64(3), latency.Count)
+	assert.InDelta(122.075, latency.Sum, 0.0001)
+	assert.Equal(uint64(0), latency.Buckets[0.05])
+	assert.Equal(uint64(1), latency.Buckets[0.1])
+	assert.Equal(uint64(1), latency.Buckets[1])
+	assert.Equal(uint64(2), latency.Buckets[2.5])
+	assert.Equal(uint64(2), latency.Buckets[60])
+}
+
+func testStatisticsFreeze(t *testing.T) {
+	var (
+		assert      = assert.New(t)
+		require     = require.New(t)
+		connectedAt = time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+		now         = connectedAt.Add(time.Minute)
+
+		d = newDevice(deviceOptions{ID: ID("mac:112233445566"), Logger: logging.NewTestLogger(nil, t)})
+	)
+
+	d.statistics = NewStatistics(func() time.Time { return now }, connectedAt)
+	d.statistics.AddMessagesReceived(1)
+	assert.Equal(time.Minute, d.statistics.UpTime())
+
+	// closing the device stops the clock, so that statistics read later are those at disconnection
+	d.requestClose(CloseReason{Text: "test"})
+	now = now.Add(time.Hour)
+	assert.Equal(time.Minute, d.statistics.UpTime())
+	assert.Zero(d.statistics.IdleTime())
+
+	data, err := d.statistics.MarshalJSON()
+	require.NoError(err)
+
+	var actualJSON map[string]interface{}
+	require.NoError(json.Unmarshal(data, &actualJSON))
+	assert.Equal("1m0s", actualJSON["upTime"])
+}
+
 func TestStatistics(t *testing.T) {
 	t.Run("InitialState", func(t *testing.T) {
 		t.Run("DefaultNow", testStatisticsInitialStateDefaultNow)
@@ -166,4 +322,8 @@ func TestStatistics(t *testing.T) {
 	})
 
 	t.Run("Concurrency", testStatisticsConcurrency)
+	t.Run("Rates", testStatisticsRates)
+	t.Run("PingPong", testStatisticsPingPong)
+	t.Run("TransactionLatency", testStatisticsTransactionLatency)
+	t.Run("Freeze", testStatisticsFreeze)
 }
@@ -2,10 +2,12 @@ package device
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/Comcast/webpa-common/wrp"
 	"github.com/Comcast/webpa-common/xhttp"
@@ -147,17 +149,71 @@ func EncodeResponse(output http.ResponseWriter, response *Response, format wrp.F
 	return
 }
 
+// Transaction describes a single request/response exchange with a device
+type Transaction struct {
+	// Key is the transaction key, which the device's response must carry
+	Key string
+
+	// Created is the time at which this transaction was registered
+	Created time.Time
+
+	// Deadline is the time after which this transaction times out.  A zero Deadline means no deadline.
+	Deadline time.Time
+
+	// Attempts is the number of times the request has been sent to the device
+	Attempts int
+}
+
+// LateResponseError is returned by Transactions.Complete when a response arrives for a transaction
+// that has already timed out.  The late response is not delivered.
+type LateResponseError struct {
+	// Transaction is the timed out transaction the response belongs to
+	Transaction Transaction
+
+	// Latency is the time between the creation of the transaction and the arrival of the late response
+	Latency time.Duration
+}
+
+func (lre *LateResponseError) Error() string {
+	return fmt.Sprintf("Late response for transaction %s after %s", lre.Transaction.Key, lre.Latency)
+}
+
+// pendingTransaction is a Transaction waiting on a response
+type pendingTransaction struct {
+	Transaction
+	result chan *Response
+}
+
 // Transactions represents a set of pending transactions.  Instances are safe for
 // concurrent access.
+//
+// Transactions that time out are remembered for a period of time, so that responses that
+// arrive after the timeout can be distinguished from responses that have no transaction at all.
+// Likewise, transactions whose request was sent more than once are remembered after they complete,
+// since the device may respond to each attempt.
 type Transactions struct {
-	lock    sync.RWMutex
-	closed  bool
-	pending map[string]chan *Response
+	lock       sync.RWMutex
+	closed     bool
+	now        func() time.Time
+	lateWindow time.Duration
+	pending    map[string]*pendingTransaction
+	expired    map[string]Transaction
+	completed  map[string]Transaction
 }
 
+// NewTransactions creates an empty set of transactions which remembers timed out transactions
+// for DefaultLateWindow.
 func NewTransactions() *Transactions {
+	return newTransactions(nil)
+}
+
+func newTransactions(o *TransactionOptions) *Transactions {
 	return &Transactions{
-		pending: make(map[string]chan *Response),
+		now:        time.Now,
+		lateWindow: o.lateWindow(),
+		pending:    make(map[string]*pendingTransaction),
+		expired:    make(map[string]Transaction),
+		completed:  make(map[string]Transaction),
 	}
 }
 
@@ -186,31 +242,80 @@ func (t *Transactions) Keys() []string {
 	return keys
 }
 
+// Get returns the pending transaction with the given key, if one exists
+func (t *Transactions) Get(transactionKey string) (Transaction, bool) {
+	defer t.lock.RUnlock()
+	t.lock.RLock()
+
+	if p, ok := t.pending[transactionKey]; ok {
+		return p.Transaction, true
+	}
+
+	return Transaction{}, false
+}
+
+// attempt records that the request for a pending transaction has been sent to the device
+func (t *Transactions) attempt(transactionKey string) {
+	defer t.lock.Unlock()
+	t.lock.Lock()
+
+	if p, ok := t.pending[transactionKey]; ok {
+		p.Attempts++
+	}
+}
+
 // Complete dispatches the given response to the appropriate channel returned from Register
 // and removes the transaction from the internal pending set.  This method is intended for
 // goroutines that are servicing queues of messages, e.g. the read pump of a Manager.  Such goroutines
 // use this method to indicate that a transaction is complete.
 //
+// If the transaction has timed out, a *LateResponseError is returned and the response is discarded.
+// If the transaction was resent and has already completed, ErrorDuplicateTransactionResponse is returned
+// and the response is discarded.
+//
 // If this method is passed a nil response, it panics.
 func (t *Transactions) Complete(transactionKey string, response *Response) error {
+	_, err := t.complete(transactionKey, response)
+	return err
+}
+
+// complete is the internal implementation of Complete, which also returns the completed Transaction
+func (t *Transactions) complete(transactionKey string, response *Response) (Transaction, error) {
 	if len(transactionKey) == 0 {
-		return ErrorInvalidTransactionKey
+		return Transaction{}, ErrorInvalidTransactionKey
 	} else if response == nil {
 		panic("nil response")
 	}
 
 	defer t.lock.Unlock()
 	t.lock.Lock()
-	result, ok := t.pending[transactionKey]
-	delete(t.pending, transactionKey)
 
+	now := t.now()
+	t.prune(now)
+
+	p, ok := t.pending[transactionKey]
 	if !ok {
-		return ErrorNoSuchTransactionKey
+		if expired, ok := t.expired[transactionKey]; ok {
+			delete(t.expired, transactionKey)
+			return expired, &LateResponseError{Transaction: expired, Latency: now.Sub(expired.Created)}
+		}
+
+		if completed, ok := t.completed[transactionKey]; ok {
+			// each attempt may draw a response, so this is remembered until it is pruned
+			return completed, ErrorDuplicateTransactionResponse
+		}
+
+		return Transaction{}, ErrorNoSuchTransactionKey
 	}
 
-	result <- response
-	close(result)
-	return nil
+	delete(t.pending, transactionKey)
+	if p.Attempts > 1 {
+		t.completed[transactionKey] = p.Transaction
+	}
+
+	p.result <- response
+	close(p.result)
+	return p.Transaction, nil
 }
 
 // Cancel simply cancels a transaction.  The transaction key is removed from the pending set.  If that
@@ -226,11 +331,43 @@ func (t *Transactions) Cancel(transactionKey string) {
 		return
 	}
 
-	result, ok := t.pending[transactionKey]
-	delete(t.pending, transactionKey)
+	if p, ok := t.pending[transactionKey]; ok {
+		delete(t.pending, transactionKey)
+		close(p.result)
+	}
+}
+
+// Timeout cancels a transaction because its deadline passed.  Unlike Cancel, the transaction is remembered
+// so that a response which arrives later is reported by Complete as a *LateResponseError.  If that transaction
+// key is not registered, this method does nothing.
+func (t *Transactions) Timeout(transactionKey string) {
+	defer t.lock.Unlock()
+	t.lock.Lock()
+	if t.closed {
+		return
+	}
+
+	t.prune(t.now())
+	if p, ok := t.pending[transactionKey]; ok {
+		delete(t.pending, transactionKey)
+		close(p.result)
+		t.expired[transactionKey] = p.Transaction
+	}
+}
+
+// prune discards timed out and completed transactions that have been remembered for longer than the late window.
+// This method must be invoked under the write lock.
+func (t *Transactions) prune(now time.Time) {
+	for key, expired := range t.expired {
+		if now.Sub(expired.Created) > t.lateWindow {
+			delete(t.expired, key)
+		}
+	}
 
-	if ok {
-		close(result)
+	for key, completed := range t.completed {
+		if now.Sub(completed.Created) > t.lateWindow {
+			delete(t.completed, key)
+		}
 	}
 }
 
@@ -244,9 +381,17 @@ func (t *Transactions) Close() error {
 	}
 
 	t.closed = true
-	for key, responses := range t.pending {
+	for key, p := range t.pending {
 		delete(t.pending, key)
-		close(responses)
+		close(p.result)
+	}
+
+	for key := range t.expired {
+		delete(t.expired, key)
+	}
+
+	for key := range t.completed {
+		delete(t.completed, key)
 	}
 
 	return nil
@@ -264,6 +409,12 @@ func (t *Transactions) Close() error {
 // The returned channel will either receive a non-nil response from some code calling Complete, or will
 // see a channel closure (nil Response) from some code calling Cancel.
 func (t *Transactions) Register(transactionKey string) (<-chan *Response, error) {
+	return t.RegisterDeadline(transactionKey, time.Time{})
+}
+
+// RegisterDeadline is like Register, but records the time by which the transaction must complete.
+// The deadline is informational: callers are still responsible for invoking Timeout or Cancel.
+func (t *Transactions) RegisterDeadline(transactionKey string, deadline time.Time) (<-chan *Response, error) {
 	if len(transactionKey) == 0 {
 		return nil, ErrorInvalidTransactionKey
 	}
@@ -278,7 +429,76 @@ func (t *Transactions) Register(transactionKey string) (<-chan *Response, error)
 		return nil, ErrorTransactionAlreadyRegistered
 	}
 
-	result := make(chan *Response, 1)
-	t.pending[transactionKey] = result
-	return result, nil
+	// a key reused after a timeout or a completion is a new transaction
+	delete(t.expired, transactionKey)
+	delete(t.completed, transactionKey)
+
+	p := &pendingTransaction{
+		Transaction: Transaction{
+			Key:      transactionKey,
+			Created:  t.now(),
+			Deadline: deadline,
+		},
+		result: make(chan *Response, 1),
+	}
+
+	t.pending[transactionKey] = p
+	return p.result, nil
+}
+
+const (
+	// DefaultLateWindow is the default length of time, measured from a transaction's creation, during which
+	// a response to a timed out transaction is recognized as late
+	DefaultLateWindow = time.Minute
+)
+
+// DefaultRetryTypes are the WRP message types resent by default when retries are enabled.  Only idempotent
+// message types are safe to resend.
+var DefaultRetryTypes = []wrp.MessageType{wrp.RetrieveMessageType}
+
+// TransactionOptions configures the timing, retrying, and accounting of transactions with devices
+type TransactionOptions struct {
+	// AttemptTimeout is how long to wait for a device's response before resending a retryable request.
+	// The request context's deadline still bounds the transaction as a whole.  If nonpositive, requests
+	// are never resent.
+	AttemptTimeout time.Duration
+
+	// MaxRetries is the maximum number of times a retryable request is resent.  If nonpositive,
+	// requests are never resent.
+	MaxRetries int
+
+	// RetryTypes are the message types which may be resent.  If empty, DefaultRetryTypes is used.
+	RetryTypes []wrp.MessageType
+
+	// LateWindow is how long, measured from a transaction's creation, a timed out or resent transaction is
+	// remembered so that a late or duplicate response can be recognized.  If nonpositive, DefaultLateWindow is used.
+	LateWindow time.Duration
+}
+
+func (o *TransactionOptions) lateWindow() time.Duration {
+	if o != nil && o.LateWindow > 0 {
+		return o.LateWindow
+	}
+
+	return DefaultLateWindow
+}
+
+// retryable tests if requests with the given message type should be resent when an attempt times out
+func (o *TransactionOptions) retryable(messageType wrp.MessageType) bool {
+	if o == nil || o.AttemptTimeout <= 0 || o.MaxRetries <= 0 {
+		return false
+	}
+
+	retryTypes := o.RetryTypes
+	if len(retryTypes) == 0 {
+		retryTypes = DefaultRetryTypes
+	}
+
+	for _, t := range retryTypes {
+		if t == messageType {
+			return true
+		}
+	}
+
+	return false
 }
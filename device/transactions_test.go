@@ -5,8 +5,12 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/Comcast/webpa-common/logging"
 	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics/xmetricstest"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -287,6 +291,181 @@ func testTransactionsCancellation(t *testing.T) {
 	<-finished
 }
 
+func testTransactionsDeadline(t *testing.T) {
+	var (
+		assert       = assert.New(t)
+		require      = require.New(t)
+		now          = time.Now()
+		deadline     = now.Add(time.Minute)
+		transactions = NewTransactions()
+	)
+
+	transactions.now = func() time.Time { return now }
+
+	_, ok := transactions.Get("transaction-id")
+	assert.False(ok)
+
+	output, err := transactions.RegisterDeadline("transaction-id", deadline)
+	require.NotNil(output)
+	require.NoError(err)
+
+	transactions.attempt("transaction-id")
+	transactions.attempt("transaction-id")
+	transactions.attempt("nosuch")
+
+	transaction, ok := transactions.Get("transaction-id")
+	assert.True(ok)
+	assert.Equal(
+		Transaction{Key: "transaction-id", Created: now, Deadline: deadline, Attempts: 2},
+		transaction,
+	)
+
+	transaction, err = transactions.complete("transaction-id", new(Response))
+	assert.NoError(err)
+	assert.Equal("transaction-id", transaction.Key)
+	assert.NotNil(<-output)
+}
+
+func testTransactionsTimeout(t *testing.T) {
+	var (
+		assert       = assert.New(t)
+		require      = require.New(t)
+		now          = time.Now()
+		transactions = newTransactions(&TransactionOptions{LateWindow: time.Minute})
+	)
+
+	transactions.now = func() time.Time { return now }
+
+	// timing out an unregistered key does nothing
+	transactions.Timeout("nosuch")
+
+	output, err := transactions.Register("late")
+	require.NotNil(output)
+	require.NoError(err)
+
+	transactions.Timeout("late")
+	assert.Nil(<-output)
+	assert.Zero(transactions.Len())
+
+	now = now.Add(15 * time.Second)
+	err = transactions.Complete("late", new(Response))
+	if late, ok := err.(*LateResponseError); assert.True(ok) {
+		assert.Equal("late", late.Transaction.Key)
+		assert.Equal(15*time.Second, late.Latency)
+		assert.Contains(late.Error(), "late")
+	}
+
+	// a late response is only reported once
+	assert.Equal(ErrorNoSuchTransactionKey, transactions.Complete("late", new(Response)))
+
+	// timed out transactions are forgotten after the late window
+	output, err = transactions.Register("forgotten")
+	require.NotNil(output)
+	require.NoError(err)
+	transactions.Timeout("forgotten")
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(ErrorNoSuchTransactionKey, transactions.Complete("forgotten", new(Response)))
+
+	// reusing a timed out key starts a new transaction
+	output, err = transactions.Register("reused")
+	require.NoError(err)
+	transactions.Timeout("reused")
+	output, err = transactions.Register("reused")
+	require.NoError(err)
+	assert.NoError(transactions.Complete("reused", new(Response)))
+	assert.NotNil(<-output)
+
+	// closing forgets timed out transactions
+	output, err = transactions.Register("closed")
+	require.NoError(err)
+	transactions.Timeout("closed")
+	require.NoError(transactions.Close())
+	assert.Equal(ErrorNoSuchTransactionKey, transactions.Complete("closed", new(Response)))
+	transactions.Timeout("closed")
+}
+
+func testTransactionsDuplicate(t *testing.T) {
+	var (
+		assert       = assert.New(t)
+		require      = require.New(t)
+		now          = time.Now()
+		transactions = newTransactions(&TransactionOptions{LateWindow: time.Minute})
+	)
+
+	transactions.now = func() time.Time { return now }
+
+	// a transaction sent once is forgotten when it completes
+	output, err := transactions.Register("once")
+	require.NoError(err)
+	transactions.attempt("once")
+	assert.NoError(transactions.Complete("once", new(Response)))
+	assert.NotNil(<-output)
+	assert.Equal(ErrorNoSuchTransactionKey, transactions.Complete("once", new(Response)))
+
+	// a resent transaction can draw a response for each attempt
+	output, err = transactions.Register("resent")
+	require.NoError(err)
+	transactions.attempt("resent")
+	transactions.attempt("resent")
+	assert.NoError(transactions.Complete("resent", new(Response)))
+	assert.NotNil(<-output)
+
+	now = now.Add(15 * time.Second)
+	completed, err := transactions.complete("resent", new(Response))
+	assert.Equal(ErrorDuplicateTransactionResponse, err)
+	assert.Equal("resent", completed.Key)
+	assert.Equal(2, completed.Attempts)
+	assert.Equal(ErrorDuplicateTransactionResponse, transactions.Complete("resent", new(Response)))
+
+	// completed transactions are forgotten after the late window
+	now = now.Add(2 * time.Minute)
+	assert.Equal(ErrorNoSuchTransactionKey, transactions.Complete("resent", new(Response)))
+
+	// reusing a completed key starts a new transaction
+	output, err = transactions.Register("reused")
+	require.NoError(err)
+	transactions.attempt("reused")
+	transactions.attempt("reused")
+	assert.NoError(transactions.Complete("reused", new(Response)))
+	<-output
+
+	output, err = transactions.Register("reused")
+	require.NoError(err)
+	assert.NoError(transactions.Complete("reused", new(Response)))
+	assert.NotNil(<-output)
+
+	// closing forgets completed transactions
+	output, err = transactions.Register("closed")
+	require.NoError(err)
+	transactions.attempt("closed")
+	transactions.attempt("closed")
+	assert.NoError(transactions.Complete("closed", new(Response)))
+	<-output
+	require.NoError(transactions.Close())
+	assert.Equal(ErrorNoSuchTransactionKey, transactions.Complete("closed", new(Response)))
+}
+
+func TestTransactionOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	var o *TransactionOptions
+	assert.Equal(DefaultLateWindow, o.lateWindow())
+	assert.False(o.retryable(wrp.RetrieveMessageType))
+
+	o = &TransactionOptions{AttemptTimeout: time.Second}
+	assert.False(o.retryable(wrp.RetrieveMessageType))
+
+	o = &TransactionOptions{AttemptTimeout: time.Second, MaxRetries: 1}
+	assert.True(o.retryable(wrp.RetrieveMessageType))
+	assert.False(o.retryable(wrp.SimpleRequestResponseMessageType))
+	assert.False(o.retryable(wrp.UpdateMessageType))
+
+	o = &TransactionOptions{AttemptTimeout: time.Second, MaxRetries: 1, RetryTypes: []wrp.MessageType{wrp.SimpleRequestResponseMessageType}}
+	assert.False(o.retryable(wrp.RetrieveMessageType))
+	assert.True(o.retryable(wrp.SimpleRequestResponseMessageType))
+}
+
 func TestTransactions(t *testing.T) {
 	t.Run("InitialState", testTransactionsInitialState)
 
@@ -303,4 +482,264 @@ func TestTransactions(t *testing.T) {
 
 	t.Run("Lifecycle", testTransactionsLifecycle)
 	t.Run("Cancellation", testTransactionsCancellation)
+	t.Run("Deadline", testTransactionsDeadline)
+	t.Run("Timeout", testTransactionsTimeout)
+	t.Run("Duplicate", testTransactionsDuplicate)
+}
+
+// transactionTestListener captures the transaction events dispatched by a manager
+type transactionTestListener struct {
+	connected    chan struct{}
+	disconnected chan struct{}
+	late         chan *Event
+	duplicate    chan *Event
+	broken       chan *Event
+}
+
+func newTransactionTestListener() *transactionTestListener {
+	return &transactionTestListener{
+		connected:    make(chan struct{}, 10),
+		disconnected: make(chan struct{}, 10),
+		late:         make(chan *Event, 10),
+		duplicate:    make(chan *Event, 10),
+		broken:       make(chan *Event, 10),
+	}
+}
+
+func (ttl *transactionTestListener) OnDeviceEvent(e *Event) {
+	switch e.Type {
+	case Connect:
+		ttl.connected <- struct{}{}
+	case Disconnect:
+		ttl.disconnected <- struct{}{}
+	case TransactionLate:
+		captured := *e
+		ttl.late <- &captured
+	case TransactionBroken:
+		captured := *e
+		ttl.broken <- &captured
+	case MessageReceived:
+		if e.Error == ErrorDuplicateTransactionResponse {
+			captured := *e
+			ttl.duplicate <- &captured
+		}
+	}
+}
+
+func writeTestResponse(require *require.Assertions, connection Connection, transactionKey string) {
+	require.NoError(connection.WriteMessage(
+		websocket.BinaryMessage,
+		wrp.MustEncode(
+			&wrp.Message{
+				Type:            wrp.RetrieveMessageType,
+				Source:          string(testDeviceIDs[0]),
+				Destination:     "test",
+				TransactionUUID: transactionKey,
+				Payload:         []byte("response"),
+			},
+			wrp.Msgpack,
+		),
+	))
+}
+
+func testManagerTransactionsRetry(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		provider = xmetricstest.NewProvider(nil, Metrics)
+
+		listener = newTransactionTestListener()
+		options  = &Options{
+			Logger:          logging.NewTestLogger(nil, t),
+			Transactions:    TransactionOptions{AttemptTimeout: 100 * time.Millisecond, MaxRetries: 2},
+			Listeners:       []Listener{listener.OnDeviceEvent},
+			MetricsProvider: provider,
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+
+		responses = make(chan *Response, 1)
+		errs      = make(chan error, 1)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	awaitSessionEvent(assert, listener.connected, "connect")
+	defer func() {
+		connection.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		response, err := manager.Route((&Request{
+			Message: &wrp.Message{
+				Type:            wrp.RetrieveMessageType,
+				Source:          "test",
+				Destination:     string(testDeviceIDs[0]),
+				TransactionUUID: "retry-me",
+			},
+		}).WithContext(ctx))
+
+		responses <- response
+		errs <- err
+	}()
+
+	// ignore the first attempt, so that the request is resent
+	assert.Equal("retry-me", readTestMessage(require, connection).TransactionUUID)
+	assert.Equal("retry-me", readTestMessage(require, connection).TransactionUUID)
+	writeTestResponse(require, connection, "retry-me")
+
+	select {
+	case response := <-responses:
+		require.NotNil(response)
+		assert.Equal("response", string(response.Message.Payload))
+		assert.NoError(<-errs)
+	case <-time.After(10 * time.Second):
+		assert.Fail("The retried transaction did not complete")
+	}
+
+	// the device's response to the second attempt is a duplicate, not a broken transaction
+	writeTestResponse(require, connection, "retry-me")
+	select {
+	case e := <-listener.duplicate:
+		assert.Equal("retry-me", e.Message.(*wrp.Message).TransactionUUID)
+	case <-time.After(10 * time.Second):
+		assert.Fail("No duplicate transaction response was dispatched")
+	}
+
+	assert.Empty(listener.broken)
+	provider.Assert(t, TransactionRetryCounter)(xmetricstest.Value(1.0))
+	provider.Assert(t, TransactionTimeoutCounter)(xmetricstest.Value(0.0))
+	provider.Assert(t, TransactionDuplicateCounter)(xmetricstest.Value(1.0))
+	provider.Assert(t, TransactionLatency, TransactionOutcomeLabel, TransactionOutcomeComplete)(xmetricstest.Histogram)
+
+	if d, ok := manager.Get(testDeviceIDs[0]); assert.True(ok) {
+		assert.Equal(uint64(1), d.Statistics().TransactionLatency().Count)
+	}
+}
+
+func testManagerTransactionsNotRetryable(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		provider = xmetricstest.NewProvider(nil, Metrics)
+
+		listener = newTransactionTestListener()
+		options  = &Options{
+			Logger:          logging.NewTestLogger(nil, t),
+			Transactions:    TransactionOptions{AttemptTimeout: 50 * time.Millisecond, MaxRetries: 2},
+			Listeners:       []Listener{listener.OnDeviceEvent},
+			MetricsProvider: provider,
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	awaitSessionEvent(assert, listener.connected, "connect")
+	defer func() {
+		connection.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	// an update is not idempotent, so it is only sent once despite the attempt timeout
+	response, err := manager.Route((&Request{
+		Message: &wrp.Message{
+			Type:            wrp.UpdateMessageType,
+			Source:          "test",
+			Destination:     string(testDeviceIDs[0]),
+			TransactionUUID: "update-me",
+		},
+	}).WithContext(ctx))
+
+	assert.Nil(response)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal("update-me", readTestMessage(require, connection).TransactionUUID)
+
+	require.NoError(connection.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, _, err = connection.ReadMessage()
+	assert.Error(err)
+
+	provider.Assert(t, TransactionRetryCounter)(xmetricstest.Value(0.0))
+	provider.Assert(t, TransactionTimeoutCounter)(xmetricstest.Value(1.0))
+}
+
+func testManagerTransactionsLate(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		provider = xmetricstest.NewProvider(nil, Metrics)
+
+		listener = newTransactionTestListener()
+		options  = &Options{
+			Logger:          logging.NewTestLogger(nil, t),
+			Listeners:       []Listener{listener.OnDeviceEvent},
+			MetricsProvider: provider,
+		}
+
+		manager, server, connectURL = startWebsocketServer(options)
+	)
+
+	defer server.Close()
+
+	connection, _, err := DefaultDialer().DialDevice(string(testDeviceIDs[0]), connectURL, nil)
+	require.NoError(err)
+	awaitSessionEvent(assert, listener.connected, "connect")
+	defer func() {
+		connection.Close()
+		awaitSessionEvent(assert, listener.disconnected, "disconnect")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	response, err := manager.Route((&Request{
+		Message: &wrp.Message{
+			Type:            wrp.RetrieveMessageType,
+			Source:          "test",
+			Destination:     string(testDeviceIDs[0]),
+			TransactionUUID: "late",
+		},
+	}).WithContext(ctx))
+
+	assert.Nil(response)
+	assert.Equal(context.DeadlineExceeded, err)
+	provider.Assert(t, TransactionTimeoutCounter)(xmetricstest.Value(1.0))
+
+	assert.Equal("late", readTestMessage(require, connection).TransactionUUID)
+	writeTestResponse(require, connection, "late")
+
+	select {
+	case e := <-listener.late:
+		if late, ok := e.Error.(*LateResponseError); assert.True(ok) {
+			assert.Equal("late", late.Transaction.Key)
+			assert.False(late.Transaction.Deadline.IsZero())
+			assert.Equal(1, late.Transaction.Attempts)
+			assert.True(late.Latency >= 100*time.Millisecond)
+		}
+
+		assert.Equal("late", e.Message.(*wrp.Message).TransactionUUID)
+	case <-time.After(10 * time.Second):
+		assert.Fail("No late transaction event was dispatched")
+	}
+
+	provider.Assert(t, TransactionLateCounter)(xmetricstest.Value(1.0))
+	provider.Assert(t, TransactionLatency, TransactionOutcomeLabel, TransactionOutcomeLate)(xmetricstest.Histogram)
+}
+
+func TestManagerTransactions(t *testing.T) {
+	t.Run("Retry", testManagerTransactionsRetry)
+	t.Run("NotRetryable", testManagerTransactionsNotRetryable)
+	t.Run("Late", testManagerTransactionsLate)
 }
@@ -0,0 +1,265 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultWatchListSize is the maximum number of devices watched when no size is configured
+	DefaultWatchListSize = 25
+
+	// WatchedDeviceLabel is the label identifying the device for each watched series
+	WatchedDeviceLabel = "device"
+
+	WatchedConnected            = "watched_device_connected"
+	WatchedUpTime               = "watched_device_uptime_seconds"
+	WatchedIdleTime             = "watched_device_idle_seconds"
+	WatchedPingLatency          = "watched_device_ping_latency_seconds"
+	WatchedPending              = "watched_device_pending_messages"
+	WatchedBytesSentRate        = "watched_device_bytes_sent_rate"
+	WatchedMessagesSentRate     = "watched_device_messages_sent_rate"
+	WatchedBytesReceivedRate    = "watched_device_bytes_received_rate"
+	WatchedMessagesReceivedRate = "watched_device_messages_received_rate"
+	WatchedTransactionLatency   = "watched_device_transaction_latency_seconds"
+)
+
+var ErrorWatchListFull = errors.New("The watch list is full")
+
+// WatchListOptions configures a WatchList
+type WatchListOptions struct {
+	// Namespace is the Prometheus namespace of the watched series
+	Namespace string
+
+	// Subsystem is the Prometheus subsystem of the watched series
+	Subsystem string
+
+	// MaxSize is the maximum number of devices that can be watched at once.  If nonpositive,
+	// DefaultWatchListSize is used.
+	MaxSize int
+}
+
+func (o *WatchListOptions) maxSize() int {
+	if o != nil && o.MaxSize > 0 {
+		return o.MaxSize
+	}
+
+	return DefaultWatchListSize
+}
+
+// WatchList is a bounded set of device identifiers whose statistics are exported as Prometheus series labeled
+// by device.  Bounding the set allows specific devices to be debugged without exploding the cardinality of
+// the exported metrics.  A WatchList is a prometheus.Collector, and must be registered to be exported.
+type WatchList struct {
+	lock     sync.RWMutex
+	registry Registry
+	maxSize  int
+	ids      map[ID]bool
+
+	connected            *prometheus.Desc
+	upTime               *prometheus.Desc
+	idleTime             *prometheus.Desc
+	pingLatency          *prometheus.Desc
+	pending              *prometheus.Desc
+	bytesSentRate        *prometheus.Desc
+	messagesSentRate     *prometheus.Desc
+	bytesReceivedRate    *prometheus.Desc
+	messagesReceivedRate *prometheus.Desc
+	transactionLatency   *prometheus.Desc
+}
+
+// NewWatchList creates an empty WatchList which reports on devices from the given registry
+func NewWatchList(registry Registry, o *WatchListOptions) *WatchList {
+	var namespace, subsystem string
+	if o != nil {
+		namespace, subsystem = o.Namespace, o.Subsystem
+	}
+
+	newDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, name),
+			help,
+			[]string{WatchedDeviceLabel},
+			nil,
+		)
+	}
+
+	return &WatchList{
+		registry: registry,
+		maxSize:  o.maxSize(),
+		ids:      make(map[ID]bool),
+
+		connected:            newDesc(WatchedConnected, "1 if the watched device is connected, 0 otherwise"),
+		upTime:               newDesc(WatchedUpTime, "the time for which the watched device has been connected"),
+		idleTime:             newDesc(WatchedIdleTime, "the time since a message was last received from the watched device"),
+		pingLatency:          newDesc(WatchedPingLatency, "the round trip time of the most recent ping to the watched device"),
+		pending:              newDesc(WatchedPending, "the number of messages waiting to be sent to the watched device"),
+		bytesSentRate:        newDesc(WatchedBytesSentRate, "the bytes per second recently sent to the watched device"),
+		messagesSentRate:     newDesc(WatchedMessagesSentRate, "the messages per second recently sent to the watched device"),
+		bytesReceivedRate:    newDesc(WatchedBytesReceivedRate, "the bytes per second recently received from the watched device"),
+		messagesReceivedRate: newDesc(WatchedMessagesReceivedRate, "the messages per second recently received from the watched device"),
+		transactionLatency:   newDesc(WatchedTransactionLatency, "the time taken by the watched device to complete transactions"),
+	}
+}
+
+// Add starts watching the given device.  The device need not be connected.  If the device is already
+// watched, this method does nothing.  ErrorWatchListFull is returned if no more devices can be watched.
+func (wl *WatchList) Add(id ID) error {
+	wl.lock.Lock()
+	defer wl.lock.Unlock()
+
+	if wl.ids[id] {
+		return nil
+	}
+
+	if len(wl.ids) >= wl.maxSize {
+		return ErrorWatchListFull
+	}
+
+	wl.ids[id] = true
+	return nil
+}
+
+// Remove stops watching the given device, returning false if the device was not watched
+func (wl *WatchList) Remove(id ID) bool {
+	wl.lock.Lock()
+	defer wl.lock.Unlock()
+
+	if !wl.ids[id] {
+		return false
+	}
+
+	delete(wl.ids, id)
+	return true
+}
+
+// IDs returns the watched device identifiers, in sorted order
+func (wl *WatchList) IDs() []ID {
+	wl.lock.RLock()
+	ids := make([]ID, 0, len(wl.ids))
+	for id := range wl.ids {
+		ids = append(ids, id)
+	}
+
+	wl.lock.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (wl *WatchList) Describe(ch chan<- *prometheus.Desc) {
+	ch <- wl.connected
+	ch <- wl.upTime
+	ch <- wl.idleTime
+	ch <- wl.pingLatency
+	ch <- wl.pending
+	ch <- wl.bytesSentRate
+	ch <- wl.messagesSentRate
+	ch <- wl.bytesReceivedRate
+	ch <- wl.messagesReceivedRate
+	ch <- wl.transactionLatency
+}
+
+func (wl *WatchList) Collect(ch chan<- prometheus.Metric) {
+	for _, id := range wl.IDs() {
+		label := string(id)
+		d, ok := wl.registry.Get(id)
+		if !ok {
+			ch <- prometheus.MustNewConstMetric(wl.connected, prometheus.GaugeValue, 0.0, label)
+			continue
+		}
+
+		var (
+			s     = d.Statistics()
+			rates = s.Rates()
+		)
+
+		ch <- prometheus.MustNewConstMetric(wl.connected, prometheus.GaugeValue, 1.0, label)
+		ch <- prometheus.MustNewConstMetric(wl.upTime, prometheus.GaugeValue, s.UpTime().Seconds(), label)
+		ch <- prometheus.MustNewConstMetric(wl.idleTime, prometheus.GaugeValue, s.IdleTime().Seconds(), label)
+		ch <- prometheus.MustNewConstMetric(wl.pingLatency, prometheus.GaugeValue, s.PingLatency().Seconds(), label)
+		ch <- prometheus.MustNewConstMetric(wl.pending, prometheus.GaugeValue, float64(d.Pending()), label)
+		ch <- prometheus.MustNewConstMetric(wl.bytesSentRate, prometheus.GaugeValue, rates.BytesSent, label)
+		ch <- prometheus.MustNewConstMetric(wl.messagesSentRate, prometheus.GaugeValue, rates.MessagesSent, label)
+		ch <- prometheus.MustNewConstMetric(wl.bytesReceivedRate, prometheus.GaugeValue, rates.BytesReceived, label)
+		ch <- prometheus.MustNewConstMetric(wl.messagesReceivedRate, prometheus.GaugeValue, rates.MessagesReceived, label)
+
+		latency := s.TransactionLatency()
+		ch <- prometheus.MustNewConstHistogram(wl.transactionLatency, latency.Count, latency.Sum, latency.Buckets, label)
+	}
+}
+
+// WatchHandler is an HTTP handler which manages a WatchList.  A GET returns the watched device identifiers
+// as a JSON array.  A PUT adds the device named by the path variable, and a DELETE removes it.
+type WatchHandler struct {
+	Logger    log.Logger
+	WatchList *WatchList
+	Variable  string
+}
+
+func (wh *WatchHandler) logger() log.Logger {
+	if wh.Logger != nil {
+		return wh.Logger
+	}
+
+	return logging.DefaultLogger()
+}
+
+func (wh *WatchHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	logger := wh.logger()
+	if request.Method == http.MethodGet {
+		data, err := json.Marshal(wh.WatchList.IDs())
+		if err != nil {
+			logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to marshal watch list as JSON", logging.ErrorKey(), err)
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		response.Write(data)
+		return
+	}
+
+	name, ok := mux.Vars(request)[wh.Variable]
+	if !ok {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "missing path variable", "variable", wh.Variable)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id, err := ParseID(name)
+	if err != nil {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to parse identifier", "deviceName", name, logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodPut:
+		if err := wh.WatchList.Add(id); err != nil {
+			logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "unable to watch device", "deviceName", name, logging.ErrorKey(), err)
+			response.WriteHeader(http.StatusConflict)
+			return
+		}
+
+	case http.MethodDelete:
+		if !wh.WatchList.Remove(id) {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
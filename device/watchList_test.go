@@ -0,0 +1,173 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testWatchListAddRemove(t *testing.T) {
+	var (
+		assert    = assert.New(t)
+		watchList = NewWatchList(new(MockRegistry), &WatchListOptions{MaxSize: 2})
+	)
+
+	assert.Empty(watchList.IDs())
+	assert.NoError(watchList.Add(ID("mac:112233445566")))
+	assert.NoError(watchList.Add(ID("mac:112233445566")))
+	assert.NoError(watchList.Add(ID("mac:111111111111")))
+	assert.Equal(ErrorWatchListFull, watchList.Add(ID("mac:222222222222")))
+	assert.Equal([]ID{"mac:111111111111", "mac:112233445566"}, watchList.IDs())
+
+	assert.True(watchList.Remove(ID("mac:112233445566")))
+	assert.False(watchList.Remove(ID("mac:112233445566")))
+	assert.NoError(watchList.Add(ID("mac:222222222222")))
+	assert.Equal([]ID{"mac:111111111111", "mac:222222222222"}, watchList.IDs())
+}
+
+func testWatchListDefaultSize(t *testing.T) {
+	var (
+		assert    = assert.New(t)
+		watchList = NewWatchList(new(MockRegistry), nil)
+	)
+
+	assert.Equal(DefaultWatchListSize, watchList.maxSize)
+}
+
+func testWatchListCollect(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		require  = require.New(t)
+		registry = new(MockRegistry)
+		device   = new(MockDevice)
+
+		connectedAt = time.Now()
+		statistics  = NewStatistics(func() time.Time { return connectedAt.Add(10 * time.Second) }, connectedAt)
+
+		watchList = NewWatchList(registry, &WatchListOptions{Namespace: "test", Subsystem: "device"})
+		gatherer  = prometheus.NewPedanticRegistry()
+	)
+
+	statistics.AddMessagesReceived(20)
+	statistics.AddTransactionLatency(200 * time.Millisecond)
+	registry.On("Get", ID("mac:112233445566")).Return(device, true)
+	registry.On("Get", ID("mac:111111111111")).Return(nil, false)
+	device.On("Statistics").Return(statistics)
+	device.On("Pending").Return(3)
+
+	require.NoError(gatherer.Register(watchList))
+	require.NoError(watchList.Add(ID("mac:112233445566")))
+	require.NoError(watchList.Add(ID("mac:111111111111")))
+
+	families, err := gatherer.Gather()
+	require.NoError(err)
+
+	values := make(map[string]map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			require.Len(metric.GetLabel(), 1)
+			assert.Equal(WatchedDeviceLabel, metric.GetLabel()[0].GetName())
+			if values[family.GetName()] == nil {
+				values[family.GetName()] = make(map[string]float64)
+			}
+
+			values[family.GetName()][metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+			if histogram := metric.GetHistogram(); histogram != nil {
+				assert.Equal(uint64(1), histogram.GetSampleCount())
+				assert.InDelta(0.2, histogram.GetSampleSum(), 0.0001)
+				assert.Len(histogram.GetBucket(), len(TransactionLatencyBuckets))
+			}
+		}
+	}
+
+	assert.Contains(values, "test_device_"+WatchedTransactionLatency)
+
+	assert.Equal(
+		map[string]float64{"mac:111111111111": 0.0, "mac:112233445566": 1.0},
+		values["test_device_"+WatchedConnected],
+	)
+
+	assert.Equal(map[string]float64{"mac:112233445566": 10.0}, values["test_device_"+WatchedUpTime])
+	assert.Equal(map[string]float64{"mac:112233445566": 0.0}, values["test_device_"+WatchedIdleTime])
+	assert.Equal(map[string]float64{"mac:112233445566": 3.0}, values["test_device_"+WatchedPending])
+	assert.Equal(map[string]float64{"mac:112233445566": 2.0}, values["test_device_"+WatchedMessagesReceivedRate])
+
+	registry.AssertExpectations(t)
+	device.AssertExpectations(t)
+}
+
+func testWatchHandler(t *testing.T) {
+	var (
+		assert    = assert.New(t)
+		require   = require.New(t)
+		watchList = NewWatchList(new(MockRegistry), &WatchListOptions{MaxSize: 1})
+		handler   = &WatchHandler{WatchList: watchList, Variable: "id"}
+		router    = mux.NewRouter()
+	)
+
+	router.Handle("/watch", handler).Methods("GET")
+	router.Handle("/watch/{id}", handler)
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(method, target, nil))
+		return response
+	}
+
+	response := serve("PUT", "/watch/mac:112233445566")
+	assert.Equal(http.StatusNoContent, response.Code)
+
+	response = serve("PUT", "/watch/mac:111111111111")
+	assert.Equal(http.StatusConflict, response.Code)
+
+	response = serve("PUT", "/watch/invalid")
+	assert.Equal(http.StatusBadRequest, response.Code)
+
+	response = serve("POST", "/watch/mac:112233445566")
+	assert.Equal(http.StatusMethodNotAllowed, response.Code)
+
+	response = serve("GET", "/watch")
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal("application/json", response.Header().Get("Content-Type"))
+
+	var ids []string
+	require.NoError(json.Unmarshal(response.Body.Bytes(), &ids))
+	assert.Equal([]string{"mac:112233445566"}, ids)
+
+	response = serve("DELETE", "/watch/mac:112233445566")
+	assert.Equal(http.StatusNoContent, response.Code)
+
+	response = serve("DELETE", "/watch/mac:112233445566")
+	assert.Equal(http.StatusNotFound, response.Code)
+
+	assert.Empty(watchList.IDs())
+}
+
+func testWatchHandlerMissingVariable(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		handler  = &WatchHandler{WatchList: NewWatchList(new(MockRegistry), nil), Variable: "id"}
+		response = httptest.NewRecorder()
+	)
+
+	handler.ServeHTTP(response, httptest.NewRequest("PUT", "/", nil))
+	assert.Equal(http.StatusInternalServerError, response.Code)
+}
+
+func TestWatchList(t *testing.T) {
+	t.Run("AddRemove", testWatchListAddRemove)
+	t.Run("DefaultSize", testWatchListDefaultSize)
+	t.Run("Collect", testWatchListCollect)
+}
+
+func TestWatchHandler(t *testing.T) {
+	t.Run("Basic", testWatchHandler)
+	t.Run("MissingVariable", testWatchHandlerMissingVariable)
+}
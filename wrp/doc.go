@@ -50,31 +50,19 @@ Some common uses of this package include:
 		return buffer.Bytes(), nil
 	}
 
-(4) Pooling encoders and/or decoders for efficiency:
+(4) Decoding high volumes of messages using pooled Messages:
 
-	// transcoding, using pools:
-	var (
-		decoderPool = NewDecoderPool(100, JSON)
-		encoderPool = NewEncoderPool(100, Msgpack)
-	)
-
-	func jsonToMsgpackUsingPools(source io.Reader) ([]byte, error) {
-		var (
-			decoder = decoderPool.Get()
-			buffer bytes.Buffer
-			encoder = encoderPool.Get()
-		)
-
-		defer decoderPool.Put(decoder)
-		defer encoderPool.Put(encoder)
-
-		// TranscodeMessage returns a *Message as its first value, which contains
-		// the generic WRP message data
-		if _, err := TranscodeMessage(encoder, decoder); err != nil {
-			return nil, err
+	// the decoder may be reused for each message, as long as it is not shared between goroutines
+	func handleFrame(decoder Decoder, frame []byte) error {
+		message, err := DecodePooled(decoder, frame)
+		if err != nil {
+			return err
 		}
 
-		return buffer.Bytes(), nil
+		// neither message nor anything in it may be used after Release, so
+		// anything that must outlive this function has to use message.Clone()
+		defer message.Release()
+		return process(message)
 	}
 
 */
@@ -15,17 +15,22 @@ import (
 // Format indicates which format is desired.
 // The zero value indicates Msgpack, which means by default other
 // infrastructure can assume msgpack-formatted data.
+//
+// Protobuf messages are not self-delimiting, so a Protobuf Decoder consumes all
+// of its input and each Protobuf message must be written to a separate output.
 type Format int
 
 const (
 	Msgpack Format = iota
 	JSON
+	Protobuf
+	CBOR
 	lastFormat
 )
 
 // AllFormats returns a distinct slice of all supported formats.
 func AllFormats() []Format {
-	return []Format{Msgpack, JSON}
+	return []Format{Msgpack, JSON, Protobuf, CBOR}
 }
 
 var (
@@ -46,6 +51,12 @@ var (
 			TypeInfos: codec.NewTypeInfos([]string{"wrp"}),
 		},
 	}
+
+	cborHandle = codec.CborHandle{
+		BasicHandle: codec.BasicHandle{
+			TypeInfos: codec.NewTypeInfos([]string{"wrp"}),
+		},
+	}
 )
 
 // ContentType returns the MIME type associated with this format
@@ -55,6 +66,10 @@ func (f Format) ContentType() string {
 		return "application/msgpack"
 	case JSON:
 		return "application/json"
+	case Protobuf:
+		return "application/x-protobuf"
+	case CBOR:
+		return "application/cbor"
 	default:
 		return "application/octet-stream"
 	}
@@ -82,19 +97,26 @@ func FormatFromContentType(contentType string, fallback ...Format) (Format, erro
 		return JSON, nil
 	} else if strings.Contains(contentType, "msgpack") {
 		return Msgpack, nil
+	} else if strings.Contains(contentType, "protobuf") {
+		return Protobuf, nil
+	} else if strings.Contains(contentType, "cbor") {
+		return CBOR, nil
 	}
 
 	return Format(-1), fmt.Errorf("Invalid WRP content type: %s", contentType)
 }
 
 // handle looks up the appropriate codec.Handle for this format constant.
-// This method panics if the format is not a valid value.
+// This method panics if the format is not a valid value, or if the format,
+// such as Protobuf, is not implemented with ugorji.
 func (f Format) handle() codec.Handle {
 	switch f {
 	case Msgpack:
 		return &msgpackHandle
 	case JSON:
 		return &jsonHandle
+	case CBOR:
+		return &cborHandle
 	}
 
 	panic(fmt.Errorf("Invalid format constant: %d", f))
@@ -142,6 +164,10 @@ type Decoder interface {
 // NewEncoder produces a ugorji Encoder using the appropriate WRP configuration
 // for the given format
 func NewEncoder(output io.Writer, f Format) Encoder {
+	if f == Protobuf {
+		return &protobufEncoder{writer: output}
+	}
+
 	return &encoderDecorator{
 		codec.NewEncoder(output, f.handle()),
 	}
@@ -150,6 +176,10 @@ func NewEncoder(output io.Writer, f Format) Encoder {
 // NewEncoderBytes produces a ugorji Encoder using the appropriate WRP configuration
 // for the given format
 func NewEncoderBytes(output *[]byte, f Format) Encoder {
+	if f == Protobuf {
+		return &protobufEncoder{bytes: output}
+	}
+
 	return &encoderDecorator{
 		codec.NewEncoderBytes(output, f.handle()),
 	}
@@ -158,12 +188,20 @@ func NewEncoderBytes(output *[]byte, f Format) Encoder {
 // NewDecoder produces a ugorji Decoder using the appropriate WRP configuration
 // for the given format
 func NewDecoder(input io.Reader, f Format) Decoder {
+	if f == Protobuf {
+		return &protobufDecoder{reader: input}
+	}
+
 	return codec.NewDecoder(input, f.handle())
 }
 
 // NewDecoderBytes produces a ugorji Decoder using the appropriate WRP configuration
 // for the given format
 func NewDecoderBytes(input []byte, f Format) Decoder {
+	if f == Protobuf {
+		return &protobufDecoder{bytes: input}
+	}
+
 	return codec.NewDecoderBytes(input, f.handle())
 }
 
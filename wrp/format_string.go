@@ -4,9 +4,9 @@ package wrp
 
 import "strconv"
 
-const _Format_name = "MsgpackJSONlastFormat"
+const _Format_name = "MsgpackJSONProtobufCBORlastFormat"
 
-var _Format_index = [...]uint8{0, 7, 11, 21}
+var _Format_index = [...]uint8{0, 7, 11, 19, 23, 33}
 
 func (i Format) String() string {
 	if i < 0 || i >= Format(len(_Format_index)-1) {
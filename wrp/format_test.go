@@ -138,6 +138,32 @@ func TestSampleMsgpack(t *testing.T) {
 		assert.NoError(decoder.Decode(&actualMessage))
 		assert.Equal(sampleMessage, actualMessage)
 	})
+
+	for _, f := range AllFormats() {
+		t.Run(fmt.Sprintf("TranscodeTo%s", f), func(t *testing.T) {
+			var (
+				assert  = assert.New(t)
+				require = require.New(t)
+
+				transcoded    []byte
+				roundTrip     []byte
+				actualMessage SimpleRequestResponse
+			)
+
+			_, err := TranscodeMessage(NewEncoderBytes(&transcoded, f), NewDecoderBytes(sampleEncoded, Msgpack))
+			require.NoError(err)
+			require.NoError(NewDecoderBytes(transcoded, f).Decode(&actualMessage))
+			assert.Equal(sampleMessage, actualMessage)
+
+			// transcoding back must reproduce the original msgpack fixture's content
+			_, err = TranscodeMessage(NewEncoderBytes(&roundTrip, Msgpack), NewDecoderBytes(transcoded, f))
+			require.NoError(err)
+
+			actualMessage = SimpleRequestResponse{}
+			require.NoError(NewDecoderBytes(roundTrip, Msgpack).Decode(&actualMessage))
+			assert.Equal(sampleMessage, actualMessage)
+		})
+	}
 }
 
 func testFormatFromContentTypeInvalid(t *testing.T, contentType string) {
@@ -193,6 +219,9 @@ func TestFormatFromContentType(t *testing.T) {
 		testFormatFromContentTypeValid(t, "application/msgpack", Msgpack)
 		testFormatFromContentTypeValid(t, "application/json", JSON)
 		testFormatFromContentTypeValid(t, "text/json", JSON)
+		testFormatFromContentTypeValid(t, "application/x-protobuf", Protobuf)
+		testFormatFromContentTypeValid(t, "application/protobuf", Protobuf)
+		testFormatFromContentTypeValid(t, "application/cbor", CBOR)
 	})
 
 	t.Run("Fallback", testFormatFromContentTypeFallback)
@@ -205,6 +234,15 @@ func testFormatString(t *testing.T) {
 	assert.NotEmpty(Msgpack.String())
 	assert.NotEmpty(Format(-1).String())
 	assert.NotEqual(JSON.String(), Msgpack.String())
+
+	names := make(map[string]bool)
+	for _, f := range AllFormats() {
+		names[f.String()] = true
+	}
+
+	assert.Len(names, len(AllFormats()))
+	assert.Equal("Protobuf", Protobuf.String())
+	assert.Equal("CBOR", CBOR.String())
 }
 
 func testFormatHandle(t *testing.T) {
@@ -212,6 +250,8 @@ func testFormatHandle(t *testing.T) {
 
 	assert.NotNil(JSON.handle())
 	assert.NotNil(Msgpack.handle())
+	assert.NotNil(CBOR.handle())
+	assert.Panics(func() { Protobuf.handle() })
 	assert.Panics(func() { Format(999).handle() })
 }
 
@@ -221,6 +261,12 @@ func testFormatContentType(t *testing.T) {
 	assert.NotEmpty(JSON.ContentType())
 	assert.NotEmpty(Msgpack.ContentType())
 	assert.NotEqual(JSON.ContentType(), Msgpack.ContentType())
+
+	for _, f := range AllFormats() {
+		actual, err := FormatFromContentType(f.ContentType())
+		assert.NoError(err)
+		assert.Equal(f, actual)
+	}
 	assert.Equal("application/octet-stream", Format(999).ContentType())
 }
 
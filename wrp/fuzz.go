@@ -0,0 +1,27 @@
+// +build gofuzz
+
+package wrp
+
+// FuzzLocator is the go-fuzz entry point for ParseLocator.  To run it:
+//
+//   go-fuzz-build -func FuzzLocator github.com/Comcast/webpa-common/wrp
+//   go-fuzz -bin wrp-fuzz.zip -workdir fuzz
+//
+// Any locator that parses must reparse from its canonical form into an identical Locator.
+func FuzzLocator(data []byte) int {
+	l, err := ParseLocator(string(data))
+	if err != nil {
+		return 0
+	}
+
+	reparsed, err := ParseLocator(l.String())
+	if err != nil {
+		panic(err)
+	}
+
+	if reparsed != l {
+		panic("canonical form of " + string(data) + " does not reparse: " + l.String())
+	}
+
+	return 1
+}
@@ -0,0 +1,153 @@
+package wrp
+
+import (
+	"errors"
+	"strings"
+)
+
+// The schemes supported by WRP locators
+const (
+	SchemeMAC    = "mac"
+	SchemeUUID   = "uuid"
+	SchemeDNS    = "dns"
+	SchemeSerial = "serial"
+	SchemeEvent  = "event"
+)
+
+const (
+	macDigits     = "0123456789abcdef"
+	macDelimiters = ":-.,"
+	macLength     = 12
+)
+
+var (
+	ErrorInvalidLocator       = errors.New("Invalid WRP locator")
+	ErrorInvalidLocatorScheme = errors.New("Invalid WRP locator scheme")
+	ErrorInvalidMAC           = errors.New("Invalid MAC address in WRP locator")
+)
+
+// Locator is the parsed form of a WRP source or destination, which has the syntax scheme:authority[/service[/ignored]].
+// For example, mac:112233445566/config/foo has the scheme mac, the authority 112233445566, the service config and
+// the ignored part /foo.  For the event scheme, the authority is the event name, so event:device-status/mac:112233445566/online
+// has the authority device-status, the service mac:112233445566 and the ignored part /online.
+type Locator struct {
+	// Scheme is the lowercased scheme, which is one of the SchemeXXX constants
+	Scheme string
+
+	// Authority identifies the device, server or event.  MAC addresses are canonicalized to 12 lowercased
+	// hexadecimal digits.
+	Authority string
+
+	// Service is the optional service, which is the path segment immediately following the authority
+	Service string
+
+	// Ignored is the remainder of the locator following the service, including its leading slash.  This part
+	// of a locator is passed through but otherwise ignored by WRP routing.
+	Ignored string
+}
+
+// ParseLocator parses and canonicalizes a WRP locator.  The scheme is case insensitive, and MAC addresses may
+// contain any of the delimiters ':', '-', '.' or ','.
+func ParseLocator(value string) (Locator, error) {
+	colon := strings.IndexByte(value, ':')
+	if colon < 0 {
+		return Locator{}, ErrorInvalidLocator
+	}
+
+	l := Locator{Scheme: strings.ToLower(value[:colon])}
+	switch l.Scheme {
+	case SchemeMAC, SchemeUUID, SchemeDNS, SchemeSerial, SchemeEvent:
+	default:
+		return Locator{}, ErrorInvalidLocatorScheme
+	}
+
+	rest := value[colon+1:]
+	if slash := strings.IndexByte(rest, '/'); slash >= 0 {
+		l.Authority, rest = rest[:slash], rest[slash+1:]
+		if slash = strings.IndexByte(rest, '/'); slash >= 0 {
+			l.Service, l.Ignored = rest[:slash], rest[slash:]
+		} else {
+			l.Service = rest
+		}
+	} else {
+		l.Authority = rest
+	}
+
+	if len(l.Authority) == 0 {
+		return Locator{}, ErrorInvalidLocator
+	}
+
+	if l.Scheme == SchemeMAC {
+		mac, ok := canonicalMAC(l.Authority)
+		if !ok {
+			return Locator{}, ErrorInvalidMAC
+		}
+
+		l.Authority = mac
+	}
+
+	return l, nil
+}
+
+// canonicalMAC strips delimiters from a MAC address and lowercases it
+func canonicalMAC(value string) (string, bool) {
+	var (
+		invalid bool
+		mac     = strings.Map(
+			func(r rune) rune {
+				switch {
+				case r >= 'A' && r <= 'F':
+					return r + ('a' - 'A')
+				case strings.ContainsRune(macDigits, r):
+					return r
+				case strings.ContainsRune(macDelimiters, r):
+					return -1
+				default:
+					invalid = true
+					return -1
+				}
+			},
+			value,
+		)
+	)
+
+	return mac, !invalid && len(mac) == macLength
+}
+
+// ID returns the scheme and authority of this locator, e.g. mac:112233445566.  For device locators, this is
+// the canonical device identifier.
+func (l Locator) ID() string {
+	return l.Scheme + ":" + l.Authority
+}
+
+// String returns the canonical text form of this locator, which ParseLocator parses back into an identical Locator
+func (l Locator) String() string {
+	output := l.ID()
+	if len(l.Service) > 0 || len(l.Ignored) > 0 {
+		output += "/" + l.Service
+	}
+
+	return output + l.Ignored
+}
+
+// SourceLocator parses this message's Source
+func (msg *Message) SourceLocator() (Locator, error) {
+	return ParseLocator(msg.Source)
+}
+
+// DestinationLocator parses this message's Destination
+func (msg *Message) DestinationLocator() (Locator, error) {
+	return ParseLocator(msg.Destination)
+}
+
+// SetSourceLocator sets this message's Source to the canonical form of a locator
+func (msg *Message) SetSourceLocator(l Locator) *Message {
+	msg.Source = l.String()
+	return msg
+}
+
+// SetDestinationLocator sets this message's Destination to the canonical form of a locator
+func (msg *Message) SetDestinationLocator(l Locator) *Message {
+	msg.Destination = l.String()
+	return msg
+}
@@ -0,0 +1,154 @@
+package wrp
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLocator(t *testing.T) {
+	testData := []struct {
+		value         string
+		expected      Locator
+		expectedError error
+		canonical     string
+	}{
+		{"MAC:11:22:33:44:55:66", Locator{Scheme: SchemeMAC, Authority: "112233445566"}, nil, "mac:112233445566"},
+		{"mac:11-aa-BB-44-55-66/config", Locator{Scheme: SchemeMAC, Authority: "11aabb445566", Service: "config"}, nil, "mac:11aabb445566/config"},
+		{"mac:11.aa.BB.44.55.66/config/", Locator{Scheme: SchemeMAC, Authority: "11aabb445566", Service: "config", Ignored: "/"}, nil, "mac:11aabb445566/config/"},
+		{"mac:11,aa,BB,44,55,66/parodus/tag/test0", Locator{Scheme: SchemeMAC, Authority: "11aabb445566", Service: "parodus", Ignored: "/tag/test0"}, nil, "mac:11aabb445566/parodus/tag/test0"},
+		{"mac:112233445566/", Locator{Scheme: SchemeMAC, Authority: "112233445566"}, nil, "mac:112233445566"},
+		{"mac:112233445566//foo", Locator{Scheme: SchemeMAC, Authority: "112233445566", Ignored: "/foo"}, nil, "mac:112233445566//foo"},
+		{"uuid:anything Goes!", Locator{Scheme: SchemeUUID, Authority: "anything Goes!"}, nil, "uuid:anything Goes!"},
+		{"Serial:1234/service", Locator{Scheme: SchemeSerial, Authority: "1234", Service: "service"}, nil, "serial:1234/service"},
+		{"dns:talaria.example.com:8080/api", Locator{Scheme: SchemeDNS, Authority: "talaria.example.com:8080", Service: "api"}, nil, "dns:talaria.example.com:8080/api"},
+		{"event:device-status/mac:112233445566/online", Locator{Scheme: SchemeEvent, Authority: "device-status", Service: "mac:112233445566", Ignored: "/online"}, nil, "event:device-status/mac:112233445566/online"},
+		{"", Locator{}, ErrorInvalidLocator, ""},
+		{"mac112233445566", Locator{}, ErrorInvalidLocator, ""},
+		{"mac:", Locator{}, ErrorInvalidLocator, ""},
+		{"event:/online", Locator{}, ErrorInvalidLocator, ""},
+		{"http://example.com", Locator{}, ErrorInvalidLocatorScheme, ""},
+		{":112233445566", Locator{}, ErrorInvalidLocatorScheme, ""},
+		{"mac:11-aa-BB-44-55", Locator{}, ErrorInvalidMAC, ""},
+		{"mac:invalid45566", Locator{}, ErrorInvalidMAC, ""},
+		{"mac:1122334455667", Locator{}, ErrorInvalidMAC, ""},
+	}
+
+	for _, record := range testData {
+		t.Run(record.value, func(t *testing.T) {
+			assert := assert.New(t)
+			actual, err := ParseLocator(record.value)
+			assert.Equal(record.expected, actual)
+			assert.Equal(record.expectedError, err)
+			if err == nil {
+				assert.Equal(record.canonical, actual.String())
+				assert.Equal(record.expected.Scheme+":"+record.expected.Authority, actual.ID())
+			}
+		})
+	}
+}
+
+// randomLocator produces locator-like text for property testing, biased towards the supported schemes
+// and the characters that are significant to ParseLocator
+type randomLocator string
+
+func (randomLocator) Generate(random *rand.Rand, size int) reflect.Value {
+	const alphabet = "/:/:-.,0123456789aAbBfFgG xX\xff"
+	schemes := []string{"mac", "MAC", "uuid", "dns", "Serial", "event", "http", ""}
+
+	text := make([]byte, random.Intn(size+1))
+	for i := range text {
+		text[i] = alphabet[random.Intn(len(alphabet))]
+	}
+
+	return reflect.ValueOf(randomLocator(schemes[random.Intn(len(schemes))] + ":" + string(text)))
+}
+
+func TestParseLocatorProperties(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+	)
+
+	// whatever ParseLocator accepts, it must accept again in canonical form, producing the same Locator
+	require.NoError(quick.Check(
+		func(value randomLocator) bool {
+			l, err := ParseLocator(string(value))
+			if err != nil {
+				return true
+			}
+
+			reparsed, err := ParseLocator(l.String())
+			return err == nil && reparsed == l && l.String() == reparsed.String()
+		},
+		&quick.Config{MaxCount: 5000},
+	))
+
+	// the parts of a locator never contain the delimiters that separate them
+	require.NoError(quick.Check(
+		func(value randomLocator) bool {
+			l, err := ParseLocator(string(value))
+			if err != nil {
+				return true
+			}
+
+			return l.Scheme == strings.ToLower(l.Scheme) &&
+				len(l.Authority) > 0 &&
+				!strings.Contains(l.Authority, "/") &&
+				!strings.Contains(l.Service, "/") &&
+				(len(l.Ignored) == 0 || l.Ignored[0] == '/')
+		},
+		&quick.Config{MaxCount: 5000},
+	))
+
+	// arbitrary strings never cause a panic
+	assert.NoError(quick.Check(
+		func(value string) bool {
+			ParseLocator(value)
+			return true
+		},
+		nil,
+	))
+}
+
+func TestMessageLocators(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		message = Message{
+			Source:      "MAC:11:22:33:44:55:66/config",
+			Destination: "event:device-status/mac:112233445566/online",
+		}
+	)
+
+	source, err := message.SourceLocator()
+	require.NoError(err)
+	assert.Equal(Locator{Scheme: SchemeMAC, Authority: "112233445566", Service: "config"}, source)
+
+	destination, err := message.DestinationLocator()
+	require.NoError(err)
+	assert.Equal(Locator{Scheme: SchemeEvent, Authority: "device-status", Service: "mac:112233445566", Ignored: "/online"}, destination)
+
+	assert.Equal(
+		&message,
+		message.SetSourceLocator(Locator{Scheme: SchemeDNS, Authority: "talaria.example.com"}).
+			SetDestinationLocator(source),
+	)
+
+	assert.Equal("dns:talaria.example.com", message.Source)
+	assert.Equal("mac:112233445566/config", message.Destination)
+
+	message.Source = "invalid"
+	_, err = message.SourceLocator()
+	assert.Equal(ErrorInvalidLocator, err)
+
+	message.Destination = "mac:invalid"
+	_, err = message.DestinationLocator()
+	assert.Equal(ErrorInvalidMAC, err)
+}
@@ -11,7 +11,7 @@ import (
 
 var (
 	// allFormats enumerates all of the supported formats to use in testing
-	allFormats = []Format{JSON, Msgpack}
+	allFormats = []Format{JSON, Msgpack, Protobuf, CBOR}
 )
 
 func testMessageSetStatus(t *testing.T) {
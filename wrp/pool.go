@@ -0,0 +1,156 @@
+package wrp
+
+import "sync"
+
+// maxPooledPayload is the largest Payload capacity, in bytes, retained by a released Message.  Larger buffers are
+// left to the garbage collector, so that an occasional large message does not pin its memory in the pool.
+const maxPooledPayload = 64 * 1024
+
+// messagePool holds released Messages for reuse by AcquireMessage
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return new(Message)
+	},
+}
+
+// AcquireMessage returns an empty Message, reusing a released Message if one is available.  Messages obtained
+// from this function should be returned via Release once they are no longer needed, though it is not an error
+// to let them be garbage collected instead.
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// DecodePooled decodes a single Message from data, using a Message obtained from AcquireMessage.  The given decoder
+// is reset to data for the duration of this call, then reset again so that it does not retain data.
+//
+// Decoding into a reused Message reuses the capacity it retains, so in the steady state decoding allocates little
+// beyond the message's strings.
+//
+// The decoded Message never aliases data: byte slice fields such as Payload are always copied.  Aliasing the frame
+// was deliberately left out.  The codec always copies into a []byte field, and a pooled Message reuses its Payload
+// capacity on the next decode, so an aliased Payload would overwrite a frame that may still be referenced elsewhere,
+// e.g. by a Response's Contents.  Since the copy lands in retained capacity, it costs no allocation.  Callers may
+// therefore modify or reuse data as soon as this function returns.
+func DecodePooled(decoder Decoder, data []byte) (*Message, error) {
+	msg := AcquireMessage()
+	decoder.ResetBytes(data)
+	err := decoder.Decode(msg)
+	decoder.ResetBytes(nil)
+
+	if err != nil {
+		msg.Release()
+		return nil, err
+	}
+
+	msg.trim()
+	return msg, nil
+}
+
+// Reset clears all fields of this message.  The capacity of its slices and its metadata map is retained for reuse
+// by decoding, so any of these obtained prior to Reset must not be used afterward.
+func (msg *Message) Reset() {
+	for k := range msg.Metadata {
+		delete(msg.Metadata, k)
+	}
+
+	*msg = Message{
+		Headers:    msg.Headers[:0],
+		Metadata:   msg.Metadata,
+		Spans:      msg.Spans[:0],
+		Payload:    msg.Payload[:0],
+		PartnerIDs: msg.PartnerIDs[:0],
+	}
+}
+
+// trim discards the retained capacity of any fields that were not decoded, so that a pooled Message is
+// indistinguishable from a Message decoded from scratch
+func (msg *Message) trim() {
+	if len(msg.Headers) == 0 {
+		msg.Headers = nil
+	}
+
+	if len(msg.Metadata) == 0 {
+		msg.Metadata = nil
+	}
+
+	if len(msg.Spans) == 0 {
+		msg.Spans = nil
+	}
+
+	if len(msg.Payload) == 0 {
+		msg.Payload = nil
+	}
+
+	if len(msg.PartnerIDs) == 0 {
+		msg.PartnerIDs = nil
+	}
+}
+
+// Release resets this message and returns it to the pool used by AcquireMessage and DecodePooled.  After calling
+// this method, neither this message nor anything obtained from its fields may be used.  Code which needs a message
+// beyond that point must use Clone beforehand.
+//
+// Release may be called on any Message, not just those obtained from the pool, provided that the message is not
+// used afterward.
+func (msg *Message) Release() {
+	msg.Reset()
+	if cap(msg.Payload) > maxPooledPayload {
+		msg.Payload = nil
+	}
+
+	messagePool.Put(msg)
+}
+
+// Clone produces a deep copy of this message, which shares no memory with this message and is never affected by Release.
+func (msg *Message) Clone() *Message {
+	clone := *msg
+	clone.Status = cloneInt64(msg.Status)
+	clone.RequestDeliveryResponse = cloneInt64(msg.RequestDeliveryResponse)
+	clone.Headers = cloneStrings(msg.Headers)
+	clone.Spans = nil
+	clone.IncludeSpans = nil
+	clone.Payload = nil
+	clone.PartnerIDs = cloneStrings(msg.PartnerIDs)
+
+	if msg.Metadata != nil {
+		clone.Metadata = make(map[string]string, len(msg.Metadata))
+		for k, v := range msg.Metadata {
+			clone.Metadata[k] = v
+		}
+	}
+
+	if msg.Spans != nil {
+		clone.Spans = make([][]string, len(msg.Spans))
+		for i, span := range msg.Spans {
+			clone.Spans[i] = cloneStrings(span)
+		}
+	}
+
+	if msg.IncludeSpans != nil {
+		includeSpans := *msg.IncludeSpans
+		clone.IncludeSpans = &includeSpans
+	}
+
+	if msg.Payload != nil {
+		clone.Payload = append([]byte{}, msg.Payload...)
+	}
+
+	return &clone
+}
+
+func cloneInt64(v *int64) *int64 {
+	if v == nil {
+		return nil
+	}
+
+	clone := *v
+	return &clone
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+
+	return append([]string{}, s...)
+}
@@ -0,0 +1,167 @@
+package wrp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPoolTestMessage produces a message with every field set, so that stale values left by pooling are detectable
+func newPoolTestMessage() *Message {
+	return (&Message{
+		Type:            SimpleRequestResponseMessageType,
+		Source:          "dns:talaria.example.com",
+		Destination:     "mac:112233445566/config",
+		TransactionUUID: "1-2-3-4",
+		ContentType:     "application/json",
+		Accept:          "application/msgpack",
+		Headers:         []string{"X-Foo: bar"},
+		Metadata:        map[string]string{"/boot-time": "1234"},
+		Spans:           [][]string{{"foo", "100", "200"}},
+		Path:            "/some/where",
+		Payload:         []byte(`{"hello": "world"}`),
+		ServiceName:     "config",
+		URL:             "http://127.0.0.1:8080/",
+		PartnerIDs:      []string{"comcast"},
+	}).SetStatus(200).SetRequestDeliveryResponse(1).SetIncludeSpans(true)
+}
+
+func TestMessageClone(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		original = newPoolTestMessage()
+		clone    = original.Clone()
+	)
+
+	assert.Equal(*original, *clone)
+	assert.Equal(Message{}, *(&Message{}).Clone())
+
+	// the clone must share no memory with the original
+	original.Release()
+	assert.Equal(*newPoolTestMessage(), *clone)
+}
+
+func TestMessageReset(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		message = newPoolTestMessage()
+	)
+
+	message.Reset()
+	message.trim()
+	assert.Equal(Message{}, *message)
+
+	message.Reset()
+	assert.Equal(Message{}, *message)
+}
+
+func TestMessageRelease(t *testing.T) {
+	assert := assert.New(t)
+
+	small := newPoolTestMessage()
+	small.Payload = make([]byte, maxPooledPayload)
+	small.Release()
+	assert.Empty(small.Payload)
+	assert.Equal(maxPooledPayload, cap(small.Payload))
+
+	// a large payload buffer is not retained by the pool
+	large := newPoolTestMessage()
+	large.Payload = make([]byte, maxPooledPayload+1)
+	large.Release()
+	assert.Nil(large.Payload)
+}
+
+func testDecodePooledReuse(t *testing.T, f Format) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		full, minimal []byte
+		expected      Message
+		decoder       = NewDecoder(nil, f)
+	)
+
+	require.NoError(NewEncoderBytes(&full, f).Encode(newPoolTestMessage()))
+	require.NoError(NewEncoderBytes(&minimal, f).Encode(&SimpleEvent{Source: "mac:112233445566", Destination: "event:test"}))
+	require.NoError(NewDecoderBytes(minimal, f).Decode(&expected))
+
+	message, err := DecodePooled(decoder, full)
+	require.NoError(err)
+	assert.Equal(*newPoolTestMessage(), *message)
+
+	// the decoded message does not alias the frame
+	for i := range full {
+		full[i] = 0
+	}
+
+	assert.Equal(*newPoolTestMessage(), *message)
+
+	// decode into the same, reset message just as the pool would, which must leave nothing stale behind
+	message.Reset()
+	decoder.ResetBytes(minimal)
+	require.NoError(decoder.Decode(message))
+	message.trim()
+	assert.Equal(expected, *message)
+
+	message.Release()
+	message, err = DecodePooled(decoder, minimal)
+	require.NoError(err)
+	assert.Equal(expected, *message)
+	message.Release()
+
+	message, err = DecodePooled(decoder, []byte{0xc1})
+	assert.Nil(message)
+	assert.Error(err)
+}
+
+func TestDecodePooled(t *testing.T) {
+	for _, f := range allFormats {
+		t.Run(f.String(), func(t *testing.T) {
+			testDecodePooledReuse(t, f)
+		})
+	}
+}
+
+func benchmarkDecodeNew(b *testing.B, f Format, data []byte) {
+	decoder := NewDecoder(nil, f)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		message := new(Message)
+		decoder.ResetBytes(data)
+		if err := decoder.Decode(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecodePooled(b *testing.B, f Format, data []byte) {
+	decoder := NewDecoder(nil, f)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		message, err := DecodePooled(decoder, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		message.Release()
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, f := range []Format{Msgpack, JSON} {
+		var data []byte
+		if err := NewEncoderBytes(&data, f).Encode(newPoolTestMessage()); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(f.String(), func(b *testing.B) {
+			b.Run("New", func(b *testing.B) { benchmarkDecodeNew(b, f, data) })
+			b.Run("Pooled", func(b *testing.B) { benchmarkDecodePooled(b, f, data) })
+		})
+	}
+}
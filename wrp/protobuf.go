@@ -0,0 +1,552 @@
+package wrp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// protobuf wire types, as defined by https://developers.google.com/protocol-buffers/docs/encoding
+const (
+	protobufVarint          = 0
+	protobufFixed64         = 1
+	protobufLengthDelimited = 2
+	protobufFixed32         = 5
+)
+
+var (
+	errProtobufTruncated = errors.New("Truncated protobuf WRP message")
+	errProtobufOverflow  = errors.New("Protobuf varint overflows 64 bits")
+)
+
+// protobufFieldNumbers assigns a protobuf field number to each wrp tag.  Every WRP message struct uses a subset
+// of these fields, so any struct can be decoded from the encoding of any other, as with the other formats.
+// The equivalent protobuf schema is:
+//
+//   message Span {
+//     repeated string parts = 1;
+//   }
+//
+//   message Message {
+//     int64 msg_type = 1;
+//     string source = 2;
+//     string dest = 3;
+//     string transaction_uuid = 4;
+//     string content_type = 5;
+//     string accept = 6;
+//     optional int64 status = 7;
+//     optional int64 rdr = 8;
+//     repeated string headers = 9;
+//     map<string, string> metadata = 10;
+//     repeated Span spans = 11;
+//     optional bool include_spans = 12;
+//     string path = 13;
+//     bytes payload = 14;
+//     string service_name = 15;
+//     string url = 16;
+//     repeated string partner_ids = 17;
+//   }
+//
+// Field numbers must never be changed or reused once published.
+var protobufFieldNumbers = map[string]uint64{
+	"msg_type":         1,
+	"source":           2,
+	"dest":             3,
+	"transaction_uuid": 4,
+	"content_type":     5,
+	"accept":           6,
+	"status":           7,
+	"rdr":              8,
+	"headers":          9,
+	"metadata":         10,
+	"spans":            11,
+	"include_spans":    12,
+	"path":             13,
+	"payload":          14,
+	"service_name":     15,
+	"url":              16,
+	"partner_ids":      17,
+}
+
+// protobufField describes how a single struct field is marshaled
+type protobufField struct {
+	number    uint64
+	index     int
+	omitEmpty bool
+}
+
+var (
+	stringSliceType = reflect.TypeOf([]string(nil))
+	byteSliceType   = reflect.TypeOf([]byte(nil))
+	spansType       = reflect.TypeOf([][]string(nil))
+	metadataType    = reflect.TypeOf(map[string]string(nil))
+
+	protobufFieldCache sync.Map
+)
+
+// protobufFieldsOf returns the marshaling plan for a WRP message struct type, which is computed once per type
+func protobufFieldsOf(t reflect.Type) ([]protobufField, error) {
+	if cached, ok := protobufFieldCache.Load(t); ok {
+		return cached.([]protobufField), nil
+	}
+
+	var fields []protobufField
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("wrp")
+		if len(tag) == 0 || tag == "-" {
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		number, ok := protobufFieldNumbers[options[0]]
+		if !ok {
+			return nil, fmt.Errorf("The wrp field %s of %s has no protobuf field number", options[0], t)
+		}
+
+		field := protobufField{number: number, index: i}
+		for _, option := range options[1:] {
+			field.omitEmpty = field.omitEmpty || option == "omitempty"
+		}
+
+		fields = append(fields, field)
+	}
+
+	protobufFieldCache.Store(t, fields)
+	return fields, nil
+}
+
+// protobufStruct dereferences a value passed to a protobuf encoder or decoder
+func protobufStruct(value interface{}, settable bool) (reflect.Value, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	} else if settable {
+		return reflect.Value{}, fmt.Errorf("Cannot decode protobuf into %T: a non-nil struct pointer is required", value)
+	}
+
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("Cannot use %T with protobuf: only WRP message structs are supported", value)
+	}
+
+	return v, nil
+}
+
+func appendUvarint(output []byte, value uint64) []byte {
+	var buffer [binary.MaxVarintLen64]byte
+	return append(output, buffer[:binary.PutUvarint(buffer[:], value)]...)
+}
+
+func appendProtobufTag(output []byte, number uint64, wireType uint64) []byte {
+	return appendUvarint(output, number<<3|wireType)
+}
+
+func appendProtobufBytes(output []byte, number uint64, value []byte) []byte {
+	output = appendProtobufTag(output, number, protobufLengthDelimited)
+	output = appendUvarint(output, uint64(len(value)))
+	return append(output, value...)
+}
+
+func appendProtobufString(output []byte, number uint64, value string) []byte {
+	output = appendProtobufTag(output, number, protobufLengthDelimited)
+	output = appendUvarint(output, uint64(len(value)))
+	return append(output, value...)
+}
+
+func appendProtobufVarint(output []byte, number uint64, value uint64) []byte {
+	output = appendProtobufTag(output, number, protobufVarint)
+	return appendUvarint(output, value)
+}
+
+// marshalProtobuf appends the protobuf encoding of a WRP message struct.  As with the other formats, scalar
+// fields tagged with omitempty are omitted when they hold zero values, and pointer fields are written whenever
+// they are set.  Repeated fields are omitted when empty, since protobuf cannot distinguish empty from absent.
+func marshalProtobuf(output []byte, v reflect.Value) ([]byte, error) {
+	fields, err := protobufFieldsOf(v.Type())
+	if err != nil {
+		return output, err
+	}
+
+	for _, field := range fields {
+		f := v.Field(field.index)
+		switch {
+		case f.Kind() == reflect.String:
+			if f.Len() > 0 || !field.omitEmpty {
+				output = appendProtobufString(output, field.number, f.String())
+			}
+
+		case f.Kind() == reflect.Int64:
+			if f.Int() != 0 || !field.omitEmpty {
+				output = appendProtobufVarint(output, field.number, uint64(f.Int()))
+			}
+
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Int64:
+			if !f.IsNil() {
+				output = appendProtobufVarint(output, field.number, uint64(f.Elem().Int()))
+			}
+
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Bool:
+			if !f.IsNil() {
+				var value uint64
+				if f.Elem().Bool() {
+					value = 1
+				}
+
+				output = appendProtobufVarint(output, field.number, value)
+			}
+
+		case f.Type() == byteSliceType:
+			if f.Len() > 0 || !field.omitEmpty {
+				output = appendProtobufBytes(output, field.number, f.Bytes())
+			}
+
+		case f.Type() == stringSliceType:
+			for _, value := range f.Interface().([]string) {
+				output = appendProtobufString(output, field.number, value)
+			}
+
+		case f.Type() == spansType:
+			for _, span := range f.Interface().([][]string) {
+				var entry []byte
+				for _, part := range span {
+					entry = appendProtobufString(entry, 1, part)
+				}
+
+				output = appendProtobufBytes(output, field.number, entry)
+			}
+
+		case f.Type() == metadataType:
+			for key, value := range f.Interface().(map[string]string) {
+				var entry []byte
+				entry = appendProtobufString(entry, 1, key)
+				entry = appendProtobufString(entry, 2, value)
+				output = appendProtobufBytes(output, field.number, entry)
+			}
+
+		default:
+			return output, fmt.Errorf("The field %s of %s cannot be encoded as protobuf", v.Type().Field(field.index).Name, v.Type())
+		}
+	}
+
+	return output, nil
+}
+
+// protobufReader walks the fields of an encoded protobuf message
+type protobufReader struct {
+	data []byte
+}
+
+func (pr *protobufReader) varint() (uint64, error) {
+	value, n := binary.Uvarint(pr.data)
+	if n == 0 {
+		return 0, errProtobufTruncated
+	} else if n < 0 {
+		return 0, errProtobufOverflow
+	}
+
+	pr.data = pr.data[n:]
+	return value, nil
+}
+
+func (pr *protobufReader) next() (number uint64, wireType uint64, err error) {
+	var tag uint64
+	if tag, err = pr.varint(); err == nil {
+		number, wireType = tag>>3, tag&7
+	}
+
+	return
+}
+
+func (pr *protobufReader) bytes() ([]byte, error) {
+	length, err := pr.varint()
+	if err != nil {
+		return nil, err
+	}
+
+	if length > uint64(len(pr.data)) {
+		return nil, errProtobufTruncated
+	}
+
+	value := pr.data[:length]
+	pr.data = pr.data[length:]
+	return value, nil
+}
+
+// skip discards a field this decoder does not know about
+func (pr *protobufReader) skip(wireType uint64) error {
+	var err error
+	switch wireType {
+	case protobufVarint:
+		_, err = pr.varint()
+	case protobufLengthDelimited:
+		_, err = pr.bytes()
+	case protobufFixed64, protobufFixed32:
+		size := 8
+		if wireType == protobufFixed32 {
+			size = 4
+		}
+
+		if len(pr.data) < size {
+			err = errProtobufTruncated
+		} else {
+			pr.data = pr.data[size:]
+		}
+
+	default:
+		err = fmt.Errorf("Unsupported protobuf wire type: %d", wireType)
+	}
+
+	return err
+}
+
+// strings decodes the repeated string field 1 of an embedded Span message
+func (pr *protobufReader) strings() ([]string, error) {
+	values := []string{}
+	for len(pr.data) > 0 {
+		number, wireType, err := pr.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if number != 1 || wireType != protobufLengthDelimited {
+			if err := pr.skip(wireType); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		value, err := pr.bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, string(value))
+	}
+
+	return values, nil
+}
+
+// entry decodes an embedded map entry message
+func (pr *protobufReader) entry() (key, value string, err error) {
+	for len(pr.data) > 0 {
+		var number, wireType uint64
+		if number, wireType, err = pr.next(); err != nil {
+			return
+		}
+
+		if (number != 1 && number != 2) || wireType != protobufLengthDelimited {
+			if err = pr.skip(wireType); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		var raw []byte
+		if raw, err = pr.bytes(); err != nil {
+			return
+		}
+
+		if number == 1 {
+			key = string(raw)
+		} else {
+			value = string(raw)
+		}
+	}
+
+	return
+}
+
+// unmarshalProtobuf decodes a protobuf WRP message into a WRP message struct.  Fields the struct
+// does not have are skipped.
+func unmarshalProtobuf(data []byte, v reflect.Value) error {
+	fields, err := protobufFieldsOf(v.Type())
+	if err != nil {
+		return err
+	}
+
+	// as with proto.Unmarshal, any existing contents of the target are discarded
+	v.Set(reflect.Zero(v.Type()))
+
+	pr := protobufReader{data: data}
+	for len(pr.data) > 0 {
+		number, wireType, err := pr.next()
+		if err != nil {
+			return err
+		}
+
+		index := -1
+		for _, field := range fields {
+			if field.number == number {
+				index = field.index
+				break
+			}
+		}
+
+		if index < 0 {
+			if err := pr.skip(wireType); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := unmarshalProtobufField(&pr, wireType, v.Field(index)); err != nil {
+			return fmt.Errorf("Unable to decode protobuf field %d: %s", number, err)
+		}
+	}
+
+	return nil
+}
+
+func unmarshalProtobufField(pr *protobufReader, wireType uint64, f reflect.Value) error {
+	expected := uint64(protobufLengthDelimited)
+	if f.Kind() == reflect.Int64 || f.Kind() == reflect.Ptr {
+		expected = protobufVarint
+	}
+
+	if wireType != expected {
+		return fmt.Errorf("Unexpected wire type %d", wireType)
+	}
+
+	if expected == protobufVarint {
+		value, err := pr.varint()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f.Kind() == reflect.Int64:
+			f.SetInt(int64(value))
+		case f.Type().Elem().Kind() == reflect.Int64:
+			f.Set(reflect.New(f.Type().Elem()))
+			f.Elem().SetInt(int64(value))
+		default:
+			f.Set(reflect.New(f.Type().Elem()))
+			f.Elem().SetBool(value != 0)
+		}
+
+		return nil
+	}
+
+	raw, err := pr.bytes()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case f.Kind() == reflect.String:
+		f.SetString(string(raw))
+
+	case f.Type() == byteSliceType:
+		f.SetBytes(append([]byte(nil), raw...))
+
+	case f.Type() == stringSliceType:
+		f.Set(reflect.Append(f, reflect.ValueOf(string(raw))))
+
+	case f.Type() == spansType:
+		span, err := (&protobufReader{data: raw}).strings()
+		if err != nil {
+			return err
+		}
+
+		f.Set(reflect.Append(f, reflect.ValueOf(span)))
+
+	case f.Type() == metadataType:
+		key, value, err := (&protobufReader{data: raw}).entry()
+		if err != nil {
+			return err
+		}
+
+		if f.IsNil() {
+			f.Set(reflect.MakeMap(metadataType))
+		}
+
+		f.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
+	}
+
+	return nil
+}
+
+// protobufEncoder is the Encoder for the Protobuf format.  Since protobuf messages are not self-delimiting,
+// each message should be written to its own output.
+type protobufEncoder struct {
+	writer io.Writer
+	bytes  *[]byte
+}
+
+func (pe *protobufEncoder) Encode(value interface{}) error {
+	if listener, ok := value.(EncodeListener); ok {
+		if err := listener.BeforeEncode(); err != nil {
+			return err
+		}
+	}
+
+	v, err := protobufStruct(value, false)
+	if err != nil {
+		return err
+	}
+
+	if pe.bytes != nil {
+		*pe.bytes, err = marshalProtobuf((*pe.bytes)[:0], v)
+		return err
+	}
+
+	var output []byte
+	if output, err = marshalProtobuf(nil, v); err != nil {
+		return err
+	}
+
+	if pe.writer == nil {
+		return errors.New("No output has been set for this protobuf encoder")
+	}
+
+	_, err = pe.writer.Write(output)
+	return err
+}
+
+func (pe *protobufEncoder) Reset(output io.Writer) {
+	pe.writer, pe.bytes = output, nil
+}
+
+func (pe *protobufEncoder) ResetBytes(output *[]byte) {
+	pe.writer, pe.bytes = nil, output
+}
+
+// protobufDecoder is the Decoder for the Protobuf format.  Since protobuf messages are not self-delimiting,
+// Decode consumes all of its input.
+type protobufDecoder struct {
+	reader io.Reader
+	bytes  []byte
+}
+
+func (pd *protobufDecoder) Decode(value interface{}) error {
+	v, err := protobufStruct(value, true)
+	if err != nil {
+		return err
+	}
+
+	data := pd.bytes
+	if pd.reader != nil {
+		if data, err = ioutil.ReadAll(pd.reader); err != nil {
+			return err
+		}
+	} else {
+		pd.bytes = nil
+	}
+
+	return unmarshalProtobuf(data, v)
+}
+
+func (pd *protobufDecoder) Reset(input io.Reader) {
+	pd.reader, pd.bytes = input, nil
+}
+
+func (pd *protobufDecoder) ResetBytes(input []byte) {
+	pd.reader, pd.bytes = nil, input
+}
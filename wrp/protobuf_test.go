@@ -0,0 +1,148 @@
+package wrp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtobufFieldNumbers(t *testing.T) {
+	assert := assert.New(t)
+
+	numbers := make(map[uint64]string)
+	for name, number := range protobufFieldNumbers {
+		assert.NotContains(numbers, number, "field number %d is used by both %s and %s", number, name, numbers[number])
+		numbers[number] = name
+	}
+
+	for _, message := range []interface{}{Message{}, SimpleRequestResponse{}, SimpleEvent{}, CRUD{}, ServiceRegistration{}, ServiceAlive{}} {
+		v, err := protobufStruct(message, false)
+		assert.NoError(err)
+		_, err = marshalProtobuf(nil, v)
+		assert.NoError(err, "%T must be encodable as protobuf", message)
+	}
+}
+
+func TestProtobufWireFormat(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+		encoded []byte
+	)
+
+	require.NoError(NewEncoderBytes(&encoded, Protobuf).Encode(&ServiceRegistration{ServiceName: "a", URL: "b"}))
+	assert.Equal(
+		[]byte{
+			0x08, 0x09, // msg_type = 9
+			0x7a, 0x01, 'a', // service_name = "a"
+			0x82, 0x01, 0x01, 'b', // url = "b"
+		},
+		encoded,
+	)
+
+	// fields unknown to the target, including any added to the schema later, are skipped
+	encoded = append(encoded,
+		0xa8, 0x1f, 0x01, // field 501, varint
+		0xb1, 0x1f, 1, 2, 3, 4, 5, 6, 7, 8, // field 502, fixed64
+		0xbd, 0x1f, 1, 2, 3, 4, // field 503, fixed32
+		0x12, 0x03, 'f', 'o', 'o', // source, which ServiceRegistration does not have
+	)
+
+	var decoded ServiceRegistration
+	require.NoError(NewDecoderBytes(encoded, Protobuf).Decode(&decoded))
+	assert.Equal(ServiceRegistration{Type: ServiceRegistrationMessageType, ServiceName: "a", URL: "b"}, decoded)
+}
+
+func TestProtobufPointerFields(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		original = (&Message{Type: SimpleRequestResponseMessageType}).
+				SetStatus(0).
+				SetRequestDeliveryResponse(-1).
+				SetIncludeSpans(false)
+
+		encoded []byte
+		decoded Message
+	)
+
+	// zero values held by pointer fields must survive a round trip
+	require.NoError(NewEncoderBytes(&encoded, Protobuf).Encode(original))
+	require.NoError(NewDecoderBytes(encoded, Protobuf).Decode(&decoded))
+	assert.Equal(*original, decoded)
+}
+
+func TestProtobufDecoderReuse(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		buffer  bytes.Buffer
+		encoder = NewEncoder(&buffer, Protobuf)
+		decoder = NewDecoder(&buffer, Protobuf)
+		decoded = Message{Headers: []string{"stale"}, Metadata: map[string]string{"stale": "true"}}
+	)
+
+	require.NoError(encoder.Encode(&SimpleEvent{Source: "mac:112233445566", Destination: "event:test", Headers: []string{"fresh"}}))
+	require.NoError(decoder.Decode(&decoded))
+	assert.Equal(
+		Message{Type: SimpleEventMessageType, Source: "mac:112233445566", Destination: "event:test", Headers: []string{"fresh"}},
+		decoded,
+	)
+
+	var output []byte
+	encoder.ResetBytes(&output)
+	require.NoError(encoder.Encode(&ServiceAlive{}))
+	assert.Equal([]byte{0x08, byte(ServiceAliveMessageType)}, output)
+
+	decoder.ResetBytes(output)
+	require.NoError(decoder.Decode(&decoded))
+	assert.Equal(Message{Type: ServiceAliveMessageType}, decoded)
+}
+
+type failingEncodeListener struct {
+	Type MessageType `wrp:"msg_type"`
+}
+
+func (failingEncodeListener) BeforeEncode() error {
+	return errors.New("expected")
+}
+
+func TestProtobufErrors(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		output  []byte
+		decoded Message
+	)
+
+	assert.Error(NewEncoderBytes(&output, Protobuf).Encode(map[string]interface{}{"msg_type": 3}))
+	assert.Error(NewEncoderBytes(&output, Protobuf).Encode(failingEncodeListener{}))
+	assert.Error(NewEncoderBytes(&output, Protobuf).Encode(&struct {
+		Unknown string `wrp:"unknown"`
+	}{}))
+
+	assert.Error(NewEncoder(nil, Protobuf).Encode(&Message{}))
+
+	assert.Error(NewDecoderBytes(nil, Protobuf).Decode(decoded))
+	assert.Error(NewDecoderBytes(nil, Protobuf).Decode((*Message)(nil)))
+
+	for _, invalid := range [][]byte{
+		{0x12},                   // truncated length
+		{0x12, 0x05, 'a'},        // length exceeds the data
+		{0x08},                   // truncated varint
+		{0x12, 0x01, 'a', 0x80},  // truncated tag
+		{0x0a, 0x01, 'a'},        // msg_type as a string
+		{0x10, 0x01},             // source as a varint
+		{0x0b},                   // unsupported wire type
+		{0xa9, 0x1f, 1, 2, 3},    // truncated fixed64
+		{0x52, 0x02, 0x0a, 0x05}, // truncated metadata entry
+		{0x5a, 0x02, 0x0a, 0x05}, // truncated span
+		{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, // varint overflow
+	} {
+		assert.Error(NewDecoderBytes(invalid, Protobuf).Decode(&decoded), "%x should not decode", invalid)
+	}
+}
@@ -0,0 +1,317 @@
+package wrp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes a problem with a single field of a WRP message
+type FieldError struct {
+	// Field is the WRP name of the field, e.g. "dest"
+	Field string `json:"field"`
+
+	// Reason describes what is wrong with the field
+	Reason string `json:"reason"`
+}
+
+func (fe FieldError) Error() string {
+	return fe.Field + ": " + fe.Reason
+}
+
+// ValidationError is returned by Validators for malformed messages.  It describes every problem found
+// with a message, rather than just the first.
+//
+// This type implements go-kit's StatusCoder and json.Marshaler, so that the default go-kit error
+// encoder responds with a 400 and a JSON description of the problems.
+type ValidationError struct {
+	// Type is the type of the invalid message
+	Type MessageType
+
+	// Errors holds the problems found with the message's fields
+	Errors []FieldError
+}
+
+func (ve *ValidationError) Error() string {
+	problems := make([]string, len(ve.Errors))
+	for i, fe := range ve.Errors {
+		problems[i] = fe.Error()
+	}
+
+	return fmt.Sprintf("Invalid WRP message of type %s: %s", ve.Type, strings.Join(problems, "; "))
+}
+
+// StatusCode always returns http.StatusBadRequest
+func (ve *ValidationError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (ve *ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Message string       `json:"message"`
+		Type    MessageType  `json:"msg_type"`
+		Errors  []FieldError `json:"errors"`
+	}{
+		Message: "Invalid WRP message",
+		Type:    ve.Type,
+		Errors:  ve.Errors,
+	})
+}
+
+// Rule checks one aspect of a WRP message, returning a FieldError for each problem found
+type Rule func(*Message) []FieldError
+
+// Validator checks that WRP messages are well formed.  A Validator returns nil for a valid message,
+// and a *ValidationError otherwise.
+type Validator interface {
+	Validate(*Message) error
+}
+
+// ValidatorFunc is a function type that implements Validator
+type ValidatorFunc func(*Message) error
+
+func (vf ValidatorFunc) Validate(m *Message) error {
+	return vf(m)
+}
+
+// TypeValidator is a Validator which applies rules according to each message's Type.  Every message must
+// pass the Common rules in addition to any rules for its Type.  All rules are applied, so that the resulting
+// ValidationError describes every problem with a message.
+//
+// A nil *TypeValidator accepts all messages.
+type TypeValidator struct {
+	// Common are the rules applied to messages of every type
+	Common []Rule
+
+	// Types holds the additional rules for each message type
+	Types map[MessageType][]Rule
+}
+
+func (tv *TypeValidator) Validate(m *Message) error {
+	if tv == nil {
+		return nil
+	}
+
+	var errors []FieldError
+	for _, rule := range tv.Common {
+		errors = append(errors, rule(m)...)
+	}
+
+	for _, rule := range tv.Types[m.Type] {
+		errors = append(errors, rule(m)...)
+	}
+
+	if len(errors) > 0 {
+		return &ValidationError{Type: m.Type, Errors: errors}
+	}
+
+	return nil
+}
+
+// DefaultValidator returns a TypeValidator which enforces the WRP specification:
+//
+//   Every message must have a known type, valid UTF-8 text fields, and locators in its source and dest, if set
+//   SimpleRequestResponse messages require source, dest and transaction_uuid
+//   SimpleEvent messages require source and dest
+//   CRUD messages require source, dest, transaction_uuid and path
+//   ServiceRegistration messages require service_name and an absolute url
+//
+// The returned TypeValidator may be modified to suit, since each call produces a new instance.
+func DefaultValidator() *TypeValidator {
+	crud := []Rule{Required("source", "dest", "transaction_uuid", "path")}
+	return &TypeValidator{
+		Common: []Rule{ValidType(), UTF8(), Locators("source", "dest")},
+		Types: map[MessageType][]Rule{
+			SimpleRequestResponseMessageType: {Required("source", "dest", "transaction_uuid")},
+			SimpleEventMessageType:           {Required("source", "dest")},
+			CreateMessageType:                crud,
+			RetrieveMessageType:              crud,
+			UpdateMessageType:                crud,
+			DeleteMessageType:                crud,
+			ServiceRegistrationMessageType:   {Required("service_name", "url"), URLs("url")},
+		},
+	}
+}
+
+// messageFields maps the WRP name of each Message field onto that field's index
+var messageFields = func() map[string]int {
+	t := reflect.TypeOf(Message{})
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("wrp"); len(tag) > 0 {
+			fields[strings.Split(tag, ",")[0]] = i
+		}
+	}
+
+	return fields
+}()
+
+// fieldIndices looks up WRP field names, panicking if any is not a field of Message
+func fieldIndices(names []string) []int {
+	indices := make([]int, len(names))
+	for i, name := range names {
+		index, ok := messageFields[name]
+		if !ok {
+			panic(fmt.Errorf("%s is not a WRP message field", name))
+		}
+
+		indices[i] = index
+	}
+
+	return indices
+}
+
+// Required produces a Rule that requires the given fields, identified by their WRP names, to be set.
+// This function panics if any name is not a field of Message.
+func Required(names ...string) Rule {
+	indices := fieldIndices(names)
+	return func(m *Message) (errors []FieldError) {
+		v := reflect.ValueOf(m).Elem()
+		for i, index := range indices {
+			f := v.Field(index)
+			var missing bool
+			switch f.Kind() {
+			case reflect.Ptr, reflect.Map, reflect.Slice:
+				missing = f.IsNil() || (f.Kind() != reflect.Ptr && f.Len() == 0)
+			case reflect.String:
+				missing = f.Len() == 0
+			case reflect.Int64:
+				missing = f.Int() == 0
+			}
+
+			if missing {
+				errors = append(errors, FieldError{Field: names[i], Reason: "is required"})
+			}
+		}
+
+		return
+	}
+}
+
+// ValidType produces a Rule that requires a message to have one of the defined MessageType values
+func ValidType() Rule {
+	return func(m *Message) []FieldError {
+		if m.Type < SimpleRequestResponseMessageType || m.Type >= lastMessageType {
+			return []FieldError{{Field: "msg_type", Reason: fmt.Sprintf("%d is not a valid message type", m.Type)}}
+		}
+
+		return nil
+	}
+}
+
+// Locators produces a Rule that requires the given string fields, if set, to be parseable by ParseLocator.
+// This function panics if any name is not a string field of Message.
+func Locators(names ...string) Rule {
+	indices := fieldIndices(names)
+	for i, index := range indices {
+		if reflect.TypeOf(Message{}).Field(index).Type.Kind() != reflect.String {
+			panic(fmt.Errorf("%s is not a string WRP message field", names[i]))
+		}
+	}
+
+	return func(m *Message) (errors []FieldError) {
+		v := reflect.ValueOf(m).Elem()
+		for i, index := range indices {
+			if value := v.Field(index).String(); len(value) > 0 {
+				if _, err := ParseLocator(value); err != nil {
+					errors = append(errors, FieldError{Field: names[i], Reason: fmt.Sprintf("%q is not a valid locator", value)})
+				}
+			}
+		}
+
+		return
+	}
+}
+
+// URLs produces a Rule that requires the given string fields, if set, to be absolute URLs.
+// This function panics if any name is not a string field of Message.
+func URLs(names ...string) Rule {
+	indices := fieldIndices(names)
+	for i, index := range indices {
+		if reflect.TypeOf(Message{}).Field(index).Type.Kind() != reflect.String {
+			panic(fmt.Errorf("%s is not a string WRP message field", names[i]))
+		}
+	}
+
+	return func(m *Message) (errors []FieldError) {
+		v := reflect.ValueOf(m).Elem()
+		for i, index := range indices {
+			value := v.Field(index).String()
+			if len(value) == 0 {
+				continue
+			}
+
+			if u, err := url.Parse(value); err != nil || !u.IsAbs() || len(u.Host) == 0 {
+				errors = append(errors, FieldError{Field: names[i], Reason: fmt.Sprintf("%q is not an absolute URL", value)})
+			}
+		}
+
+		return
+	}
+}
+
+// UTF8 produces a Rule that requires every text field of a message, including headers, metadata, spans and
+// partner IDs, to be valid UTF-8.  The payload is not checked, as it may be binary.
+func UTF8() Rule {
+	return func(m *Message) (errors []FieldError) {
+		invalid := func(field string) {
+			errors = append(errors, FieldError{Field: field, Reason: "is not valid UTF-8"})
+		}
+
+		for _, f := range []struct {
+			name  string
+			value string
+		}{
+			{"source", m.Source},
+			{"dest", m.Destination},
+			{"transaction_uuid", m.TransactionUUID},
+			{"content_type", m.ContentType},
+			{"accept", m.Accept},
+			{"path", m.Path},
+			{"service_name", m.ServiceName},
+			{"url", m.URL},
+		} {
+			if !utf8.ValidString(f.value) {
+				invalid(f.name)
+			}
+		}
+
+		if !allUTF8(m.Headers) {
+			invalid("headers")
+		}
+
+		for key, value := range m.Metadata {
+			if !utf8.ValidString(key) || !utf8.ValidString(value) {
+				invalid("metadata")
+				break
+			}
+		}
+
+		for _, span := range m.Spans {
+			if !allUTF8(span) {
+				invalid("spans")
+				break
+			}
+		}
+
+		if !allUTF8(m.PartnerIDs) {
+			invalid("partner_ids")
+		}
+
+		return
+	}
+}
+
+func allUTF8(values []string) bool {
+	for _, v := range values {
+		if !utf8.ValidString(v) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,205 @@
+package wrp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatorFunc(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		expected = errors.New("expected")
+		v        = ValidatorFunc(func(*Message) error { return expected })
+	)
+
+	assert.Equal(expected, v.Validate(new(Message)))
+}
+
+func TestValidationError(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		err = &ValidationError{
+			Type: SimpleEventMessageType,
+			Errors: []FieldError{
+				{Field: "source", Reason: "is required"},
+				{Field: "dest", Reason: "is required"},
+			},
+		}
+	)
+
+	assert.Equal("Invalid WRP message of type SimpleEventMessageType: source: is required; dest: is required", err.Error())
+	assert.Equal(http.StatusBadRequest, err.StatusCode())
+
+	data, err2 := json.Marshal(err)
+	require.NoError(err2)
+	assert.JSONEq(
+		`{"message": "Invalid WRP message", "msg_type": 4, "errors": [{"field": "source", "reason": "is required"}, {"field": "dest", "reason": "is required"}]}`,
+		string(data),
+	)
+}
+
+func TestRuleConstructorsPanic(t *testing.T) {
+	assert := assert.New(t)
+	assert.Panics(func() { Required("nosuch") })
+	assert.Panics(func() { Locators("status") })
+	assert.Panics(func() { URLs("headers") })
+}
+
+func TestTypeValidator(t *testing.T) {
+	var (
+		assert = assert.New(t)
+
+		nilValidator *TypeValidator
+		called       []string
+
+		rule = func(name string, errors ...FieldError) Rule {
+			return func(*Message) []FieldError {
+				called = append(called, name)
+				return errors
+			}
+		}
+
+		tv = TypeValidator{
+			Common: []Rule{rule("common")},
+			Types: map[MessageType][]Rule{
+				SimpleEventMessageType: {rule("event", FieldError{Field: "dest", Reason: "expected"})},
+			},
+		}
+	)
+
+	assert.NoError(nilValidator.Validate(&Message{}))
+
+	assert.NoError(tv.Validate(&Message{Type: CreateMessageType}))
+	assert.Equal([]string{"common"}, called)
+
+	called = nil
+	err := tv.Validate(&Message{Type: SimpleEventMessageType})
+	assert.Equal([]string{"common", "event"}, called)
+	assert.Equal(&ValidationError{Type: SimpleEventMessageType, Errors: []FieldError{{Field: "dest", Reason: "expected"}}}, err)
+}
+
+func TestDefaultValidator(t *testing.T) {
+	var (
+		status int64 = 200
+
+		testData = []struct {
+			description string
+			message     Message
+			expected    []FieldError
+		}{
+			{
+				description: "SimpleRequestResponse",
+				message:     Message{Type: SimpleRequestResponseMessageType, Source: "dns:talaria.example.com", Destination: "mac:112233445566/config", TransactionUUID: "1234"},
+			},
+			{
+				description: "SimpleRequestResponseMissingFields",
+				message:     Message{Type: SimpleRequestResponseMessageType, Source: "dns:talaria.example.com"},
+				expected: []FieldError{
+					{Field: "dest", Reason: "is required"},
+					{Field: "transaction_uuid", Reason: "is required"},
+				},
+			},
+			{
+				description: "SimpleEvent",
+				message:     Message{Type: SimpleEventMessageType, Source: "mac:112233445566", Destination: "event:device-status/mac:112233445566/online"},
+			},
+			{
+				description: "SimpleEventBadLocators",
+				message:     Message{Type: SimpleEventMessageType, Source: "mac112233445566", Destination: "event:/online"},
+				expected: []FieldError{
+					{Field: "source", Reason: `"mac112233445566" is not a valid locator`},
+					{Field: "dest", Reason: `"event:/online" is not a valid locator`},
+				},
+			},
+			{
+				description: "CRUD",
+				message:     Message{Type: UpdateMessageType, Source: "dns:example.com", Destination: "uuid:1234/service", TransactionUUID: "1234", Path: "/some/where"},
+			},
+			{
+				description: "CRUDMissingPath",
+				message:     Message{Type: DeleteMessageType, Source: "dns:example.com", Destination: "uuid:1234/service", TransactionUUID: "1234", Status: &status},
+				expected:    []FieldError{{Field: "path", Reason: "is required"}},
+			},
+			{
+				description: "ServiceRegistration",
+				message:     Message{Type: ServiceRegistrationMessageType, ServiceName: "config", URL: "tcp://127.0.0.1:6666"},
+			},
+			{
+				description: "ServiceRegistrationMissingFields",
+				message:     Message{Type: ServiceRegistrationMessageType},
+				expected: []FieldError{
+					{Field: "service_name", Reason: "is required"},
+					{Field: "url", Reason: "is required"},
+				},
+			},
+			{
+				description: "ServiceRegistrationRelativeURL",
+				message:     Message{Type: ServiceRegistrationMessageType, ServiceName: "config", URL: "/relative"},
+				expected:    []FieldError{{Field: "url", Reason: `"/relative" is not an absolute URL`}},
+			},
+			{
+				description: "ServiceAlive",
+				message:     Message{Type: ServiceAliveMessageType},
+			},
+			{
+				description: "InvalidType",
+				message:     Message{Type: MessageType(99)},
+				expected:    []FieldError{{Field: "msg_type", Reason: "99 is not a valid message type"}},
+			},
+			{
+				description: "MissingType",
+				message:     Message{Source: "dns:example.com"},
+				expected:    []FieldError{{Field: "msg_type", Reason: "0 is not a valid message type"}},
+			},
+			{
+				description: "InvalidUTF8",
+				message: Message{
+					Type:            SimpleEventMessageType,
+					Source:          "dns:example.com",
+					Destination:     "event:\xff",
+					TransactionUUID: "\xfe",
+					Headers:         []string{"ok", "\xff"},
+					Metadata:        map[string]string{"key": "\xff"},
+					Spans:           [][]string{{"ok"}, {"\xff"}},
+					PartnerIDs:      []string{"\xff"},
+					Payload:         []byte{0xff, 0xfe},
+				},
+				expected: []FieldError{
+					{Field: "dest", Reason: "is not valid UTF-8"},
+					{Field: "transaction_uuid", Reason: "is not valid UTF-8"},
+					{Field: "headers", Reason: "is not valid UTF-8"},
+					{Field: "metadata", Reason: "is not valid UTF-8"},
+					{Field: "spans", Reason: "is not valid UTF-8"},
+					{Field: "partner_ids", Reason: "is not valid UTF-8"},
+				},
+			},
+		}
+	)
+
+	for _, record := range testData {
+		t.Run(record.description, func(t *testing.T) {
+			var (
+				assert  = assert.New(t)
+				require = require.New(t)
+				message = record.message
+			)
+
+			err := DefaultValidator().Validate(&message)
+			if len(record.expected) == 0 {
+				assert.NoError(err)
+				return
+			}
+
+			require.IsType(&ValidationError{}, err)
+			assert.Equal(record.message.Type, err.(*ValidationError).Type)
+			assert.Equal(record.expected, err.(*ValidationError).Errors)
+		})
+	}
+}
@@ -64,6 +64,28 @@ func DecodeRequestHeaders(ctx context.Context, original *http.Request) (*Entity,
 	return entity, err
 }
 
+// ValidateDecoder decorates a Decoder so that each message it decodes must pass the given wrp.Validator.
+// The *wrp.ValidationError returned for an invalid message is rendered by go-kit's default error encoder
+// as a 400 response describing each problem.  If v is nil, d is returned as is.
+func ValidateDecoder(d Decoder, v wrp.Validator) Decoder {
+	if v == nil {
+		return d
+	}
+
+	return func(ctx context.Context, original *http.Request) (*Entity, error) {
+		entity, err := d(ctx, original)
+		if err != nil {
+			return entity, err
+		}
+
+		if err := v.Validate(&entity.Message); err != nil {
+			return nil, err
+		}
+
+		return entity, nil
+	}
+}
+
 // MessageFunc is a strategy for post-processing a WRP message, adding things to the
 // context or performing other processing on the message itself.
 type MessageFunc func(context.Context, *wrp.Message) context.Context
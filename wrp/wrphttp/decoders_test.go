@@ -3,7 +3,9 @@ package wrphttp
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"testing"
@@ -150,3 +152,74 @@ func TestDecodeRequestHeaders(t *testing.T) {
 	t.Run("Success", testDecodeRequestHeadersSuccess)
 	t.Run("Invalid", testDecodeRequestHeadersInvalid)
 }
+
+func TestValidateDecoder(t *testing.T) {
+	t.Run("NilValidator", func(t *testing.T) {
+		var (
+			assert   = assert.New(t)
+			expected = &Entity{Message: wrp.Message{Type: wrp.MessageType(99)}}
+			decoder  = ValidateDecoder(func(context.Context, *http.Request) (*Entity, error) { return expected, nil }, nil)
+		)
+
+		require.NotNil(t, decoder)
+		entity, err := decoder(context.Background(), httptest.NewRequest("POST", "/", nil))
+		assert.Equal(expected, entity)
+		assert.NoError(err)
+	})
+
+	t.Run("DecodeError", func(t *testing.T) {
+		var (
+			assert    = assert.New(t)
+			validated bool
+			decoder   = ValidateDecoder(
+				func(context.Context, *http.Request) (*Entity, error) { return nil, errors.New("expected") },
+				wrp.ValidatorFunc(func(*wrp.Message) error { validated = true; return nil }),
+			)
+		)
+
+		entity, err := decoder(context.Background(), httptest.NewRequest("POST", "/", nil))
+		assert.Nil(entity)
+		assert.Error(err)
+		assert.False(validated)
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		var (
+			assert  = assert.New(t)
+			require = require.New(t)
+			served  int
+
+			handler = NewHTTPHandler(
+				HandlerFunc(func(ResponseWriter, *Request) { served++ }),
+				WithDecoder(ValidateDecoder(DecodeEntity(wrp.JSON), wrp.DefaultValidator())),
+			)
+		)
+
+		valid := httptest.NewRequest("POST", "/", bytes.NewReader(wrp.MustEncode(
+			&wrp.SimpleEvent{Source: "dns:example.com", Destination: "event:test"}, wrp.JSON,
+		)))
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, valid)
+		assert.Equal(1, served)
+
+		invalid := httptest.NewRequest("POST", "/", bytes.NewReader(wrp.MustEncode(
+			&wrp.SimpleRequestResponse{Source: "dns:example.com"}, wrp.JSON,
+		)))
+
+		response = httptest.NewRecorder()
+		handler.ServeHTTP(response, invalid)
+		assert.Equal(1, served)
+		assert.Equal(http.StatusBadRequest, response.Code)
+
+		var body struct {
+			Errors []wrp.FieldError `json:"errors"`
+		}
+
+		require.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+		assert.Equal(
+			[]wrp.FieldError{{Field: "dest", Reason: "is required"}, {Field: "transaction_uuid", Reason: "is required"}},
+			body.Errors,
+		)
+	})
+}
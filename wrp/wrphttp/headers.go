@@ -5,83 +5,307 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/Comcast/webpa-common/wrp"
 )
 
+// The prefixes of HTTP headers that carry WRP fields.  Both prefixes are accepted when decoding.
 const (
-	MessageTypeHeader             = "X-Xmidt-Message-Type"
-	TransactionUuidHeader         = "X-Xmidt-Transaction-Uuid"
-	StatusHeader                  = "X-Xmidt-Status"
-	RequestDeliveryResponseHeader = "X-Xmidt-Request-Delivery-Response"
-	IncludeSpansHeader            = "X-Xmidt-Include-Spans"
-	SpanHeader                    = "X-Xmidt-Span"
-	PathHeader                    = "X-Xmidt-Path"
-	SourceHeader                  = "X-Xmidt-Source"
+	// XmidtHeaderPrefix is the prefix of emitted WRP headers, unless a HeaderCodec is configured otherwise
+	XmidtHeaderPrefix = "X-Xmidt-"
+
+	// MidtHeaderPrefix is the legacy prefix used by the header constants in the wrp package
+	MidtHeaderPrefix = "X-Midt-"
+)
+
+// The names of WRP headers, minus their prefix
+const (
+	messageTypeSuffix             = "Message-Type"
+	legacyMessageTypeSuffix       = "Msg-Type"
+	transactionUuidSuffix         = "Transaction-Uuid"
+	statusSuffix                  = "Status"
+	requestDeliveryResponseSuffix = "Request-Delivery-Response"
+	headersSuffix                 = "Headers"
+	metadataSuffix                = "Metadata"
+	includeSpansSuffix            = "Include-Spans"
+	spanSuffix                    = "Span"
+	legacySpansSuffix             = "Spans"
+	pathSuffix                    = "Path"
+	sourceSuffix                  = "Source"
+	acceptSuffix                  = "Accept"
+	serviceNameSuffix             = "Service-Name"
+	urlSuffix                     = "Url"
+	partnerIDSuffix               = "Partner-Id"
+)
+
+const (
+	MessageTypeHeader             = XmidtHeaderPrefix + messageTypeSuffix
+	TransactionUuidHeader         = XmidtHeaderPrefix + transactionUuidSuffix
+	StatusHeader                  = XmidtHeaderPrefix + statusSuffix
+	RequestDeliveryResponseHeader = XmidtHeaderPrefix + requestDeliveryResponseSuffix
+	HeadersHeader                 = XmidtHeaderPrefix + headersSuffix
+	MetadataHeader                = XmidtHeaderPrefix + metadataSuffix
+	IncludeSpansHeader            = XmidtHeaderPrefix + includeSpansSuffix
+	SpanHeader                    = XmidtHeaderPrefix + spanSuffix
+	PathHeader                    = XmidtHeaderPrefix + pathSuffix
+	SourceHeader                  = XmidtHeaderPrefix + sourceSuffix
 	DestinationHeader             = "X-Webpa-Device-Name"
-	AcceptHeader                  = "X-Xmidt-Accept"
+	AcceptHeader                  = XmidtHeaderPrefix + acceptSuffix
+	ServiceNameHeader             = XmidtHeaderPrefix + serviceNameSuffix
+	URLHeader                     = XmidtHeaderPrefix + urlSuffix
+	PartnerIDHeader               = XmidtHeaderPrefix + partnerIDSuffix
 )
 
 var (
 	errMissingMessageTypeHeader = fmt.Errorf("Missing %s header", MessageTypeHeader)
 )
 
-// getMessageType extracts the wrp.MessageType from header.  This is a required field.
+// HeaderCodec translates between WRP messages and HTTP headers.  Every field of wrp.Message except the
+// payload has a header representation:
+//
+//   msg_type, source, transaction_uuid, status, rdr, include_spans, path, accept, service_name and url
+//   are single-valued headers, e.g. X-Xmidt-Message-Type or X-Xmidt-Service-Name
+//
+//   dest is always the X-Webpa-Device-Name header, and content_type is always the Content-Type header
 //
-// This function panics if the message type header is missing or invalid.
-func getMessageType(h http.Header) wrp.MessageType {
-	value := h.Get(MessageTypeHeader)
+//   headers is the multi-valued Headers header, and partner_ids is the multi-valued Partner-Id header,
+//   whose values may also be comma-separated lists
+//
+//   metadata is the multi-valued Metadata header, with each value of the form key=value, so keys cannot contain =
+//
+//   spans is the multi-valued Span header, with each value being a comma-separated triple
+//
+// When decoding, headers with either XmidtHeaderPrefix or MidtHeaderPrefix are accepted, as are the legacy
+// X-Midt-Msg-Type and X-Midt-Spans headers.  When encoding, headers are emitted with the configured Prefix.
+//
+// The zero value of this type is a valid codec that emits headers with XmidtHeaderPrefix.
+type HeaderCodec struct {
+	// Prefix is the prefix of emitted WRP headers.  If unset, XmidtHeaderPrefix is used.
+	Prefix string
+}
+
+func (hc HeaderCodec) prefix() string {
+	if len(hc.Prefix) > 0 {
+		return hc.Prefix
+	}
+
+	return XmidtHeaderPrefix
+}
+
+// prefixes returns the prefixes accepted by this codec on input, in order of precedence
+func (hc HeaderCodec) prefixes() []string {
+	switch p := hc.prefix(); p {
+	case XmidtHeaderPrefix:
+		return []string{XmidtHeaderPrefix, MidtHeaderPrefix}
+	case MidtHeaderPrefix:
+		return []string{MidtHeaderPrefix, XmidtHeaderPrefix}
+	default:
+		return []string{p, XmidtHeaderPrefix, MidtHeaderPrefix}
+	}
+}
+
+// values returns the values of the first header, across all accepted prefixes and the given suffixes, that is present
+func (hc HeaderCodec) values(h http.Header, suffixes ...string) ([]string, string) {
+	for _, p := range hc.prefixes() {
+		for _, s := range suffixes {
+			if v := h[http.CanonicalHeaderKey(p+s)]; len(v) > 0 {
+				return v, s
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// get returns the first value of the first header, across all accepted prefixes and the given suffixes, that is present
+func (hc HeaderCodec) get(h http.Header, suffixes ...string) string {
+	if v, _ := hc.values(h, suffixes...); len(v) > 0 {
+		return v[0]
+	}
+
+	return ""
+}
+
+// Negotiate returns a HeaderCodec which emits headers with the same prefix used by the WRP headers in h, e.g.
+// the headers of a request which is being responded to.  If h contains no message type header, this codec
+// is returned as is.
+func (hc HeaderCodec) Negotiate(h http.Header) HeaderCodec {
+	for _, p := range hc.prefixes() {
+		if len(h.Get(p+messageTypeSuffix)) > 0 || len(h.Get(p+legacyMessageTypeSuffix)) > 0 {
+			return HeaderCodec{Prefix: p}
+		}
+	}
+
+	return hc
+}
+
+// Decode transfers header fields onto the given WRP message.  The payload is not handled by this method.
+func (hc HeaderCodec) Decode(h http.Header, m *wrp.Message) (err error) {
+	value := hc.get(h, messageTypeSuffix, legacyMessageTypeSuffix)
 	if len(value) == 0 {
-		panic(errMissingMessageTypeHeader)
+		return errMissingMessageTypeHeader
 	}
 
-	messageType, err := wrp.StringToMessageType(value)
-	if err != nil {
-		panic(err)
+	if m.Type, err = wrp.StringToMessageType(value); err != nil {
+		return
+	}
+
+	if m.Status, err = parseInt(hc.get(h, statusSuffix)); err != nil {
+		return
+	}
+
+	if m.RequestDeliveryResponse, err = parseInt(hc.get(h, requestDeliveryResponseSuffix)); err != nil {
+		return
+	}
+
+	if m.IncludeSpans, err = parseBool(hc.get(h, includeSpansSuffix)); err != nil {
+		return
+	}
+
+	if m.Spans, err = parseSpans(hc.values(h, spanSuffix, legacySpansSuffix)); err != nil {
+		return
+	}
+
+	metadata, _ := hc.values(h, metadataSuffix)
+	if m.Metadata, err = parseMetadata(metadata); err != nil {
+		return
+	}
+
+	m.Source = hc.get(h, sourceSuffix)
+	m.Destination = h.Get(DestinationHeader)
+	m.TransactionUUID = hc.get(h, transactionUuidSuffix)
+	m.ContentType = h.Get("Content-Type")
+	m.Accept = hc.get(h, acceptSuffix)
+	m.Path = hc.get(h, pathSuffix)
+	m.ServiceName = hc.get(h, serviceNameSuffix)
+	m.URL = hc.get(h, urlSuffix)
+	if headers, _ := hc.values(h, headersSuffix); len(headers) > 0 {
+		m.Headers = append([]string(nil), headers...)
+	} else {
+		m.Headers = nil
+	}
+
+	partnerIDs, _ := hc.values(h, partnerIDSuffix)
+	m.PartnerIDs = parseList(partnerIDs)
+
+	return
+}
+
+// Encode adds the HTTP header representation of a given WRP message, using this codec's prefix.
+// The payload is not handled by this method, to allow further headers to be written by calling code.
+func (hc HeaderCodec) Encode(h http.Header, m *wrp.Message) {
+	p := hc.prefix()
+	h.Set(p+messageTypeSuffix, m.Type.FriendlyName())
+
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{p + sourceSuffix, m.Source},
+		{DestinationHeader, m.Destination},
+		{p + transactionUuidSuffix, m.TransactionUUID},
+		{"Content-Type", m.ContentType},
+		{p + acceptSuffix, m.Accept},
+		{p + pathSuffix, m.Path},
+		{p + serviceNameSuffix, m.ServiceName},
+		{p + urlSuffix, m.URL},
+	} {
+		if len(f.value) > 0 {
+			h.Set(f.name, f.value)
+		}
+	}
+
+	if m.Status != nil {
+		h.Set(p+statusSuffix, strconv.FormatInt(*m.Status, 10))
+	}
+
+	if m.RequestDeliveryResponse != nil {
+		h.Set(p+requestDeliveryResponseSuffix, strconv.FormatInt(*m.RequestDeliveryResponse, 10))
+	}
+
+	if m.IncludeSpans != nil {
+		h.Set(p+includeSpansSuffix, strconv.FormatBool(*m.IncludeSpans))
+	}
+
+	for _, s := range m.Spans {
+		h.Add(p+spanSuffix, strings.Join(s, ","))
 	}
 
-	return messageType
+	for _, v := range m.Headers {
+		h.Add(p+headersSuffix, v)
+	}
+
+	// sort the metadata so that the emitted headers are deterministic
+	keys := make([]string, 0, len(m.Metadata))
+	for k := range m.Metadata {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Add(p+metadataSuffix, k+"="+m.Metadata[k])
+	}
+
+	for _, v := range m.PartnerIDs {
+		h.Add(p+partnerIDSuffix, v)
+	}
 }
 
-// getIntHeader returns the header as a int64, or returns nil if the header is absent.
-// This function panics if the header is present but not a valid integer.
-func getIntHeader(h http.Header, n string) *int64 {
-	value := h.Get(n)
+// parseInt returns the value as an int64, or returns nil if the value is empty
+func parseInt(value string) (*int64, error) {
 	if len(value) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	i, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return &i
+	return &i, nil
 }
 
-func getBoolHeader(h http.Header, n string) *bool {
-	value := h.Get(n)
+// parseBool returns the value as a bool, or returns nil if the value is empty
+func parseBool(value string) (*bool, error) {
 	if len(value) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	b, err := strconv.ParseBool(value)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return &b
+	return &b, nil
 }
 
-func getSpans(h http.Header) [][]string {
+// parseSpans parses span header values.  Each Span value is a comma-separated triple, while the values of
+// the legacy Spans header are the flattened elements of all the spans.
+func parseSpans(values []string, suffix string) ([][]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
 	var spans [][]string
+	if suffix == legacySpansSuffix {
+		if len(values)%3 != 0 {
+			return nil, fmt.Errorf("Invalid %s header: %s", MidtHeaderPrefix+legacySpansSuffix, strings.Join(values, ","))
+		}
+
+		for i := 0; i < len(values); i += 3 {
+			spans = append(spans, []string{values[i], values[i+1], values[i+2]})
+		}
+
+		return spans, nil
+	}
 
-	for _, value := range h[SpanHeader] {
+	for _, value := range values {
 		fields := strings.Split(value, ",")
 		if len(fields) != 3 {
-			panic(fmt.Errorf("Invalid %s header: %s", SpanHeader, value))
+			return nil, fmt.Errorf("Invalid %s header: %s", SpanHeader, value)
 		}
 
 		for i := 0; i < len(fields); i++ {
@@ -91,7 +315,40 @@ func getSpans(h http.Header) [][]string {
 		spans = append(spans, fields)
 	}
 
-	return spans
+	return spans, nil
+}
+
+// parseMetadata parses metadata header values of the form key=value
+func parseMetadata(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	metadata := make(map[string]string, len(values))
+	for _, value := range values {
+		i := strings.IndexByte(value, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid %s header: %s", MetadataHeader, value)
+		}
+
+		metadata[value[:i]] = value[i+1:]
+	}
+
+	return metadata, nil
+}
+
+// parseList flattens header values that may be comma-separated lists, discarding empty elements
+func parseList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); len(element) > 0 {
+				list = append(list, element)
+			}
+		}
+	}
+
+	return list
 }
 
 func readPayload(h http.Header, p io.Reader) ([]byte, string) {
@@ -133,9 +390,8 @@ func NewMessageFromHeaders(h http.Header, p io.Reader) (message *wrp.Message, er
 
 	payload, contentType := readPayload(h, p)
 	message = new(wrp.Message)
-	err = SetMessageFromHeaders(h, message)
-	if err != nil {
-		message = nil
+	if err = SetMessageFromHeaders(h, message); err != nil {
+		return nil, err
 	}
 
 	message.Payload = payload
@@ -143,76 +399,17 @@ func NewMessageFromHeaders(h http.Header, p io.Reader) (message *wrp.Message, er
 	return
 }
 
-// SetMessageFromHeaders transfers header fields onto the given WRP message.  The payload is not
-// handled by this method.
-func SetMessageFromHeaders(h http.Header, m *wrp.Message) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			switch v := r.(type) {
-			case error:
-				err = v
-			default:
-				err = fmt.Errorf("Unable to create WRP message: %s", v)
-			}
-		}
-	}()
-
-	m.Type = getMessageType(h)
-	m.Source = h.Get(SourceHeader)
-	m.Destination = h.Get(DestinationHeader)
-	m.TransactionUUID = h.Get(TransactionUuidHeader)
-	m.Status = getIntHeader(h, StatusHeader)
-	m.RequestDeliveryResponse = getIntHeader(h, RequestDeliveryResponseHeader)
-	m.IncludeSpans = getBoolHeader(h, IncludeSpansHeader)
-	m.Spans = getSpans(h)
-	m.ContentType = h.Get("Content-Type")
-	m.Accept = h.Get(AcceptHeader)
-	m.Path = h.Get(PathHeader)
-
-	return
+// SetMessageFromHeaders transfers header fields onto the given WRP message, using a default HeaderCodec.
+// The payload is not handled by this method.
+func SetMessageFromHeaders(h http.Header, m *wrp.Message) error {
+	return HeaderCodec{}.Decode(h, m)
 }
 
-// AddMessageHeaders adds the HTTP header representation of a given WRP message.
+// AddMessageHeaders adds the HTTP header representation of a given WRP message, using a default HeaderCodec.
 // This function does not handle the payload, to allow further headers to be written by
 // calling code.
 func AddMessageHeaders(h http.Header, m *wrp.Message) {
-	h.Set(MessageTypeHeader, m.Type.FriendlyName())
-
-	if len(m.Source) > 0 {
-		h.Set(SourceHeader, m.Source)
-	}
-
-	if len(m.Destination) > 0 {
-		h.Set(DestinationHeader, m.Destination)
-	}
-
-	if len(m.TransactionUUID) > 0 {
-		h.Set(TransactionUuidHeader, m.TransactionUUID)
-	}
-
-	if m.Status != nil {
-		h.Set(StatusHeader, strconv.FormatInt(*m.Status, 10))
-	}
-
-	if m.RequestDeliveryResponse != nil {
-		h.Set(RequestDeliveryResponseHeader, strconv.FormatInt(*m.RequestDeliveryResponse, 10))
-	}
-
-	if m.IncludeSpans != nil {
-		h.Set(IncludeSpansHeader, strconv.FormatBool(*m.IncludeSpans))
-	}
-
-	for _, s := range m.Spans {
-		h.Add(SpanHeader, strings.Join(s, ","))
-	}
-
-	if len(m.Accept) > 0 {
-		h.Set(AcceptHeader, m.Accept)
-	}
-
-	if len(m.Path) > 0 {
-		h.Set(PathHeader, m.Path)
-	}
+	HeaderCodec{}.Encode(h, m)
 }
 
 // ReadPayload extracts the payload from a reader, setting the appropriate
@@ -357,3 +357,192 @@ func TestWritePayload(t *testing.T) {
 	t.Run("NoHeader", testWritePayloadNoHeader)
 	t.Run("WithHeader", testWritePayloadWithHeader)
 }
+
+func testHeaderCodecLegacyHeaders(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		header = http.Header{
+			wrp.MsgTypeHeader:         []string{"SimpleRequestResponse"},
+			wrp.SourceHeader:          []string{"dns:talaria.example.com"},
+			DestinationHeader:         []string{"mac:112233445566"},
+			wrp.TransactionUuidHeader: []string{"1234"},
+			wrp.StatusHeader:          []string{"200"},
+			wrp.RDRHeader:             []string{"1"},
+			wrp.HeadersArrHeader:      []string{"a", "b"},
+			wrp.IncludeSpansHeader:    []string{"true"},
+			wrp.SpansHeader:           []string{"foo", "100", "200", "bar", "300", "400"},
+			wrp.PathHeader:            []string{"/foo/bar"},
+			http.CanonicalHeaderKey(MidtHeaderPrefix + "Metadata"): []string{"/key=value"},
+		}
+
+		actual wrp.Message
+	)
+
+	require.NoError(HeaderCodec{}.Decode(header, &actual))
+	assert.Equal(
+		*(&wrp.Message{
+			Type:            wrp.SimpleRequestResponseMessageType,
+			Source:          "dns:talaria.example.com",
+			Destination:     "mac:112233445566",
+			TransactionUUID: "1234",
+			Headers:         []string{"a", "b"},
+			Spans:           [][]string{{"foo", "100", "200"}, {"bar", "300", "400"}},
+			Path:            "/foo/bar",
+			Metadata:        map[string]string{"/key": "value"},
+		}).SetStatus(200).SetRequestDeliveryResponse(1).SetIncludeSpans(true),
+		actual,
+	)
+
+	// when both prefixes are present, the codec's own prefix takes precedence
+	header.Set(SourceHeader, "mac:112233445566")
+	require.NoError(HeaderCodec{}.Decode(header, &actual))
+	assert.Equal("mac:112233445566", actual.Source)
+
+	require.NoError(HeaderCodec{Prefix: MidtHeaderPrefix}.Decode(header, &actual))
+	assert.Equal("dns:talaria.example.com", actual.Source)
+}
+
+func testHeaderCodecPartnerIDs(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		header = http.Header{
+			MessageTypeHeader: []string{"SimpleEvent"},
+			PartnerIDHeader:   []string{"comcast, sky", "", "nbc"},
+		}
+
+		actual = wrp.Message{PartnerIDs: []string{"stale"}, Headers: []string{"stale"}}
+	)
+
+	require.NoError(HeaderCodec{}.Decode(header, &actual))
+	assert.Equal([]string{"comcast", "sky", "nbc"}, actual.PartnerIDs)
+	assert.Nil(actual.Headers)
+}
+
+func testHeaderCodecInvalid(t *testing.T) {
+	for _, header := range []http.Header{
+		{},
+		{wrp.MsgTypeHeader: []string{"this is not a valid message type"}},
+		{MessageTypeHeader: []string{"SimpleEvent"}, StatusHeader: []string{"this is not a valid integer"}},
+		{MessageTypeHeader: []string{"SimpleEvent"}, RequestDeliveryResponseHeader: []string{"this is not a valid integer"}},
+		{MessageTypeHeader: []string{"SimpleEvent"}, IncludeSpansHeader: []string{"this is not a valid boolean"}},
+		{MessageTypeHeader: []string{"SimpleEvent"}, SpanHeader: []string{"this is not a valid span"}},
+		{MessageTypeHeader: []string{"SimpleEvent"}, wrp.SpansHeader: []string{"foo", "100"}},
+		{MessageTypeHeader: []string{"SimpleEvent"}, MetadataHeader: []string{"novalue"}},
+		{MessageTypeHeader: []string{"SimpleEvent"}, MetadataHeader: []string{"=nokey"}},
+	} {
+		var message wrp.Message
+		assert.Error(t, HeaderCodec{}.Decode(header, &message), "%v should not decode", header)
+	}
+}
+
+func testHeaderCodecEncodePrefix(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		actual = make(http.Header)
+	)
+
+	HeaderCodec{Prefix: MidtHeaderPrefix}.Encode(actual, &wrp.Message{
+		Type:        wrp.ServiceRegistrationMessageType,
+		Destination: "mac:112233445566",
+		ServiceName: "config",
+		URL:         "tcp://127.0.0.1:6666",
+		Metadata:    map[string]string{"b": "2", "a": "1"},
+		PartnerIDs:  []string{"comcast"},
+	})
+
+	assert.Equal(
+		http.Header{
+			"X-Midt-Message-Type": []string{"ServiceRegistration"},
+			DestinationHeader:     []string{"mac:112233445566"},
+			"X-Midt-Service-Name": []string{"config"},
+			"X-Midt-Url":          []string{"tcp://127.0.0.1:6666"},
+			"X-Midt-Metadata":     []string{"a=1", "b=2"},
+			"X-Midt-Partner-Id":   []string{"comcast"},
+		},
+		actual,
+	)
+}
+
+func testHeaderCodecNegotiate(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		custom = HeaderCodec{Prefix: "X-Custom-"}
+	)
+
+	assert.Equal(HeaderCodec{Prefix: MidtHeaderPrefix}, HeaderCodec{}.Negotiate(http.Header{wrp.MsgTypeHeader: []string{"event"}}))
+	assert.Equal(HeaderCodec{Prefix: MidtHeaderPrefix}, HeaderCodec{}.Negotiate(http.Header{"X-Midt-Message-Type": []string{"event"}}))
+	assert.Equal(HeaderCodec{Prefix: XmidtHeaderPrefix}, HeaderCodec{}.Negotiate(http.Header{MessageTypeHeader: []string{"event"}}))
+	assert.Equal(HeaderCodec{Prefix: XmidtHeaderPrefix}, custom.Negotiate(http.Header{MessageTypeHeader: []string{"event"}}))
+	assert.Equal(custom, custom.Negotiate(http.Header{"X-Custom-Message-Type": []string{"event"}}))
+	assert.Equal(custom, custom.Negotiate(http.Header{}))
+	assert.Equal(HeaderCodec{}, HeaderCodec{}.Negotiate(http.Header{}))
+}
+
+func testHeaderCodecRoundTrip(t *testing.T, codec HeaderCodec, format wrp.Format) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		original = (&wrp.Message{
+			Type:            wrp.SimpleRequestResponseMessageType,
+			Source:          "dns:talaria.example.com",
+			Destination:     "mac:112233445566/config",
+			TransactionUUID: "1-2-3-4",
+			ContentType:     "application/json",
+			Accept:          "application/msgpack",
+			Headers:         []string{"X-Foo: bar", "X-Moo: goo, gar"},
+			Metadata:        map[string]string{"/boot-time": "1234", "/trust": "level=1000"},
+			Spans:           [][]string{{"foo", "100", "200"}, {"bar", "300", "400"}},
+			Path:            "/some/where",
+			ServiceName:     "config",
+			URL:             "http://127.0.0.1:8080/",
+			PartnerIDs:      []string{"comcast", "sky"},
+		}).SetStatus(0).SetRequestDeliveryResponse(-1).SetIncludeSpans(false)
+
+		header  = make(http.Header)
+		decoded wrp.Message
+
+		encoded []byte
+	)
+
+	codec.Encode(header, original)
+	require.NoError(codec.Decode(header, &decoded))
+	assert.Equal(*original, decoded)
+
+	require.NoError(wrp.NewEncoderBytes(&encoded, format).Encode(&decoded))
+
+	var transcoded wrp.Message
+	require.NoError(wrp.NewDecoderBytes(encoded, format).Decode(&transcoded))
+	assert.Equal(*original, transcoded)
+
+	header = make(http.Header)
+	codec.Encode(header, &transcoded)
+
+	decoded = wrp.Message{}
+	require.NoError(codec.Decode(header, &decoded))
+	assert.Equal(*original, decoded)
+}
+
+func TestHeaderCodec(t *testing.T) {
+	t.Run("LegacyHeaders", testHeaderCodecLegacyHeaders)
+	t.Run("PartnerIDs", testHeaderCodecPartnerIDs)
+	t.Run("Invalid", testHeaderCodecInvalid)
+	t.Run("EncodePrefix", testHeaderCodecEncodePrefix)
+	t.Run("Negotiate", testHeaderCodecNegotiate)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, codec := range []HeaderCodec{{}, {Prefix: MidtHeaderPrefix}, {Prefix: "X-Custom-"}} {
+			t.Run(codec.prefix(), func(t *testing.T) {
+				for _, format := range []wrp.Format{wrp.JSON, wrp.Msgpack} {
+					t.Run(format.String(), func(t *testing.T) {
+						testHeaderCodecRoundTrip(t, codec, format)
+					})
+				}
+			})
+		}
+	})
+}
@@ -118,3 +118,40 @@ func (erw *entityResponseWriter) WriteWRP(v interface{}) (int, error) {
 	erw.ResponseWriter.Header().Set("Content-Type", erw.f.ContentType())
 	return erw.ResponseWriter.Write(output)
 }
+
+// NewHeaderResponseWriter creates a ResponseWriterFunc that returns a header-based ResponseWriter.  The returned
+// ResponseWriter writes the fields of WRP messages as HTTP headers, using the given HeaderCodec negotiated against
+// the request's headers, and the WRP payload as the HTTP entity.
+func NewHeaderResponseWriter(codec HeaderCodec) ResponseWriterFunc {
+	return func(httpResponse http.ResponseWriter, wrpRequest *Request) (ResponseWriter, error) {
+		return &headerResponseWriter{
+			ResponseWriter: httpResponse,
+			codec:          codec.Negotiate(wrpRequest.Original.Header),
+		}, nil
+	}
+}
+
+// headerResponseWriter provides ResponseWriter behavior that writes WRP messages as HTTP headers and a payload
+type headerResponseWriter struct {
+	http.ResponseWriter
+	codec HeaderCodec
+}
+
+func (hrw *headerResponseWriter) WriteWRP(v interface{}) (int, error) {
+	message, ok := v.(*wrp.Message)
+	if !ok {
+		// transcode other WRP types, which have no header representation of their own
+		var encoded []byte
+		if err := wrp.NewEncoderBytes(&encoded, wrp.Msgpack).Encode(v); err != nil {
+			return 0, err
+		}
+
+		message = new(wrp.Message)
+		if err := wrp.NewDecoderBytes(encoded, wrp.Msgpack).Decode(message); err != nil {
+			return 0, err
+		}
+	}
+
+	hrw.codec.Encode(hrw.ResponseWriter.Header(), message)
+	return WritePayload(hrw.ResponseWriter.Header(), hrw.ResponseWriter, message)
+}
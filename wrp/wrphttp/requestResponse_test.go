@@ -2,6 +2,7 @@ package wrphttp
 
 import (
 	"context"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 
@@ -136,3 +137,86 @@ func TestEntityResponseWriter(t *testing.T) {
 		}
 	})
 }
+
+func testHeaderResponseWriterMessage(t *testing.T, requestHeader, expectedPrefix string) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		hrw          = NewHeaderResponseWriter(HeaderCodec{})
+		httpResponse = httptest.NewRecorder()
+		wrpRequest   = &Request{
+			Original: httptest.NewRequest("POST", "/", nil),
+		}
+
+		expected = &wrp.Message{
+			Type:        wrp.SimpleRequestResponseMessageType,
+			Source:      "mac:112233445566",
+			ContentType: "text/plain",
+			Payload:     []byte("hi there"),
+			PartnerIDs:  []string{"comcast"},
+		}
+	)
+
+	require.NotNil(hrw)
+	wrpRequest.Original.Header.Set(requestHeader, "SimpleRequestResponse")
+
+	wrpResponse, err := hrw(httpResponse, wrpRequest)
+	require.NoError(err)
+	require.NotNil(wrpResponse)
+
+	count, err := wrpResponse.WriteWRP(expected)
+	require.NoError(err)
+	assert.Equal(len(expected.Payload), count)
+
+	assert.Equal("SimpleRequestResponse", httpResponse.Header().Get(expectedPrefix+"Message-Type"))
+	assert.Equal("comcast", httpResponse.Header().Get(expectedPrefix+"Partner-Id"))
+
+	actual, err := NewMessageFromHeaders(httpResponse.Header(), httpResponse.Body)
+	require.NoError(err)
+	assert.Equal(*expected, *actual)
+}
+
+func testHeaderResponseWriterTranscode(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		require = require.New(t)
+
+		hrw          = NewHeaderResponseWriter(HeaderCodec{})
+		httpResponse = httptest.NewRecorder()
+		wrpRequest   = &Request{
+			Original: httptest.NewRequest("POST", "/", nil),
+		}
+	)
+
+	wrpResponse, err := hrw(httpResponse, wrpRequest)
+	require.NoError(err)
+
+	count, err := wrpResponse.WriteWRP(&wrp.ServiceRegistration{ServiceName: "config", URL: "tcp://127.0.0.1:6666"})
+	require.NoError(err)
+	assert.Zero(count)
+	assert.Equal(
+		http.Header{
+			MessageTypeHeader: []string{"ServiceRegistration"},
+			ServiceNameHeader: []string{"config"},
+			URLHeader:         []string{"tcp://127.0.0.1:6666"},
+		},
+		httpResponse.Header(),
+	)
+
+	count, err = wrpResponse.WriteWRP("this is not a WRP message")
+	assert.Error(err)
+	assert.Zero(count)
+}
+
+func TestHeaderResponseWriter(t *testing.T) {
+	t.Run("Xmidt", func(t *testing.T) {
+		testHeaderResponseWriterMessage(t, MessageTypeHeader, XmidtHeaderPrefix)
+	})
+
+	t.Run("Midt", func(t *testing.T) {
+		testHeaderResponseWriterMessage(t, wrp.MsgTypeHeader, MidtHeaderPrefix)
+	})
+
+	t.Run("Transcode", testHeaderResponseWriterTranscode)
+}